@@ -56,3 +56,16 @@ const gracefulShutdown = () => {
 // Handle various termination signals
 process.on("SIGTERM", gracefulShutdown);
 process.on("SIGINT", gracefulShutdown);
+
+// short-lived processes (jobs, scripts) exit when the event loop is empty, without a signal. The pending spans are
+// flushed once, the flush schedules work so the process exits after it completes
+let flushedOnExit = false;
+process.on("beforeExit", () => {
+    if (flushedOnExit) {
+        return;
+    }
+    flushedOnExit = true;
+    Promise.all([provider.shutdown(), sdk.shutdown()]).catch((err) => {
+        console.error("Error flushing spans on exit", err);
+    });
+});
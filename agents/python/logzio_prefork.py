@@ -0,0 +1,19 @@
+# Metrics exporter of python servers that load the application before forking their workers (gunicorn --preload),
+# selected by the instrumentor with OTEL_METRICS_EXPORTER=logzio_otlp_prefork. The meter provider and its periodic
+# reader are created in the master, before the application and its instruments are loaded, so the workers inherit
+# them: the SDK restarts the reader thread in each forked worker, and the exporter closes the HTTP connections
+# inherited from the master, a worker never writes to a connection the master or another worker uses.
+
+import os
+
+import requests
+from opentelemetry.exporter.otlp.proto.http.metric_exporter import OTLPMetricExporter
+
+
+class PreforkOTLPMetricExporter(OTLPMetricExporter):
+    def __init__(self, *args, **kwargs):
+        session = kwargs.pop("session", None) or requests.Session()
+        super().__init__(*args, session=session, **kwargs)
+        if hasattr(os, "register_at_fork"):
+            # a closed session opens new connections on its next request
+            os.register_at_fork(after_in_child=session.close)
@@ -0,0 +1,67 @@
+# Runs in the agent image build, with the agent packages on the PYTHONPATH: a worker forked from a master configured
+# like the auto-instrumentation of a gunicorn --preload container exports the metrics of the instruments created in
+# the master, on its own connection.
+
+import http.server
+import os
+import threading
+import time
+import unittest
+
+
+class _Collector(http.server.BaseHTTPRequestHandler):
+    # keep the connections alive, the exporter of the master reuses its connection
+    protocol_version = "HTTP/1.1"
+    requests = []
+
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers.get("Content-Length", 0)))
+        self.requests.append((self.client_address, body))
+        self.send_response(200)
+        self.send_header("Content-Length", "0")
+        self.end_headers()
+
+    def log_message(self, *args):
+        pass
+
+
+class PreforkExportTest(unittest.TestCase):
+    def test_forked_worker_exports_metrics(self):
+        server = http.server.ThreadingHTTPServer(("127.0.0.1", 0), _Collector)
+        threading.Thread(target=server.serve_forever, daemon=True).start()
+        self.addCleanup(server.shutdown)
+
+        os.environ.update({
+            "OTEL_METRICS_EXPORTER": "logzio_otlp_prefork",
+            "OTEL_TRACES_EXPORTER": "none",
+            "OTEL_LOGS_EXPORTER": "none",
+            "OTEL_EXPORTER_OTLP_METRICS_ENDPOINT": "http://127.0.0.1:%d/v1/metrics" % server.server_address[1],
+            "OTEL_METRIC_EXPORT_INTERVAL": "200",
+        })
+        from opentelemetry import metrics
+        from opentelemetry.distro import OpenTelemetryConfigurator
+
+        OpenTelemetryConfigurator().configure()
+        counter = metrics.get_meter("logzio.prefork.test").create_counter("requests")
+        # the master exported once, its connection is kept alive
+        counter.add(1, {"process": "master"})
+        self.assertTrue(metrics.get_meter_provider().force_flush())
+        master_connections = {address for address, _ in _Collector.requests}
+        self.assertTrue(master_connections, "the master exported no metrics")
+
+        pid = os.fork()
+        if pid == 0:
+            # the worker only exports through the reader thread, os._exit skips the shutdown flush
+            counter.add(1, {"process": "worker-%d" % os.getpid()})
+            time.sleep(2)
+            os._exit(0)
+        _, status = os.waitpid(pid, 0)
+        self.assertEqual(os.waitstatus_to_exitcode(status), 0)
+
+        worker_exports = [address for address, body in _Collector.requests if b"worker-%d" % pid in body]
+        self.assertTrue(worker_exports, "the forked worker exported no metrics")
+        self.assertFalse(master_connections.intersection(worker_exports), "the worker exported on the master connection")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,149 @@
+package v1alpha1
+
+import (
+	"encoding/json"
+
+	"github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+)
+
+// ConversionDataAnnotation holds the v1beta1 fields v1alpha1 has no place for, so that an InstrumentedApplication
+// read and written back as v1alpha1 keeps them
+const ConversionDataAnnotation = "logz.io/conversion-data"
+
+// conversionData are the v1beta1 fields of the ConversionDataAnnotation
+type conversionData struct {
+	Containers []v1beta1.ContainerInstrumentation `json:"containers,omitempty"`
+}
+
+// ConvertTo converts the InstrumentedApplication to the v1beta1 hub version
+func (src *InstrumentedApplication) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1beta1.InstrumentedApplication)
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Spec = v1beta1.InstrumentedApplicationSpec(*src.Spec.DeepCopy())
+
+	status := src.Status.DeepCopy()
+	dst.Status = v1beta1.InstrumentedApplicationStatus{
+		InstrumentationDetection: v1beta1.InstrumentationStatus{
+			Phase: v1beta1.InstrumentationPhase(status.InstrumentationDetection.Phase),
+		},
+		TracesInstrumented:      status.TracesInstrumented,
+		MetricsInstrumented:     status.MetricsInstrumented,
+		AppDetected:             status.AppDetected,
+		InstrumentationWarnings: status.InstrumentationWarnings,
+		DetectionDisagreements:  status.DetectionDisagreements,
+		ObservedGeneration:      status.ObservedGeneration,
+		Conditions:              status.Conditions,
+	}
+	for _, compatibility := range status.LibraryCompatibility {
+		dst.Status.LibraryCompatibility = append(dst.Status.LibraryCompatibility, v1beta1.LibraryCompatibility{
+			ContainerName:      compatibility.ContainerName,
+			Language:           compatibility.Language,
+			AgentVersion:       compatibility.AgentVersion,
+			Covered:            convertCoverageTo(compatibility.Covered),
+			UnsupportedVersion: convertCoverageTo(compatibility.UnsupportedVersion),
+			Uncovered:          convertCoverageTo(compatibility.Uncovered),
+			UncoveredCount:     compatibility.UncoveredCount,
+		})
+	}
+	if vulnerabilities := status.Vulnerabilities; vulnerabilities != nil {
+		dst.Status.Vulnerabilities = &v1beta1.VulnerabilitySummary{
+			Critical: vulnerabilities.Critical,
+			High:     vulnerabilities.High,
+			Medium:   vulnerabilities.Medium,
+			Low:      vulnerabilities.Low,
+			Unknown:  vulnerabilities.Unknown,
+		}
+		for _, finding := range vulnerabilities.Findings {
+			dst.Status.Vulnerabilities.Findings = append(dst.Status.Vulnerabilities.Findings, v1beta1.VulnerabilityFinding(finding))
+		}
+	}
+
+	raw, exists := dst.Annotations[ConversionDataAnnotation]
+	if !exists {
+		return nil
+	}
+	delete(dst.Annotations, ConversionDataAnnotation)
+	if len(dst.Annotations) == 0 {
+		dst.Annotations = nil
+	}
+	var data conversionData
+	if err := json.Unmarshal([]byte(raw), &data); err != nil {
+		return err
+	}
+	dst.Status.Containers = data.Containers
+	return nil
+}
+
+// ConvertFrom converts the v1beta1 hub version to the InstrumentedApplication
+func (dst *InstrumentedApplication) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1beta1.InstrumentedApplication)
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Spec = InstrumentedApplicationSpec(*src.Spec.DeepCopy())
+
+	status := src.Status.DeepCopy()
+	dst.Status = InstrumentedApplicationStatus{
+		InstrumentationDetection: InstrumentationStatus{
+			Phase: InstrumentationPhase(status.InstrumentationDetection.Phase),
+		},
+		TracesInstrumented:      status.TracesInstrumented,
+		MetricsInstrumented:     status.MetricsInstrumented,
+		AppDetected:             status.AppDetected,
+		InstrumentationWarnings: status.InstrumentationWarnings,
+		DetectionDisagreements:  status.DetectionDisagreements,
+		ObservedGeneration:      status.ObservedGeneration,
+		Conditions:              status.Conditions,
+	}
+	for _, compatibility := range status.LibraryCompatibility {
+		dst.Status.LibraryCompatibility = append(dst.Status.LibraryCompatibility, LibraryCompatibility{
+			ContainerName:      compatibility.ContainerName,
+			Language:           compatibility.Language,
+			AgentVersion:       compatibility.AgentVersion,
+			Covered:            convertCoverageFrom(compatibility.Covered),
+			UnsupportedVersion: convertCoverageFrom(compatibility.UnsupportedVersion),
+			Uncovered:          convertCoverageFrom(compatibility.Uncovered),
+			UncoveredCount:     compatibility.UncoveredCount,
+		})
+	}
+	if vulnerabilities := status.Vulnerabilities; vulnerabilities != nil {
+		dst.Status.Vulnerabilities = &VulnerabilitySummary{
+			Critical: vulnerabilities.Critical,
+			High:     vulnerabilities.High,
+			Medium:   vulnerabilities.Medium,
+			Low:      vulnerabilities.Low,
+			Unknown:  vulnerabilities.Unknown,
+		}
+		for _, finding := range vulnerabilities.Findings {
+			dst.Status.Vulnerabilities.Findings = append(dst.Status.Vulnerabilities.Findings, VulnerabilityFinding(finding))
+		}
+	}
+
+	if len(status.Containers) == 0 {
+		return nil
+	}
+	raw, err := json.Marshal(conversionData{Containers: status.Containers})
+	if err != nil {
+		return err
+	}
+	if dst.Annotations == nil {
+		dst.Annotations = make(map[string]string)
+	}
+	dst.Annotations[ConversionDataAnnotation] = string(raw)
+	return nil
+}
+
+func convertCoverageTo(libraries []LibraryCoverage) []v1beta1.LibraryCoverage {
+	var converted []v1beta1.LibraryCoverage
+	for _, library := range libraries {
+		converted = append(converted, v1beta1.LibraryCoverage(library))
+	}
+	return converted
+}
+
+func convertCoverageFrom(libraries []v1beta1.LibraryCoverage) []LibraryCoverage {
+	var converted []LibraryCoverage
+	for _, library := range libraries {
+		converted = append(converted, LibraryCoverage(library))
+	}
+	return converted
+}
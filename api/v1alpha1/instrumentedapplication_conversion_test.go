@@ -0,0 +1,149 @@
+package v1alpha1
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestConversionRoundTrip(t *testing.T) {
+	enabled := true
+	spec := v1beta1.InstrumentedApplicationSpec{
+		Languages: []common.LanguageByContainer{
+			{ContainerName: "app", Language: common.PythonProgrammingLanguage, PythonServerModel: common.GunicornPythonServerModel, PythonPreload: true},
+		},
+		Applications: []common.ApplicationByContainer{{ContainerName: "app", Application: "nginx"}},
+		Enabled:      &enabled,
+		LogType:      "python",
+	}
+	conditions := []metav1.Condition{{
+		Type:               v1beta1.DetectionSucceededCondition,
+		Status:             metav1.ConditionTrue,
+		Reason:             v1beta1.DetectedReason,
+		LastTransitionTime: metav1.Unix(1700000000, 0),
+	}}
+	containers := []v1beta1.ContainerInstrumentation{
+		{ContainerName: "app", Language: common.PythonProgrammingLanguage, AgentVersion: "v1.0.3", ServiceName: "app",
+			State: v1beta1.InstrumentedContainerState, Reason: v1beta1.AgentInjectedReason},
+		{ContainerName: "sidecar", State: v1beta1.SkippedContainerState, Reason: v1beta1.LanguageNotDetectedReason, Message: "no language"},
+	}
+	compatibility := []v1beta1.LibraryCompatibility{{
+		ContainerName:      "app",
+		Language:           common.PythonProgrammingLanguage,
+		AgentVersion:       "v1.0.3",
+		Covered:            []v1beta1.LibraryCoverage{{Name: "flask", Version: "2.3.2", Instrumentation: "opentelemetry-instrumentation-flask", SupportedVersions: ">=1.0,<3.0"}},
+		UnsupportedVersion: []v1beta1.LibraryCoverage{{Name: "django", Version: "1.9"}},
+		Uncovered:          []v1beta1.LibraryCoverage{{Name: "left-pad"}},
+		UncoveredCount:     3,
+	}}
+	vulnerabilities := &v1beta1.VulnerabilitySummary{
+		High: 1,
+		Findings: []v1beta1.VulnerabilityFinding{{ID: "GHSA-xxxx", Aliases: []string{"CVE-2023-0001"}, ContainerName: "app",
+			Package: "flask", Version: "2.3.2", Ecosystem: "PyPI", Severity: "HIGH", Fixed: "2.3.3"}},
+	}
+
+	tests := []struct {
+		name string
+		app  v1beta1.InstrumentedApplication
+	}{
+		{
+			name: "empty",
+			app:  v1beta1.InstrumentedApplication{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}},
+		},
+		{
+			name: "spec only",
+			app: v1beta1.InstrumentedApplication{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Labels: map[string]string{"app": "web"}},
+				Spec:       spec,
+			},
+		},
+		{
+			name: "status without containers",
+			app: v1beta1.InstrumentedApplication{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Spec:       spec,
+				Status: v1beta1.InstrumentedApplicationStatus{
+					InstrumentationDetection: v1beta1.InstrumentationStatus{Phase: v1beta1.CompletedInstrumentationDetectionPhase},
+					TracesInstrumented:       true,
+					AppDetected:              true,
+					InstrumentationWarnings:  []string{"container app: warning"},
+					DetectionDisagreements:   []string{"app"},
+					LibraryCompatibility:     compatibility,
+					Vulnerabilities:          vulnerabilities,
+					ObservedGeneration:       4,
+					Conditions:               conditions,
+				},
+			},
+		},
+		{
+			name: "containers kept in the conversion annotation",
+			app: v1beta1.InstrumentedApplication{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: map[string]string{"logz.io/other": "value"}},
+				Spec:       spec,
+				Status: v1beta1.InstrumentedApplicationStatus{
+					InstrumentationDetection: v1beta1.InstrumentationStatus{Phase: v1beta1.CompletedInstrumentationDetectionPhase},
+					TracesInstrumented:       true,
+					Containers:               containers,
+					LibraryCompatibility:     compatibility,
+					Vulnerabilities:          &v1beta1.VulnerabilitySummary{},
+					Conditions:               conditions,
+				},
+			},
+		},
+		{
+			name: "containers without other annotations",
+			app: v1beta1.InstrumentedApplication{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Status:     v1beta1.InstrumentedApplicationStatus{Containers: containers},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := tt.app.DeepCopy()
+			var spoke InstrumentedApplication
+			if err := spoke.ConvertFrom(hub); err != nil {
+				t.Fatalf("ConvertFrom: %v", err)
+			}
+			if !reflect.DeepEqual(hub, &tt.app) {
+				t.Errorf("ConvertFrom changed its source")
+			}
+			if _, exists := spoke.Annotations[ConversionDataAnnotation]; exists != (len(tt.app.Status.Containers) > 0) {
+				t.Errorf("conversion annotation set = %v, want %v", exists, len(tt.app.Status.Containers) > 0)
+			}
+
+			var converted v1beta1.InstrumentedApplication
+			if err := spoke.ConvertTo(&converted); err != nil {
+				t.Fatalf("ConvertTo: %v", err)
+			}
+			if !reflect.DeepEqual(converted, tt.app) {
+				t.Errorf("round trip through v1alpha1 = %+v, want %+v", converted, tt.app)
+			}
+
+			// a v1alpha1 object converted to v1beta1 and back is unchanged too
+			var hubAgain v1beta1.InstrumentedApplication
+			if err := spoke.ConvertTo(&hubAgain); err != nil {
+				t.Fatalf("ConvertTo: %v", err)
+			}
+			var spokeAgain InstrumentedApplication
+			if err := spokeAgain.ConvertFrom(&hubAgain); err != nil {
+				t.Fatalf("ConvertFrom: %v", err)
+			}
+			if !reflect.DeepEqual(spokeAgain, spoke) {
+				t.Errorf("round trip through v1beta1 = %+v, want %+v", spokeAgain, spoke)
+			}
+		})
+	}
+}
+
+func TestConvertToInvalidConversionData(t *testing.T) {
+	spoke := InstrumentedApplication{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ConversionDataAnnotation: "{"}}}
+	var hub v1beta1.InstrumentedApplication
+	if err := spoke.ConvertTo(&hub); err == nil {
+		t.Errorf("ConvertTo accepted an invalid %s annotation", ConversionDataAnnotation)
+	}
+}
@@ -38,6 +38,108 @@ type InstrumentedApplicationStatus struct {
 	TracesInstrumented       bool                  `json:"tracesInstrumented"`
 	MetricsInstrumented      bool                  `json:"metricsInstrumented"`
 	AppDetected              bool                  `json:"appDetected"`
+	// InstrumentationWarnings lists the reasons the injected instrumentation may not work as expected
+	InstrumentationWarnings []string `json:"instrumentationWarnings,omitempty"`
+	// DetectionDisagreements lists the containers the detected replicas of the workload disagree on
+	DetectionDisagreements []string `json:"detectionDisagreements,omitempty"`
+	// LibraryCompatibility matches the libraries detected in each container against the libraries the agent instruments
+	LibraryCompatibility []LibraryCompatibility `json:"libraryCompatibility,omitempty"`
+	// Vulnerabilities summarizes the known vulnerabilities of the detected libraries, matched against the offline
+	// vulnerability database
+	Vulnerabilities *VulnerabilitySummary `json:"vulnerabilities,omitempty"`
+	// ObservedGeneration is the generation of the InstrumentedApplication the status was last written for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions are the latest observations of the detection and the instrumentation of the workload, with their
+	// reasons and the time they last changed
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// Condition types of an InstrumentedApplication
+const (
+	// DetectionSucceededCondition is true once the languages of the workload are detected
+	DetectionSucceededCondition = "DetectionSucceeded"
+	// InstrumentedCondition is true when the pods of the workload are instrumented, or will be once they are created
+	// by the pod webhook
+	InstrumentedCondition = "Instrumented"
+	// AppDetectedCondition is true when the application of the workload is detected and annotated
+	AppDetectedCondition = "AppDetected"
+	// DegradedCondition is true when the instrumentation may not work as expected, or the detected replicas disagree
+	DegradedCondition = "Degraded"
+	// SBOMStoredCondition is true when the SBOM of the last full detection result is stored in its ConfigMap, it is
+	// only set when SBOMs are written
+	SBOMStoredCondition = "SBOMStored"
+)
+
+// Condition reasons of an InstrumentedApplication
+const (
+	DetectionPendingReason           = "DetectionPending"
+	DetectionRunningReason           = "DetectionRunning"
+	DetectedReason                   = "Detected"
+	ImageDetectionFailedReason       = "ImageDetectionFailed"
+	DetectionPodFailedReason         = "DetectionPodFailed"
+	DetectionContainerFailedReason   = "DetectionContainerFailed"
+	DetectionRejectedReason          = "DetectionRejected"
+	PodTemplatePatchedReason         = "PodTemplatePatched"
+	PodTemplateInstrumentedReason    = "PodTemplateInstrumented"
+	PodTemplateNotInstrumentedReason = "PodTemplateNotInstrumented"
+	PodTemplateImmutableReason       = "PodTemplateImmutable"
+	PodWebhookReason                 = "PodWebhook"
+	RolledBackReason                 = "RolledBack"
+	ApplicationDetectedReason        = "ApplicationDetected"
+	ApplicationNotDetectedReason     = "ApplicationNotDetected"
+	InstrumentationWarningsReason    = "InstrumentationWarnings"
+	DetectionDisagreementsReason     = "DetectionDisagreements"
+	AsExpectedReason                 = "AsExpected"
+	SBOMStoredReason                 = "SBOMStored"
+	SBOMCompressedReason             = "SBOMCompressed"
+	SBOMTooLargeReason               = "SBOMTooLarge"
+	SBOMStoreFailedReason            = "SBOMStoreFailed"
+)
+
+// VulnerabilitySummary counts the vulnerabilities of the detected libraries by severity
+type VulnerabilitySummary struct {
+	Critical int `json:"critical"`
+	High     int `json:"high"`
+	Medium   int `json:"medium"`
+	Low      int `json:"low"`
+	Unknown  int `json:"unknown"`
+	// Findings lists the vulnerabilities, the most severe first, limited in size
+	Findings []VulnerabilityFinding `json:"findings,omitempty"`
+}
+
+// VulnerabilityFinding is a vulnerability affecting the version of a library detected in a container
+type VulnerabilityFinding struct {
+	ID            string   `json:"id"`
+	Aliases       []string `json:"aliases,omitempty"`
+	ContainerName string   `json:"containerName"`
+	Package       string   `json:"package"`
+	Version       string   `json:"version"`
+	Ecosystem     string   `json:"ecosystem"`
+	Severity      string   `json:"severity"`
+	// Fixed is the first version fixing the vulnerability, empty when no fix is known
+	Fixed string `json:"fixed,omitempty"`
+}
+
+// LibraryCompatibility describes which libraries of a container are instrumented by the agent of its language
+type LibraryCompatibility struct {
+	ContainerName string                     `json:"containerName"`
+	Language      common.ProgrammingLanguage `json:"language"`
+	AgentVersion  string                     `json:"agentVersion"`
+	// Covered are the libraries instrumented by the agent
+	Covered []LibraryCoverage `json:"covered,omitempty"`
+	// UnsupportedVersion are libraries the agent instruments in other versions only
+	UnsupportedVersion []LibraryCoverage `json:"unsupportedVersion,omitempty"`
+	// Uncovered are the libraries the agent does not instrument, limited in size, UncoveredCount holds the full count
+	Uncovered      []LibraryCoverage `json:"uncovered,omitempty"`
+	UncoveredCount int               `json:"uncoveredCount,omitempty"`
+}
+
+// LibraryCoverage is a detected library and the agent instrumentation that matches it
+type LibraryCoverage struct {
+	Name              string `json:"name"`
+	Version           string `json:"version,omitempty"`
+	Instrumentation   string `json:"instrumentation,omitempty"`
+	SupportedVersions string `json:"supportedVersions,omitempty"`
 }
 
 type InstrumentationStatus struct {
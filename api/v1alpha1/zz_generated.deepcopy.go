@@ -25,6 +25,7 @@ package v1alpha1
 import (
 	"github.com/logzio/kubernetes-instrumentor/common"
 	_ "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -34,7 +35,7 @@ func (in *InstrumentedApplication) DeepCopyInto(out *InstrumentedApplication) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstrumentedApplication.
@@ -94,6 +95,13 @@ func (in *InstrumentedApplicationSpec) DeepCopyInto(out *InstrumentedApplication
 		in, out := &in.Languages, &out.Languages
 		*out = make([]common.LanguageByContainer, len(*in))
 		copy(*out, *in)
+		for i := range *in {
+			if (*in)[i].Processes != nil {
+				in, out := &(*in)[i].Processes, &(*out)[i].Processes
+				*out = make([]common.ContainerProcess, len(*in))
+				copy(*out, *in)
+			}
+		}
 	}
 
 	if in.Applications != nil {
@@ -123,6 +131,35 @@ func (in *InstrumentedApplicationSpec) DeepCopy() *InstrumentedApplicationSpec {
 func (in *InstrumentedApplicationStatus) DeepCopyInto(out *InstrumentedApplicationStatus) {
 	*out = *in
 	out.InstrumentationDetection = in.InstrumentationDetection
+	if in.InstrumentationWarnings != nil {
+		in, out := &in.InstrumentationWarnings, &out.InstrumentationWarnings
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DetectionDisagreements != nil {
+		in, out := &in.DetectionDisagreements, &out.DetectionDisagreements
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.LibraryCompatibility != nil {
+		in, out := &in.LibraryCompatibility, &out.LibraryCompatibility
+		*out = make([]LibraryCompatibility, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Vulnerabilities != nil {
+		in, out := &in.Vulnerabilities, &out.Vulnerabilities
+		*out = new(VulnerabilitySummary)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstrumentedApplicationStatus.
@@ -149,3 +186,90 @@ func (in *InstrumentationStatus) DeepCopy() *InstrumentationStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LibraryCompatibility) DeepCopyInto(out *LibraryCompatibility) {
+	*out = *in
+	if in.Covered != nil {
+		in, out := &in.Covered, &out.Covered
+		*out = make([]LibraryCoverage, len(*in))
+		copy(*out, *in)
+	}
+	if in.UnsupportedVersion != nil {
+		in, out := &in.UnsupportedVersion, &out.UnsupportedVersion
+		*out = make([]LibraryCoverage, len(*in))
+		copy(*out, *in)
+	}
+	if in.Uncovered != nil {
+		in, out := &in.Uncovered, &out.Uncovered
+		*out = make([]LibraryCoverage, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LibraryCompatibility.
+func (in *LibraryCompatibility) DeepCopy() *LibraryCompatibility {
+	if in == nil {
+		return nil
+	}
+	out := new(LibraryCompatibility)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LibraryCoverage) DeepCopyInto(out *LibraryCoverage) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LibraryCoverage.
+func (in *LibraryCoverage) DeepCopy() *LibraryCoverage {
+	if in == nil {
+		return nil
+	}
+	out := new(LibraryCoverage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VulnerabilitySummary) DeepCopyInto(out *VulnerabilitySummary) {
+	*out = *in
+	if in.Findings != nil {
+		in, out := &in.Findings, &out.Findings
+		*out = make([]VulnerabilityFinding, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VulnerabilitySummary.
+func (in *VulnerabilitySummary) DeepCopy() *VulnerabilitySummary {
+	if in == nil {
+		return nil
+	}
+	out := new(VulnerabilitySummary)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VulnerabilityFinding) DeepCopyInto(out *VulnerabilityFinding) {
+	*out = *in
+	if in.Aliases != nil {
+		in, out := &in.Aliases, &out.Aliases
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VulnerabilityFinding.
+func (in *VulnerabilityFinding) DeepCopy() *VulnerabilityFinding {
+	if in == nil {
+		return nil
+	}
+	out := new(VulnerabilityFinding)
+	in.DeepCopyInto(out)
+	return out
+}
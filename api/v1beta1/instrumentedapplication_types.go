@@ -0,0 +1,216 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Credits: https://github.com/keyval-dev/odigos
+*/
+
+package v1beta1
+
+import (
+	"github.com/logzio/kubernetes-instrumentor/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// InstrumentedApplicationSpec defines the desired state of InstrumentedApplication
+type InstrumentedApplicationSpec struct {
+	Languages                []common.LanguageByContainer    `json:"languages,omitempty"`
+	Applications             []common.ApplicationByContainer `json:"applications,omitempty"`
+	Enabled                  *bool                           `json:"enabled,omitempty"`
+	LogType                  string                          `json:"logType"`
+	WaitingForDataCollection bool                            `json:"waitingForDataCollection"`
+}
+
+// InstrumentedApplicationStatus defines the observed state of InstrumentedApplication
+type InstrumentedApplicationStatus struct {
+	InstrumentationDetection InstrumentationStatus `json:"instrumentationDetection,omitempty"`
+	// TracesInstrumented is true when the pods of the workload are instrumented, Containers tells which of their
+	// containers are
+	TracesInstrumented  bool `json:"tracesInstrumented"`
+	MetricsInstrumented bool `json:"metricsInstrumented"`
+	AppDetected         bool `json:"appDetected"`
+	// Containers is the instrumentation state of each container of the pod template, once the workload is detected
+	Containers []ContainerInstrumentation `json:"containers,omitempty"`
+	// InstrumentationWarnings lists the reasons the injected instrumentation may not work as expected
+	InstrumentationWarnings []string `json:"instrumentationWarnings,omitempty"`
+	// DetectionDisagreements lists the containers the detected replicas of the workload disagree on
+	DetectionDisagreements []string `json:"detectionDisagreements,omitempty"`
+	// LibraryCompatibility matches the libraries detected in each container against the libraries the agent instruments
+	LibraryCompatibility []LibraryCompatibility `json:"libraryCompatibility,omitempty"`
+	// Vulnerabilities summarizes the known vulnerabilities of the detected libraries, matched against the offline
+	// vulnerability database
+	Vulnerabilities *VulnerabilitySummary `json:"vulnerabilities,omitempty"`
+	// ObservedGeneration is the generation of the InstrumentedApplication the status was last written for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions are the latest observations of the detection and the instrumentation of the workload, with their
+	// reasons and the time they last changed
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// Condition types of an InstrumentedApplication
+const (
+	// DetectionSucceededCondition is true once the languages of the workload are detected
+	DetectionSucceededCondition = "DetectionSucceeded"
+	// InstrumentedCondition is true when the pods of the workload are instrumented, or will be once they are created
+	// by the pod webhook
+	InstrumentedCondition = "Instrumented"
+	// AppDetectedCondition is true when the application of the workload is detected and annotated
+	AppDetectedCondition = "AppDetected"
+	// DegradedCondition is true when the instrumentation may not work as expected, or the detected replicas disagree
+	DegradedCondition = "Degraded"
+	// SBOMStoredCondition is true when the SBOM of the last full detection result is stored in its ConfigMap, it is
+	// only set when SBOMs are written
+	SBOMStoredCondition = "SBOMStored"
+)
+
+// Condition reasons of an InstrumentedApplication
+const (
+	DetectionPendingReason           = "DetectionPending"
+	DetectionRunningReason           = "DetectionRunning"
+	DetectedReason                   = "Detected"
+	ImageDetectionFailedReason       = "ImageDetectionFailed"
+	DetectionPodFailedReason         = "DetectionPodFailed"
+	DetectionContainerFailedReason   = "DetectionContainerFailed"
+	DetectionRejectedReason          = "DetectionRejected"
+	PodTemplatePatchedReason         = "PodTemplatePatched"
+	PodTemplateInstrumentedReason    = "PodTemplateInstrumented"
+	PodTemplateNotInstrumentedReason = "PodTemplateNotInstrumented"
+	PodTemplateImmutableReason       = "PodTemplateImmutable"
+	PodWebhookReason                 = "PodWebhook"
+	RolledBackReason                 = "RolledBack"
+	ApplicationDetectedReason        = "ApplicationDetected"
+	ApplicationNotDetectedReason     = "ApplicationNotDetected"
+	InstrumentationWarningsReason    = "InstrumentationWarnings"
+	DetectionDisagreementsReason     = "DetectionDisagreements"
+	AsExpectedReason                 = "AsExpected"
+	SBOMStoredReason                 = "SBOMStored"
+	SBOMCompressedReason             = "SBOMCompressed"
+	SBOMTooLargeReason               = "SBOMTooLarge"
+	SBOMStoreFailedReason            = "SBOMStoreFailed"
+)
+
+// ContainerInstrumentation is the instrumentation state of a container of the workload
+type ContainerInstrumentation struct {
+	ContainerName string `json:"containerName"`
+	// Language is the instrumented language of the container, or its detected language when it is not instrumented
+	Language common.ProgrammingLanguage `json:"language,omitempty"`
+	// AgentVersion is the version of the agent image injected in the pod template for the language
+	AgentVersion string `json:"agentVersion,omitempty"`
+	// ServiceName is the service name the agent reports the spans of the container with
+	ServiceName string                        `json:"serviceName,omitempty"`
+	State       ContainerInstrumentationState `json:"state"`
+	Reason      string                        `json:"reason"`
+	Message     string                        `json:"message,omitempty"`
+}
+
+type ContainerInstrumentationState string
+
+const (
+	// InstrumentedContainerState is the state of a container the agent of its language is injected in
+	InstrumentedContainerState ContainerInstrumentationState = "Instrumented"
+	// NotInstrumentedContainerState is the state of a container that would be instrumented if the workload asked for it
+	NotInstrumentedContainerState ContainerInstrumentationState = "NotInstrumented"
+	// SkippedContainerState is the state of a container that is not instrumented even when the workload asks for it
+	SkippedContainerState ContainerInstrumentationState = "Skipped"
+)
+
+// Container instrumentation reasons, the reasons of the Instrumented condition are used too
+const (
+	AgentInjectedReason               = "AgentInjected"
+	InstrumentationNotRequestedReason = "InstrumentationNotRequested"
+	InstrumentationPendingReason      = "InstrumentationPending"
+	LanguageNotDetectedReason         = "LanguageNotDetected"
+	MixedLanguagePolicyReason         = "MixedLanguagePolicy"
+	NativeSidecarNotOptedInReason     = "NativeSidecarNotOptedIn"
+	ExistingAgentReason               = "ExistingAgent"
+)
+
+// VulnerabilitySummary counts the vulnerabilities of the detected libraries by severity
+type VulnerabilitySummary struct {
+	Critical int `json:"critical"`
+	High     int `json:"high"`
+	Medium   int `json:"medium"`
+	Low      int `json:"low"`
+	Unknown  int `json:"unknown"`
+	// Findings lists the vulnerabilities, the most severe first, limited in size
+	Findings []VulnerabilityFinding `json:"findings,omitempty"`
+}
+
+// VulnerabilityFinding is a vulnerability affecting the version of a library detected in a container
+type VulnerabilityFinding struct {
+	ID            string   `json:"id"`
+	Aliases       []string `json:"aliases,omitempty"`
+	ContainerName string   `json:"containerName"`
+	Package       string   `json:"package"`
+	Version       string   `json:"version"`
+	Ecosystem     string   `json:"ecosystem"`
+	Severity      string   `json:"severity"`
+	// Fixed is the first version fixing the vulnerability, empty when no fix is known
+	Fixed string `json:"fixed,omitempty"`
+}
+
+// LibraryCompatibility describes which libraries of a container are instrumented by the agent of its language
+type LibraryCompatibility struct {
+	ContainerName string                     `json:"containerName"`
+	Language      common.ProgrammingLanguage `json:"language"`
+	AgentVersion  string                     `json:"agentVersion"`
+	// Covered are the libraries instrumented by the agent
+	Covered []LibraryCoverage `json:"covered,omitempty"`
+	// UnsupportedVersion are libraries the agent instruments in other versions only
+	UnsupportedVersion []LibraryCoverage `json:"unsupportedVersion,omitempty"`
+	// Uncovered are the libraries the agent does not instrument, limited in size, UncoveredCount holds the full count
+	Uncovered      []LibraryCoverage `json:"uncovered,omitempty"`
+	UncoveredCount int               `json:"uncoveredCount,omitempty"`
+}
+
+// LibraryCoverage is a detected library and the agent instrumentation that matches it
+type LibraryCoverage struct {
+	Name              string `json:"name"`
+	Version           string `json:"version,omitempty"`
+	Instrumentation   string `json:"instrumentation,omitempty"`
+	SupportedVersions string `json:"supportedVersions,omitempty"`
+}
+
+type InstrumentationStatus struct {
+	Phase InstrumentationPhase `json:"phase,omitempty"`
+}
+
+type InstrumentationPhase string
+
+const (
+	PendingInstrumentationDetectionPhase   InstrumentationPhase = "Pending"
+	RunningInstrumentationDetectionPhase   InstrumentationPhase = "Running"
+	CompletedInstrumentationDetectionPhase InstrumentationPhase = "Completed"
+	ErrorInstrumentationDetectionPhase     InstrumentationPhase = "Error"
+)
+
+// InstrumentedApplication is the Schema for the instrumented applications API
+type InstrumentedApplication struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   InstrumentedApplicationSpec   `json:"spec,omitempty"`
+	Status InstrumentedApplicationStatus `json:"status,omitempty"`
+}
+
+// InstrumentedApplicationList contains a list of InstrumentedApplication
+type InstrumentedApplicationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []InstrumentedApplication `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&InstrumentedApplication{}, &InstrumentedApplicationList{})
+}
@@ -22,6 +22,8 @@ type ApplicationByContainer struct {
 	ContainerName string      `json:"containerName"`
 	Application   Application `json:"application"`
 	LogType       string      `json:"logType"`
+	// NativeSidecar is set for init containers with restartPolicy Always
+	NativeSidecar bool `json:"nativeSidecar,omitempty"`
 }
 
 type Application string
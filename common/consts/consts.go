@@ -30,6 +30,26 @@ const (
 	SkipAppDetectionAnnotation                     = "logz.io/skip_app_detection"
 	SupportedResourceDeployment                    = "Deployment"
 	SupportedResourceStatefulSet                   = "StatefulSet"
+	SupportedResourceDaemonSet                     = "DaemonSet"
+	SupportedResourceCronJob                       = "CronJob"
+	SupportedResourceJob                           = "Job"
+	SupportedResourceReplicaSet                    = "ReplicaSet"
+	SupportedResourcePod                           = "Pod"
+	// TerminationMessageMaxLength is the size kubernetes truncates container termination messages to
+	TerminationMessageMaxLength = 4096
+	DetectionReportTokenEnvVar  = "DETECTION_REPORT_TOKEN"
+	DetectionPodNameEnvVar      = "POD_NAME"
+	DetectionPodNamespaceEnvVar = "POD_NAMESPACE"
+	DetectionTargetAppEnvVar    = "DETECTION_INSTRUMENTED_APPLICATION"
+	DetectionReportPath         = "/detection-report"
+	DetectionAgentPath          = "/detect"
+	DetectionAgentTokenEnvVar   = "DETECTION_AGENT_TOKEN"
+	// DetectionAgentTokenSecret holds the shared detection agent token under the token key, the instrumentor generates
+	// it when it does not exist
+	DetectionAgentTokenSecret = "detection-agent-token"
+	// the detection agent requests and responses are signed with the shared token instead of sending it
+	DetectionAgentTimestampHeader = "X-Detection-Timestamp"
+	DetectionAgentSignatureHeader = "X-Detection-Signature"
 )
 
 var (
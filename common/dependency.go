@@ -0,0 +1,33 @@
+package common
+
+// Dependency is a library found in the dependency files of a container
+type Dependency struct {
+	Name      string              `json:"name"`
+	Version   string              `json:"version,omitempty"`
+	Ecosystem DependencyEcosystem `json:"ecosystem"`
+}
+
+// DependencyEcosystem is the package ecosystem a dependency is published in
+type DependencyEcosystem string
+
+const (
+	NpmDependencyEcosystem    DependencyEcosystem = "npm"
+	PyPIDependencyEcosystem   DependencyEcosystem = "pypi"
+	MavenDependencyEcosystem  DependencyEcosystem = "maven"
+	NuGetDependencyEcosystem  DependencyEcosystem = "nuget"
+	GolangDependencyEcosystem DependencyEcosystem = "golang"
+)
+
+// DependenciesByContainer is the dependency inventory of a container, merged from all its processes
+type DependenciesByContainer struct {
+	ContainerName string       `json:"containerName"`
+	Dependencies  []Dependency `json:"dependencies"`
+}
+
+// LanguageEcosystems maps the detected languages to the ecosystems of their libraries
+var LanguageEcosystems = map[ProgrammingLanguage]DependencyEcosystem{
+	JavaProgrammingLanguage:       MavenDependencyEcosystem,
+	PythonProgrammingLanguage:     PyPIDependencyEcosystem,
+	DotNetProgrammingLanguage:     NuGetDependencyEcosystem,
+	JavascriptProgrammingLanguage: NpmDependencyEcosystem,
+}
@@ -21,4 +21,40 @@ package common
 type DetectionResult struct {
 	LanguageByContainer    []LanguageByContainer    `json:"languageByContainer"`
 	ApplicationByContainer []ApplicationByContainer `json:"applicationByContainer"`
+	// DependenciesByContainer is dropped from the compact result, it is only known when the full result is reported
+	DependenciesByContainer []DependenciesByContainer `json:"dependenciesByContainer,omitempty"`
+}
+
+// PodDetectionResult is the detection result of one of the target pods of a batched detection pod
+type PodDetectionResult struct {
+	PodUID string          `json:"podUID"`
+	Result DetectionResult `json:"result"`
+}
+
+// DetectionReport is sent by the detection pod to the instrumentor, it is not limited in size like the termination message
+type DetectionReport struct {
+	Namespace string          `json:"namespace"`
+	PodName   string          `json:"podName"`
+	Result    DetectionResult `json:"result"`
+	// Pods holds the results of a batched detection pod, Result is empty in that case
+	Pods []PodDetectionResult `json:"pods,omitempty"`
+	// InstrumentedApplication and TargetContainer are set by ephemeral detection containers, PodName is the name of
+	// the detected pod in that case
+	InstrumentedApplication string `json:"instrumentedApplication,omitempty"`
+	TargetContainer         string `json:"targetContainer,omitempty"`
+}
+
+// DetectionRequest asks the node detection agent to detect the containers of a pod running on its node
+type DetectionRequest struct {
+	PodUID         string   `json:"podUID"`
+	ContainerNames []string `json:"containerNames"`
+}
+
+// Compact returns the result without the dependencies, it is written to the size limited termination message. It keeps
+// every field the instrumentor patches the containers with
+func (r DetectionResult) Compact() DetectionResult {
+	return DetectionResult{
+		LanguageByContainer:    r.LanguageByContainer,
+		ApplicationByContainer: r.ApplicationByContainer,
+	}
 }
@@ -18,12 +18,50 @@ Credits: https://github.com/keyval-dev/odigos
 
 package common
 
+// LanguageByContainer is the language detected for a container. Language and ProcessName are the ones of the
+// primary process, Processes lists every process of a detected language in the container
 type LanguageByContainer struct {
 	ContainerName              string              `json:"containerName"`
 	Language                   ProgrammingLanguage `json:"language"`
 	ProcessName                string              `json:"processName,omitempty"`
 	OpentelemetryPreconfigured bool                `json:"opentelemetryPreconfigured"`
 	ActiveServiceName          string              `json:"activeServiceName"`
+	PythonServerModel          PythonServerModel   `json:"pythonServerModel,omitempty"`
+	PythonPreload              bool                `json:"pythonPreload,omitempty"`
+	Processes                  []ContainerProcess  `json:"processes,omitempty"`
+	// NativeSidecar is set for init containers with restartPolicy Always
+	NativeSidecar bool `json:"nativeSidecar,omitempty"`
+}
+
+// ContainerProcess is a process of a detected language. The command line is stored as a digest only, it may
+// hold secrets
+type ContainerProcess struct {
+	PID           int                 `json:"pid"`
+	Exe           string              `json:"exe"`
+	Language      ProgrammingLanguage `json:"language"`
+	Runtime       string              `json:"runtime,omitempty"`
+	CmdLineDigest string              `json:"cmdLineDigest,omitempty"`
+	Primary       bool                `json:"primary,omitempty"`
+}
+
+// ProcessLanguages returns the distinct languages of the container processes, the primary language first
+func (l LanguageByContainer) ProcessLanguages() []ProgrammingLanguage {
+	languages := []ProgrammingLanguage{l.Language}
+	for _, p := range l.Processes {
+		found := false
+		for _, language := range languages {
+			found = found || language == p.Language
+		}
+		if !found {
+			languages = append(languages, p.Language)
+		}
+	}
+	return languages
+}
+
+// IsMixed reports whether the container runs processes of more than one language
+func (l LanguageByContainer) IsMixed() bool {
+	return len(l.ProcessLanguages()) > 1
 }
 
 type ProgrammingLanguage string
@@ -34,3 +72,15 @@ const (
 	DotNetProgrammingLanguage     ProgrammingLanguage = "dotnet"
 	JavascriptProgrammingLanguage ProgrammingLanguage = "javascript"
 )
+
+// PythonServerModel is the process model a python application is served with.
+// Pre-fork models (gunicorn, uwsgi, celery) load the application in a master process and fork workers from it
+type PythonServerModel string
+
+const (
+	PlainPythonServerModel    PythonServerModel = "plain"
+	GunicornPythonServerModel PythonServerModel = "gunicorn"
+	UwsgiPythonServerModel    PythonServerModel = "uwsgi"
+	CeleryPythonServerModel   PythonServerModel = "celery"
+	UvicornPythonServerModel  PythonServerModel = "uvicorn"
+)
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// SignDetectionAgentMessage returns the hex HMAC-SHA256 of the message parts with the shared detection agent token.
+// The parts are length prefixed, so moving bytes from a part to the next changes the signature
+func SignDetectionAgentMessage(token string, parts ...[]byte) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	for _, part := range parts {
+		mac.Write(binary.BigEndian.AppendUint64(nil, uint64(len(part))))
+		mac.Write(part)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidDetectionAgentSignature compares a signature with the signature of the message parts in constant time
+func ValidDetectionAgentSignature(token string, signature string, parts ...[]byte) bool {
+	return token != "" && hmac.Equal([]byte(signature), []byte(SignDetectionAgentMessage(token, parts...)))
+}
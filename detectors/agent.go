@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	"github.com/logzio/kubernetes-instrumentor/common/utils"
+)
+
+const (
+	maxDetectionRequestSize = 1 << 20
+	// maxConcurrentDetections bounds the /proc scans running at the same time on the node
+	maxConcurrentDetections = 4
+	// maxRequestAge is the clock skew accepted between the instrumentor and the agent, a signed request is accepted
+	// once within it
+	maxRequestAge = time.Minute
+)
+
+// seenSignatures are the signatures of the requests accepted within maxRequestAge, a captured request can not be
+// replayed
+type seenSignatures struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// valid checks the signature of a request made at the unix timestamp, and records it
+func (s *seenSignatures) valid(token string, timestamp string, signature string, parts ...[]byte) bool {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	sent := time.Unix(unix, 0)
+	if sent.Before(now.Add(-maxRequestAge)) || sent.After(now.Add(maxRequestAge)) {
+		return false
+	}
+	if !utils.ValidDetectionAgentSignature(token, signature, append([][]byte{[]byte(timestamp)}, parts...)...) {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for seenSignature, expiry := range s.seen {
+		if now.After(expiry) {
+			delete(s.seen, seenSignature)
+		}
+	}
+	if _, replayed := s.seen[signature]; replayed {
+		return false
+	}
+	s.seen[signature] = sent.Add(2 * maxRequestAge)
+	return true
+}
+
+// serveAgent runs the detector as a long running node agent, the instrumentor calls it instead of creating a
+// detection pod for every workload. Requests and responses are signed with the shared agent token, which is never sent
+// over the unencrypted connection
+func serveAgent(address string) {
+	token := os.Getenv(consts.DetectionAgentTokenEnvVar)
+	if token == "" {
+		log.Fatalf("agent mode requires the %s environment variable\n", consts.DetectionAgentTokenEnvVar)
+	}
+
+	detections := make(chan struct{}, maxConcurrentDetections)
+	signatures := &seenSignatures{seen: make(map[string]time.Time)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(consts.DetectionAgentPath, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxDetectionRequestSize))
+		if err != nil {
+			http.Error(w, "invalid detection request", http.StatusBadRequest)
+			return
+		}
+		timestamp := req.Header.Get(consts.DetectionAgentTimestampHeader)
+		signature := req.Header.Get(consts.DetectionAgentSignatureHeader)
+		if !signatures.valid(token, timestamp, signature, []byte(req.Method), []byte(req.URL.Path), body) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var detectionRequest common.DetectionRequest
+		if err = json.Unmarshal(body, &detectionRequest); err != nil || detectionRequest.PodUID == "" {
+			http.Error(w, "invalid detection request", http.StatusBadRequest)
+			return
+		}
+
+		detections <- struct{}{}
+		result, err := detectPod(detectionRequest.PodUID, detectionRequest.ContainerNames, nil)
+		<-detections
+		if err != nil {
+			log.Printf("could not detect pod %s, error: %s\n", detectionRequest.PodUID, err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		data, err := json.Marshal(result)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// the response is bound to the request signature, so it can not be replayed for another request
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(consts.DetectionAgentSignatureHeader, utils.SignDetectionAgentMessage(token, []byte(signature), data))
+		w.Write(data)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	log.Printf("detection agent listening on %s\n", address)
+	log.Fatal(server.ListenAndServe())
+}
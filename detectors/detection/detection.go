@@ -0,0 +1,100 @@
+package detection
+
+import (
+	"log"
+
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/detectors/appDetector"
+	"github.com/logzio/kubernetes-instrumentor/detectors/langDetector"
+	"github.com/logzio/kubernetes-instrumentor/detectors/opentelemetryDetector"
+	"github.com/logzio/kubernetes-instrumentor/detectors/process"
+	"github.com/logzio/kubernetes-instrumentor/detectors/serviceNameDetector"
+)
+
+// DetectContainer runs the language, application, opentelemetry and service name detectors on the processes
+// of a container and adds the findings to the detection result
+func DetectContainer(containerName string, processes []process.Details, result *common.DetectionResult) {
+	languageProcesses := langDetector.DetectLanguage(processes)
+	log.Printf("language detection result: %v\n", languageProcesses)
+
+	detectedAppName := appDetector.DetectApplication(processes)
+	if len(languageProcesses) > 0 {
+		// OpenTelemetry detection if language detected
+		otelDetected := opentelemetryDetector.DetectApplication(processes)
+		log.Printf("opentelemetry detection result: %v\n", otelDetected)
+		activeServiceName := serviceNameDetector.DetectServiceName(processes)
+		log.Printf("service name detection result: %s\n", activeServiceName)
+		languageResult := common.LanguageByContainer{
+			ContainerName:              containerName,
+			Language:                   languageProcesses[0].Language,
+			ProcessName:                languageProcesses[0].Exe,
+			OpentelemetryPreconfigured: otelDetected,
+			ActiveServiceName:          activeServiceName,
+			Processes:                  languageProcesses,
+		}
+		// a python process may run next to a primary process of another language
+		for _, p := range languageProcesses {
+			if p.Language == common.PythonProgrammingLanguage {
+				languageResult.PythonServerModel, languageResult.PythonPreload = langDetector.DetectPythonServerModel(processes)
+				log.Printf("python server model detection result: %s, preload: %v\n", languageResult.PythonServerModel, languageResult.PythonPreload)
+				break
+			}
+		}
+		if languageResult.IsMixed() {
+			log.Printf("container %s runs processes of several languages: %v\n", containerName, languageResult.ProcessLanguages())
+		}
+		result.LanguageByContainer = append(result.LanguageByContainer, languageResult)
+	}
+
+	addContainerDependencies(containerName, processes, result)
+
+	// Only one detected app is relevant (the rest is duplicated)
+	if len(detectedAppName) > 0 {
+		result.ApplicationByContainer = append(result.ApplicationByContainer, common.ApplicationByContainer{
+			ContainerName: containerName,
+			Application:   common.Application(detectedAppName[0]),
+		})
+	}
+}
+
+// addContainerDependencies records the libraries found in the dependency files of the container processes
+func addContainerDependencies(containerName string, processes []process.Details, result *common.DetectionResult) {
+	seen := make(map[common.Dependency]bool)
+	var dependencies []common.Dependency
+	for _, p := range processes {
+		for _, dep := range p.Dependencies {
+			if !seen[dep] {
+				seen[dep] = true
+				dependencies = append(dependencies, dep)
+			}
+		}
+	}
+	if len(dependencies) == 0 {
+		return
+	}
+	result.DependenciesByContainer = append(result.DependenciesByContainer, common.DependenciesByContainer{
+		ContainerName: containerName,
+		Dependencies:  dependencies,
+	})
+}
+
+// ContainerResult returns the part of the detection result that belongs to a container
+func ContainerResult(result common.DetectionResult, containerName string) common.DetectionResult {
+	var containerResult common.DetectionResult
+	for _, l := range result.LanguageByContainer {
+		if l.ContainerName == containerName {
+			containerResult.LanguageByContainer = append(containerResult.LanguageByContainer, l)
+		}
+	}
+	for _, a := range result.ApplicationByContainer {
+		if a.ContainerName == containerName {
+			containerResult.ApplicationByContainer = append(containerResult.ApplicationByContainer, a)
+		}
+	}
+	for _, d := range result.DependenciesByContainer {
+		if d.ContainerName == containerName {
+			containerResult.DependenciesByContainer = append(containerResult.DependenciesByContainer, d)
+		}
+	}
+	return containerResult
+}
@@ -0,0 +1,374 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/logzio/kubernetes-instrumentor/detectors/process"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+var (
+	// ErrLayerTooLarge is returned when the uncompressed layers exceed the limit of ApplyLayerLimit
+	ErrLayerTooLarge = errors.New("the uncompressed layers exceed the unpack limit")
+	// ErrUnsupportedCompression is returned for zstd compressed layers, only gzip and uncompressed layers are read
+	ErrUnsupportedCompression = errors.New("zstd compressed layers are not supported")
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Config is the part of the OCI image config that describes how the container process is started
+type Config struct {
+	Entrypoint []string `json:"Entrypoint"`
+	Cmd        []string `json:"Cmd"`
+	Env        []string `json:"Env"`
+	WorkingDir string   `json:"WorkingDir"`
+}
+
+// Command returns the command line the container runtime starts for the image
+func (c *Config) Command() []string {
+	return append(append([]string{}, c.Entrypoint...), c.Cmd...)
+}
+
+type imageConfigFile struct {
+	Config Config `json:"config"`
+}
+
+// docker save manifest.json entry
+type dockerManifest struct {
+	Config string   `json:"Config"`
+	Layers []string `json:"Layers"`
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// UnpackTarball unpacks an image tarball, in either `docker save` or OCI layout format, into rootfs
+// and returns the image config
+func UnpackTarball(tarPath string, rootfs string) (*Config, error) {
+	layoutDir, err := os.MkdirTemp("", "image-layout-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(layoutDir)
+
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err = extractTar(file, layoutDir); err != nil {
+		return nil, fmt.Errorf("could not read image tarball: %w", err)
+	}
+
+	configPath, layerPaths, err := readLayout(layoutDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, layerPath := range layerPaths {
+		if err = UnpackLayer(path.Join(layoutDir, layerPath), rootfs); err != nil {
+			return nil, fmt.Errorf("could not unpack layer %s: %w", layerPath, err)
+		}
+	}
+
+	data, err := os.ReadFile(path.Join(layoutDir, configPath))
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig reads the container config from an image config blob
+func ParseConfig(data []byte) (*Config, error) {
+	var configFile imageConfigFile
+	if err := json.Unmarshal(data, &configFile); err != nil {
+		return nil, fmt.Errorf("could not parse image config: %w", err)
+	}
+	return &configFile.Config, nil
+}
+
+// readLayout returns the config and layer paths relative to the layout directory
+func readLayout(layoutDir string) (string, []string, error) {
+	if data, err := os.ReadFile(path.Join(layoutDir, "manifest.json")); err == nil {
+		var manifests []dockerManifest
+		if err = json.Unmarshal(data, &manifests); err != nil {
+			return "", nil, fmt.Errorf("could not parse manifest.json: %w", err)
+		}
+		if len(manifests) == 0 {
+			return "", nil, errors.New("manifest.json does not contain any image")
+		}
+		return manifests[0].Config, manifests[0].Layers, nil
+	}
+
+	data, err := os.ReadFile(path.Join(layoutDir, "index.json"))
+	if err != nil {
+		return "", nil, errors.New("unrecognized image tarball, expected manifest.json or index.json")
+	}
+	var index ociIndex
+	if err = json.Unmarshal(data, &index); err != nil {
+		return "", nil, fmt.Errorf("could not parse index.json: %w", err)
+	}
+	if len(index.Manifests) == 0 {
+		return "", nil, errors.New("index.json does not contain any image")
+	}
+
+	manifestDescriptor := index.Manifests[0]
+	data, err = os.ReadFile(path.Join(layoutDir, blobPath(manifestDescriptor.Digest)))
+	if err != nil {
+		return "", nil, err
+	}
+	// multi platform images point to a nested index
+	if strings.Contains(manifestDescriptor.MediaType, "index") || strings.Contains(manifestDescriptor.MediaType, "manifest.list") {
+		var nested ociIndex
+		if err = json.Unmarshal(data, &nested); err != nil || len(nested.Manifests) == 0 {
+			return "", nil, errors.New("could not read the nested image index")
+		}
+		data, err = os.ReadFile(path.Join(layoutDir, blobPath(nested.Manifests[0].Digest)))
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	var manifest ociManifest
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return "", nil, fmt.Errorf("could not parse image manifest: %w", err)
+	}
+	var layers []string
+	for _, layer := range manifest.Layers {
+		layers = append(layers, blobPath(layer.Digest))
+	}
+	return blobPath(manifest.Config.Digest), layers, nil
+}
+
+func blobPath(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// UnpackLayer applies a (possibly gzip compressed) layer tarball on top of rootfs, including whiteout files
+func UnpackLayer(layerPath string, rootfs string) error {
+	file, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return ApplyLayer(file, rootfs)
+}
+
+// ApplyLayer applies a layer stream on top of rootfs, gzip compressed layers are detected by their magic bytes
+func ApplyLayer(layer io.Reader, rootfs string) error {
+	_, err := ApplyLayerLimit(layer, rootfs, -1)
+	return err
+}
+
+// ApplyLayerLimit applies a layer stream on top of rootfs and returns the size of the uncompressed layer. A layer
+// larger than limit fails with ErrLayerTooLarge before more than limit bytes are extracted, a negative limit does not
+// bound the layer
+func ApplyLayerLimit(layer io.Reader, rootfs string, limit int64) (int64, error) {
+	reader := bufio.NewReader(layer)
+	var uncompressed io.Reader = reader
+	magic, err := reader.Peek(len(zstdMagic))
+	switch {
+	case err == nil && bytes.Equal(magic, zstdMagic):
+		return 0, ErrUnsupportedCompression
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return 0, err
+		}
+		defer gzipReader.Close()
+		uncompressed = gzipReader
+	}
+
+	counter := &limitedReader{reader: uncompressed, remaining: limit}
+	err = extractTar(counter, rootfs)
+	return counter.read, err
+}
+
+// limitedReader fails with ErrLayerTooLarge once more than remaining bytes were read, a negative remaining is no limit
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+	read      int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining >= 0 && int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.reader.Read(p)
+	l.read += int64(n)
+	if l.remaining >= 0 {
+		if int64(n) > l.remaining {
+			return 0, ErrLayerTooLarge
+		}
+		l.remaining -= int64(n)
+	}
+	return n, err
+}
+
+func extractTar(reader io.Reader, dest string) error {
+	root, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+
+	// the paths written by this tarball, whiteouts only hide the content of the lower layers whatever the order of the
+	// entries is
+	extracted := make(map[string]bool)
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+		// symlinks extracted by earlier entries are followed inside the image root, not on the host
+		base := path.Base(name)
+		dir, err := process.ResolveInRoot(root, path.Dir(name))
+		if err != nil {
+			log.Printf("skipping %s: %s", name, err)
+			continue
+		}
+		target := filepath.Join(root, dir, base)
+
+		if !insideRoot(root, target) {
+			log.Printf("skipping %s, a symlink points it outside of the image root", name)
+			continue
+		}
+
+		if base == opaqueWhiteout {
+			// remove everything the lower layers put in the directory
+			removeLowerEntries(filepath.Dir(target), extracted)
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			if hidden := filepath.Join(filepath.Dir(target), strings.TrimPrefix(base, whiteoutPrefix)); !extracted[hidden] {
+				os.RemoveAll(hidden)
+			}
+			continue
+		}
+		markExtracted(root, target, extracted)
+
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			log.Printf("could not create directory for %s: %s", name, err)
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			os.RemoveAll(target)
+			if err = writeFile(target, tarReader); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			os.RemoveAll(target)
+			if err = os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := process.ResolveInRoot(root, path.Clean("/"+header.Linkname))
+			if err != nil {
+				log.Printf("skipping hard link %s: %s", name, err)
+				continue
+			}
+			source = filepath.Join(root, source)
+			if !insideRoot(root, source) {
+				log.Printf("skipping hard link %s, its target %s is outside of the image root", name, header.Linkname)
+				continue
+			}
+			os.RemoveAll(target)
+			if err = os.Link(source, target); err != nil {
+				log.Printf("could not create hard link %s: %s", name, err)
+			}
+		default:
+			// devices and fifos are not needed for detection
+		}
+	}
+}
+
+// markExtracted records target and its parent directories as written by the current tarball
+func markExtracted(root string, target string, extracted map[string]bool) {
+	for p := target; p != root && !extracted[p]; p = filepath.Dir(p) {
+		extracted[p] = true
+	}
+}
+
+// removeLowerEntries removes the entries of dir that were not written by the current tarball, the directories it wrote
+// keep their own entries only
+func removeLowerEntries(dir string, extracted map[string]bool) {
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		p := filepath.Join(dir, entry.Name())
+		switch {
+		case !extracted[p]:
+			os.RemoveAll(p)
+		case entry.IsDir():
+			removeLowerEntries(p, extracted)
+		}
+	}
+}
+
+// insideRoot makes sure that the directory of target does not resolve outside of root on the host, a last check after
+// the symlinks were resolved inside root
+func insideRoot(root string, target string) bool {
+	dir := filepath.Dir(target)
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator))
+		}
+		if !os.IsNotExist(err) || dir == filepath.Dir(dir) {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func writeFile(target string, reader io.Reader) error {
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, reader)
+	return err
+}
@@ -0,0 +1,256 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// entry of a test layer: a file when content is set, a symlink or a hard link when link is set, a directory otherwise
+type entry struct {
+	name     string
+	content  string
+	link     string
+	hardLink bool
+}
+
+func layer(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644}
+		switch {
+		case e.hardLink:
+			header.Typeflag, header.Linkname = tar.TypeLink, e.link
+		case e.link != "":
+			header.Typeflag, header.Linkname = tar.TypeSymlink, e.link
+		case e.content != "" || filepath.Base(e.name)[:1] == ".":
+			header.Typeflag, header.Size = tar.TypeReg, int64(len(e.content))
+		default:
+			header.Typeflag, header.Mode = tar.TypeDir, 0755
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tree lists the files of root with their content, and the directories with a trailing slash
+func tree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(p)
+			files[rel] = "->" + target
+		case info.IsDir():
+			files[rel+"/"] = ""
+		default:
+			data, _ := os.ReadFile(p)
+			files[rel] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func keys(m map[string]string) []string {
+	var k []string
+	for key := range m {
+		k = append(k, key)
+	}
+	sort.Strings(k)
+	return k
+}
+
+func TestApplyLayerWhiteouts(t *testing.T) {
+	lower := []entry{
+		{name: "app/"},
+		{name: "app/a", content: "a"},
+		{name: "app/sub/"},
+		{name: "app/sub/old", content: "old"},
+		{name: "keep", content: "keep"},
+		{name: "gone", content: "gone"},
+	}
+	tests := []struct {
+		name  string
+		upper []entry
+		want  map[string]string
+	}{
+		{
+			name:  "whiteout of a lower file",
+			upper: []entry{{name: ".wh.gone"}},
+			want:  map[string]string{"app/": "", "app/a": "a", "app/sub/": "", "app/sub/old": "old", "keep": "keep"},
+		},
+		{
+			name:  "opaque directory after its new entries",
+			upper: []entry{{name: "app/c", content: "c"}, {name: "app/sub/new", content: "new"}, {name: "app/.wh..wh..opq"}, {name: "app/d", content: "d"}},
+			want:  map[string]string{"app/": "", "app/c": "c", "app/d": "d", "app/sub/": "", "app/sub/new": "new", "gone": "gone", "keep": "keep"},
+		},
+		{
+			name:  "opaque directory before its new entries",
+			upper: []entry{{name: "app/"}, {name: "app/.wh..wh..opq"}, {name: "app/c", content: "c"}},
+			want:  map[string]string{"app/": "", "app/c": "c", "gone": "gone", "keep": "keep"},
+		},
+		{
+			name:  "whiteout of a file of the same layer",
+			upper: []entry{{name: "new", content: "new"}, {name: ".wh.new"}, {name: ".wh.gone"}},
+			want:  map[string]string{"app/": "", "app/a": "a", "app/sub/": "", "app/sub/old": "old", "keep": "keep", "new": "new"},
+		},
+	}
+	for _, test := range tests {
+		root := t.TempDir()
+		for _, l := range [][]entry{lower, test.upper} {
+			if err := ApplyLayer(bytes.NewReader(layer(t, l...)), root); err != nil {
+				t.Fatalf("%s: ApplyLayer() error: %s", test.name, err)
+			}
+		}
+		if got := tree(t, root); !equal(got, test.want) {
+			t.Errorf("%s: rootfs = %v, want %v", test.name, keys(got), keys(test.want))
+		}
+	}
+}
+
+func TestApplyLayerStaysInRoot(t *testing.T) {
+	host := t.TempDir()
+	if err := os.WriteFile(filepath.Join(host, "secret"), []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		entries []entry
+		want    map[string]string
+	}{
+		{
+			name:    "parent directory names",
+			entries: []entry{{name: "../../evil", content: "evil"}},
+			want:    map[string]string{"evil": "evil"},
+		},
+		{
+			name:    "relative symlink to the parent of the root",
+			entries: []entry{{name: "up", link: "../../.."}, {name: "up/evil", content: "evil"}},
+			want:    map[string]string{"up": "->../../..", "evil": "evil"},
+		},
+		{
+			name:    "absolute symlink to a host directory",
+			entries: []entry{{name: "host", link: host}, {name: "host/evil", content: "evil"}},
+			want:    map[string]string{"host": "->" + host, filepath.Join(host[1:], "evil"): "evil"},
+		},
+		{
+			name:    "symlink replaced by a directory of the root",
+			entries: []entry{{name: "etc", link: host}, {name: "etc/", content: ""}, {name: "etc/secret", content: "image"}},
+			want:    map[string]string{"etc": "->" + host, filepath.Join(host[1:], "secret"): "image"},
+		},
+		{
+			name:    "hard link to a host file",
+			entries: []entry{{name: "stolen", link: "../" + filepath.Base(host) + "/secret", hardLink: true}},
+			want:    map[string]string{},
+		},
+		{
+			name:    "hard link through a symlink",
+			entries: []entry{{name: "host", link: host}, {name: "stolen", link: "host/secret", hardLink: true}},
+			want:    map[string]string{"host": "->" + host},
+		},
+	}
+	for _, test := range tests {
+		root := t.TempDir()
+		if err := ApplyLayer(bytes.NewReader(layer(t, test.entries...)), root); err != nil {
+			t.Fatalf("%s: ApplyLayer() error: %s", test.name, err)
+		}
+		got := tree(t, root)
+		// directories created for the nested paths are not listed
+		for name := range got {
+			if name[len(name)-1] == '/' {
+				delete(got, name)
+			}
+		}
+		if !equal(got, test.want) {
+			t.Errorf("%s: rootfs = %v, want %v", test.name, got, test.want)
+		}
+		hostFiles := tree(t, host)
+		if len(hostFiles) != 1 || hostFiles["secret"] != "host" {
+			t.Fatalf("%s: host directory changed: %v", test.name, hostFiles)
+		}
+	}
+}
+
+func TestApplyLayerGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(layer(t, entry{name: "app/main.py", content: "print()"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := ApplyLayer(&compressed, root); err != nil {
+		t.Fatalf("ApplyLayer() error: %s", err)
+	}
+	if got := tree(t, root); got["app/main.py"] != "print()" {
+		t.Errorf("rootfs = %v, want app/main.py", got)
+	}
+}
+
+func TestApplyLayerLimit(t *testing.T) {
+	data := layer(t, entry{name: "app/main.py", content: strings.Repeat("0", 8<<10)})
+	tests := []struct {
+		name    string
+		layer   []byte
+		limit   int64
+		wantErr error
+	}{
+		{name: "no limit", layer: data, limit: -1},
+		{name: "under the limit", layer: data, limit: int64(len(data))},
+		{name: "over the limit", layer: data, limit: 4 << 10, wantErr: ErrLayerTooLarge},
+		{name: "zstd", layer: append([]byte{0x28, 0xb5, 0x2f, 0xfd}, data...), limit: -1, wantErr: ErrUnsupportedCompression},
+	}
+	for _, test := range tests {
+		root := t.TempDir()
+		size, err := ApplyLayerLimit(bytes.NewReader(test.layer), root, test.limit)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: ApplyLayerLimit() error = %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+		if test.wantErr == nil && size != int64(len(data)) {
+			t.Errorf("%s: ApplyLayerLimit() size = %d, want %d", test.name, size, len(data))
+		}
+		if test.wantErr != nil && size > test.limit+1 && test.limit >= 0 {
+			t.Errorf("%s: ApplyLayerLimit() read %d bytes, want at most %d", test.name, size, test.limit+1)
+		}
+	}
+}
+
+func equal(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, exists := b[key]; !exists || other != value {
+			return false
+		}
+	}
+	return true
+}
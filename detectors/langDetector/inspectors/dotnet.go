@@ -19,10 +19,9 @@ Credits: https://github.com/keyval-dev/odigos
 package inspectors
 
 import (
-	"fmt"
 	"github.com/logzio/kubernetes-instrumentor/common"
 	"github.com/logzio/kubernetes-instrumentor/detectors/process"
-	"os"
+	"path"
 	"strings"
 )
 
@@ -33,13 +32,27 @@ const (
 	dotnet = "DOTNET"
 )
 
+// dotnetRuntimeLibraries are loaded by every .NET process, framework dependent or self-contained
+var dotnetRuntimeLibraries = map[string]bool{
+	"libcoreclr.so":    true,
+	"libhostfxr.so":    true,
+	"libhostpolicy.so": true,
+}
+
 var DotNet = &dotnetInspector{}
 
+// Inspect looks for the .NET runtime variables in the process environment, which is read from /proc/<pid>/environ
+// for running processes or from the image config in offline mode, and for the .NET runtime libraries mapped in the
+// process memory of self-contained apps that set no runtime variable
 func (d *dotnetInspector) Inspect(p *process.Details) (common.ProgrammingLanguage, bool) {
-	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", p.ProcessID))
-	if err == nil {
-		environ := string(data)
-		if strings.Contains(environ, aspnet) || strings.Contains(environ, dotnet) {
+	for key, value := range p.Env {
+		entry := key + "=" + value
+		if strings.Contains(entry, aspnet) || strings.Contains(entry, dotnet) {
+			return common.DotNetProgrammingLanguage, true
+		}
+	}
+	for _, file := range p.MappedFiles {
+		if dotnetRuntimeLibraries[path.Base(file)] {
 			return common.DotNetProgrammingLanguage, true
 		}
 	}
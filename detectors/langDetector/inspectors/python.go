@@ -21,6 +21,7 @@ package inspectors
 import (
 	"github.com/logzio/kubernetes-instrumentor/common"
 	"github.com/logzio/kubernetes-instrumentor/detectors/process"
+	"path"
 	"strings"
 )
 
@@ -28,12 +29,144 @@ type pythonInspector struct{}
 
 var Python = &pythonInspector{}
 
-const pythonProcessName = "python"
+const (
+	pythonProcessName = "python"
+	// uwsgi embeds the python interpreter, so the exe is not named python
+	uwsgiProcessName = "uwsgi"
+	gunicornArg      = "gunicorn"
+	celeryArg        = "celery"
+	uvicornArg       = "uvicorn"
+)
+
+// celery pools that run tasks without forking worker processes
+var celeryNonForkingPools = []string{"solo", "threads", "gevent", "eventlet"}
 
 func (p *pythonInspector) Inspect(process *process.Details) (common.ProgrammingLanguage, bool) {
-	if strings.Contains(process.ExeName, pythonProcessName) || strings.Contains(process.CmdLine, pythonProcessName) {
+	if strings.Contains(process.ExeName, pythonProcessName) || strings.Contains(process.CmdLine, pythonProcessName) ||
+		strings.Contains(path.Base(process.ExeName), uwsgiProcessName) {
 		return common.PythonProgrammingLanguage, true
 	}
 
 	return "", false
 }
+
+// InspectServerModel returns the server model of the python application and whether the application is loaded
+// before the workers are forked (preload). The master process is the python process whose parent is outside the container
+func (p *pythonInspector) InspectServerModel(processes []process.Details) (common.PythonServerModel, bool) {
+	pids := make(map[int]bool)
+	for _, proc := range processes {
+		pids[proc.ProcessID] = true
+	}
+
+	var candidates []process.Details
+	for _, proc := range processes {
+		if _, isPython := p.Inspect(&proc); isPython && !pids[proc.ParentProcessID] {
+			candidates = append(candidates, proc)
+		}
+	}
+	// fall back to all python processes if the process tree could not be read
+	if len(candidates) == 0 {
+		for _, proc := range processes {
+			if _, isPython := p.Inspect(&proc); isPython {
+				candidates = append(candidates, proc)
+			}
+		}
+	}
+
+	for _, proc := range candidates {
+		args := cmdLineArgs(proc.CmdLine)
+		switch {
+		case strings.Contains(path.Base(proc.ExeName), uwsgiProcessName) || hasCommand(args, uwsgiProcessName):
+			return common.UwsgiPythonServerModel, !uwsgiLazyApps(args, proc.Env)
+		case hasCommand(args, gunicornArg):
+			return common.GunicornPythonServerModel, hasArg(args, "--preload") || strings.Contains(proc.Env["GUNICORN_CMD_ARGS"], "--preload")
+		case hasCommand(args, celeryArg):
+			return common.CeleryPythonServerModel, hasArg(args, "worker") && celeryForkingPool(args)
+		case hasCommand(args, uvicornArg):
+			// uvicorn starts its workers with the spawn method, the application is never loaded before the fork
+			return common.UvicornPythonServerModel, false
+		}
+	}
+
+	return common.PlainPythonServerModel, false
+}
+
+func cmdLineArgs(cmdLine string) []string {
+	var args []string
+	for _, arg := range strings.Split(cmdLine, "\x00") {
+		if arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
+
+// hasCommand checks if the command is the executable (gunicorn app:app) or a python module (python -m gunicorn app:app)
+func hasCommand(args []string, command string) bool {
+	for i, arg := range args {
+		if path.Base(arg) == command && (i == 0 || i == 1 || args[i-1] == "-m") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasArg(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == name || strings.HasPrefix(arg, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// uwsgiLazyApps reports whether uwsgi loads the application in each worker, from the --lazy-apps and --lazy options or
+// their UWSGI_LAZY_APPS and UWSGI_LAZY variables
+func uwsgiLazyApps(args []string, env map[string]string) bool {
+	for _, name := range []string{"--lazy-apps", "--lazy"} {
+		for _, arg := range args {
+			if arg == name {
+				return true
+			}
+			if value, found := strings.CutPrefix(arg, name+"="); found && uwsgiTrue(value) {
+				return true
+			}
+		}
+	}
+	for _, name := range []string{"UWSGI_LAZY_APPS", "UWSGI_LAZY"} {
+		if value, exists := env[name]; exists && uwsgiTrue(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// uwsgiTrue parses the value of a uwsgi boolean option the way uwsgi does, anything but 0, false, off and no is true
+func uwsgiTrue(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "0", "false", "off", "no":
+		return false
+	}
+	return true
+}
+
+// celeryForkingPool returns false if the worker runs with one of the non-forking pools, prefork is the default pool
+func celeryForkingPool(args []string) bool {
+	pool := ""
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "--pool=") {
+			pool = strings.TrimPrefix(arg, "--pool=")
+		} else if (arg == "--pool" || arg == "-P") && i+1 < len(args) {
+			pool = args[i+1]
+		} else if strings.HasPrefix(arg, "-P") && len(arg) > 2 {
+			pool = strings.TrimPrefix(arg, "-P")
+		}
+	}
+
+	for _, p := range celeryNonForkingPools {
+		if pool == p {
+			return false
+		}
+	}
+	return true
+}
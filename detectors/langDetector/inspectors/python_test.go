@@ -0,0 +1,178 @@
+package inspectors
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/detectors/process"
+)
+
+func cmdLine(args ...string) string {
+	return strings.Join(args, "\x00") + "\x00"
+}
+
+func TestInspectServerModel(t *testing.T) {
+	tests := []struct {
+		name        string
+		processes   []process.Details
+		wantModel   common.PythonServerModel
+		wantPreload bool
+	}{
+		{
+			name:      "plain python",
+			processes: []process.Details{{ProcessID: 1, ExeName: "/usr/bin/python3", CmdLine: cmdLine("python3", "app.py")}},
+			wantModel: common.PlainPythonServerModel,
+		},
+		{
+			name: "gunicorn master and workers",
+			processes: []process.Details{
+				{ProcessID: 1, ExeName: "/usr/local/bin/python3.11", CmdLine: cmdLine("/usr/local/bin/python3.11", "/usr/local/bin/gunicorn", "app:app")},
+				{ProcessID: 7, ParentProcessID: 1, ExeName: "/usr/local/bin/python3.11", CmdLine: cmdLine("/usr/local/bin/python3.11", "/usr/local/bin/gunicorn", "app:app")},
+			},
+			wantModel: common.GunicornPythonServerModel,
+		},
+		{
+			name:        "gunicorn preload argument",
+			processes:   []process.Details{{ProcessID: 1, ExeName: "/usr/bin/python3", CmdLine: cmdLine("python3", "-m", "gunicorn", "--preload", "app:app")}},
+			wantModel:   common.GunicornPythonServerModel,
+			wantPreload: true,
+		},
+		{
+			name:        "gunicorn preload variable",
+			processes:   []process.Details{{ProcessID: 1, ExeName: "/usr/bin/python3", CmdLine: cmdLine("gunicorn", "app:app"), Env: map[string]string{"GUNICORN_CMD_ARGS": "--workers 4 --preload"}}},
+			wantModel:   common.GunicornPythonServerModel,
+			wantPreload: true,
+		},
+		{
+			name: "shell wrapper starting gunicorn",
+			processes: []process.Details{
+				{ProcessID: 1, ExeName: "/bin/sh", CmdLine: cmdLine("/bin/sh", "-c", "gunicorn --preload app:app")},
+				{ProcessID: 8, ParentProcessID: 1, ExeName: "/usr/bin/python3", CmdLine: cmdLine("python3", "/usr/bin/gunicorn", "--preload", "app:app")},
+			},
+			wantModel:   common.GunicornPythonServerModel,
+			wantPreload: true,
+		},
+		{
+			name:        "uwsgi binary",
+			processes:   []process.Details{{ProcessID: 1, ExeName: "/usr/local/bin/uwsgi", CmdLine: cmdLine("uwsgi", "--http", ":8080", "--module", "app")}},
+			wantModel:   common.UwsgiPythonServerModel,
+			wantPreload: true,
+		},
+		{
+			name:      "uwsgi lazy apps argument",
+			processes: []process.Details{{ProcessID: 1, ExeName: "/usr/local/bin/uwsgi", CmdLine: cmdLine("uwsgi", "--lazy-apps", "--module", "app")}},
+			wantModel: common.UwsgiPythonServerModel,
+		},
+		{
+			name:      "uwsgi lazy apps variable",
+			processes: []process.Details{{ProcessID: 1, ExeName: "/usr/local/bin/uwsgi", CmdLine: cmdLine("uwsgi", "--module", "app"), Env: map[string]string{"UWSGI_LAZY_APPS": "1"}}},
+			wantModel: common.UwsgiPythonServerModel,
+		},
+		{
+			name:        "uwsgi lazy apps disabled",
+			processes:   []process.Details{{ProcessID: 1, ExeName: "/usr/local/bin/uwsgi", CmdLine: cmdLine("uwsgi", "--module", "app"), Env: map[string]string{"UWSGI_LAZY_APPS": "false"}}},
+			wantModel:   common.UwsgiPythonServerModel,
+			wantPreload: true,
+		},
+		{
+			name:        "celery prefork worker",
+			processes:   []process.Details{{ProcessID: 1, ExeName: "/usr/bin/python3", CmdLine: cmdLine("python3", "/usr/bin/celery", "-A", "tasks", "worker")}},
+			wantModel:   common.CeleryPythonServerModel,
+			wantPreload: true,
+		},
+		{
+			name:      "celery solo worker",
+			processes: []process.Details{{ProcessID: 1, ExeName: "/usr/bin/python3", CmdLine: cmdLine("celery", "-A", "tasks", "worker", "--pool=solo")}},
+			wantModel: common.CeleryPythonServerModel,
+		},
+		{
+			name:      "celery beat",
+			processes: []process.Details{{ProcessID: 1, ExeName: "/usr/bin/python3", CmdLine: cmdLine("celery", "-A", "tasks", "beat")}},
+			wantModel: common.CeleryPythonServerModel,
+		},
+		{
+			name:      "uvicorn workers",
+			processes: []process.Details{{ProcessID: 1, ExeName: "/usr/bin/python3", CmdLine: cmdLine("uvicorn", "app:app", "--workers", "4")}},
+			wantModel: common.UvicornPythonServerModel,
+		},
+		{
+			name:      "gunicorn argument of a plain script",
+			processes: []process.Details{{ProcessID: 1, ExeName: "/usr/bin/python3", CmdLine: cmdLine("python3", "manage.py", "run", "gunicorn")}},
+			wantModel: common.PlainPythonServerModel,
+		},
+	}
+	for _, test := range tests {
+		model, preload := Python.InspectServerModel(test.processes)
+		if model != test.wantModel || preload != test.wantPreload {
+			t.Errorf("%s: InspectServerModel() = (%s, %t), want (%s, %t)", test.name, model, preload, test.wantModel, test.wantPreload)
+		}
+	}
+}
+
+func TestHasCommand(t *testing.T) {
+	tests := []struct {
+		args    []string
+		command string
+		want    bool
+	}{
+		{[]string{"gunicorn", "app:app"}, "gunicorn", true},
+		{[]string{"/usr/local/bin/gunicorn", "app:app"}, "gunicorn", true},
+		{[]string{"python3", "/usr/local/bin/gunicorn", "app:app"}, "gunicorn", true},
+		{[]string{"python3", "-m", "gunicorn", "app:app"}, "gunicorn", true},
+		{[]string{"python3", "-u", "-m", "celery", "worker"}, "celery", true},
+		{[]string{"python3", "app.py", "gunicorn"}, "gunicorn", false},
+		{[]string{"python3", "-m", "gunicorn_wrapper"}, "gunicorn", false},
+		{nil, "gunicorn", false},
+	}
+	for _, test := range tests {
+		if got := hasCommand(test.args, test.command); got != test.want {
+			t.Errorf("hasCommand(%q, %s) = %t, want %t", test.args, test.command, got, test.want)
+		}
+	}
+}
+
+func TestCeleryForkingPool(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"celery", "-A", "tasks", "worker"}, true},
+		{[]string{"celery", "worker", "--pool=prefork"}, true},
+		{[]string{"celery", "worker", "--pool=solo"}, false},
+		{[]string{"celery", "worker", "--pool", "threads"}, false},
+		{[]string{"celery", "worker", "-P", "gevent"}, false},
+		{[]string{"celery", "worker", "-Peventlet"}, false},
+		{[]string{"celery", "worker", "-P"}, true},
+	}
+	for _, test := range tests {
+		if got := celeryForkingPool(test.args); got != test.want {
+			t.Errorf("celeryForkingPool(%q) = %t, want %t", test.args, got, test.want)
+		}
+	}
+}
+
+func TestUwsgiLazyApps(t *testing.T) {
+	tests := []struct {
+		args []string
+		env  map[string]string
+		want bool
+	}{
+		{[]string{"uwsgi", "--module", "app"}, nil, false},
+		{[]string{"uwsgi", "--lazy-apps"}, nil, true},
+		{[]string{"uwsgi", "--lazy"}, nil, true},
+		{[]string{"uwsgi", "--lazy-apps=true"}, nil, true},
+		{[]string{"uwsgi", "--lazy-apps=0"}, nil, false},
+		{[]string{"uwsgi"}, map[string]string{"UWSGI_LAZY_APPS": "1"}, true},
+		{[]string{"uwsgi"}, map[string]string{"UWSGI_LAZY_APPS": "yes"}, true},
+		{[]string{"uwsgi"}, map[string]string{"UWSGI_LAZY_APPS": "0"}, false},
+		{[]string{"uwsgi"}, map[string]string{"UWSGI_LAZY_APPS": "false"}, false},
+		{[]string{"uwsgi"}, map[string]string{"UWSGI_LAZY_APPS": "Off"}, false},
+		{[]string{"uwsgi"}, map[string]string{"UWSGI_LAZY_APPS": "no", "UWSGI_LAZY": "1"}, true},
+	}
+	for _, test := range tests {
+		if got := uwsgiLazyApps(test.args, test.env); got != test.want {
+			t.Errorf("uwsgiLazyApps(%q, %v) = %t, want %t", test.args, test.env, got, test.want)
+		}
+	}
+}
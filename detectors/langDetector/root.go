@@ -19,6 +19,10 @@ Credits: https://github.com/keyval-dev/odigos
 package langDetector
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+
 	"github.com/logzio/kubernetes-instrumentor/common"
 	"github.com/logzio/kubernetes-instrumentor/detectors/langDetector/inspectors"
 	"github.com/logzio/kubernetes-instrumentor/detectors/process"
@@ -30,20 +34,75 @@ type inspector interface {
 
 var inspectorsList = []inspector{inspectors.Java, inspectors.Python, inspectors.DotNet, inspectors.NodeJs}
 
-// DetectLanguage returns a list of all the detected languages in the process-app list
-// For go applications the process-app path is also returned, in all other languages the value is empty
-func DetectLanguage(processes []process.Details) ([]common.ProgrammingLanguage, string) {
-	var result []common.ProgrammingLanguage
-	processName := ""
+// DetectLanguage returns every process of a detected language, the primary process first. The primary process is
+// the detected process closest to the root of the process tree of the container, the lowest PID on a tie
+func DetectLanguage(processes []process.Details) []common.ContainerProcess {
+	parents := make(map[int]int)
+	for _, p := range processes {
+		parents[p.ProcessID] = p.ParentProcessID
+	}
+
+	var result []common.ContainerProcess
+	var depths []int
 	for _, p := range processes {
 		for _, i := range inspectorsList {
 			inspectionResult, detected := i.Inspect(&p)
 			if detected {
-				result = append(result, inspectionResult)
+				result = append(result, common.ContainerProcess{
+					PID:           p.ProcessID,
+					Exe:           p.ExeName,
+					Language:      inspectionResult,
+					Runtime:       path.Base(p.ExeName),
+					CmdLineDigest: cmdLineDigest(p.CmdLine),
+				})
+				depths = append(depths, processDepth(parents, p.ProcessID))
 				break
 			}
 		}
 	}
+	if len(result) == 0 {
+		return nil
+	}
+
+	primary := 0
+	for i := range result {
+		if depths[i] < depths[primary] || (depths[i] == depths[primary] && result[i].PID < result[primary].PID) {
+			primary = i
+		}
+	}
+	result[primary].Primary = true
+	result[0], result[primary] = result[primary], result[0]
+	return result
+}
+
+// processDepth is the number of ancestors of the process inside the container
+func processDepth(parents map[int]int, pid int) int {
+	depth := 0
+	seen := map[int]bool{pid: true}
+	for {
+		parent, exists := parents[pid]
+		if !exists {
+			return depth
+		}
+		if _, inContainer := parents[parent]; !inContainer || seen[parent] {
+			return depth
+		}
+		seen[parent] = true
+		pid = parent
+		depth++
+	}
+}
+
+func cmdLineDigest(cmdLine string) string {
+	if cmdLine == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(cmdLine))
+	return hex.EncodeToString(sum[:8])
+}
 
-	return result, processName
+// DetectPythonServerModel returns the server model of the python processes and whether the application is preloaded
+// in the master process before the workers are forked
+func DetectPythonServerModel(processes []process.Details) (common.PythonServerModel, bool) {
+	return inspectors.Python.InspectServerModel(processes)
 }
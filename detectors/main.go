@@ -20,13 +20,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/logzio/kubernetes-instrumentor/common"
-	"github.com/logzio/kubernetes-instrumentor/detectors/appDetector"
-	"github.com/logzio/kubernetes-instrumentor/detectors/langDetector"
-	"github.com/logzio/kubernetes-instrumentor/detectors/opentelemetryDetector"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	"github.com/logzio/kubernetes-instrumentor/detectors/detection"
 	"github.com/logzio/kubernetes-instrumentor/detectors/process"
-	"github.com/logzio/kubernetes-instrumentor/detectors/serviceNameDetector"
 	"io/fs"
 	"log"
 	"os"
@@ -34,77 +34,207 @@ import (
 )
 
 type Args struct {
-	PodUID         string
+	PodUIDs        []string
 	ContainerNames []string
+	ReportURL      string
+	// agent mode
+	AgentAddress string
+	// ephemeral container mode
+	TargetContainer string
+	// offline mode
+	RootFS   string
+	ImageTar string
+	Cmd      string
+	Env      envFlags
+	// snapshot modes
+	Record string
+	Replay string
+}
+
+// envFlags collects repeated --env KEY=VALUE flags
+type envFlags []string
+
+func (e *envFlags) String() string {
+	return strings.Join(*e, ",")
+}
+
+func (e *envFlags) Set(value string) error {
+	*e = append(*e, value)
+	return nil
 }
 
 func main() {
 	args := parseArgs()
-	var containerResults []common.LanguageByContainer
-	var detectedAppResults []common.ApplicationByContainer
-	for _, containerName := range args.ContainerNames {
-		processes, err := process.FindAllInContainer(args.PodUID, containerName)
+	if args.Replay != "" {
+		replaySnapshot(args.Replay)
+		return
+	}
+	if args.RootFS != "" || args.ImageTar != "" {
+		if err := detectOffline(args); err != nil {
+			log.Fatalf("offline detection failed, error: %s\n", err)
+		}
+		return
+	}
+	if args.AgentAddress != "" {
+		serveAgent(args.AgentAddress)
+		return
+	}
+
+	var snapshot *process.Snapshot
+	if args.Record != "" {
+		snapshot = process.NewSnapshot()
+	}
+
+	if len(args.PodUIDs) > 1 {
+		results, err := detectPods(args.PodUIDs, args.ContainerNames, snapshot)
 		if err != nil {
 			log.Fatalf("could not find processes, error: %s\n", err)
 		}
+		writeSnapshot(snapshot, args.Record)
 
-		processResults, processName := langDetector.DetectLanguage(processes)
-		log.Printf("language detection result: %s\n", processResults)
-
-		detectedAppName := appDetector.DetectApplication(processes)
-		if len(processResults) > 0 {
-			// OpenTelemetry detection if language detected
-			otelDetected := opentelemetryDetector.DetectApplication(processes)
-			log.Printf("opentelemetry detection result: %v\n", otelDetected)
-			activeServiceName := serviceNameDetector.DetectServiceName(processes)
-			log.Printf("service name detection result: %s\n", activeServiceName)
-			containerResults = append(containerResults, common.LanguageByContainer{
-				ContainerName:              containerName,
-				Language:                   processResults[0],
-				ProcessName:                processName,
-				OpentelemetryPreconfigured: otelDetected,
-				ActiveServiceName:          activeServiceName,
-			})
+		err = publishBatchDetectionResult(results, args.ReportURL)
+		if err != nil {
+			log.Fatalf("could not publish detection result, error: %s\n", err)
 		}
+		return
+	}
 
-		// Only one detected app is relevant (the rest is duplicated)
-		if len(detectedAppName) > 0 {
-			detectedAppResults = append(detectedAppResults, common.ApplicationByContainer{
-				ContainerName: containerName,
-				Application:   common.Application(detectedAppName[0]),
-			})
-		}
+	var detectionResult common.DetectionResult
+	var err error
+	if args.TargetContainer != "" {
+		detectionResult, err = detectNamespace(args.TargetContainer, snapshot)
+	} else {
+		detectionResult, err = detectPod(args.PodUIDs[0], args.ContainerNames, snapshot)
+	}
+	if err != nil {
+		log.Fatalf("could not find processes, error: %s\n", err)
+	}
+	writeSnapshot(snapshot, args.Record)
 
+	err = publishDetectionResult(detectionResult, args.TargetContainer, args.ReportURL)
+	if err != nil {
+		log.Fatalf("could not publish detection result, error: %s\n", err)
 	}
+}
 
-	detectionResult := common.DetectionResult{
-		LanguageByContainer:    containerResults,
-		ApplicationByContainer: detectedAppResults,
+// detectPods detects a batch of pods scheduled on this node, container names missing from a pod are ignored
+func detectPods(podUIDs []string, containerNames []string, snapshot *process.Snapshot) ([]common.PodDetectionResult, error) {
+	var results []common.PodDetectionResult
+	for _, podUID := range podUIDs {
+		result, err := detectPod(podUID, containerNames, snapshot)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, common.PodDetectionResult{PodUID: podUID, Result: result})
 	}
+	return results, nil
+}
 
-	err := publishDetectionResult(detectionResult)
+// detectPod runs the detectors against the processes of the given containers of a pod on this node, and records them
+// in the snapshot when one is given
+func detectPod(podUID string, containerNames []string, snapshot *process.Snapshot) (common.DetectionResult, error) {
+	var detectionResult common.DetectionResult
+	for _, containerName := range containerNames {
+		processes, err := process.FindAllInContainer(podUID, containerName)
+		if err != nil {
+			return detectionResult, err
+		}
+
+		detection.DetectContainer(containerName, processes, &detectionResult)
+		if snapshot != nil {
+			snapshot.Record(podUID, containerName, processes, detection.ContainerResult(detectionResult, containerName))
+		}
+	}
+	return detectionResult, nil
+}
+
+// detectNamespace runs the detectors against the processes sharing the PID namespace of an ephemeral container
+func detectNamespace(containerName string, snapshot *process.Snapshot) (common.DetectionResult, error) {
+	var detectionResult common.DetectionResult
+	processes, err := process.FindAllInNamespace()
+	if errors.Is(err, fs.ErrPermission) {
+		// the ephemeral container runs as the user of the detector image unless the target container sets runAsUser
+		return detectionResult, fmt.Errorf("the detector running as uid %d can not read the processes of container %s, "+
+			"set runAsUser to the user of its image in the security context of the container or of the pod: %w", os.Getuid(), containerName, err)
+	}
 	if err != nil {
-		log.Fatalf("could not publish detection result, error: %s\n", err)
+		return detectionResult, err
+	}
+
+	detection.DetectContainer(containerName, processes, &detectionResult)
+	if snapshot != nil {
+		snapshot.Record("", containerName, processes, detectionResult)
 	}
+	return detectionResult, nil
 }
 
 func parseArgs() *Args {
 	result := Args{}
-	var names string
-	flag.StringVar(&result.PodUID, "pod-uid", "", "The UID of the target pod")
-	flag.StringVar(&names, "container-names", "", "The container names in the target pod")
+	var names, podUIDs string
+	flag.StringVar(&podUIDs, "pod-uid", "", "The UID of the target pod, or comma separated UIDs of several pods on this node")
+	flag.StringVar(&names, "container-names", "", "The container names in the target pods")
+	flag.StringVar(&result.ReportURL, "report-url", "", "The instrumentor endpoint the full detection result is sent to")
+	flag.StringVar(&result.AgentAddress, "agent-address", "", "Agent mode: serve detection requests for the pods of this node on the given address")
+	flag.StringVar(&result.TargetContainer, "target-container", "", "Ephemeral container mode: the container whose process namespace the detector shares")
+	flag.StringVar(&result.RootFS, "rootfs", "", "Offline mode: detect against an unpacked container filesystem instead of /proc")
+	flag.StringVar(&result.ImageTar, "image-tar", "", "Offline mode: detect against an image tarball (docker save or OCI layout)")
+	flag.StringVar(&result.Cmd, "cmd", "", "Offline mode: the container command, defaults to the image entrypoint and cmd")
+	flag.Var(&result.Env, "env", "Offline mode: KEY=VALUE environment variable of the container, can be repeated")
+	flag.StringVar(&result.Record, "record", "", "Write a redacted snapshot of the processes and dependency files read to this file, - prints it base64 encoded to stdout")
+	flag.StringVar(&result.Replay, "replay", "", "Replay mode: run the detectors against a snapshot written with --record")
 	flag.Parse()
 
+	result.PodUIDs = strings.Split(podUIDs, ",")
 	result.ContainerNames = strings.Split(names, ",")
 
 	return &result
 }
 
-func publishDetectionResult(result common.DetectionResult) error {
-	data, err := json.Marshal(result)
+// publishDetectionResult writes the result of a pod, or of the target container of an ephemeral detection container
+func publishDetectionResult(result common.DetectionResult, targetContainer string, reportURL string) error {
+	return publish(common.DetectionReport{Result: result, TargetContainer: targetContainer}, result, result.Compact(), reportURL)
+}
+
+// publishBatchDetectionResult writes the results of a batch as a list of pod results
+func publishBatchDetectionResult(results []common.PodDetectionResult, reportURL string) error {
+	compact := make([]common.PodDetectionResult, 0, len(results))
+	for _, podResult := range results {
+		compact = append(compact, common.PodDetectionResult{PodUID: podResult.PodUID, Result: podResult.Result.Compact()})
+	}
+	return publish(common.DetectionReport{Pods: results}, results, compact, reportURL)
+}
+
+// publish sends the full report to the instrumentor and writes a compact summary to the termination
+// message, which kubernetes truncates at 4096 bytes. If the report could not be delivered the full result is
+// written when it fits. A compact summary that does not fit either is not written: the instrumentor already has the
+// delivered report, otherwise the detection fails instead of leaving a truncated result
+func publish(report common.DetectionReport, full interface{}, compact interface{}, reportURL string) error {
+	delivered := false
+	if reportURL != "" {
+		err := sendDetectionReport(report, reportURL)
+		if err != nil {
+			log.Printf("could not send detection report, falling back to the termination message, error: %s\n", err)
+		} else {
+			delivered = true
+		}
+	}
+
+	data, err := json.Marshal(full)
 	if err != nil {
 		return err
 	}
+	if delivered || len(data) > consts.TerminationMessageMaxLength {
+		data, err = json.Marshal(compact)
+		if err != nil {
+			return err
+		}
+	}
+	if len(data) > consts.TerminationMessageMaxLength {
+		if delivered {
+			return nil
+		}
+		return fmt.Errorf("the detection result of %d bytes does not fit the termination message", len(data))
+	}
 
 	return os.WriteFile("/dev/detection-result", data, fs.ModePerm)
 }
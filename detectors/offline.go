@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/detectors/detection"
+	"github.com/logzio/kubernetes-instrumentor/detectors/image"
+	"github.com/logzio/kubernetes-instrumentor/detectors/process"
+)
+
+const offlineContainerName = "app"
+
+// detectOffline runs the detectors against an unpacked root filesystem or an image tarball instead of /proc
+// and prints the detection result to stdout. Logs are written to stderr. Errors are returned so the unpacked image is
+// removed before the detectors exit
+func detectOffline(args *Args) error {
+	rootfs := args.RootFS
+	config := &image.Config{}
+	if args.ImageTar != "" {
+		var err error
+		rootfs, err = os.MkdirTemp("", "detection-rootfs-")
+		if err != nil {
+			return fmt.Errorf("could not create rootfs directory: %w", err)
+		}
+		defer os.RemoveAll(rootfs)
+
+		config, err = image.UnpackTarball(args.ImageTar, rootfs)
+		if err != nil {
+			return fmt.Errorf("could not unpack image: %w", err)
+		}
+	}
+
+	cmd := config.Command()
+	if args.Cmd != "" {
+		cmd = strings.Fields(args.Cmd)
+	}
+	env := process.ParseEnv(config.Env)
+	for key, value := range process.ParseEnv(args.Env) {
+		env[key] = value
+	}
+
+	details, err := process.FromRootFS(rootfs, cmd, env, config.WorkingDir)
+	if err != nil {
+		return fmt.Errorf("could not inspect rootfs: %w", err)
+	}
+	log.Printf("offline process: exe=%s cmdline=%s\n", details.ExeName, strings.ReplaceAll(details.CmdLine, "\x00", " "))
+
+	containerName := offlineContainerName
+	if len(args.ContainerNames) > 0 && args.ContainerNames[0] != "" {
+		containerName = args.ContainerNames[0]
+	}
+
+	var detectionResult common.DetectionResult
+	detection.DetectContainer(containerName, []process.Details{details}, &detectionResult)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(detectionResult); err != nil {
+		return fmt.Errorf("could not print detection result: %w", err)
+	}
+	return nil
+}
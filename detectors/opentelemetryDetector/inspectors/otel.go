@@ -19,6 +19,7 @@ Credits: https://github.com/keyval-dev/odigos
 package inspectors
 
 import (
+	"github.com/logzio/kubernetes-instrumentor/common"
 	"github.com/logzio/kubernetes-instrumentor/detectors/process"
 	"log"
 	"strings"
@@ -78,11 +79,11 @@ func otelInCmdLine(cmdLine string) bool {
 	return false
 }
 
-func otelInDeps(deps map[string]string) bool {
+func otelInDeps(deps []common.Dependency) bool {
 	detected := false
-	for dep := range deps {
-		if strings.Contains(dep, opentelemetryStr) || strings.Contains(dep, heliosStr) {
-			log.Printf("Found opentelemetry dependency: %s", dep)
+	for _, dep := range deps {
+		if strings.Contains(dep.Name, opentelemetryStr) || strings.Contains(dep.Name, heliosStr) {
+			log.Printf("Found opentelemetry dependency: %s", dep.Name)
 			detected = true
 		}
 	}
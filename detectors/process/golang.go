@@ -0,0 +1,29 @@
+package process
+
+import (
+	"debug/buildinfo"
+
+	"github.com/logzio/kubernetes-instrumentor/common"
+)
+
+// extractGoDeps lists the modules compiled into a go binary from its embedded build info, binaries of other languages
+// have no build info and yield no dependencies
+func extractGoDeps(exePath string) []common.Dependency {
+	info, err := buildinfo.ReadFile(exePath)
+	if err != nil {
+		return nil
+	}
+
+	var deps []common.Dependency
+	for _, module := range info.Deps {
+		if module.Replace != nil {
+			module = module.Replace
+		}
+		deps = append(deps, common.Dependency{
+			Name:      module.Path,
+			Version:   module.Version,
+			Ecosystem: common.GolangDependencyEcosystem,
+		})
+	}
+	return deps
+}
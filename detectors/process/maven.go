@@ -0,0 +1,179 @@
+package process
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// maxNestedJarSize bounds the size of a jar nested in a fat jar that is read in memory
+	maxNestedJarSize  = 64 << 20
+	pomPropertiesFile = "pom.properties"
+)
+
+// jarFileName matches the <artifact>-<version>.jar naming of maven artifacts
+var jarFileName = regexp.MustCompile(`^(.+?)-(\d[\w.\-]*)\.jar$`)
+
+// extractMavenDeps lists the maven artifacts of a jar from the pom.properties files it embeds, including the libraries
+// nested in spring boot (BOOT-INF/lib) and war (WEB-INF/lib) archives. The artifact and version are taken from the
+// file name when the jar has no maven metadata
+func extractMavenDeps(filepath string) map[string]string {
+	deps := make(map[string]string)
+	reader, err := zip.OpenReader(filepath)
+	if err != nil {
+		return deps
+	}
+	defer reader.Close()
+
+	if !extractJarDeps(&reader.Reader, deps) {
+		addJarNameDep(path.Base(filepath), deps)
+	}
+	return deps
+}
+
+// extractJarDeps adds the artifacts of the jar to deps, returns whether the jar itself has maven metadata
+func extractJarDeps(reader *zip.Reader, deps map[string]string) bool {
+	hasMetadata := false
+	for _, file := range reader.File {
+		switch {
+		case strings.HasPrefix(file.Name, "META-INF/maven/") && path.Base(file.Name) == pomPropertiesFile:
+			if name, version, ok := readPomProperties(file); ok {
+				deps[name] = version
+				hasMetadata = true
+			}
+		case strings.HasSuffix(file.Name, ".jar") && file.UncompressedSize64 <= maxNestedJarSize:
+			if !extractNestedJarDeps(file, deps) {
+				addJarNameDep(path.Base(file.Name), deps)
+			}
+		}
+	}
+	return hasMetadata
+}
+
+func extractNestedJarDeps(file *zip.File, deps map[string]string) bool {
+	rc, err := file.Open()
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, maxNestedJarSize))
+	if err != nil {
+		return false
+	}
+	nested, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return false
+	}
+
+	hasMetadata := false
+	for _, nestedFile := range nested.File {
+		if strings.HasPrefix(nestedFile.Name, "META-INF/maven/") && path.Base(nestedFile.Name) == pomPropertiesFile {
+			if name, version, ok := readPomProperties(nestedFile); ok {
+				deps[name] = version
+				hasMetadata = true
+			}
+		}
+	}
+	return hasMetadata
+}
+
+// readPomProperties returns the groupId:artifactId and version of a pom.properties file
+func readPomProperties(file *zip.File) (string, string, bool) {
+	rc, err := file.Open()
+	if err != nil {
+		return "", "", false
+	}
+	defer rc.Close()
+
+	properties := make(map[string]string)
+	scanner := bufio.NewScanner(rc)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			properties[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if properties["groupId"] == "" || properties["artifactId"] == "" {
+		return "", "", false
+	}
+	return properties["groupId"] + ":" + properties["artifactId"], properties["version"], true
+}
+
+func addJarNameDep(fileName string, deps map[string]string) {
+	if matches := jarFileName.FindStringSubmatch(fileName); matches != nil {
+		deps[matches[1]] = matches[2]
+	}
+}
+
+// repackJarMetadata returns a jar holding only the maven metadata of the jar and of its nested jars, snapshots keep the
+// artifacts a jar declares without its classes
+func repackJarMetadata(filepath string) ([]byte, error) {
+	reader, err := zip.OpenReader(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return repackMetadata(&reader.Reader, true)
+}
+
+func repackMetadata(reader *zip.Reader, nested bool) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, file := range reader.File {
+		var data []byte
+		switch {
+		case strings.HasPrefix(file.Name, "META-INF/maven/") && path.Base(file.Name) == pomPropertiesFile:
+			rc, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err = io.ReadAll(io.LimitReader(rc, maxNestedJarSize))
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+		case nested && strings.HasSuffix(file.Name, ".jar") && file.UncompressedSize64 <= maxNestedJarSize:
+			rc, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			content, err := io.ReadAll(io.LimitReader(rc, maxNestedJarSize))
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			nestedReader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+			if err != nil {
+				continue
+			}
+			// nested jars without metadata are kept empty, their file name still names the artifact
+			if data, err = repackMetadata(nestedReader, false); err != nil {
+				return nil, err
+			}
+		default:
+			continue
+		}
+		w, err := writer.Create(file.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -23,6 +23,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"github.com/fntlnz/mountinfo"
+	"github.com/logzio/kubernetes-instrumentor/common"
 	"io"
 	"log"
 	"os"
@@ -38,11 +39,14 @@ type PackageReference struct {
 }
 
 type Details struct {
-	ProcessID    int
-	ExeName      string
-	CmdLine      string
-	Env          map[string]string
-	Dependencies map[string]string
+	ProcessID       int
+	ParentProcessID int
+	ExeName         string
+	CmdLine         string
+	Env             map[string]string
+	Dependencies    []common.Dependency
+	// MappedFiles are the files mapped in the process memory, such as the shared libraries of its runtime
+	MappedFiles []string
 }
 
 func findFiles(rootPath string, targetFiles []string) []string {
@@ -59,7 +63,7 @@ func findFiles(rootPath string, targetFiles []string) []string {
 			foundFiles = append(foundFiles, findFiles(fullPath, targetFiles)...)
 		} else {
 			for _, target := range targetFiles {
-				if target == ".csproj" && strings.HasSuffix(file.Name(), ".csproj") {
+				if strings.HasPrefix(target, ".") && strings.HasSuffix(file.Name(), target) {
 					foundFiles = append(foundFiles, fullPath)
 				} else if file.Name() == target {
 					foundFiles = append(foundFiles, fullPath)
@@ -70,32 +74,56 @@ func findFiles(rootPath string, targetFiles []string) []string {
 	return foundFiles
 }
 
-func extractDependencies(pid int) map[string]string {
-	basepath := path.Join("/proc", strconv.Itoa(pid), "root")
-	// List of target dependency files
-	targetFiles := []string{"package.json", "requirements.txt", "Startup.cs", ".csproj"}
+func extractDependencies(pid int) []common.Dependency {
+	return extractDependenciesFromRoot(path.Join("/proc", strconv.Itoa(pid), "root"))
+}
+
+// dependencyFile extracts the dependencies of a dependency file, published in the ecosystem
+type dependencyFile struct {
+	ecosystem common.DependencyEcosystem
+	extract   func(string) map[string]string
+}
+
+// dependencyFileNames are the dependency files searched for, by name or by extension
+var dependencyFileNames = []string{"package.json", "requirements.txt", "Startup.cs", ".csproj", ".jar"}
+
+func findDependencyFiles(basepath string) []string {
 	// Find all matching files recursively
-	matchingFiles := findFiles(basepath, targetFiles)
+	matchingFiles := findFiles(basepath, dependencyFileNames)
 	log.Println("Found dependency files: ", matchingFiles)
+	return matchingFiles
+}
 
-	files := map[string]func(string) map[string]string{
-		"package.json":     extractNodejsDeps,
-		"requirements.txt": extractPythonDeps,
-		"Startup.cs":       extractDotNetDeps,
-		".csproj":          extractDotNetCsProjDeps,
+func extractDependenciesFromRoot(basepath string) []common.Dependency {
+	matchingFiles := findDependencyFiles(basepath)
+
+	files := map[string]dependencyFile{
+		"package.json":     {common.NpmDependencyEcosystem, extractNodejsDeps},
+		"requirements.txt": {common.PyPIDependencyEcosystem, extractPythonDeps},
+		"Startup.cs":       {common.NuGetDependencyEcosystem, extractDotNetDeps},
+		".csproj":          {common.NuGetDependencyEcosystem, extractDotNetCsProjDeps},
+		".jar":             {common.MavenDependencyEcosystem, extractMavenDeps},
 	}
 
-	allDeps := make(map[string]string)
+	allDeps := make(map[common.Dependency]bool)
+	var result []common.Dependency
 	for _, filepath := range matchingFiles {
 		handler, ok := files[path.Base(filepath)]
+		if !ok {
+			handler, ok = files[path.Ext(filepath)]
+		}
 		if ok {
-			for k, v := range handler(filepath) {
-				allDeps[k] = v
+			for k, v := range handler.extract(filepath) {
+				dep := common.Dependency{Name: k, Version: v, Ecosystem: handler.ecosystem}
+				if !allDeps[dep] {
+					allDeps[dep] = true
+					result = append(result, dep)
+				}
 			}
 		}
 	}
 
-	return allDeps
+	return result
 }
 
 func extractNodejsDeps(filepath string) map[string]string {
@@ -112,7 +140,17 @@ func extractNodejsDeps(filepath string) map[string]string {
 
 	if dependencies, ok := jsonData["dependencies"].(map[string]interface{}); ok {
 		for pkg, ver := range dependencies {
-			deps[pkg] = ver.(string)
+			if version, ok := ver.(string); ok {
+				deps[pkg] = version
+			}
+		}
+	}
+	// installed packages carry their resolved version
+	if strings.Contains(filepath, "/node_modules/") {
+		name, _ := jsonData["name"].(string)
+		version, _ := jsonData["version"].(string)
+		if name != "" && version != "" {
+			deps[name] = version
 		}
 	}
 	return deps
@@ -178,11 +216,82 @@ func extractDotNetCsProjDeps(filepath string) map[string]string {
 	return deps
 }
 
+// ParseEnv converts KEY=VALUE entries into a map, malformed entries are skipped
+func ParseEnv(entries []string) map[string]string {
+	env := make(map[string]string)
+	for _, line := range entries {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue // Skip malformed entries
+		}
+		env[parts[0]] = parts[1]
+	}
+	return env
+}
+
+// readParentProcessID returns the ppid field of /proc/<pid>/stat, or 0 if it can not be read.
+// The process name may contain spaces, so the fields are parsed after its closing parenthesis
+func readParentProcessID(dname string) int {
+	stat, err := os.ReadFile(path.Join("/proc", dname, "stat"))
+	if err != nil {
+		log.Println("Error reading stat file", dname)
+		return 0
+	}
+
+	data := string(stat)
+	idx := strings.LastIndex(data, ")")
+	if idx == -1 {
+		return 0
+	}
+	// fields after the process name: state, ppid, ...
+	fields := strings.Fields(data[idx+1:])
+	if len(fields) < 2 {
+		return 0
+	}
+
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0
+	}
+	return ppid
+}
+
 func FindAllInContainer(podUID string, containerName string) ([]Details, error) {
+	containerRoot := fmt.Sprintf("%s/containers/%s", podUID, containerName)
+	return findAll(func(dname string) bool {
+		mi, err := mountinfo.GetMountInfo(path.Join("/proc", dname, "mountinfo"))
+		if err != nil {
+			log.Println("Error getting mount info", dname)
+			return false
+		}
+
+		for _, m := range mi {
+			if strings.Contains(m.Root, containerRoot) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// FindAllInNamespace returns every process of the current PID namespace except the detector itself, it is used by
+// ephemeral detection containers which share the process namespace of the target container
+func FindAllInNamespace() ([]Details, error) {
+	self := strconv.Itoa(os.Getpid())
+	return findAll(func(dname string) bool {
+		return dname != self
+	})
+}
+
+func findAll(match func(dname string) bool) ([]Details, error) {
 	proc, err := os.Open("/proc")
 	if err != nil {
 		return nil, err
 	}
+	defer proc.Close()
 
 	var detectedContainers []Details
 	for {
@@ -209,71 +318,57 @@ func FindAllInContainer(podUID string, containerName string) ([]Details, error)
 				return nil, err
 			}
 
-			mi, err := mountinfo.GetMountInfo(path.Join("/proc", dname, "mountinfo"))
-			if err != nil {
-				log.Println("Error getting mount info", dname)
+			if !match(dname) {
 				continue
 			}
 
-			for _, m := range mi {
-				root := m.Root
-				if strings.Contains(root, fmt.Sprintf("%s/containers/%s", podUID, containerName)) {
-					exeName, err := os.Readlink(path.Join("/proc", dname, "exe"))
-					if err != nil {
-						// Read link may fail if target process-app runs not as root
-						log.Println("Error reading links")
-						exeName = ""
-					}
-
-					cmdLine, err := os.ReadFile(path.Join("/proc", dname, "cmdline"))
-					var cmd string
-					if err != nil {
-						log.Println("Error reading cmdline")
-						cmd = ""
-					} else {
-						cmd = string(cmdLine)
-					}
-
-					// Read environment variables
-					envFilePath := path.Join("/proc", strconv.Itoa(pid), "environ")
-					envBytes, err := os.ReadFile(envFilePath)
-					if err != nil {
-						log.Println("Error reading env file", envFilePath)
-						return nil, err
-					}
-
-					env := make(map[string]string)
-					for _, line := range strings.Split(string(envBytes), "\x00") {
-						if line == "" {
-							continue
-						}
-						parts := strings.SplitN(line, "=", 2)
-						if len(parts) != 2 {
-							continue // Skip malformed entries
-						}
-						env[parts[0]] = parts[1]
-					}
-					// Add dependencies
-					deps := extractDependencies(pid)
-					detectedContainers = append(detectedContainers, Details{
-						ProcessID:    pid,
-						ExeName:      exeName,
-						CmdLine:      cmd,
-						Env:          env,
-						Dependencies: deps,
-					})
-				}
+			exeName, err := os.Readlink(path.Join("/proc", dname, "exe"))
+			if err != nil {
+				// Read link may fail if target process-app runs not as root
+				log.Println("Error reading links")
+				exeName = ""
+			}
+
+			cmdLine, err := os.ReadFile(path.Join("/proc", dname, "cmdline"))
+			var cmd string
+			if err != nil {
+				log.Println("Error reading cmdline")
+				cmd = ""
+			} else {
+				cmd = string(cmdLine)
+			}
+
+			// Read environment variables
+			envFilePath := path.Join("/proc", strconv.Itoa(pid), "environ")
+			envBytes, err := os.ReadFile(envFilePath)
+			if err != nil {
+				log.Println("Error reading env file", envFilePath)
+				return nil, err
 			}
+
+			env := ParseEnv(strings.Split(string(envBytes), "\x00"))
+			// Add dependencies
+			deps := append(extractDependencies(pid), extractGoDeps(path.Join("/proc", dname, "exe"))...)
+			detectedContainers = append(detectedContainers, Details{
+				ProcessID:       pid,
+				ParentProcessID: readParentProcessID(dname),
+				ExeName:         exeName,
+				CmdLine:         cmd,
+				Env:             env,
+				Dependencies:    deps,
+				MappedFiles:     readMappedFiles(path.Join("/proc", dname, "maps")),
+			})
 		}
 	}
 	log.Print("Detected containers:")
 	for i, container := range detectedContainers {
 		log.Printf("%d: %s", i, container.ExeName)
 		log.Printf("PID: %d", container.ProcessID)
+		log.Printf("PPID: %d", container.ParentProcessID)
 		log.Printf("CmdLine: %s", container.CmdLine)
 		log.Println("Dependencies:")
-		for depKey, depValue := range container.Dependencies {
-			log.Printf("Dependency: %s=%s", depKey, depValue)
+		for _, dep := range container.Dependencies {
+			log.Printf("Dependency: %s %s=%s", dep.Ecosystem, dep.Name, dep.Version)
 		}
 		log.Println("Environment variables:")
 		for varKey, varValue := range container.Env {
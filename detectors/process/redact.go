@@ -0,0 +1,108 @@
+package process
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+const (
+	// RedactedValue replaces the secrets and environment values removed from snapshots
+	RedactedValue = "<redacted>"
+	// the .NET inspector looks for these markers in the environment
+	dotnetEnvMarker = "DOTNET"
+	aspnetEnvMarker = "ASPNET"
+)
+
+// snapshotEnvValues are the environment variables whose values the detectors read, the values of the other variables
+// are redacted from snapshots
+var snapshotEnvValues = map[string]bool{
+	"OTEL_RESOURCE_ATTRIBUTES": true,
+	"OTEL_SERVICE_NAME":        true,
+	"GUNICORN_CMD_ARGS":        true,
+	"UWSGI_LAZY_APPS":          true,
+	"UWSGI_LAZY":               true,
+}
+
+var (
+	secretName   = regexp.MustCompile(`(?i)(pass(word|wd)?|secret|token|api[-_.]?key|credential|auth|private[-_.]?key)`)
+	urlUserInfo  = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/\s@]+@`)
+	servicesLine = regexp.MustCompile(`^\s*services\.Add`)
+)
+
+// redactEnv keeps the keys of the environment and the values the detectors use, runtime variables (DOTNET_*,
+// ASPNETCORE_*) keep their values unless they look like secrets
+func redactEnv(env map[string]string) map[string]string {
+	redacted := make(map[string]string)
+	for key, value := range env {
+		runtimeVariable := strings.Contains(key, dotnetEnvMarker) || strings.Contains(key, aspnetEnvMarker)
+		if (snapshotEnvValues[key] || runtimeVariable) && !secretName.MatchString(key) {
+			redacted[key] = redactURLs(value)
+		} else {
+			redacted[key] = RedactedValue
+		}
+	}
+	return redacted
+}
+
+// redactCmdLine removes the values of arguments that look like secrets (--password=..., -Ddb.password=...,
+// --token ...) and the credentials of URLs from a NUL separated command line
+func redactCmdLine(cmdLine string) string {
+	trailing := strings.HasSuffix(cmdLine, "\x00")
+	args := strings.Split(strings.TrimSuffix(cmdLine, "\x00"), "\x00")
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if name, _, found := strings.Cut(arg, "="); found && secretName.MatchString(name) {
+			args[i] = name + "=" + RedactedValue
+			continue
+		}
+		if strings.HasPrefix(arg, "-") && secretName.MatchString(arg) && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			args[i+1] = RedactedValue
+			i++
+			continue
+		}
+		args[i] = redactURLs(arg)
+	}
+	redacted := strings.Join(args, "\x00")
+	if trailing {
+		redacted += "\x00"
+	}
+	return redacted
+}
+
+// redactURLs removes the user info of URLs, for example the credentials or the token of a private package index
+func redactURLs(value string) string {
+	return urlUserInfo.ReplaceAllString(value, "${1}redacted@")
+}
+
+// sanitizeDependencyFile keeps the parts of a dependency file the detectors read: the name, version and dependencies
+// of a package.json, the services registrations of a Startup.cs and the other files without URL credentials
+func sanitizeDependencyFile(name string, data []byte) []byte {
+	switch {
+	case name == "package.json":
+		var pkg map[string]interface{}
+		if err := json.Unmarshal(data, &pkg); err != nil {
+			return nil
+		}
+		sanitized := make(map[string]interface{})
+		for _, field := range []string{"name", "version", "dependencies"} {
+			if value, exists := pkg[field]; exists {
+				sanitized[field] = value
+			}
+		}
+		out, err := json.MarshalIndent(sanitized, "", "  ")
+		if err != nil {
+			return nil
+		}
+		return out
+	case name == "Startup.cs":
+		var lines []string
+		for _, line := range strings.Split(string(data), "\n") {
+			if servicesLine.MatchString(line) {
+				lines = append(lines, line)
+			}
+		}
+		return []byte(strings.Join(lines, "\n"))
+	}
+	return []byte(redactURLs(string(data)))
+}
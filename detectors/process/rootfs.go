@@ -0,0 +1,134 @@
+package process
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	maxSymlinks = 40
+	// linux limits the interpreter line of scripts to 256 bytes
+	maxShebangLength = 256
+)
+
+var errTooManySymlinks = errors.New("too many levels of symbolic links")
+
+// FromRootFS builds the details of the process that would run cmd in an unpacked container filesystem.
+// The details match what would be read from /proc for the running container: the exe is the resolved binary
+// (the interpreter for scripts with a shebang) and the cmdline is NUL separated
+func FromRootFS(rootfs string, cmd []string, env map[string]string, workingDir string) (Details, error) {
+	if len(cmd) == 0 {
+		return Details{}, errors.New("no command to inspect, set --cmd or use an image with an entrypoint")
+	}
+
+	exeName := lookPath(rootfs, cmd[0], env["PATH"], workingDir)
+	args := cmd
+	if interpreter := readShebang(path.Join(rootfs, exeName)); len(interpreter) > 0 {
+		// the kernel runs the interpreter with the script path as an argument
+		if path.Base(interpreter[0]) == "env" && len(interpreter) > 1 {
+			interpreter = interpreter[1:]
+			interpreter[0] = lookPath(rootfs, interpreter[0], env["PATH"], workingDir)
+		}
+		args = append(append(interpreter, exeName), cmd[1:]...)
+		exeName = resolveInRoot(rootfs, interpreter[0])
+	}
+
+	return Details{
+		ExeName:      exeName,
+		CmdLine:      strings.Join(args, "\x00") + "\x00",
+		Env:          env,
+		Dependencies: append(extractDependenciesFromRoot(rootfs), extractGoDeps(path.Join(rootfs, exeName))...),
+	}, nil
+}
+
+// lookPath resolves the command the same way execve does in the container, using the PATH of the image
+func lookPath(rootfs string, command string, pathEnv string, workingDir string) string {
+	if strings.Contains(command, "/") {
+		if !path.IsAbs(command) {
+			command = path.Join("/", workingDir, command)
+		}
+		return resolveInRoot(rootfs, command)
+	}
+
+	if pathEnv == "" {
+		pathEnv = defaultPath
+	}
+	for _, dir := range strings.Split(pathEnv, ":") {
+		candidate := path.Join("/", dir, command)
+		if info, err := os.Stat(path.Join(rootfs, resolveInRoot(rootfs, candidate))); err == nil && !info.IsDir() {
+			return resolveInRoot(rootfs, candidate)
+		}
+	}
+	return command
+}
+
+// ResolveInRoot follows the symlinks of every component of p inside the root filesystem, the way the kernel does with
+// rootfs as the root: absolute targets and ".." never leave rootfs. It returns the resolved absolute path inside
+// rootfs, the components that do not exist are kept as they are
+func ResolveInRoot(rootfs string, p string) (string, error) {
+	resolved := "/"
+	components := strings.Split(p, "/")
+	links := 0
+	for len(components) > 0 {
+		component := components[0]
+		components = components[1:]
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, component)
+		target, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", errTooManySymlinks
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		components = append(strings.Split(target, "/"), components...)
+	}
+	return resolved, nil
+}
+
+// resolveInRoot resolves p inside the root filesystem. A path looping through symlinks resolves to the root itself,
+// so no file outside of rootfs is ever read through it
+func resolveInRoot(rootfs string, p string) string {
+	resolved, err := ResolveInRoot(rootfs, p)
+	if err != nil {
+		return "/"
+	}
+	return resolved
+}
+
+func readShebang(filePath string) []string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	// only the first line is relevant, binaries may not contain a new line at all
+	buf := make([]byte, maxShebangLength)
+	n, _ := io.ReadFull(file, buf)
+	line := string(buf[:n])
+	if !strings.HasPrefix(line, "#!") {
+		return nil
+	}
+	if idx := strings.IndexByte(line, '\n'); idx != -1 {
+		line = line[:idx]
+	}
+	return strings.Fields(strings.TrimPrefix(line, "#!"))
+}
@@ -0,0 +1,144 @@
+package process
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// rootFS creates the files (content) and the symlinks (target prefixed with "->") of a root filesystem
+func rootFS(t *testing.T, entries map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range entries {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if len(content) > 2 && content[:2] == "->" {
+			err = os.Symlink(content[2:], p)
+		} else {
+			err = os.WriteFile(p, []byte(content), 0755)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestResolveInRoot(t *testing.T) {
+	root := rootFS(t, map[string]string{
+		"usr/bin/python3.11":  "",
+		"usr/bin/python3":     "->python3.11",
+		"usr/bin/python":      "->/usr/bin/python3",
+		"bin":                 "->usr/bin",
+		"escape":              "->../../../../etc",
+		"absolute":            "->/etc/passwd",
+		"host":                "->" + os.TempDir(),
+		"loop":                "->loop",
+		"app/current":         "->../releases/2",
+		"releases/2/main.py":  "",
+		"releases/2/previous": "->../1",
+	})
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "/usr/bin/python3.11", want: "/usr/bin/python3.11"},
+		{path: "/usr/bin/python", want: "/usr/bin/python3.11"},
+		{path: "/bin/python", want: "/usr/bin/python3.11"},
+		{path: "/app/current/main.py", want: "/releases/2/main.py"},
+		{path: "/app/current/previous/main.py", want: "/releases/1/main.py"},
+		{path: "/missing/file", want: "/missing/file"},
+		{path: "/../../etc/passwd", want: "/etc/passwd"},
+		{path: "/escape/passwd", want: "/etc/passwd"},
+		{path: "/absolute", want: "/etc/passwd"},
+		{path: "/host/file", want: filepath.Join(os.TempDir(), "file")},
+		{path: "/loop/file", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ResolveInRoot(root, test.path)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("ResolveInRoot(%s) = (%q, %v), want (%q, error %t)", test.path, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestFromRootFS(t *testing.T) {
+	root := rootFS(t, map[string]string{
+		"usr/local/bin/python3.11": "",
+		"usr/local/bin/python3":    "->python3.11",
+		"usr/local/bin/gunicorn":   "#!/usr/local/bin/python3\nimport gunicorn\n",
+		"usr/local/bin/celery":     "#!/usr/bin/env python3\nimport celery\n",
+		"usr/bin/env":              "",
+		"srv/app/run":              "#!/usr/local/bin/python3 -u\n",
+		"usr/bin/evil":             "->/../../../../usr/local/bin/python3",
+	})
+	env := map[string]string{"PATH": "/usr/local/bin:/usr/bin"}
+
+	tests := []struct {
+		name        string
+		cmd         []string
+		env         map[string]string
+		workingDir  string
+		wantExe     string
+		wantCmdLine string
+		wantErr     bool
+	}{
+		{
+			name:        "script with an interpreter",
+			cmd:         []string{"gunicorn", "app:app"},
+			env:         env,
+			wantExe:     "/usr/local/bin/python3.11",
+			wantCmdLine: "/usr/local/bin/python3\x00/usr/local/bin/gunicorn\x00app:app\x00",
+		},
+		{
+			name:        "env interpreter",
+			cmd:         []string{"celery", "worker"},
+			env:         env,
+			wantExe:     "/usr/local/bin/python3.11",
+			wantCmdLine: "/usr/local/bin/python3.11\x00/usr/local/bin/celery\x00worker\x00",
+		},
+		{
+			name:        "relative command with interpreter arguments",
+			cmd:         []string{"./run"},
+			env:         env,
+			workingDir:  "/srv/app",
+			wantExe:     "/usr/local/bin/python3.11",
+			wantCmdLine: "/usr/local/bin/python3\x00-u\x00/srv/app/run\x00",
+		},
+		{
+			name:        "binary through an escaping symlink",
+			cmd:         []string{"/usr/bin/evil", "-c", "pass"},
+			env:         env,
+			wantExe:     "/usr/local/bin/python3.11",
+			wantCmdLine: "/usr/bin/evil\x00-c\x00pass\x00",
+		},
+		{
+			name:        "command not found",
+			cmd:         []string{"java", "-jar", "app.jar"},
+			env:         map[string]string{},
+			wantExe:     "java",
+			wantCmdLine: "java\x00-jar\x00app.jar\x00",
+		},
+		{
+			name:    "no command",
+			env:     env,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		details, err := FromRootFS(root, test.cmd, test.env, test.workingDir)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: FromRootFS() error = %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if details.ExeName != test.wantExe || details.CmdLine != test.wantCmdLine {
+			t.Errorf("%s: FromRootFS() = (%q, %q), want (%q, %q)", test.name, details.ExeName, details.CmdLine, test.wantExe, test.wantCmdLine)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package process
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/logzio/kubernetes-instrumentor/common"
+)
+
+const (
+	snapshotVersion      = 1
+	snapshotManifestName = "snapshot.json"
+	snapshotFilesDir     = "files"
+	// maxSnapshotFileSize bounds the dependency files kept in a snapshot, larger files are listed without content
+	maxSnapshotFileSize = 4 << 20
+)
+
+// Snapshot is a redacted record of what the detectors read for some containers: their processes and the dependency
+// files found in their filesystem. Replaying it runs the detectors against the record instead of /proc
+type Snapshot struct {
+	Version    int                 `json:"version"`
+	CreatedAt  time.Time           `json:"createdAt"`
+	Containers []ContainerSnapshot `json:"containers"`
+
+	// files holds the content of the dependency files by archive path
+	files map[string][]byte
+}
+
+// ContainerSnapshot is the record of a container, PodUID is empty for the ephemeral container mode
+type ContainerSnapshot struct {
+	PodUID        string            `json:"podUID,omitempty"`
+	ContainerName string            `json:"containerName"`
+	Processes     []ProcessSnapshot `json:"processes"`
+	// DependencyFiles are the paths of the dependency files in the container filesystem
+	DependencyFiles []string `json:"dependencyFiles,omitempty"`
+	// Result is the detection result of the container when it was recorded
+	Result *common.DetectionResult `json:"result,omitempty"`
+}
+
+// ProcessSnapshot is the record of a process. Env holds every variable name, the values the detectors do not read are
+// redacted. Maps lists the files mapped in the process memory
+type ProcessSnapshot struct {
+	PID       int                 `json:"pid"`
+	PPID      int                 `json:"ppid"`
+	Exe       string              `json:"exe"`
+	CmdLine   []string            `json:"cmdline"`
+	Env       map[string]string   `json:"env"`
+	Maps      []string            `json:"maps,omitempty"`
+	GoModules []common.Dependency `json:"goModules,omitempty"`
+}
+
+// NewSnapshot creates an empty snapshot to record containers into
+func NewSnapshot() *Snapshot {
+	return &Snapshot{Version: snapshotVersion, CreatedAt: time.Now().UTC(), files: make(map[string][]byte)}
+}
+
+// Record adds the processes of a container and the dependency files of its filesystem, read through /proc
+func (s *Snapshot) Record(podUID string, containerName string, processes []Details, result common.DetectionResult) {
+	container := ContainerSnapshot{PodUID: podUID, ContainerName: containerName, Result: &result}
+	recordedFiles := make(map[string]bool)
+	for _, p := range processes {
+		dname := strconv.Itoa(p.ProcessID)
+		var goModules []common.Dependency
+		for _, dep := range p.Dependencies {
+			if dep.Ecosystem == common.GolangDependencyEcosystem {
+				goModules = append(goModules, dep)
+			}
+		}
+		container.Processes = append(container.Processes, ProcessSnapshot{
+			PID:       p.ProcessID,
+			PPID:      p.ParentProcessID,
+			Exe:       p.ExeName,
+			CmdLine:   strings.Split(strings.TrimSuffix(redactCmdLine(p.CmdLine), "\x00"), "\x00"),
+			Env:       redactEnv(p.Env),
+			Maps:      p.MappedFiles,
+			GoModules: goModules,
+		})
+
+		// the processes of a container usually share its filesystem, each file is recorded once
+		root := path.Join("/proc", dname, "root")
+		for _, file := range findDependencyFiles(root) {
+			relative := strings.TrimPrefix(file, root)
+			if recordedFiles[relative] {
+				continue
+			}
+			recordedFiles[relative] = true
+			container.DependencyFiles = append(container.DependencyFiles, relative)
+			if data, err := snapshotFile(file); err == nil {
+				s.files[s.filePath(len(s.Containers), relative)] = data
+			}
+		}
+	}
+	s.Containers = append(s.Containers, container)
+}
+
+// filePath is the archive path of a dependency file of the container at index
+func (s *Snapshot) filePath(index int, file string) string {
+	return path.Join(snapshotFilesDir, strconv.Itoa(index), file)
+}
+
+// snapshotFile reads a dependency file for the snapshot, sanitized
+func snapshotFile(file string) ([]byte, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(file, ".jar") {
+		return repackJarMetadata(file)
+	}
+	if info.Size() > maxSnapshotFileSize {
+		return nil, fmt.Errorf("%s is too large to record", file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return sanitizeDependencyFile(path.Base(file), data), nil
+}
+
+// readMappedFiles returns the files mapped in the memory of a process, without addresses and duplicates
+func readMappedFiles(mapsPath string) []string {
+	file, err := os.Open(mapsPath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	seen := make(map[string]bool)
+	var mapped []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// address perms offset dev inode pathname
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+		name := strings.Join(fields[5:], " ")
+		if !seen[name] {
+			seen[name] = true
+			mapped = append(mapped, name)
+		}
+	}
+	sort.Strings(mapped)
+	return mapped
+}
+
+// Write stores the snapshot as a gzipped tar archive
+func (s *Snapshot) Write(file string) error {
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err = s.WriteArchive(out); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// WriteArchive writes the snapshot as a gzipped tar archive to out
+func (s *Snapshot) WriteArchive(out io.Writer) error {
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	manifest, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeTarFile(tw, snapshotManifestName, manifest); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = writeTarFile(tw, name, s.files[name]); err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// ReadSnapshot reads a snapshot archive written by Write
+func ReadSnapshot(file string) (*Snapshot, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	snapshot := &Snapshot{files: make(map[string][]byte)}
+	manifestFound := false
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxNestedJarSize))
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == snapshotManifestName {
+			if err = json.Unmarshal(data, snapshot); err != nil {
+				return nil, fmt.Errorf("invalid snapshot manifest: %w", err)
+			}
+			manifestFound = true
+			continue
+		}
+		snapshot.files[path.Clean(header.Name)] = data
+	}
+	if !manifestFound {
+		return nil, errors.New("not a detection snapshot, snapshot.json is missing")
+	}
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	return snapshot, nil
+}
+
+// Replay rebuilds the process details of the container at index from the snapshot, the dependency files are restored
+// in a temporary root and read by the same extractors as a live detection
+func (s *Snapshot) Replay(index int) ([]Details, error) {
+	container := s.Containers[index]
+	root, err := os.MkdirTemp("", "detection-replay-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(root)
+
+	for _, file := range container.DependencyFiles {
+		data, exists := s.files[s.filePath(index, file)]
+		if !exists {
+			continue
+		}
+		target := filepath.Join(root, filepath.FromSlash(path.Clean("/"+file)))
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(target, data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	dependencies := extractDependenciesFromRoot(root)
+
+	var processes []Details
+	for _, p := range container.Processes {
+		cmdLine := ""
+		if len(p.CmdLine) > 0 {
+			cmdLine = strings.Join(p.CmdLine, "\x00") + "\x00"
+		}
+		processes = append(processes, Details{
+			ProcessID:       p.PID,
+			ParentProcessID: p.PPID,
+			ExeName:         p.Exe,
+			CmdLine:         cmdLine,
+			Env:             p.Env,
+			Dependencies:    append(append([]common.Dependency(nil), dependencies...), p.GoModules...),
+			MappedFiles:     p.Maps,
+		})
+	}
+	return processes, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/detectors/detection"
+	"github.com/logzio/kubernetes-instrumentor/detectors/process"
+)
+
+const (
+	// logSnapshotFile as the --record file prints the snapshot to stdout instead of a file
+	logSnapshotFile     = "-"
+	snapshotBeginMarker = "-----BEGIN DETECTION SNAPSHOT-----"
+	snapshotEndMarker   = "-----END DETECTION SNAPSHOT-----"
+	snapshotLineLength  = 76
+)
+
+// writeSnapshot stores the recorded snapshot, a failure is logged without failing the detection
+func writeSnapshot(snapshot *process.Snapshot, file string) {
+	if snapshot == nil {
+		return
+	}
+	if file == logSnapshotFile {
+		logSnapshot(snapshot)
+		return
+	}
+	if err := snapshot.Write(file); err != nil {
+		log.Printf("could not write detection snapshot, error: %s\n", err)
+		return
+	}
+	log.Printf("detection snapshot written to %s\n", file)
+}
+
+// logSnapshot prints the snapshot archive base64 encoded between marker lines, so it can be read from the logs of a
+// detection container that exits once it reported its result
+func logSnapshot(snapshot *process.Snapshot) {
+	var archive bytes.Buffer
+	if err := snapshot.WriteArchive(&archive); err != nil {
+		log.Printf("could not write detection snapshot, error: %s\n", err)
+		return
+	}
+	encoded := base64.StdEncoding.EncodeToString(archive.Bytes())
+	var out strings.Builder
+	out.WriteString(snapshotBeginMarker + "\n")
+	for len(encoded) > 0 {
+		n := snapshotLineLength
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		out.WriteString(encoded[:n] + "\n")
+		encoded = encoded[n:]
+	}
+	out.WriteString(snapshotEndMarker + "\n")
+	fmt.Print(out.String())
+}
+
+// replaySnapshot runs the detectors against a recorded snapshot and prints the detection result to stdout, the result
+// of a single pod or namespace as a detection result and the results of a batch as pod results. Whether each container
+// is detected as it was when recorded is logged to stderr
+func replaySnapshot(file string) {
+	snapshot, err := process.ReadSnapshot(file)
+	if err != nil {
+		log.Fatalf("could not read detection snapshot, error: %s\n", err)
+	}
+
+	var podUIDs []string
+	results := make(map[string]*common.DetectionResult)
+	for i, container := range snapshot.Containers {
+		processes, err := snapshot.Replay(i)
+		if err != nil {
+			log.Fatalf("could not replay container %s, error: %s\n", container.ContainerName, err)
+		}
+		result, exists := results[container.PodUID]
+		if !exists {
+			result = &common.DetectionResult{}
+			results[container.PodUID] = result
+			podUIDs = append(podUIDs, container.PodUID)
+		}
+		detection.DetectContainer(container.ContainerName, processes, result)
+
+		if container.Result != nil {
+			replayed := detection.ContainerResult(*result, container.ContainerName)
+			if reflect.DeepEqual(replayed, *container.Result) {
+				log.Printf("container %s: replayed result matches the recorded result\n", container.ContainerName)
+			} else {
+				log.Printf("container %s: replayed result differs from the recorded result %+v\n", container.ContainerName, *container.Result)
+			}
+		}
+	}
+
+	var output interface{}
+	if len(podUIDs) == 1 {
+		output = results[podUIDs[0]]
+	} else {
+		var podResults []common.PodDetectionResult
+		for _, podUID := range podUIDs {
+			podResults = append(podResults, common.PodDetectionResult{PodUID: podUID, Result: *results[podUID]})
+		}
+		output = podResults
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(output); err != nil {
+		log.Fatalf("could not print detection result, error: %s\n", err)
+	}
+}
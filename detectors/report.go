@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+)
+
+const (
+	reportAttempts = 3
+	reportTimeout  = 10 * time.Second
+)
+
+// sendDetectionReport posts the detection result to the instrumentor, authenticated with the token the instrumentor
+// generated for this detection pod
+func sendDetectionReport(report common.DetectionReport, reportURL string) error {
+	report.Namespace = os.Getenv(consts.DetectionPodNamespaceEnvVar)
+	report.PodName = os.Getenv(consts.DetectionPodNameEnvVar)
+	report.InstrumentedApplication = os.Getenv(consts.DetectionTargetAppEnvVar)
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	httpClient := &http.Client{Timeout: reportTimeout}
+	for attempt := 1; ; attempt++ {
+		err = postDetectionReport(httpClient, reportURL, data)
+		if err == nil || attempt == reportAttempts {
+			return err
+		}
+		log.Printf("detection report attempt %d failed, error: %s\n", attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func postDetectionReport(httpClient *http.Client, reportURL string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, reportURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+os.Getenv(consts.DetectionReportTokenEnvVar))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("instrumentor returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package compatibility
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/logzio/kubernetes-instrumentor/common"
+)
+
+//go:embed catalogue/*.json
+var catalogueFiles embed.FS
+
+// Catalogue lists the libraries the agent of a language instruments
+type Catalogue struct {
+	Language         common.ProgrammingLanguage `json:"language"`
+	AgentVersion     string                     `json:"agentVersion"`
+	Instrumentations []Instrumentation          `json:"instrumentations"`
+}
+
+// Instrumentation is an agent module, package or instrumentation and the libraries it instruments
+type Instrumentation struct {
+	Name      string    `json:"name"`
+	Libraries []Library `json:"libraries"`
+}
+
+// Library is an instrumented library, Versions is a range like ">=3.0 <5" with "||" between alternatives, empty
+// when every version is supported
+type Library struct {
+	Name     string `json:"name"`
+	Versions string `json:"versions"`
+}
+
+var catalogues = mustLoadCatalogues()
+
+func mustLoadCatalogues() map[common.ProgrammingLanguage]Catalogue {
+	entries, err := catalogueFiles.ReadDir("catalogue")
+	if err != nil {
+		panic(err)
+	}
+	loaded := make(map[common.ProgrammingLanguage]Catalogue)
+	for _, entry := range entries {
+		data, err := catalogueFiles.ReadFile(path.Join("catalogue", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var catalogue Catalogue
+		if err = json.Unmarshal(data, &catalogue); err != nil {
+			panic(fmt.Sprintf("invalid compatibility catalogue %s: %v", entry.Name(), err))
+		}
+		loaded[catalogue.Language] = catalogue
+	}
+	return loaded
+}
+
+// CatalogueFor returns the compatibility catalogue of the agent of the language
+func CatalogueFor(language common.ProgrammingLanguage) (Catalogue, bool) {
+	catalogue, exists := catalogues[language]
+	return catalogue, exists
+}
@@ -0,0 +1,170 @@
+package compatibility
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+)
+
+// maxUncovered bounds the uncovered libraries listed per container, the status only keeps their count beyond it
+const maxUncovered = 100
+
+var pypiSeparators = regexp.MustCompile(`[-_.]+`)
+
+// libraryKey normalizes a library name the way its ecosystem compares names
+func libraryKey(ecosystem common.DependencyEcosystem, name string) string {
+	switch ecosystem {
+	case common.PyPIDependencyEcosystem:
+		return pypiSeparators.ReplaceAllString(strings.ToLower(name), "-")
+	case common.NuGetDependencyEcosystem:
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// artifactID returns the artifact of a maven groupId:artifactId name
+func artifactID(name string) string {
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+type catalogueEntry struct {
+	instrumentation string
+	library         Library
+}
+
+// index maps the normalized library names of the catalogue to the instrumentations matching them, maven libraries are
+// also indexed by artifact since jars without metadata are only known by their file name
+func (c Catalogue) index(ecosystem common.DependencyEcosystem) map[string][]catalogueEntry {
+	entries := make(map[string][]catalogueEntry)
+	for _, instrumentation := range c.Instrumentations {
+		for _, library := range instrumentation.Libraries {
+			entry := catalogueEntry{instrumentation: instrumentation.Name, library: library}
+			key := libraryKey(ecosystem, library.Name)
+			entries[key] = append(entries[key], entry)
+			if ecosystem == common.MavenDependencyEcosystem {
+				artifact := artifactID(library.Name)
+				entries[artifact] = append(entries[artifact], entry)
+			}
+		}
+	}
+	return entries
+}
+
+// Match classifies the dependencies of a container against the catalogue of the agent of the language
+func Match(containerName string, language common.ProgrammingLanguage, dependencies []common.Dependency) (v1.LibraryCompatibility, bool) {
+	catalogue, exists := CatalogueFor(language)
+	ecosystem, known := common.LanguageEcosystems[language]
+	if !exists || !known {
+		return v1.LibraryCompatibility{}, false
+	}
+
+	compatibility := v1.LibraryCompatibility{
+		ContainerName: containerName,
+		Language:      language,
+		AgentVersion:  catalogue.AgentVersion,
+	}
+	index := catalogue.index(ecosystem)
+	for _, dep := range uniqueDependencies(ecosystem, dependencies) {
+		entries := index[libraryKey(ecosystem, dep.Name)]
+		if len(entries) == 0 && ecosystem == common.MavenDependencyEcosystem && !strings.Contains(dep.Name, ":") {
+			entries = index[dep.Name]
+		}
+		if len(entries) == 0 {
+			compatibility.UncoveredCount++
+			if len(compatibility.Uncovered) < maxUncovered {
+				compatibility.Uncovered = append(compatibility.Uncovered, v1.LibraryCoverage{Name: dep.Name, Version: dep.Version})
+			}
+			continue
+		}
+
+		coverage := v1.LibraryCoverage{
+			Name:              dep.Name,
+			Version:           dep.Version,
+			Instrumentation:   entries[0].instrumentation,
+			SupportedVersions: entries[0].library.Versions,
+		}
+		parsed, ok := parseVersion(dep.Version)
+		if !ok {
+			// the version is unknown, the library is assumed to be covered
+			compatibility.Covered = append(compatibility.Covered, coverage)
+			continue
+		}
+		supported := false
+		for _, entry := range entries {
+			if inRange(parsed, entry.library.Versions) {
+				coverage.Instrumentation = entry.instrumentation
+				coverage.SupportedVersions = entry.library.Versions
+				supported = true
+				break
+			}
+		}
+		if supported {
+			compatibility.Covered = append(compatibility.Covered, coverage)
+		} else {
+			var ranges []string
+			for _, entry := range entries {
+				ranges = append(ranges, entry.library.Versions)
+			}
+			coverage.SupportedVersions = strings.Join(ranges, " || ")
+			compatibility.UnsupportedVersion = append(compatibility.UnsupportedVersion, coverage)
+		}
+	}
+	return compatibility, true
+}
+
+// uniqueDependencies returns the dependencies of the ecosystem sorted by name, one per library. An installed version
+// is preferred over a declared range, opentelemetry packages are not libraries of the application and are skipped
+func uniqueDependencies(ecosystem common.DependencyEcosystem, dependencies []common.Dependency) []common.Dependency {
+	byKey := make(map[string]common.Dependency)
+	for _, dep := range dependencies {
+		if dep.Ecosystem != ecosystem || strings.Contains(strings.ToLower(dep.Name), "opentelemetry") {
+			continue
+		}
+		key := libraryKey(ecosystem, dep.Name)
+		if existing, exists := byKey[key]; exists && isPinned(existing.Version) {
+			continue
+		}
+		byKey[key] = dep
+	}
+
+	var unique []common.Dependency
+	for _, dep := range byKey {
+		unique = append(unique, dep)
+	}
+	sort.Slice(unique, func(i, j int) bool {
+		return unique[i].Name < unique[j].Name
+	})
+	return unique
+}
+
+func isPinned(version string) bool {
+	return version != "" && version[0] >= '0' && version[0] <= '9'
+}
+
+// Report matches the dependencies of every detected container against the agents of the languages running in it
+func Report(result common.DetectionResult) []v1.LibraryCompatibility {
+	dependencies := make(map[string][]common.Dependency)
+	for _, d := range result.DependenciesByContainer {
+		dependencies[d.ContainerName] = append(dependencies[d.ContainerName], d.Dependencies...)
+	}
+
+	var report []v1.LibraryCompatibility
+	for _, l := range result.LanguageByContainer {
+		deps, exists := dependencies[l.ContainerName]
+		if !exists {
+			continue
+		}
+		for _, language := range l.ProcessLanguages() {
+			if compatibility, ok := Match(l.ContainerName, language, deps); ok {
+				report = append(report, compatibility)
+			}
+		}
+	}
+	return report
+}
@@ -0,0 +1,129 @@
+package compatibility
+
+import (
+	"testing"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+)
+
+func names(coverage []v1.LibraryCoverage) []string {
+	var result []string
+	for _, c := range coverage {
+		result = append(result, c.Name)
+	}
+	return result
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name               string
+		language           common.ProgrammingLanguage
+		dependencies       []common.Dependency
+		covered            []string
+		unsupportedVersion []string
+		uncovered          []string
+	}{
+		{
+			name:     "python versions and name normalization",
+			language: common.PythonProgrammingLanguage,
+			dependencies: []common.Dependency{
+				{Name: "Flask", Version: "2.3.2", Ecosystem: common.PyPIDependencyEcosystem},
+				{Name: "requests", Version: "3.1.0", Ecosystem: common.PyPIDependencyEcosystem},
+				{Name: "Kafka_Python", Version: "2.0.2", Ecosystem: common.PyPIDependencyEcosystem},
+				{Name: "numpy", Version: "1.26.0", Ecosystem: common.PyPIDependencyEcosystem},
+			},
+			covered:            []string{"Flask", "Kafka_Python"},
+			unsupportedVersion: []string{"requests"},
+			uncovered:          []string{"numpy"},
+		},
+		{
+			name:     "installed version preferred over a declared range",
+			language: common.PythonProgrammingLanguage,
+			dependencies: []common.Dependency{
+				{Name: "flask", Version: ">=0.1", Ecosystem: common.PyPIDependencyEcosystem},
+				{Name: "flask", Version: "0.12", Ecosystem: common.PyPIDependencyEcosystem},
+			},
+			unsupportedVersion: []string{"flask"},
+		},
+		{
+			name:     "unknown version assumed covered",
+			language: common.PythonProgrammingLanguage,
+			dependencies: []common.Dependency{
+				{Name: "flask", Version: "*", Ecosystem: common.PyPIDependencyEcosystem},
+			},
+			covered: []string{"flask"},
+		},
+		{
+			name:     "other ecosystems and opentelemetry packages skipped",
+			language: common.PythonProgrammingLanguage,
+			dependencies: []common.Dependency{
+				{Name: "express", Version: "4.18.2", Ecosystem: common.NpmDependencyEcosystem},
+				{Name: "opentelemetry-instrumentation-flask", Version: "0.40b0", Ecosystem: common.PyPIDependencyEcosystem},
+			},
+		},
+		{
+			name:     "maven group and artifact",
+			language: common.JavaProgrammingLanguage,
+			dependencies: []common.Dependency{
+				{Name: "org.apache.httpcomponents:httpclient", Version: "4.5.13", Ecosystem: common.MavenDependencyEcosystem},
+				{Name: "httpasyncclient", Version: "4.1.5", Ecosystem: common.MavenDependencyEcosystem},
+				{Name: "com.amazonaws:aws-java-sdk-core", Version: "2.1.0", Ecosystem: common.MavenDependencyEcosystem},
+			},
+			covered:            []string{"httpasyncclient", "org.apache.httpcomponents:httpclient"},
+			unsupportedVersion: []string{"com.amazonaws:aws-java-sdk-core"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := Match("app", test.language, test.dependencies)
+			if !ok {
+				t.Fatalf("Match returned no report for %s", test.language)
+			}
+			if got.ContainerName != "app" || got.Language != test.language || got.AgentVersion == "" {
+				t.Errorf("Match returned container %q, language %q and agent version %q", got.ContainerName, got.Language, got.AgentVersion)
+			}
+			if !equal(names(got.Covered), test.covered) {
+				t.Errorf("covered = %v, want %v", names(got.Covered), test.covered)
+			}
+			if !equal(names(got.UnsupportedVersion), test.unsupportedVersion) {
+				t.Errorf("unsupportedVersion = %v, want %v", names(got.UnsupportedVersion), test.unsupportedVersion)
+			}
+			if !equal(names(got.Uncovered), test.uncovered) || got.UncoveredCount != len(test.uncovered) {
+				t.Errorf("uncovered = %v (%d), want %v", names(got.Uncovered), got.UncoveredCount, test.uncovered)
+			}
+		})
+	}
+}
+
+func TestMatchUncoveredBound(t *testing.T) {
+	var dependencies []common.Dependency
+	for i := 0; i < maxUncovered+10; i++ {
+		dependencies = append(dependencies, common.Dependency{Name: "lib" + string(rune('a'+i%26)) + string(rune('a'+i/26)), Version: "1.0", Ecosystem: common.NpmDependencyEcosystem})
+	}
+	got, ok := Match("app", common.JavascriptProgrammingLanguage, dependencies)
+	if !ok {
+		t.Fatal("Match returned no report for javascript")
+	}
+	if len(got.Uncovered) != maxUncovered || got.UncoveredCount != maxUncovered+10 {
+		t.Errorf("uncovered lists %d libraries and counts %d, want %d and %d", len(got.Uncovered), got.UncoveredCount, maxUncovered, maxUncovered+10)
+	}
+}
+
+func TestMatchUnknownLanguage(t *testing.T) {
+	if _, ok := Match("app", common.ProgrammingLanguage("go"), nil); ok {
+		t.Error("Match returned a report for a language without a catalogue")
+	}
+}
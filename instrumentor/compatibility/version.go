@@ -0,0 +1,105 @@
+package compatibility
+
+import (
+	"strconv"
+	"strings"
+)
+
+// version is the numeric release segments of a library version, pre-release and build suffixes are ignored
+type version []int
+
+// parseVersion reads the release segments of a pinned or ranged version like "4.18.2", "^4.18.2", "~=2.0" or "0.40b0".
+// Unknown versions like "*", "latest" or "detected" are not parsed
+func parseVersion(raw string) (version, bool) {
+	raw = strings.TrimLeft(strings.TrimSpace(raw), "^~=<>!vV ")
+	var parsed version
+	for _, segment := range strings.Split(raw, ".") {
+		digits := 0
+		for digits < len(segment) && segment[digits] >= '0' && segment[digits] <= '9' {
+			digits++
+		}
+		if digits == 0 {
+			break
+		}
+		value, err := strconv.Atoi(segment[:digits])
+		if err != nil {
+			break
+		}
+		parsed = append(parsed, value)
+		if digits < len(segment) {
+			break
+		}
+	}
+	return parsed, len(parsed) > 0
+}
+
+// compare returns -1, 0 or 1, missing segments count as zero
+func (v version) compare(other version) int {
+	for i := 0; i < len(v) || i < len(other); i++ {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(other) {
+			b = other[i]
+		}
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// inRange reports whether the version satisfies the range, an empty range matches every version
+func inRange(v version, versionRange string) bool {
+	if strings.TrimSpace(versionRange) == "" {
+		return true
+	}
+	for _, alternative := range strings.Split(versionRange, "||") {
+		if satisfiesAll(v, strings.Fields(alternative)) {
+			return true
+		}
+	}
+	return false
+}
+
+func satisfiesAll(v version, constraints []string) bool {
+	for _, constraint := range constraints {
+		operator := constraint[:len(constraint)-len(strings.TrimLeft(constraint, "<>=!"))]
+		bound, ok := parseVersion(constraint[len(operator):])
+		if !ok {
+			return false
+		}
+		c := v.compare(bound)
+		switch operator {
+		case ">=":
+			if c < 0 {
+				return false
+			}
+		case ">":
+			if c <= 0 {
+				return false
+			}
+		case "<=":
+			if c > 0 {
+				return false
+			}
+		case "<":
+			if c >= 0 {
+				return false
+			}
+		case "!=":
+			if c == 0 {
+				return false
+			}
+		default:
+			if c != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package compatibility
+
+import "testing"
+
+func TestInRange(t *testing.T) {
+	tests := []struct {
+		version      string
+		versionRange string
+		want         bool
+	}{
+		{"4.18.2", "", true},
+		{"4.18.2", ">=4.0 <5.0", true},
+		{"5.0.0", ">=4.0 <5.0", false},
+		{"3.9", ">=4.0 <5.0", false},
+		{"4.0", ">=4.0", true},
+		{"4.0", ">4.0", false},
+		{"4.0.1", ">4.0", true},
+		{"2.0", "<=2", true},
+		{"2.0.1", "<=2", false},
+		{"1.2.3", "1.2.3", true},
+		{"1.2", "=1.2.0", true},
+		{"1.2.4", "1.2.3", false},
+		{"1.2.3", "!=1.2.3", false},
+		{"0.13.5", ">=0.13 <0.14", true},
+		{"0.14.0", ">=0.13 <0.14", false},
+		{"2.5", "<2.0 || >=2.4", true},
+		{"2.1", "<2.0 || >=2.4", false},
+		{"^4.18.2", ">=4.0 <5.0", true},
+		{"0.40b0", ">=0.40", true},
+		{"1.0", ">=latest", false},
+	}
+	for _, test := range tests {
+		v, ok := parseVersion(test.version)
+		if !ok {
+			t.Fatalf("parseVersion(%q) failed", test.version)
+		}
+		if got := inRange(v, test.versionRange); got != test.want {
+			t.Errorf("inRange(%q, %q) = %t, want %t", test.version, test.versionRange, got, test.want)
+		}
+	}
+}
+
+func TestParseVersionUnknown(t *testing.T) {
+	for _, raw := range []string{"", "*", "latest", "detected", "x.1"} {
+		if v, ok := parseVersion(raw); ok {
+			t.Errorf("parseVersion(%q) = %v, want no version", raw, v)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// isBatchOwner reports whether the InstrumentedApplication belongs to a CronJob or a Job, whose pods may only run for
+// seconds
+func isBatchOwner(instrumentedApp *v1.InstrumentedApplication) bool {
+	owner := metav1.GetControllerOf(instrumentedApp)
+	return owner != nil && owner.APIVersion == batchv1.SchemeGroupVersion.String() &&
+		(owner.Kind == consts.SupportedResourceCronJob || owner.Kind == consts.SupportedResourceJob)
+}
+
+// isCronJobRun reports whether the Job was created by a CronJob
+func isCronJobRun(job *batchv1.Job) bool {
+	owner := metav1.GetControllerOf(job)
+	return owner != nil && owner.APIVersion == batchv1.SchemeGroupVersion.String() && owner.Kind == consts.SupportedResourceCronJob
+}
+
+// detectionBackend returns the detection backend of the InstrumentedApplication. Batch workloads are detected from
+// their images first with the process backend too, a run's pod is detected only when the images are not enough
+func (r *InstrumentedApplicationReconciler) detectionBackend(instrumentedApp *v1.InstrumentedApplication) string {
+	if r.DetectionBackend == ProcessDetectionBackend && isBatchOwner(instrumentedApp) {
+		return ImageWithFallbackDetectionBackend
+	}
+	return r.DetectionBackend
+}
+
+// detectsImages reports whether the InstrumentedApplication is detected from its images first
+func (r *InstrumentedApplicationReconciler) detectsImages(instrumentedApp *v1.InstrumentedApplication) bool {
+	backend := r.detectionBackend(instrumentedApp)
+	return backend == ImageDetectionBackend || backend == ImageWithFallbackDetectionBackend
+}
+
+// jobPods returns the running pods of the Job
+func jobPods(ctx context.Context, c client.Reader, obj client.Object) ([]corev1.Pod, error) {
+	job := obj.(*batchv1.Job)
+	return runningPodsOf(ctx, c, job.Namespace, job.Spec.Template.Labels, job.UID, "", "")
+}
+
+// cronJobPods returns the running pods of the newest active run of the CronJob
+func cronJobPods(ctx context.Context, c client.Reader, obj client.Object) ([]corev1.Pod, error) {
+	cj := obj.(*batchv1.CronJob)
+	var jobs batchv1.JobList
+	if err := c.List(ctx, &jobs, client.InNamespace(cj.Namespace)); err != nil {
+		return nil, err
+	}
+	var newest []corev1.Pod
+	var newestTime metav1.Time
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if !isControlledBy(job, cj.UID) || job.Status.Active == 0 {
+			continue
+		}
+		pods, err := jobPods(ctx, c, job)
+		if err != nil {
+			return nil, err
+		}
+		if len(pods) > 0 && (newest == nil || newestTime.Before(&job.CreationTimestamp)) {
+			newest, newestTime = pods, job.CreationTimestamp
+		}
+	}
+	return newest, nil
+}
+
+// batchRunPodRequests maps the running pods of batch runs to the InstrumentedApplication of their Job or CronJob, so a
+// detection waiting for a run starts as soon as the run's pod is running
+func (r *InstrumentedApplicationReconciler) batchRunPodRequests(ctx context.Context, obj client.Object) []reconcile.Request {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Status.Phase != corev1.PodRunning {
+		return nil
+	}
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.APIVersion != batchv1.SchemeGroupVersion.String() || owner.Kind != consts.SupportedResourceJob {
+		return nil
+	}
+	var job batchv1.Job
+	if err := r.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: owner.Name}, &job); err != nil {
+		return nil
+	}
+	gvk, name, uid := batchv1.SchemeGroupVersion.WithKind(consts.SupportedResourceJob), job.Name, job.UID
+	if isCronJobRun(&job) {
+		cronJob := metav1.GetControllerOf(&job)
+		gvk, name, uid = batchv1.SchemeGroupVersion.WithKind(consts.SupportedResourceCronJob), cronJob.Name, cronJob.UID
+	}
+	instrumentedApp, err := instrumentedAppOf(ctx, r.Client, gvk, pod.Namespace, name, uid)
+	if err != nil || instrumentedApp == nil {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(instrumentedApp)}}
+}
+
+// detectBatchRun detects a running pod of a batch workload waiting for process detection right away: with the
+// detection agent when available, otherwise by dispatching its queued detection pod without the retry delay
+func (r *InstrumentedApplicationReconciler) detectBatchRun(ctx context.Context, logger logr.Logger, instrumentedApp *v1.InstrumentedApplication) error {
+	key := client.ObjectKeyFromObject(instrumentedApp)
+	if pods, err := r.currentRevisionPods(ctx, instrumentedApp); err != nil || len(pods) == 0 {
+		return nil
+	}
+	if r.DetectionAgent && r.detectionStrategy(ctx, instrumentedApp.Namespace) != EphemeralDetectionStrategy {
+		results, err := r.detectReplicasWithAgent(ctx, logger, instrumentedApp)
+		if err == nil {
+			detectionResult, disagreements := mergeReplicaResults(results)
+			return r.updateMergedDetectionResult(ctx, detectionResult, disagreements, logger, *instrumentedApp, key)
+		}
+		logger.V(0).Info("could not detect the batch run with the detection agent", "error", err.Error())
+	}
+	r.detectionQueue.retryAfter(key, 0)
+	return nil
+}
+
+// jobTemplateWarning explains why a Job is not instrumented
+func jobTemplateWarning(job *batchv1.Job) string {
+	return fmt.Sprintf("%s %s is not instrumented, the pod template of a Job can not be changed, instrument the CronJob "+
+		"creating it or the workload creating the Job", consts.SupportedResourceJob, job.Name)
+}
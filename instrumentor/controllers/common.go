@@ -21,11 +21,16 @@ package controllers
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/go-logr/logr"
-	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1alpha1"
+	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
 	"github.com/logzio/kubernetes-instrumentor/common/consts"
 	"github.com/logzio/kubernetes-instrumentor/instrumentor/patch"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -57,14 +62,20 @@ func shouldSkip(annotations map[string]string, namespace string) bool {
 }
 
 func syncInstrumentedApps(ctx context.Context, req *ctrl.Request, c client.Client, scheme *runtime.Scheme,
-	readyReplicas int32, object client.Object, podTemplateSpec *v1.PodTemplateSpec, ownerKey string) error {
+	workload WorkloadAdapter, object client.Object, podWebhook bool) error {
 	logger := log.FromContext(ctx)
 	err := c.Get(ctx, req.NamespacedName, object)
 	if err != nil {
 		logger.Error(err, "error getting kubernetes objects")
 		return err
 	}
-	instApps, err := getInstrumentedApps(ctx, req, c, ownerKey)
+	podTemplateSpec, err := workload.PodTemplate(object)
+	if err != nil {
+		logger.Error(err, "error reading the pod template")
+		return err
+	}
+	readyReplicas := workload.ReadyReplicas(object)
+	instApps, err := getInstrumentedApps(ctx, req, c, ownerIndexKey(workload.GroupVersionKind()))
 	if err != nil {
 		logger.Error(err, "error finding InstrumentedApp objects")
 		return err
@@ -93,17 +104,28 @@ func syncInstrumentedApps(ctx context.Context, req *ctrl.Request, c client.Clien
 		}
 
 		err = c.Create(ctx, &instrumentedApp)
+		if apierrors.IsAlreadyExists(err) {
+			var existing apiV1.InstrumentedApplication
+			if err = c.Get(ctx, client.ObjectKeyFromObject(&instrumentedApp), &existing); err != nil {
+				return err
+			}
+			// the cached index may not list the InstrumentedApplication created by a previous sync yet
+			if isControlledBy(&existing, object.GetUID()) {
+				return nil
+			}
+			instrumentedApp.Name = kindQualifiedName(workload.GroupVersionKind(), req.Name)
+			err = c.Create(ctx, &instrumentedApp)
+			if apierrors.IsAlreadyExists(err) {
+				return nil
+			}
+		}
 		if err != nil {
 			logger.Error(err, "error creating InstrumentedApp object")
 			return err
 		}
 
-		instrumentedApp.Status = apiV1.InstrumentedApplicationStatus{
-			InstrumentationDetection: apiV1.InstrumentationStatus{
-				Phase: apiV1.PendingInstrumentationDetectionPhase,
-			},
-		}
-		err = c.Status().Update(ctx, &instrumentedApp)
+		setDetectionPhase(&instrumentedApp, apiV1.PendingInstrumentationDetectionPhase, apiV1.DetectionPendingReason, "waiting for the languages of the workload to be detected")
+		err = updateStatus(ctx, c, &instrumentedApp)
 		if err != nil {
 			logger.Error(err, "error updating InstrumentedApp object with phase")
 		}
@@ -124,15 +146,32 @@ func syncInstrumentedApps(ctx context.Context, req *ctrl.Request, c client.Clien
 	if err != nil {
 		return err
 	}
+	// the pod template of a Job or the spec of a pod is immutable, they are detected and never patched
+	if warning := workload.ImmutableReason(object); warning != "" {
+		if shouldInstrument(podTemplateSpec) {
+			return setImmutableTemplate(ctx, c, &instApp, podTemplateSpec, warning)
+		}
+		return updateContainerStatuses(ctx, c, &instApp, podTemplateSpec)
+	}
 	// instrumentation detection process
 	if shouldInstrument(podTemplateSpec) {
-		err = processInstrumentedApps(ctx, podTemplateSpec, &instApp, logger, c, object)
+		if podWebhook {
+			err = processWebhookInstrumentation(ctx, podTemplateSpec, &instApp, logger, c, object)
+		} else {
+			err = processInstrumentedApps(ctx, workload, &instApp, logger, c, object)
+		}
 		if err != nil {
 			return err
 		}
 	}
 	if shouldRollBackTraces(podTemplateSpec) {
-		err = processRollback(ctx, podTemplateSpec, &instApp, logger, c, object)
+		err = processRollback(ctx, workload, &instApp, logger, c, object, podWebhook)
+		if err != nil {
+			return err
+		}
+	}
+	if !shouldInstrument(podTemplateSpec) && !shouldRollBackTraces(podTemplateSpec) {
+		err = updateContainerStatuses(ctx, c, &instApp, podTemplateSpec)
 		if err != nil {
 			return err
 		}
@@ -171,11 +210,15 @@ func processLogType(ctx context.Context, podTemplateSpec *v1.PodTemplateSpec, in
 	return nil
 }
 
-func processRollback(ctx context.Context, podTemplateSpec *v1.PodTemplateSpec, instApp *apiV1.InstrumentedApplication, logger logr.Logger, c client.Client, object client.Object) error {
+func processRollback(ctx context.Context, workload WorkloadAdapter, instApp *apiV1.InstrumentedApplication, logger logr.Logger, c client.Client, object client.Object, podWebhook bool) error {
 	objectKey := client.ObjectKeyFromObject(object)
 	if err := c.Get(ctx, objectKey, object); err != nil {
 		return err
 	}
+	podTemplateSpec, err := workload.PodTemplate(object)
+	if err != nil {
+		return err
+	}
 	instAppKey := client.ObjectKeyFromObject(instApp)
 	if err := c.Get(ctx, instAppKey, instApp); err != nil {
 		return err
@@ -184,9 +227,13 @@ func processRollback(ctx context.Context, podTemplateSpec *v1.PodTemplateSpec, i
 	if err != nil {
 		return err
 	}
-	if instrumented != instApp.Status.TracesInstrumented {
-		instApp.Status.TracesInstrumented = instrumented
-		err = c.Status().Update(ctx, instApp)
+	// the pod webhook stops instrumenting new pods once the template asks for the rollback, the template is unchanged
+	if podWebhook {
+		instrumented = instApp.Status.TracesInstrumented
+	}
+	if instrumentedChanged(instApp, instrumented) {
+		setTemplateInstrumented(instApp, instrumented, podWebhook)
+		err = updateStatus(ctx, c, instApp)
 		if err != nil {
 			return err
 		}
@@ -194,13 +241,18 @@ func processRollback(ctx context.Context, podTemplateSpec *v1.PodTemplateSpec, i
 	annotations := podTemplateSpec.GetAnnotations()
 	if instrumented && strings.ToLower(annotations[TracesInstrumentAnnotation]) == "rollback" {
 		logger.V(0).Info("Rolling back instrumentation", "object", object)
-		err = patch.RollbackPatch(podTemplateSpec, instApp)
-		if err != nil {
-			return err
-		}
-		err = c.Update(ctx, object)
-		if err != nil {
-			return err
+		if !podWebhook {
+			err = patch.RollbackPatch(podTemplateSpec, instApp)
+			if err != nil {
+				return err
+			}
+			if err = workload.SetPodTemplate(object, podTemplateSpec); err != nil {
+				return err
+			}
+			err = c.Update(ctx, object)
+			if err != nil {
+				return err
+			}
 		}
 		// update crd active service names due to rollback
 		for i := range instApp.Spec.Languages {
@@ -210,21 +262,29 @@ func processRollback(ctx context.Context, podTemplateSpec *v1.PodTemplateSpec, i
 		if err != nil {
 			return err
 		}
-		instApp.Status.TracesInstrumented = false
-		err = c.Status().Update(ctx, instApp)
+		setTracesInstrumented(instApp, false, apiV1.RolledBackReason, "the instrumentation was rolled back")
+		instApp.Status.InstrumentationWarnings = updateStrategyWarnings(object)
+		if podWebhook {
+			instApp.Status.InstrumentationWarnings = []string{webhookRecreateWarning(object)}
+		}
+		err = updateStatus(ctx, c, instApp)
 		if err != nil {
 			return err
 		}
 		logger.V(0).Info("Successfully rolled back instrumentation, changing instrumented app status to not instrumented")
 	}
-	return nil
+	return updateContainerStatuses(ctx, c, instApp, podTemplateSpec)
 }
 
-func processInstrumentedApps(ctx context.Context, podTemplateSpec *v1.PodTemplateSpec, instApp *apiV1.InstrumentedApplication, logger logr.Logger, c client.Client, object client.Object) error {
+func processInstrumentedApps(ctx context.Context, workload WorkloadAdapter, instApp *apiV1.InstrumentedApplication, logger logr.Logger, c client.Client, object client.Object) error {
 	objectKey := client.ObjectKeyFromObject(object)
 	if err := c.Get(ctx, objectKey, object); err != nil {
 		return err
 	}
+	podTemplateSpec, err := workload.PodTemplate(object)
+	if err != nil {
+		return err
+	}
 	instAppKey := client.ObjectKeyFromObject(instApp)
 	if err := c.Get(ctx, instAppKey, instApp); err != nil {
 		return err
@@ -233,10 +293,10 @@ func processInstrumentedApps(ctx context.Context, podTemplateSpec *v1.PodTemplat
 	if err != nil {
 		return err
 	}
-	if instrumented != instApp.Status.TracesInstrumented {
+	if instrumentedChanged(instApp, instrumented) {
 		logger.V(0).Info("updating .status.instrumented", "instrumented", instrumented)
-		instApp.Status.TracesInstrumented = instrumented
-		err = c.Status().Update(ctx, instApp)
+		setTemplateInstrumented(instApp, instrumented, false)
+		err = updateStatus(ctx, c, instApp)
 		if err != nil {
 			return err
 		}
@@ -248,6 +308,9 @@ func processInstrumentedApps(ctx context.Context, podTemplateSpec *v1.PodTemplat
 		if err != nil {
 			return err
 		}
+		if err = workload.SetPodTemplate(object, podTemplateSpec); err != nil {
+			return err
+		}
 		err = c.Update(ctx, object)
 		if err != nil {
 			return err
@@ -257,8 +320,12 @@ func processInstrumentedApps(ctx context.Context, podTemplateSpec *v1.PodTemplat
 			return err
 		}
 		// instApp.Status.TracesInstrumented is a part of the status in the custom resource definition
-		instApp.Status.TracesInstrumented = true
-		err = c.Status().Update(ctx, instApp)
+		setTracesInstrumented(instApp, true, apiV1.PodTemplatePatchedReason, "the pod template was patched with the instrumentation of the detected languages")
+		instApp.Status.InstrumentationWarnings = append(patch.InstrumentationWarnings(podTemplateSpec, instApp), updateStrategyWarnings(object)...)
+		for _, warning := range instApp.Status.InstrumentationWarnings {
+			logger.V(0).Info("Instrumentation warning", "warning", warning)
+		}
+		err = updateStatus(ctx, c, instApp)
 		if err != nil {
 			return err
 		}
@@ -270,6 +337,9 @@ func processInstrumentedApps(ctx context.Context, podTemplateSpec *v1.PodTemplat
 		if err != nil {
 			return err
 		}
+		if err = workload.SetPodTemplate(object, podTemplateSpec); err != nil {
+			return err
+		}
 		err = c.Update(ctx, object)
 		if err != nil {
 			return err
@@ -280,7 +350,46 @@ func processInstrumentedApps(ctx context.Context, podTemplateSpec *v1.PodTemplat
 		}
 	}
 	logger.V(0).Info("Successfully instrumented pod: " + podTemplateSpec.GetName())
-	return nil
+	return updateContainerStatuses(ctx, c, instApp, podTemplateSpec)
+}
+
+// processWebhookInstrumentation records the instrumentation the pod webhook applies to the pods of the workload when
+// they are created, the pod template is not changed. The template is patched in memory like the webhook patches the
+// pods to keep the service names of the InstrumentedApplication up to date
+func processWebhookInstrumentation(ctx context.Context, podTemplateSpec *v1.PodTemplateSpec, instApp *apiV1.InstrumentedApplication, logger logr.Logger, c client.Client, object client.Object) error {
+	instAppKey := client.ObjectKeyFromObject(instApp)
+	if err := c.Get(ctx, instAppKey, instApp); err != nil {
+		return err
+	}
+	patched := podTemplateSpec.DeepCopy()
+	languages := instApp.Spec.DeepCopy().Languages
+	if err := patch.ModifyObject(patched, instApp); err != nil {
+		return err
+	}
+	if !equality.Semantic.DeepEqual(languages, instApp.Spec.Languages) {
+		if err := c.Update(ctx, instApp); err != nil {
+			return err
+		}
+	}
+	// the containers are instrumented as the webhook patches them
+	if !instrumentedChanged(instApp, true) {
+		return updateContainerStatuses(ctx, c, instApp, patched)
+	}
+
+	logger.V(0).Info("Instrumenting the pods of the workload when they are created")
+	setTemplateInstrumented(instApp, true, true)
+	instApp.Status.InstrumentationWarnings = append(patch.InstrumentationWarnings(patched, instApp), webhookRecreateWarning(object))
+	for _, warning := range instApp.Status.InstrumentationWarnings {
+		logger.V(0).Info("Instrumentation warning", "warning", warning)
+	}
+	instApp.Status.Containers = containerStatuses(patched, instApp)
+	return updateStatus(ctx, c, instApp)
+}
+
+// webhookRecreateWarning reminds that the pod webhook only changes the pods created after the instrumentation changed
+func webhookRecreateWarning(object client.Object) string {
+	return fmt.Sprintf("the pod webhook applies instrumentation changes to pods created from now on, the running pods of %s "+
+		"are updated when they are recreated, for example with kubectl rollout restart", object.GetName())
 }
 
 func processDetectedApps(ctx context.Context, req *ctrl.Request, c client.Client, podTemplateSpec *v1.PodTemplateSpec, instApp apiV1.InstrumentedApplication, logger logr.Logger, object client.Object) error {
@@ -290,11 +399,10 @@ func processDetectedApps(ctx context.Context, req *ctrl.Request, c client.Client
 		return err
 	}
 
-	if detected != instApp.Status.AppDetected {
-		instApp.Status.AppDetected = detected
+	if detected != instApp.Status.AppDetected || meta.FindStatusCondition(instApp.Status.Conditions, apiV1.AppDetectedCondition) == nil {
 		c.Get(ctx, req.NamespacedName, &instApp)
-		instApp.Status.AppDetected = detected
-		err = c.Status().Update(ctx, &instApp)
+		setAppDetected(&instApp, detected)
+		err = updateStatus(ctx, c, &instApp)
 		if err != nil {
 			logger.Error(err, "Error computing instrumented app status for annotation patching")
 		}
@@ -303,6 +411,54 @@ func processDetectedApps(ctx context.Context, req *ctrl.Request, c client.Client
 	return nil
 }
 
+// setImmutableTemplate adds the warning to the InstrumentedApplication status once, the workload is not instrumented
+// since its pod template can not be patched
+func setImmutableTemplate(ctx context.Context, c client.Client, instApp *apiV1.InstrumentedApplication, podTemplateSpec *v1.PodTemplateSpec, warning string) error {
+	if err := c.Get(ctx, client.ObjectKeyFromObject(instApp), instApp); err != nil {
+		return err
+	}
+	warned := false
+	for _, w := range instApp.Status.InstrumentationWarnings {
+		warned = warned || w == warning
+	}
+	containers := patch.ContainerStatuses(podTemplateSpec, instApp, apiV1.PodTemplateImmutableReason, warning)
+	condition := meta.FindStatusCondition(instApp.Status.Conditions, apiV1.InstrumentedCondition)
+	if warned && condition != nil && condition.Reason == apiV1.PodTemplateImmutableReason && equality.Semantic.DeepEqual(containers, instApp.Status.Containers) {
+		return nil
+	}
+	if !warned {
+		instApp.Status.InstrumentationWarnings = append(instApp.Status.InstrumentationWarnings, warning)
+	}
+	setTracesInstrumented(instApp, false, apiV1.PodTemplateImmutableReason, warning)
+	instApp.Status.Containers = containers
+	return updateStatus(ctx, c, instApp)
+}
+
+// updateStrategyWarnings returns a warning when the pod template changes of the instrumentor are not rolled out to the
+// running pods: with the OnDelete update strategy, a DaemonSet or StatefulSet replaces a pod only when it is deleted,
+// and a ReplicaSet never replaces its running pods
+func updateStrategyWarnings(object client.Object) []string {
+	kind := ""
+	switch o := object.(type) {
+	case *appsv1.ReplicaSet:
+		return []string{fmt.Sprintf("%s %s does not replace its running pods, they are updated only when they are deleted",
+			consts.SupportedResourceReplicaSet, o.Name)}
+	case *appsv1.DaemonSet:
+		if o.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType {
+			kind = consts.SupportedResourceDaemonSet
+		}
+	case *appsv1.StatefulSet:
+		if o.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+			kind = consts.SupportedResourceStatefulSet
+		}
+	}
+	if kind == "" {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s %s uses the OnDelete update strategy, its running pods are updated only when they are deleted",
+		kind, object.GetName())}
+}
+
 func shouldRollBackTraces(podTemplateSpec *v1.PodTemplateSpec) bool {
 	annotations := podTemplateSpec.GetAnnotations()
 	if val, exists := annotations[TracesInstrumentAnnotation]; exists && strings.ToLower(val) == "rollback" {
@@ -311,6 +467,18 @@ func shouldRollBackTraces(podTemplateSpec *v1.PodTemplateSpec) bool {
 	return false
 }
 
+// containerStatuses returns the instrumentation state of the containers of the pod template, the containers that are
+// not instrumented are waiting for the instrumentation, rolled back, or the workload does not ask for it
+func containerStatuses(podTemplateSpec *v1.PodTemplateSpec, instApp *apiV1.InstrumentedApplication) []apiV1.ContainerInstrumentation {
+	reason, message := apiV1.InstrumentationNotRequestedReason, fmt.Sprintf("set the %s annotation to true to instrument the workload", TracesInstrumentAnnotation)
+	if shouldRollBackTraces(podTemplateSpec) {
+		reason, message = apiV1.RolledBackReason, "the instrumentation was rolled back"
+	} else if shouldInstrument(podTemplateSpec) {
+		reason, message = apiV1.InstrumentationPendingReason, "the container is instrumented once the pod template is patched"
+	}
+	return patch.ContainerStatuses(podTemplateSpec, instApp, reason, message)
+}
+
 func shouldInstrument(podSpec *v1.PodTemplateSpec) bool {
 	annotations := podSpec.GetAnnotations()
 	if val, exists := annotations[consts.SkipAppDetectionAnnotation]; exists && strings.ToLower(val) == "true" {
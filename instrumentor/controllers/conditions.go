@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// maxConditionMessageLength keeps condition messages listing warnings readable in kubectl describe
+const maxConditionMessageLength = 1024
+
+// updateStatus writes the status of the InstrumentedApplication observed at its current generation, with the Degraded
+// condition computed from its warnings and disagreements
+func updateStatus(ctx context.Context, c client.Client, instApp *v1.InstrumentedApplication) error {
+	instApp.Status.ObservedGeneration = instApp.Generation
+	setDegradedCondition(instApp)
+	return c.Status().Update(ctx, instApp)
+}
+
+func setCondition(instApp *v1.InstrumentedApplication, conditionType string, status bool, reason string, message string) {
+	conditionStatus := metav1.ConditionFalse
+	if status {
+		conditionStatus = metav1.ConditionTrue
+	}
+	if len(message) > maxConditionMessageLength {
+		message = message[:maxConditionMessageLength-3] + "..."
+	}
+	meta.SetStatusCondition(&instApp.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: instApp.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// setDetectionPhase moves the detection to the phase, the DetectionSucceeded condition records why. The message of a
+// completed detection lists the detected languages
+func setDetectionPhase(instApp *v1.InstrumentedApplication, phase v1.InstrumentationPhase, reason string, message string) {
+	instApp.Status.InstrumentationDetection.Phase = phase
+	if phase == v1.CompletedInstrumentationDetectionPhase {
+		message = detectedLanguagesMessage(instApp)
+	}
+	setCondition(instApp, v1.DetectionSucceededCondition, phase == v1.CompletedInstrumentationDetectionPhase, reason, message)
+}
+
+// setTracesInstrumented records whether the pods of the workload are instrumented, the Instrumented condition records
+// why
+func setTracesInstrumented(instApp *v1.InstrumentedApplication, instrumented bool, reason string, message string) {
+	instApp.Status.TracesInstrumented = instrumented
+	setCondition(instApp, v1.InstrumentedCondition, instrumented, reason, message)
+}
+
+// setAppDetected records whether the application of the workload is detected and annotated
+func setAppDetected(instApp *v1.InstrumentedApplication, detected bool) {
+	instApp.Status.AppDetected = detected
+	if detected {
+		setCondition(instApp, v1.AppDetectedCondition, true, v1.ApplicationDetectedReason,
+			fmt.Sprintf("application %s is detected", getDetectedApplication(instApp)))
+		return
+	}
+	setCondition(instApp, v1.AppDetectedCondition, false, v1.ApplicationNotDetectedReason, "the pod template is not annotated with the detected application")
+}
+
+func setDegradedCondition(instApp *v1.InstrumentedApplication) {
+	switch {
+	case len(instApp.Status.InstrumentationWarnings) > 0:
+		setCondition(instApp, v1.DegradedCondition, true, v1.InstrumentationWarningsReason, strings.Join(instApp.Status.InstrumentationWarnings, "; "))
+	case len(instApp.Status.DetectionDisagreements) > 0:
+		setCondition(instApp, v1.DegradedCondition, true, v1.DetectionDisagreementsReason,
+			"the detected replicas disagree on: "+strings.Join(instApp.Status.DetectionDisagreements, "; "))
+	default:
+		setCondition(instApp, v1.DegradedCondition, false, v1.AsExpectedReason, "")
+	}
+}
+
+func detectedLanguagesMessage(instApp *v1.InstrumentedApplication) string {
+	if len(instApp.Spec.Languages) == 0 {
+		return "no supported language was detected"
+	}
+	var languages []string
+	for _, container := range instApp.Spec.Languages {
+		languages = append(languages, fmt.Sprintf("%s in container %s", container.Language, container.ContainerName))
+	}
+	return "detected " + strings.Join(languages, ", ")
+}
+
+func getDetectedApplication(instApp *v1.InstrumentedApplication) string {
+	if len(instApp.Spec.Applications) == 0 {
+		return ""
+	}
+	return string(instApp.Spec.Applications[0].Application)
+}
+
+// instrumentedChanged reports whether the status does not record the instrumentation of the pod template yet, or was
+// written before the Instrumented condition existed
+func instrumentedChanged(instApp *v1.InstrumentedApplication, instrumented bool) bool {
+	return instrumented != instApp.Status.TracesInstrumented || meta.FindStatusCondition(instApp.Status.Conditions, v1.InstrumentedCondition) == nil
+}
+
+// setTemplateInstrumented records the instrumentation read from the pod template, or applied by the pod webhook
+func setTemplateInstrumented(instApp *v1.InstrumentedApplication, instrumented bool, podWebhook bool) {
+	switch {
+	case instrumented && podWebhook:
+		setTracesInstrumented(instApp, true, v1.PodWebhookReason, "the pod webhook instruments the pods of the workload when they are created")
+	case instrumented:
+		setTracesInstrumented(instApp, true, v1.PodTemplateInstrumentedReason, "the pod template is instrumented")
+	default:
+		setTracesInstrumented(instApp, false, v1.PodTemplateNotInstrumentedReason, "the pod template is not instrumented")
+	}
+}
+
+// updateContainerStatuses writes the instrumentation state of the containers of the pod template when it changed
+func updateContainerStatuses(ctx context.Context, c client.Client, instApp *v1.InstrumentedApplication, podTemplateSpec *corev1.PodTemplateSpec) error {
+	containers := containerStatuses(podTemplateSpec, instApp)
+	if equality.Semantic.DeepEqual(containers, instApp.Status.Containers) {
+		return nil
+	}
+	instApp.Status.Containers = containers
+	return updateStatus(ctx, c, instApp)
+}
@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	"github.com/logzio/kubernetes-instrumentor/common/utils"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// DetectionAgentLabel selects the detection agent DaemonSet pods in the instrumentor namespace
+	DetectionAgentLabel   = "logz.io/detection-agent"
+	detectionAgentTimeout = 30 * time.Second
+	// agentDetectionConcurrency is the number of workloads detected with the detection agents at the same time
+	agentDetectionConcurrency = 4
+	detectionAgentTokenKey    = "token"
+)
+
+var detectionAgentHTTPClient = &http.Client{Timeout: detectionAgentTimeout}
+
+// detectWithAgent asks the detection agent running on the node of the target pod to detect its containers.
+// An error means the agent is not available or failed, and a detection pod should be created instead
+func (r *InstrumentedApplicationReconciler) detectWithAgent(ctx context.Context, logger logr.Logger, targetPod *corev1.Pod) (*common.DetectionResult, error) {
+	agentPod, err := r.nodeDetectionAgent(ctx, targetPod.Spec.NodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(common.DetectionRequest{
+		PodUID:         string(targetPod.UID),
+		ContainerNames: r.getContainerNames(targetPod),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	agentURL := fmt.Sprintf("http://%s%s", net.JoinHostPort(agentPod.Status.PodIP, strconv.Itoa(r.DetectionAgentPort)), consts.DetectionAgentPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, agentURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	// the token is not sent over the unencrypted connection, the request and the response are signed with it
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := utils.SignDetectionAgentMessage(r.DetectionAgentToken, []byte(timestamp), []byte(req.Method), []byte(req.URL.Path), data)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(consts.DetectionAgentTimestampHeader, timestamp)
+	req.Header.Set(consts.DetectionAgentSignatureHeader, signature)
+
+	resp, err := detectionAgentHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("detection agent %s returned %s", agentPod.Name, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDetectionReportSize))
+	if err != nil {
+		return nil, err
+	}
+	if !utils.ValidDetectionAgentSignature(r.DetectionAgentToken, resp.Header.Get(consts.DetectionAgentSignatureHeader), []byte(signature), body) {
+		return nil, fmt.Errorf("detection agent %s returned a response with an invalid signature", agentPod.Name)
+	}
+
+	var result common.DetectionResult
+	if err = json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	logger.V(0).Info("detected pod with detection agent", "agent", agentPod.Name, "pod", targetPod.Name)
+	return &result, nil
+}
+
+// runAgentDetections runs the queued detection agent calls, agentDetectionConcurrency at a time, until the manager
+// stops. It only runs on the leader
+func (r *InstrumentedApplicationReconciler) runAgentDetections(ctx context.Context) error {
+	return runBackgroundDetections(ctx, r.agentDetections, agentDetectionConcurrency, r.detectWithAgents)
+}
+
+// detectWithAgents completes the detection of the InstrumentedApplication with the detection agents, outside of
+// Reconcile. A detection pod is queued when an agent is not available or fails
+func (r *InstrumentedApplicationReconciler) detectWithAgents(ctx context.Context, key types.NamespacedName) {
+	defer r.agentDetections.done(key)
+	logger := log.FromContext(ctx).WithName("detection-agent").WithValues("instrumentedApplication", key)
+	var instrumentedApp v1.InstrumentedApplication
+	if err := r.Get(ctx, key, &instrumentedApp); err != nil ||
+		instrumentedApp.Status.InstrumentationDetection.Phase != v1.RunningInstrumentationDetectionPhase {
+		return
+	}
+
+	results, err := r.detectReplicasWithAgent(ctx, logger, &instrumentedApp)
+	if err != nil {
+		logger.V(0).Info("detection agent not available, creating a detection pod", "error", err.Error())
+		r.enqueueDetection(ctx, &instrumentedApp)
+		return
+	}
+	detectionResult, disagreements := mergeReplicaResults(results)
+	if err = r.updateMergedDetectionResult(ctx, detectionResult, disagreements, logger, instrumentedApp, key); err != nil {
+		logger.Error(err, "error updating detection result")
+	}
+}
+
+// detectReplicasWithAgent detects the chosen replicas of the workload with the detection agents of their nodes, the
+// results are returned by pod name. An error means a detection pod should be created instead
+func (r *InstrumentedApplicationReconciler) detectReplicasWithAgent(ctx context.Context, logger logr.Logger, instrumentedApp *v1.InstrumentedApplication) (map[string]common.DetectionResult, error) {
+	pods, err := r.choosePods(ctx, instrumentedApp, r.detectionReplicaCount())
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]common.DetectionResult)
+	for i := range pods {
+		result, err := r.detectWithAgent(ctx, logger, &pods[i])
+		if err != nil {
+			return nil, err
+		}
+		results[pods[i].Name] = *result
+		r.storeDetectionResult(ctx, logger, r.podImageDigests(&pods[i]), *result)
+	}
+	return results, nil
+}
+
+// nodeDetectionAgent returns the ready detection agent pod scheduled on the node
+func (r *InstrumentedApplicationReconciler) nodeDetectionAgent(ctx context.Context, nodeName string) (*corev1.Pod, error) {
+	var agentPods corev1.PodList
+	err := r.List(ctx, &agentPods, client.InNamespace(utils.GetCurrentNamespace()), client.MatchingLabels{DetectionAgentLabel: "true"})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range agentPods.Items {
+		pod := &agentPods.Items[i]
+		if pod.Spec.NodeName == nodeName && pod.Status.PodIP != "" && isPodReady(pod) {
+			return pod, nil
+		}
+	}
+	return nil, fmt.Errorf("no ready detection agent on node %s", nodeName)
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// EnsureDetectionAgentToken returns the shared detection agent token of the secret in the namespace, the secret is
+// created with a random token when it does not exist. The detection agents wait for it to start
+func EnsureDetectionAgentToken(ctx context.Context, c client.Client, namespace string) (string, error) {
+	key := client.ObjectKey{Namespace: namespace, Name: consts.DetectionAgentTokenSecret}
+	var secret corev1.Secret
+	err := c.Get(ctx, key, &secret)
+	if err == nil && len(secret.Data[detectionAgentTokenKey]) > 0 {
+		return string(secret.Data[detectionAgentTokenKey]), nil
+	}
+	if err == nil {
+		return "", fmt.Errorf("secret %s has no %s key", key, detectionAgentTokenKey)
+	}
+	if !apierrors.IsNotFound(err) {
+		return "", err
+	}
+
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); err != nil {
+		return "", err
+	}
+	secret = corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+		Data:       map[string][]byte{detectionAgentTokenKey: []byte(hex.EncodeToString(buf))},
+	}
+	err = c.Create(ctx, &secret)
+	// another replica created the secret first, every replica uses the same token
+	if apierrors.IsAlreadyExists(err) {
+		if err = c.Get(ctx, key, &secret); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+	return string(secret.Data[detectionAgentTokenKey]), nil
+}
@@ -0,0 +1,306 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/common/utils"
+	"github.com/logzio/kubernetes-instrumentor/detectors/process"
+	"github.com/logzio/kubernetes-instrumentor/detectors/serviceNameDetector"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// SkipDetectionCacheAnnotation on the pod template forces a new detection instead of reusing a cached result
+	SkipDetectionCacheAnnotation = "logz.io/skip-detection-cache"
+	detectionCacheLabel          = "logz.io/detection-cache"
+	detectionCacheNamePrefix     = "detection-cache-"
+	// detection pods carry the image digests of the target pod, so the result can be cached once the pod completes
+	detectionImageDigestsAnnotation = "logz.io/detection-image-digests"
+	detectionCacheResultKey         = "result"
+	detectionCacheDigestsKey        = "digests"
+	detectionCacheCreatedKey        = "createdAt"
+	// maxDetectionCacheResultSize keeps the cache entries well below the 1 MiB ConfigMap limit, the dependencies are
+	// left out of larger results
+	maxDetectionCacheResultSize = 512 * 1024
+)
+
+// cachedContainerResult is the detection result of a container image, stored without the container name
+// so it can be reused by any pod running the same image digest with the same command, args and env
+type cachedContainerResult struct {
+	Digest       string                         `json:"digest"`
+	Language     *common.LanguageByContainer    `json:"language,omitempty"`
+	Application  *common.ApplicationByContainer `json:"application,omitempty"`
+	Dependencies []common.Dependency            `json:"dependencies,omitempty"`
+}
+
+// cachedDetectionResult returns the cached detection result for the running pod of the workload, if the images of all
+// its containers were detected before and the cache entry has not expired
+func (r *InstrumentedApplicationReconciler) cachedDetectionResult(ctx context.Context, logger logr.Logger, instrumentedApp *v1.InstrumentedApplication) (*common.DetectionResult, bool) {
+	if r.DetectionCacheTTL <= 0 {
+		return nil, false
+	}
+
+	podTemplate, err := r.getOwnerPodTemplate(ctx, instrumentedApp)
+	if err != nil || strings.ToLower(podTemplate.Annotations[SkipDetectionCacheAnnotation]) == "true" ||
+		recordsDetection(podTemplate.Annotations) {
+		return nil, false
+	}
+	pod, err := r.choosePod(ctx, instrumentedApp)
+	if err != nil {
+		return nil, false
+	}
+	digests := r.podImageDigests(pod)
+	if digests == nil {
+		return nil, false
+	}
+
+	var cm corev1.ConfigMap
+	err = r.APIReader.Get(ctx, client.ObjectKey{Namespace: utils.GetCurrentNamespace(), Name: detectionCacheName(r.detectorVersion(), digests)}, &cm)
+	if err != nil {
+		return nil, false
+	}
+
+	if r.detectionCacheExpired(&cm) {
+		logger.V(0).Info("detection cache entry expired", "configmap", cm.Name)
+		if err = r.Delete(ctx, &cm); client.IgnoreNotFound(err) != nil {
+			logger.Error(err, "failed to delete expired detection cache entry")
+		}
+		return nil, false
+	}
+
+	var entries []cachedContainerResult
+	if err = json.Unmarshal([]byte(cm.Data[detectionCacheResultKey]), &entries); err != nil {
+		logger.Error(err, "error parsing detection cache entry", "configmap", cm.Name)
+		return nil, false
+	}
+	entriesByDigest := make(map[string]cachedContainerResult)
+	for _, entry := range entries {
+		entriesByDigest[entry.Digest] = entry
+	}
+
+	var result common.DetectionResult
+	for _, container := range r.detectedContainers(&pod.Spec) {
+		entry, exists := entriesByDigest[digests[container.Name]]
+		if !exists {
+			continue
+		}
+		if entry.Language != nil {
+			language := *entry.Language
+			language.ContainerName = container.Name
+			// the service name comes from the environment of the workload, not from the image
+			language.ActiveServiceName = containerSpecServiceName(container)
+			result.LanguageByContainer = append(result.LanguageByContainer, language)
+		}
+		if entry.Application != nil {
+			application := *entry.Application
+			application.ContainerName = container.Name
+			result.ApplicationByContainer = append(result.ApplicationByContainer, application)
+		}
+		if len(entry.Dependencies) > 0 {
+			result.DependenciesByContainer = append(result.DependenciesByContainer, common.DependenciesByContainer{
+				ContainerName: container.Name,
+				Dependencies:  entry.Dependencies,
+			})
+		}
+	}
+
+	logger.V(0).Info("reusing cached detection result", "configmap", cm.Name)
+	return &result, true
+}
+
+func (r *InstrumentedApplicationReconciler) detectionCacheExpired(cm *corev1.ConfigMap) bool {
+	createdAt, err := time.Parse(time.RFC3339, cm.Data[detectionCacheCreatedKey])
+	return err != nil || time.Since(createdAt) > r.DetectionCacheTTL
+}
+
+// sweepExpiredDetectionCache deletes the expired cache entries, including the ones no workload reads anymore
+func (r *InstrumentedApplicationReconciler) sweepExpiredDetectionCache(ctx context.Context) {
+	if r.DetectionCacheTTL <= 0 {
+		return
+	}
+	logger := log.FromContext(ctx).WithName("detection-cache")
+	var cms corev1.ConfigMapList
+	err := r.APIReader.List(ctx, &cms, client.InNamespace(utils.GetCurrentNamespace()), client.MatchingLabels{detectionCacheLabel: "true"})
+	if err != nil {
+		logger.Error(err, "could not list detection cache entries")
+		return
+	}
+	for i := range cms.Items {
+		if !r.detectionCacheExpired(&cms.Items[i]) {
+			continue
+		}
+		if err = r.Delete(ctx, &cms.Items[i]); client.IgnoreNotFound(err) != nil {
+			logger.Error(err, "failed to delete expired detection cache entry", "configmap", cms.Items[i].Name)
+		}
+	}
+}
+
+// storeDetectionResult caches the detection result by the image digests of the detected pod
+func (r *InstrumentedApplicationReconciler) storeDetectionResult(ctx context.Context, logger logr.Logger, digests map[string]string, result common.DetectionResult) {
+	if r.DetectionCacheTTL <= 0 || digests == nil {
+		return
+	}
+
+	entries := make(map[string]*cachedContainerResult)
+	for containerName, digest := range digests {
+		entries[containerName] = &cachedContainerResult{Digest: digest}
+	}
+	for i := range result.LanguageByContainer {
+		if entry, exists := entries[result.LanguageByContainer[i].ContainerName]; exists {
+			entry.Language = &result.LanguageByContainer[i]
+		}
+	}
+	for i := range result.ApplicationByContainer {
+		if entry, exists := entries[result.ApplicationByContainer[i].ContainerName]; exists {
+			entry.Application = &result.ApplicationByContainer[i]
+		}
+	}
+	for _, d := range result.DependenciesByContainer {
+		if entry, exists := entries[d.ContainerName]; exists {
+			entry.Dependencies = d.Dependencies
+		}
+	}
+
+	var cachedEntries []cachedContainerResult
+	for _, entry := range entries {
+		cachedEntries = append(cachedEntries, *entry)
+	}
+	data, err := json.Marshal(cachedEntries)
+	if err != nil {
+		logger.Error(err, "error serializing detection cache entry")
+		return
+	}
+	if len(data) > maxDetectionCacheResultSize {
+		logger.V(0).Info("detection result too large to cache with its dependencies", "size", len(data))
+		for i := range cachedEntries {
+			cachedEntries[i].Dependencies = nil
+		}
+		if data, err = json.Marshal(cachedEntries); err != nil {
+			logger.Error(err, "error serializing detection cache entry")
+			return
+		}
+	}
+	digestsData, _ := json.Marshal(digests)
+
+	cm := corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      detectionCacheName(r.detectorVersion(), digests),
+			Namespace: utils.GetCurrentNamespace(),
+			Labels:    map[string]string{detectionCacheLabel: "true"},
+		},
+		Data: map[string]string{
+			detectionCacheResultKey:  string(data),
+			detectionCacheDigestsKey: string(digestsData),
+			detectionCacheCreatedKey: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	err = r.Create(ctx, &cm)
+	if apierrors.IsAlreadyExists(err) {
+		err = r.Update(ctx, &cm)
+	}
+	if err != nil {
+		logger.Error(err, "error storing detection cache entry", "configmap", cm.Name)
+	}
+}
+
+// podImageDigests returns the cache key of every detected container, its image digest qualified with the hash of its
+// command, args and env, or nil if any digest is unknown. The detectors read the python server model from the command
+// line and the OpenTelemetry configuration from the env, so containers running the same image differently do not share
+// a result
+func (r *InstrumentedApplicationReconciler) podImageDigests(pod *corev1.Pod) map[string]string {
+	imageIDs := make(map[string]string)
+	for _, status := range pod.Status.ContainerStatuses {
+		imageIDs[status.Name] = status.ImageID
+	}
+	for _, status := range pod.Status.InitContainerStatuses {
+		imageIDs[status.Name] = status.ImageID
+	}
+
+	digests := make(map[string]string)
+	for _, container := range r.detectedContainers(&pod.Spec) {
+		digest := imageDigest(imageIDs[container.Name])
+		if digest == "" {
+			return nil
+		}
+		digests[container.Name] = digest + "/" + containerSpecHash(container)
+	}
+	return digests
+}
+
+// containerSpecHash hashes the command, args and env of the container. Env values from secrets, config maps and the
+// downward API are only hashed by name, they are not known before the container runs
+func containerSpecHash(container corev1.Container) string {
+	hash := sha256.New()
+	for _, arg := range container.Command {
+		hash.Write([]byte("command\x00" + arg + "\x00"))
+	}
+	for _, arg := range container.Args {
+		hash.Write([]byte("arg\x00" + arg + "\x00"))
+	}
+	for _, envVar := range container.Env {
+		value := envVar.Value
+		if envVar.ValueFrom != nil {
+			value = ""
+		}
+		hash.Write([]byte("env\x00" + envVar.Name + "=" + value + "\x00"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// imageDigest extracts the digest from a container status image id, for example docker-pullable://nginx@sha256:...
+func imageDigest(imageID string) string {
+	if idx := strings.LastIndex(imageID, "@"); idx != -1 {
+		imageID = imageID[idx+1:]
+	}
+	if strings.HasPrefix(imageID, "sha256:") {
+		return imageID
+	}
+	return ""
+}
+
+// detectorVersion identifies what produced the cached results: the detection backend and the detector image. Results
+// of an older detector are not reused after an upgrade, they expire with the TTL
+func (r *InstrumentedApplicationReconciler) detectorVersion() string {
+	return r.DetectionBackend + "/" + r.InstrumentationDetectorImage + ":" + r.InstrumentationDetectorTag
+}
+
+// detectionCacheName is derived from the detector version and the set of cache keys, the same images run the same way
+// in different containers share the entry
+func detectionCacheName(detector string, digests map[string]string) string {
+	unique := make(map[string]bool)
+	for _, digest := range digests {
+		unique[digest] = true
+	}
+	var sorted []string
+	for digest := range unique {
+		sorted = append(sorted, digest)
+	}
+	sort.Strings(sorted)
+
+	sum := sha256.Sum256([]byte(detector + "\x00" + strings.Join(sorted, ",")))
+	return detectionCacheNamePrefix + hex.EncodeToString(sum[:])[:32]
+}
+
+// containerSpecServiceName detects the service name from the literal env values of the container spec
+func containerSpecServiceName(container corev1.Container) string {
+	env := make(map[string]string)
+	for _, envVar := range container.Env {
+		if envVar.ValueFrom == nil {
+			env[envVar.Name] = envVar.Value
+		}
+	}
+	return serviceNameDetector.DetectServiceName([]process.Details{{Env: env}})
+}
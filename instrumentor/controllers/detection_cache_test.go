@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	appDigest     = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	sidecarDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func cachePod(containers []corev1.Container, imageIDs map[string]string) *corev1.Pod {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: containers}}
+	for name, imageID := range imageIDs {
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{Name: name, ImageID: imageID})
+	}
+	return pod
+}
+
+func TestContainerSpecHash(t *testing.T) {
+	base := corev1.Container{
+		Name:    "app",
+		Image:   "python:3.11",
+		Command: []string{"gunicorn"},
+		Args:    []string{"app:app"},
+		Env:     []corev1.EnvVar{{Name: "OTEL_SERVICE_NAME", Value: "orders"}},
+	}
+	tests := []struct {
+		name     string
+		change   func(c *corev1.Container)
+		wantSame bool
+	}{
+		{name: "same spec", change: func(c *corev1.Container) {}, wantSame: true},
+		{name: "other image tag", change: func(c *corev1.Container) { c.Image = "python:3.12" }, wantSame: true},
+		{name: "other container name", change: func(c *corev1.Container) { c.Name = "web" }, wantSame: true},
+		{name: "other command", change: func(c *corev1.Container) { c.Command = []string{"uwsgi"} }},
+		{name: "other args", change: func(c *corev1.Container) { c.Args = []string{"--preload", "app:app"} }},
+		{name: "args moved to the command", change: func(c *corev1.Container) { c.Command, c.Args = []string{"gunicorn", "app:app"}, nil }},
+		{name: "other env value", change: func(c *corev1.Container) { c.Env[0].Value = "payments" }},
+		{name: "added env", change: func(c *corev1.Container) {
+			c.Env = append(c.Env, corev1.EnvVar{Name: "GUNICORN_CMD_ARGS", Value: "--preload"})
+		}},
+		{name: "env from a secret", change: func(c *corev1.Container) {
+			c.Env[0] = corev1.EnvVar{Name: "OTEL_SERVICE_NAME", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{Key: "name"}}}
+		}},
+	}
+	want := containerSpecHash(base)
+	for _, test := range tests {
+		changed := base
+		changed.Command = append([]string(nil), base.Command...)
+		changed.Args = append([]string(nil), base.Args...)
+		changed.Env = append([]corev1.EnvVar(nil), base.Env...)
+		test.change(&changed)
+		if got := containerSpecHash(changed); (got == want) != test.wantSame {
+			t.Errorf("%s: containerSpecHash() = %s, base %s, want same %t", test.name, got, want, test.wantSame)
+		}
+	}
+}
+
+func TestPodImageDigests(t *testing.T) {
+	app := corev1.Container{Name: "app", Args: []string{"serve"}}
+	sidecar := corev1.Container{Name: "istio-proxy"}
+	logger := corev1.Container{Name: "logger"}
+	tests := []struct {
+		name       string
+		containers []corev1.Container
+		imageIDs   map[string]string
+		want       map[string]string
+	}{
+		{
+			name:       "pullable image id",
+			containers: []corev1.Container{app},
+			imageIDs:   map[string]string{"app": "docker-pullable://registry.example.com/app@" + appDigest},
+			want:       map[string]string{"app": appDigest + "/" + containerSpecHash(app)},
+		},
+		{
+			name:       "digest image id",
+			containers: []corev1.Container{app, logger},
+			imageIDs:   map[string]string{"app": appDigest, "logger": "registry.example.com/logger@" + sidecarDigest},
+			want:       map[string]string{"app": appDigest + "/" + containerSpecHash(app), "logger": sidecarDigest + "/" + containerSpecHash(logger)},
+		},
+		{
+			name:       "skipped containers are not part of the key",
+			containers: []corev1.Container{app, sidecar},
+			imageIDs:   map[string]string{"app": appDigest},
+			want:       map[string]string{"app": appDigest + "/" + containerSpecHash(app)},
+		},
+		{
+			name:       "container not started",
+			containers: []corev1.Container{app, logger},
+			imageIDs:   map[string]string{"app": appDigest},
+		},
+		{
+			name:       "image id without a digest",
+			containers: []corev1.Container{app},
+			imageIDs:   map[string]string{"app": "docker://registry.example.com/app:latest"},
+		},
+	}
+	r := &InstrumentedApplicationReconciler{}
+	for _, test := range tests {
+		got := r.podImageDigests(cachePod(test.containers, test.imageIDs))
+		if (got == nil) != (test.want == nil) || len(got) != len(test.want) {
+			t.Errorf("%s: podImageDigests() = %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for name, digest := range test.want {
+			if got[name] != digest {
+				t.Errorf("%s: podImageDigests() = %v, want %v", test.name, got, test.want)
+			}
+		}
+	}
+}
+
+func TestDetectionCacheName(t *testing.T) {
+	detector := (&InstrumentedApplicationReconciler{
+		DetectionBackend:             ProcessDetectionBackend,
+		InstrumentationDetectorImage: "logzio/instrumentation-detector",
+		InstrumentationDetectorTag:   "v1.0.3",
+	}).detectorVersion()
+	digests := map[string]string{"app": appDigest + "/a", "worker": sidecarDigest + "/b"}
+	want := detectionCacheName(detector, digests)
+	tests := []struct {
+		name     string
+		detector string
+		digests  map[string]string
+		wantSame bool
+	}{
+		{name: "same containers", detector: detector, digests: map[string]string{"worker": sidecarDigest + "/b", "app": appDigest + "/a"}, wantSame: true},
+		{name: "renamed containers", detector: detector, digests: map[string]string{"web": appDigest + "/a", "jobs": sidecarDigest + "/b"}, wantSame: true},
+		{name: "other detector tag", detector: ProcessDetectionBackend + "/logzio/instrumentation-detector:v1.0.4", digests: digests},
+		{name: "other detection backend", detector: ImageDetectionBackend + "/logzio/instrumentation-detector:v1.0.3", digests: digests},
+		{name: "other container spec", detector: detector, digests: map[string]string{"app": appDigest + "/c", "worker": sidecarDigest + "/b"}},
+		{name: "other image", detector: detector, digests: map[string]string{"app": appDigest + "/a", "worker": appDigest + "/b"}},
+		{name: "fewer containers", detector: detector, digests: map[string]string{"app": appDigest + "/a"}},
+	}
+	for _, test := range tests {
+		got := detectionCacheName(test.detector, test.digests)
+		if (got == want) != test.wantSame {
+			t.Errorf("%s: detectionCacheName() = %s, base %s, want same %t", test.name, got, want, test.wantSame)
+		}
+		if len(got) > 63 {
+			t.Errorf("%s: detectionCacheName() = %s is not a valid ConfigMap name", test.name, got)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+// DetectionPodConfig holds the scheduling, resources and image pull settings of detection pods
+type DetectionPodConfig struct {
+	Resources         corev1.ResourceRequirements   `json:"resources,omitempty"`
+	Tolerations       []corev1.Toleration           `json:"tolerations,omitempty"`
+	PriorityClassName string                        `json:"priorityClassName,omitempty"`
+	ImagePullSecrets  []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	ImagePullPolicy   corev1.PullPolicy             `json:"imagePullPolicy,omitempty"`
+}
+
+// DefaultDetectionPodConfig bounds the resources of detection pods, so they fit in namespace quotas
+func DefaultDetectionPodConfig() DetectionPodConfig {
+	return DetectionPodConfig{
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("10m"),
+				corev1.ResourceMemory: resource.MustParse("32Mi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("200m"),
+				corev1.ResourceMemory: resource.MustParse("128Mi"),
+			},
+		},
+	}
+}
+
+// LoadDetectionPodConfig reads a YAML detection pod config, the default resources apply when the file sets none
+func LoadDetectionPodConfig(path string) (DetectionPodConfig, error) {
+	config := DefaultDetectionPodConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = yaml.UnmarshalStrict(data, &config)
+	return config, err
+}
+
+// detectionPodTolerations adds the tolerations of the target pods to the configured tolerations, so the detection
+// pod is not evicted from the nodes the targets run on
+func (c DetectionPodConfig) detectionPodTolerations(targets []detectionTarget) []corev1.Toleration {
+	var tolerations []corev1.Toleration
+	add := func(toleration corev1.Toleration) {
+		for _, existing := range tolerations {
+			if existing.MatchToleration(&toleration) && equalTolerationSeconds(existing, toleration) {
+				return
+			}
+		}
+		tolerations = append(tolerations, toleration)
+	}
+
+	for _, toleration := range c.Tolerations {
+		add(toleration)
+	}
+	for _, target := range targets {
+		for _, toleration := range target.pod.Spec.Tolerations {
+			add(toleration)
+		}
+	}
+	return tolerations
+}
+
+func equalTolerationSeconds(a corev1.Toleration, b corev1.Toleration) bool {
+	if a.TolerationSeconds == nil || b.TolerationSeconds == nil {
+		return a.TolerationSeconds == b.TolerationSeconds
+	}
+	return *a.TolerationSeconds == *b.TolerationSeconds
+}
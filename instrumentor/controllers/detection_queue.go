@@ -0,0 +1,447 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common/utils"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// DetectionPriorityAnnotation on the pod template orders the detection queue, higher values are detected first
+	DetectionPriorityAnnotation = "logz.io/detection-priority"
+	// DetectionPodLabel marks detection pods, so the running ones can be counted across namespaces and the pod webhook
+	// skips them
+	DetectionPodLabel = "logz.io/instrumentation-detection"
+	// detectionTargetsAnnotation maps the UIDs of the pods a detection pod detects to their InstrumentedApplications,
+	// it associates detection pods with InstrumentedApplications across namespaces
+	detectionTargetsAnnotation = "logz.io/detection-targets"
+	// detectionTargetKey indexes detection pods by the namespaced names of their InstrumentedApplications
+	detectionTargetKey         = ".metadata.detectionTargets"
+	detectionDispatchInterval  = 2 * time.Second
+	detectionRetryDelay        = 30 * time.Second
+	detectionOrphanSweepPeriod = 5 * time.Minute
+)
+
+var errDetectionNotRunning = errors.New("detection is not running")
+
+// detectionTarget is a pod to detect and the InstrumentedApplication the result belongs to
+type detectionTarget struct {
+	app *v1.InstrumentedApplication
+	pod *corev1.Pod
+}
+
+// detectionTargets maps target pod UIDs to InstrumentedApplications
+type detectionTargets map[string]types.NamespacedName
+
+// podUIDs returns the UIDs of the target pods of the InstrumentedApplication, sorted
+func (t detectionTargets) podUIDs(key types.NamespacedName) []string {
+	var podUIDs []string
+	for podUID, target := range t {
+		if target == key {
+			podUIDs = append(podUIDs, podUID)
+		}
+	}
+	sort.Strings(podUIDs)
+	return podUIDs
+}
+
+// detectionPodTargets returns the targets of a detection pod, pods created without the annotation detect the
+// pod of their controller owner
+func detectionPodTargets(pod *corev1.Pod) detectionTargets {
+	targets := make(detectionTargets)
+	var values map[string]string
+	if json.Unmarshal([]byte(pod.Annotations[detectionTargetsAnnotation]), &values) == nil {
+		for podUID, value := range values {
+			// targets in the namespace of the detection pod may be stored by name only
+			namespace, name := pod.Namespace, value
+			if parts := strings.SplitN(value, "/", 2); len(parts) == 2 {
+				namespace, name = parts[0], parts[1]
+			}
+			targets[podUID] = types.NamespacedName{Namespace: namespace, Name: name}
+		}
+	}
+	if len(targets) > 0 {
+		return targets
+	}
+
+	if owner := metav1.GetControllerOf(pod); owner != nil && owner.APIVersion == apiGVStr && owner.Kind == "InstrumentedApplication" {
+		targets[""] = types.NamespacedName{Namespace: pod.Namespace, Name: owner.Name}
+	}
+	return targets
+}
+
+// detectionTargetIndex returns the detectionTargetKey values of a detection pod
+func detectionTargetIndex(obj client.Object) []string {
+	var keys []string
+	for _, key := range detectionPodTargets(obj.(*corev1.Pod)) {
+		keys = append(keys, key.String())
+	}
+	return keys
+}
+
+type queuedDetection struct {
+	key       types.NamespacedName
+	priority  int
+	enqueued  time.Time
+	notBefore time.Time
+}
+
+// detectionQueue holds the InstrumentedApplications waiting for a detection pod, and the ones whose detection pod
+// was created and did not complete yet
+type detectionQueue struct {
+	mu         sync.Mutex
+	pending    map[types.NamespacedName]*queuedDetection
+	dispatched map[types.NamespacedName]bool
+}
+
+func newDetectionQueue() *detectionQueue {
+	return &detectionQueue{
+		pending:    make(map[types.NamespacedName]*queuedDetection),
+		dispatched: make(map[types.NamespacedName]bool),
+	}
+}
+
+func (q *detectionQueue) add(key types.NamespacedName, priority int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[key] != nil || q.dispatched[key] {
+		return
+	}
+	q.pending[key] = &queuedDetection{key: key, priority: priority, enqueued: time.Now()}
+}
+
+func (q *detectionQueue) contains(key types.NamespacedName) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending[key] != nil || q.dispatched[key]
+}
+
+// isPending reports whether the detection is queued and its detection pod not created yet
+func (q *detectionQueue) isPending(key types.NamespacedName) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending[key] != nil
+}
+
+// ready returns the pending detections by priority, then by the time they were queued
+func (q *detectionQueue) ready(now time.Time) []queuedDetection {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var items []queuedDetection
+	for _, item := range q.pending {
+		if !now.Before(item.notBefore) {
+			items = append(items, *item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].priority != items[j].priority {
+			return items[i].priority > items[j].priority
+		}
+		return items[i].enqueued.Before(items[j].enqueued)
+	})
+	return items
+}
+
+func (q *detectionQueue) markDispatched(key types.NamespacedName) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, key)
+	q.dispatched[key] = true
+}
+
+func (q *detectionQueue) retryAfter(key types.NamespacedName, delay time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if item := q.pending[key]; item != nil {
+		item.notBefore = time.Now().Add(delay)
+	}
+}
+
+func (q *detectionQueue) done(key types.NamespacedName) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, key)
+	delete(q.dispatched, key)
+}
+
+// enqueueDetection queues the InstrumentedApplication for a detection pod
+func (r *InstrumentedApplicationReconciler) enqueueDetection(ctx context.Context, instrumentedApp *v1.InstrumentedApplication) {
+	priority := 0
+	if podTemplate, err := r.getOwnerPodTemplate(ctx, instrumentedApp); err == nil {
+		priority = detectionPriority(podTemplate)
+	}
+	r.detectionQueue.add(client.ObjectKeyFromObject(instrumentedApp), priority)
+}
+
+// detectionPriority prefers the explicit priority annotation, then workloads annotated for instrumentation
+func detectionPriority(podTemplate *corev1.PodTemplateSpec) int {
+	if priority, err := strconv.Atoi(podTemplate.Annotations[DetectionPriorityAnnotation]); err == nil {
+		return priority
+	}
+	if strings.ToLower(podTemplate.Annotations[TracesInstrumentAnnotation]) == "true" || podTemplate.Annotations[LogTypeAnnotation] != "" {
+		return 1
+	}
+	return 0
+}
+
+// dispatchDetections creates detection pods for the queued detections within the concurrency limits, and periodically
+// sweeps orphaned detection pods and expired cache entries, until the manager stops. It only runs on the leader
+func (r *InstrumentedApplicationReconciler) dispatchDetections(ctx context.Context) error {
+	ticker := time.NewTicker(detectionDispatchInterval)
+	defer ticker.Stop()
+	sweepTicker := time.NewTicker(detectionOrphanSweepPeriod)
+	defer sweepTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			r.dispatchQueuedDetections(ctx)
+		case <-sweepTicker.C:
+			r.sweepOrphanedDetectionPods(ctx)
+			r.sweepExpiredDetectionCache(ctx)
+		}
+	}
+}
+
+func (r *InstrumentedApplicationReconciler) dispatchQueuedDetections(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("detection-queue")
+	items := r.detectionQueue.ready(time.Now())
+	if len(items) == 0 {
+		return
+	}
+
+	var detectionPods corev1.PodList
+	if err := r.List(ctx, &detectionPods, client.MatchingLabels{DetectionPodLabel: "true"}); err != nil {
+		logger.Error(err, "could not list detection pods")
+		return
+	}
+	running := 0
+	runningOnNode := make(map[string]int)
+	for _, pod := range detectionPods.Items {
+		if pod.Status.Phase == corev1.PodPending || pod.Status.Phase == corev1.PodRunning {
+			running++
+			runningOnNode[pod.Spec.NodeName]++
+		}
+	}
+
+	batchSize := r.DetectionBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	// open batches by node and namespace, a batch becomes a single detection pod
+	openBatches := make(map[string]int)
+	var batches [][]detectionTarget
+	replicas := make(map[types.NamespacedName][]*corev1.Pod)
+	for _, item := range items {
+		targets, err := r.resolveDetectionTargets(ctx, item.key)
+		if err != nil {
+			if apierrors.IsNotFound(err) || errors.Is(err, errDetectionNotRunning) {
+				r.detectionQueue.done(item.key)
+			} else {
+				logger.V(0).Info("could not find a pod to detect, retrying later", "instrumentedApplication", item.key, "error", err.Error())
+				r.detectionQueue.retryAfter(item.key, detectionRetryDelay)
+			}
+			continue
+		}
+
+		// replicas that do not fit within the limits are not detected
+		for _, target := range targets {
+			batchKey := target.pod.Spec.NodeName + "/" + target.pod.Namespace
+			if i, exists := openBatches[batchKey]; exists && len(batches[i]) < batchSize {
+				batches[i] = append(batches[i], target)
+				replicas[item.key] = append(replicas[item.key], target.pod)
+				continue
+			}
+
+			nodeName := target.pod.Spec.NodeName
+			if (r.MaxConcurrentDetections > 0 && running >= r.MaxConcurrentDetections) ||
+				(r.MaxNodeDetections > 0 && runningOnNode[nodeName] >= r.MaxNodeDetections) {
+				continue
+			}
+			running++
+			runningOnNode[nodeName]++
+			openBatches[batchKey] = len(batches)
+			batches = append(batches, []detectionTarget{target})
+			replicas[item.key] = append(replicas[item.key], target.pod)
+		}
+	}
+
+	// the replicas are recorded before the detection pods are created, so no result completes the detection early
+	for key, pods := range replicas {
+		if len(pods) > 1 {
+			if err := r.setDetectionReplicas(ctx, key, pods); err != nil {
+				logger.Error(err, "error recording detected replicas", "instrumentedApplication", key)
+			}
+		}
+	}
+
+	created := make(map[types.NamespacedName][]*corev1.Pod)
+	failed := make(map[types.NamespacedName]error)
+	for _, batch := range batches {
+		err := r.createDetectionBatch(ctx, batch)
+		for _, target := range batch {
+			key := client.ObjectKeyFromObject(target.app)
+			if err != nil {
+				failed[key] = err
+				continue
+			}
+			created[key] = append(created[key], target.pod)
+		}
+	}
+
+	for key, err := range failed {
+		// the detection completes with the replicas whose detection pods were created
+		if pods, exists := created[key]; exists {
+			if err = r.setDetectionReplicas(ctx, key, pods); err != nil {
+				logger.Error(err, "error recording detected replicas", "instrumentedApplication", key)
+			}
+			continue
+		}
+		if isAdmissionError(err) {
+			if err := r.setDetectionError(ctx, key, v1.DetectionRejectedReason, err.Error()); err != nil {
+				logger.Error(err, "error updating instrument app status", "instrumentedApplication", key)
+			}
+			continue
+		}
+		r.detectionQueue.retryAfter(key, detectionRetryDelay)
+	}
+	for key := range created {
+		r.detectionQueue.markDispatched(key)
+	}
+}
+
+func (r *InstrumentedApplicationReconciler) createDetectionBatch(ctx context.Context, batch []detectionTarget) error {
+	logger := log.FromContext(ctx).WithName("detection-queue")
+	langDetectionPod, reportSecret, err := r.createLangDetectionPod(batch)
+	if err == nil && reportSecret != nil {
+		err = r.createWithDetectionReportSecret(ctx, reportSecret, langDetectionPod, func() error { return r.Create(ctx, langDetectionPod) })
+	} else if err == nil {
+		err = r.Create(ctx, langDetectionPod)
+	}
+	if err != nil {
+		for _, target := range batch {
+			logger.Error(err, "error creating detection pod", "instrumentedApplication", client.ObjectKeyFromObject(target.app))
+		}
+		return err
+	}
+	logger.V(0).Info("created detection pod", "node", langDetectionPod.Spec.NodeName, "targets", len(batch))
+	return nil
+}
+
+// resolveDetectionTargets returns the replicas of the current revision of the workload to detect
+func (r *InstrumentedApplicationReconciler) resolveDetectionTargets(ctx context.Context, key types.NamespacedName) ([]detectionTarget, error) {
+	var instrumentedApp v1.InstrumentedApplication
+	if err := r.Get(ctx, key, &instrumentedApp); err != nil {
+		return nil, err
+	}
+	if instrumentedApp.Status.InstrumentationDetection.Phase != v1.RunningInstrumentationDetectionPhase {
+		return nil, errDetectionNotRunning
+	}
+
+	pods, err := r.choosePods(ctx, &instrumentedApp, r.detectionReplicaCount())
+	if err != nil {
+		return nil, err
+	}
+	var targets []detectionTarget
+	for i := range pods {
+		targets = append(targets, detectionTarget{app: &instrumentedApp, pod: &pods[i]})
+	}
+	return targets, nil
+}
+
+// detectionPodInUse reports whether an InstrumentedApplication detected by the pod did not read its result yet
+func (r *InstrumentedApplicationReconciler) detectionPodInUse(ctx context.Context, pod *corev1.Pod) bool {
+	for _, key := range detectionPodTargets(pod) {
+		var instrumentedApp v1.InstrumentedApplication
+		err := r.Get(ctx, key, &instrumentedApp)
+		if err == nil && instrumentedApp.Status.InstrumentationDetection.Phase == v1.RunningInstrumentationDetectionPhase {
+			return true
+		}
+	}
+	return false
+}
+
+// detectionPods lists the detection pods of an InstrumentedApplication, in its namespace or in the operator namespace
+func (r *InstrumentedApplicationReconciler) detectionPods(ctx context.Context, key types.NamespacedName) ([]corev1.Pod, error) {
+	var pods corev1.PodList
+	err := r.List(ctx, &pods, client.MatchingFields{detectionTargetKey: key.String()})
+	return pods.Items, err
+}
+
+// deleteOrphanedDetectionPods deletes the detection pods of a deleted InstrumentedApplication, detection pods in the
+// operator namespace have no owner reference for the garbage collector to follow
+func (r *InstrumentedApplicationReconciler) deleteOrphanedDetectionPods(ctx context.Context, logger logr.Logger, key types.NamespacedName) error {
+	pods, err := r.detectionPods(ctx, key)
+	if err != nil {
+		return err
+	}
+	for i := range pods {
+		if r.detectionPodInUse(ctx, &pods[i]) {
+			continue
+		}
+		if err = r.Delete(ctx, &pods[i]); client.IgnoreNotFound(err) != nil {
+			logger.Error(err, "failed to delete orphaned detection pod", "pod", pods[i].Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepOrphanedDetectionPods deletes the detection pods in the operator namespace whose InstrumentedApplications were
+// deleted while the instrumentor was not running
+func (r *InstrumentedApplicationReconciler) sweepOrphanedDetectionPods(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("detection-queue")
+	var pods corev1.PodList
+	err := r.List(ctx, &pods, client.InNamespace(utils.GetCurrentNamespace()), client.MatchingLabels{DetectionPodLabel: "true"})
+	if err != nil {
+		logger.Error(err, "could not list detection pods")
+		return
+	}
+
+	for i := range pods.Items {
+		orphaned := true
+		for _, key := range detectionPodTargets(&pods.Items[i]) {
+			var instrumentedApp v1.InstrumentedApplication
+			if err = r.Get(ctx, key, &instrumentedApp); !apierrors.IsNotFound(err) {
+				orphaned = false
+				break
+			}
+		}
+		if !orphaned {
+			continue
+		}
+		if err = r.Delete(ctx, &pods.Items[i]); client.IgnoreNotFound(err) != nil {
+			logger.Error(err, "failed to delete orphaned detection pod", "pod", pods.Items[i].Name)
+		}
+	}
+}
+
+// detectionPodRequests maps a detection pod to the InstrumentedApplications it detects
+func detectionPodRequests(ctx context.Context, obj client.Object) []reconcile.Request {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, key := range detectionPodTargets(pod) {
+		requests = append(requests, reconcile.Request{NamespacedName: key})
+	}
+	return requests
+}
@@ -0,0 +1,465 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	"github.com/logzio/kubernetes-instrumentor/common/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// detectedDeployment returns a deployment with a running replica on each node, its ReplicaSet and its running
+// InstrumentedApplication
+func detectedDeployment(namespace string, name string, nodes ...string) []client.Object {
+	labels := map[string]string{"app": name}
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			UID:         types.UID(namespace + "-" + name),
+			Annotations: map[string]string{deploymentRevisionAnnotation: "1"},
+		},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels}}},
+	}
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       namespace,
+		Name:            name + "-5c9f",
+		UID:             types.UID(namespace + "-" + name + "-5c9f"),
+		Labels:          map[string]string{"app": name, appsv1.DefaultDeploymentUniqueLabelKey: "5c9f"},
+		Annotations:     map[string]string{deploymentRevisionAnnotation: "1"},
+		OwnerReferences: []metav1.OwnerReference{controllerReference("apps/v1", "Deployment", dep.Name, dep.UID)},
+	}}
+	app := runningInstrumentedApp(namespace, "deployment-"+name)
+	app.OwnerReferences = []metav1.OwnerReference{controllerReference("apps/v1", "Deployment", dep.Name, dep.UID)}
+	objects := []client.Object{dep, rs, app}
+	for i, node := range nodes {
+		objects = append(objects, runningPod(namespace, fmt.Sprintf("%s-5c9f-%d", name, i), node, rs.Labels,
+			controllerReference("apps/v1", "ReplicaSet", rs.Name, rs.UID)))
+	}
+	return objects
+}
+
+func controllerReference(apiVersion string, kind string, name string, uid types.UID) metav1.OwnerReference {
+	controller := true
+	return metav1.OwnerReference{APIVersion: apiVersion, Kind: kind, Name: name, UID: uid, Controller: &controller}
+}
+
+func runningPod(namespace string, name string, node string, labels map[string]string, owner metav1.OwnerReference) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       namespace,
+			Name:            name,
+			UID:             types.UID(namespace + "-" + name),
+			Labels:          labels,
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Spec:   corev1.PodSpec{NodeName: node, Containers: []corev1.Container{{Name: "app"}}},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+// runningDetectionPod returns a detection pod detecting the InstrumentedApplications
+func runningDetectionPod(namespace string, name string, node string, phase corev1.PodPhase, targets map[string]string) *corev1.Pod {
+	data, _ := json.Marshal(targets)
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Labels:      map[string]string{DetectionPodLabel: "true"},
+			Annotations: map[string]string{detectionTargetsAnnotation: string(data)},
+		},
+		Spec:   corev1.PodSpec{NodeName: node},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+}
+
+func TestDetectionPriority(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        int
+	}{
+		{name: "not annotated"},
+		{name: "priority annotation", annotations: map[string]string{DetectionPriorityAnnotation: "5"}, want: 5},
+		{name: "negative priority", annotations: map[string]string{DetectionPriorityAnnotation: "-1", TracesInstrumentAnnotation: "true"}, want: -1},
+		{name: "invalid priority", annotations: map[string]string{DetectionPriorityAnnotation: "high"}},
+		{name: "traces instrument annotation", annotations: map[string]string{TracesInstrumentAnnotation: "True"}, want: 1},
+		{name: "traces instrument disabled", annotations: map[string]string{TracesInstrumentAnnotation: "false"}},
+		{name: "log type annotation", annotations: map[string]string{LogTypeAnnotation: "python"}, want: 1},
+	}
+	for _, test := range tests {
+		podTemplate := &corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Annotations: test.annotations}}
+		if got := detectionPriority(podTemplate); got != test.want {
+			t.Errorf("%s: detectionPriority() = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEnqueueDetectionPriority(t *testing.T) {
+	objects := append(detectedDeployment("shop", "orders", "node-a"), detectedDeployment("shop", "payments", "node-a")...)
+	objects[0].(*appsv1.Deployment).Spec.Template.Annotations = map[string]string{TracesInstrumentAnnotation: "true"}
+	r := newTestReconciler(t, objects...)
+
+	ctx := context.Background()
+	for _, name := range []string{"deployment-payments", "deployment-orders", "deployment-missing"} {
+		app := runningInstrumentedApp("shop", name)
+		_ = r.Get(ctx, client.ObjectKeyFromObject(app), app)
+		r.enqueueDetection(ctx, app)
+		time.Sleep(time.Millisecond)
+	}
+	var got []string
+	for _, item := range r.detectionQueue.ready(time.Now()) {
+		got = append(got, fmt.Sprintf("%s=%d", item.key.Name, item.priority))
+	}
+	want := []string{"deployment-orders=1", "deployment-payments=0", "deployment-missing=0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queued detections = %v, want %v", got, want)
+	}
+}
+
+func TestDetectionQueue(t *testing.T) {
+	key := func(name string) types.NamespacedName { return types.NamespacedName{Namespace: "shop", Name: name} }
+	// detections of the same priority are ordered by the time they were queued
+	add := func(q *detectionQueue, name string, priority int) {
+		q.add(key(name), priority)
+		time.Sleep(time.Millisecond)
+	}
+	tests := []struct {
+		name  string
+		apply func(q *detectionQueue)
+		want  []string
+	}{
+		{
+			name: "priority then queue order",
+			apply: func(q *detectionQueue) {
+				add(q, "a", 0)
+				add(q, "b", 1)
+				add(q, "c", 0)
+				add(q, "d", 1)
+			},
+			want: []string{"b", "d", "a", "c"},
+		},
+		{
+			name: "queued once",
+			apply: func(q *detectionQueue) {
+				add(q, "a", 0)
+				add(q, "b", 0)
+				add(q, "a", 5)
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "dispatched detections are not queued again",
+			apply: func(q *detectionQueue) {
+				add(q, "a", 0)
+				q.markDispatched(key("a"))
+				add(q, "a", 0)
+				add(q, "b", 0)
+			},
+			want: []string{"b"},
+		},
+		{
+			name: "done detections can be queued again",
+			apply: func(q *detectionQueue) {
+				add(q, "a", 0)
+				q.markDispatched(key("a"))
+				q.done(key("a"))
+				add(q, "a", 0)
+			},
+			want: []string{"a"},
+		},
+		{
+			name: "retried detections wait",
+			apply: func(q *detectionQueue) {
+				add(q, "a", 1)
+				add(q, "b", 0)
+				q.retryAfter(key("a"), time.Minute)
+			},
+			want: []string{"b"},
+		},
+	}
+	for _, test := range tests {
+		q := newDetectionQueue()
+		test.apply(q)
+		var got []string
+		for _, item := range q.ready(time.Now()) {
+			got = append(got, item.key.Name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: ready() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDispatchQueuedDetections(t *testing.T) {
+	type queued struct {
+		namespace string
+		name      string
+		nodes     []string
+		priority  int
+	}
+	tests := []struct {
+		name             string
+		maxConcurrent    int
+		maxNode          int
+		batchSize        int
+		replicas         int
+		queued           []queued
+		running          []*corev1.Pod
+		wantPodsByNode   map[string]int
+		wantDispatched   []string
+		wantPodsDetected map[string]int
+	}{
+		{
+			name:           "pod per detection",
+			maxConcurrent:  10,
+			maxNode:        2,
+			queued:         []queued{{"shop", "orders", []string{"node-a"}, 0}, {"shop", "payments", []string{"node-b"}, 0}},
+			wantPodsByNode: map[string]int{"node-a": 1, "node-b": 1},
+			wantDispatched: []string{"orders", "payments"},
+		},
+		{
+			name:             "batched by node and namespace",
+			batchSize:        2,
+			queued:           []queued{{"shop", "orders", []string{"node-a"}, 0}, {"shop", "payments", []string{"node-a"}, 0}, {"shop", "cart", []string{"node-a"}, 0}},
+			wantPodsByNode:   map[string]int{"node-a": 2},
+			wantDispatched:   []string{"cart", "orders", "payments"},
+			wantPodsDetected: map[string]int{"node-a": 3},
+		},
+		{
+			name:             "other namespaces are not batched",
+			batchSize:        5,
+			queued:           []queued{{"shop", "orders", []string{"node-a"}, 0}, {"billing", "payments", []string{"node-a"}, 0}},
+			wantPodsByNode:   map[string]int{"node-a": 2},
+			wantDispatched:   []string{"orders", "payments"},
+			wantPodsDetected: map[string]int{"node-a": 2},
+		},
+		{
+			name:           "global limit by priority",
+			maxConcurrent:  2,
+			queued:         []queued{{"shop", "orders", []string{"node-a"}, 0}, {"shop", "payments", []string{"node-b"}, 1}},
+			running:        []*corev1.Pod{runningDetectionPod("shop", "detection-1", "node-c", corev1.PodRunning, nil)},
+			wantPodsByNode: map[string]int{"node-b": 1, "node-c": 1},
+			wantDispatched: []string{"payments"},
+		},
+		{
+			name:          "completed detection pods do not count",
+			maxConcurrent: 1,
+			queued:        []queued{{"shop", "orders", []string{"node-a"}, 0}},
+			running: []*corev1.Pod{
+				runningDetectionPod("shop", "detection-1", "node-a", corev1.PodSucceeded, nil),
+				runningDetectionPod("shop", "detection-2", "node-a", corev1.PodFailed, nil),
+			},
+			wantPodsByNode: map[string]int{"node-a": 3},
+			wantDispatched: []string{"orders"},
+		},
+		{
+			name:           "node limit",
+			maxNode:        1,
+			queued:         []queued{{"shop", "orders", []string{"node-a"}, 0}, {"shop", "payments", []string{"node-a"}, 0}, {"shop", "cart", []string{"node-b"}, 0}},
+			running:        []*corev1.Pod{runningDetectionPod("shop", "detection-1", "node-b", corev1.PodPending, nil)},
+			wantPodsByNode: map[string]int{"node-a": 1, "node-b": 1},
+			wantDispatched: []string{"orders"},
+		},
+		{
+			name:             "replicas within the node limit",
+			maxNode:          1,
+			replicas:         3,
+			queued:           []queued{{"shop", "orders", []string{"node-a", "node-b", "node-a"}, 0}},
+			wantPodsByNode:   map[string]int{"node-a": 1, "node-b": 1},
+			wantDispatched:   []string{"orders"},
+			wantPodsDetected: map[string]int{"node-a": 1, "node-b": 1},
+		},
+		{
+			name:           "unlimited",
+			queued:         []queued{{"shop", "orders", []string{"node-a"}, 0}, {"shop", "payments", []string{"node-a"}, 0}, {"shop", "cart", []string{"node-a"}, 0}},
+			wantPodsByNode: map[string]int{"node-a": 3},
+			wantDispatched: []string{"cart", "orders", "payments"},
+		},
+		{
+			name:           "no running replica",
+			queued:         []queued{{"shop", "orders", nil, 0}},
+			wantPodsByNode: map[string]int{},
+		},
+	}
+	for _, test := range tests {
+		var objects []client.Object
+		for _, item := range test.queued {
+			objects = append(objects, detectedDeployment(item.namespace, item.name, item.nodes...)...)
+		}
+		for _, pod := range test.running {
+			objects = append(objects, pod)
+		}
+		r := newTestReconciler(t, objects...)
+		r.MaxConcurrentDetections = test.maxConcurrent
+		r.MaxNodeDetections = test.maxNode
+		r.DetectionBatchSize = test.batchSize
+		r.DetectionReplicas = test.replicas
+		for _, item := range test.queued {
+			r.detectionQueue.add(types.NamespacedName{Namespace: item.namespace, Name: "deployment-" + item.name}, item.priority)
+		}
+
+		ctx := context.Background()
+		r.dispatchQueuedDetections(ctx)
+
+		var pods corev1.PodList
+		if err := r.List(ctx, &pods, client.MatchingLabels{DetectionPodLabel: "true"}); err != nil {
+			t.Fatal(err)
+		}
+		podsByNode := make(map[string]int)
+		detected := make(map[string]int)
+		for _, pod := range pods.Items {
+			podsByNode[pod.Spec.NodeName]++
+			detected[pod.Spec.NodeName] += len(detectionPodTargets(&pod))
+		}
+		if !reflect.DeepEqual(podsByNode, test.wantPodsByNode) {
+			t.Errorf("%s: detection pods by node = %v, want %v", test.name, podsByNode, test.wantPodsByNode)
+		}
+		if test.wantPodsDetected != nil {
+			for _, pod := range test.running {
+				detected[pod.Spec.NodeName] -= len(detectionPodTargets(pod))
+			}
+			if !reflect.DeepEqual(detected, test.wantPodsDetected) {
+				t.Errorf("%s: detected pods by node = %v, want %v", test.name, detected, test.wantPodsDetected)
+			}
+		}
+
+		var dispatched []string
+		for _, item := range test.queued {
+			key := types.NamespacedName{Namespace: item.namespace, Name: "deployment-" + item.name}
+			if r.detectionQueue.contains(key) && !r.detectionQueue.isPending(key) {
+				dispatched = append(dispatched, item.name)
+			}
+		}
+		sort.Strings(dispatched)
+		if !reflect.DeepEqual(dispatched, test.wantDispatched) {
+			t.Errorf("%s: dispatched detections = %v, want %v", test.name, dispatched, test.wantDispatched)
+		}
+	}
+}
+
+func TestDispatchRecordsReplicas(t *testing.T) {
+	r := newTestReconciler(t, detectedDeployment("shop", "orders", "node-a", "node-b", "node-c")...)
+	r.DetectionReplicas = 2
+	key := types.NamespacedName{Namespace: "shop", Name: "deployment-orders"}
+	r.detectionQueue.add(key, 0)
+
+	ctx := context.Background()
+	r.dispatchQueuedDetections(ctx)
+
+	var app v1.InstrumentedApplication
+	if err := r.Get(ctx, key, &app); err != nil {
+		t.Fatal(err)
+	}
+	if replicas := detectionReplicas(&app); len(replicas) != 2 {
+		t.Errorf("detected replicas = %v, want 2", replicas)
+	}
+	pods, err := r.detectionPods(ctx, key)
+	if err != nil || len(pods) != 2 || pods[0].Spec.NodeName == pods[1].Spec.NodeName {
+		t.Errorf("detection pods = %d (%v), want 2 on different nodes", len(pods), err)
+	}
+}
+
+func TestDispatchDropsFinishedDetections(t *testing.T) {
+	objects := detectedDeployment("shop", "orders", "node-a")
+	objects[2].(*v1.InstrumentedApplication).Status.InstrumentationDetection.Phase = v1.CompletedInstrumentationDetectionPhase
+	r := newTestReconciler(t, objects...)
+	completed := types.NamespacedName{Namespace: "shop", Name: "deployment-orders"}
+	deleted := types.NamespacedName{Namespace: "shop", Name: "deployment-deleted"}
+	r.detectionQueue.add(completed, 0)
+	r.detectionQueue.add(deleted, 0)
+
+	r.dispatchQueuedDetections(context.Background())
+	if r.detectionQueue.contains(completed) || r.detectionQueue.contains(deleted) {
+		t.Errorf("finished detections are still queued")
+	}
+}
+
+func TestSweepOrphanedDetectionPods(t *testing.T) {
+	operatorNamespace := utils.GetCurrentNamespace()
+	tests := []struct {
+		name       string
+		pod        *corev1.Pod
+		wantExists bool
+	}{
+		{
+			name:       "detected application exists",
+			pod:        runningDetectionPod(operatorNamespace, "detection-1", "node-a", corev1.PodRunning, map[string]string{"pod-1": "shop/deployment-orders"}),
+			wantExists: true,
+		},
+		{
+			name: "detected application deleted",
+			pod:  runningDetectionPod(operatorNamespace, "detection-1", "node-a", corev1.PodSucceeded, map[string]string{"pod-1": "shop/deployment-deleted"}),
+		},
+		{
+			name: "batch of deleted applications",
+			pod: runningDetectionPod(operatorNamespace, "detection-1", "node-a", corev1.PodRunning,
+				map[string]string{"pod-1": "shop/deployment-deleted", "pod-2": "billing/deployment-deleted"}),
+		},
+		{
+			name: "one application of the batch exists",
+			pod: runningDetectionPod(operatorNamespace, "detection-1", "node-a", corev1.PodRunning,
+				map[string]string{"pod-1": "shop/deployment-deleted", "pod-2": "shop/deployment-orders"}),
+			wantExists: true,
+		},
+		{
+			name:       "detection pod in the application namespace",
+			pod:        runningDetectionPod("shop", "detection-1", "node-a", corev1.PodRunning, map[string]string{"pod-1": "shop/deployment-deleted"}),
+			wantExists: true,
+		},
+	}
+	for _, test := range tests {
+		r := newTestReconciler(t, runningInstrumentedApp("shop", "deployment-orders"), test.pod)
+		ctx := context.Background()
+		r.sweepOrphanedDetectionPods(ctx)
+
+		err := r.Get(ctx, client.ObjectKeyFromObject(test.pod), &corev1.Pod{})
+		if exists := !apierrors.IsNotFound(err); exists != test.wantExists {
+			t.Errorf("%s: detection pod exists = %t (%v), want %t", test.name, exists, err, test.wantExists)
+		}
+	}
+}
+
+func TestDetectionPodTargets(t *testing.T) {
+	owned := runningDetectionPod("shop", "detection-1", "node-a", corev1.PodRunning, nil)
+	owned.Annotations = nil
+	owned.OwnerReferences = []metav1.OwnerReference{controllerReference(apiGVStr, "InstrumentedApplication", "deployment-orders", "app-1")}
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		want detectionTargets
+	}{
+		{
+			name: "namespaced targets",
+			pod:  runningDetectionPod(consts.DefaultNamespace, "detection-1", "node-a", corev1.PodRunning, map[string]string{"pod-1": "shop/deployment-orders"}),
+			want: detectionTargets{"pod-1": {Namespace: "shop", Name: "deployment-orders"}},
+		},
+		{
+			name: "targets in the detection pod namespace",
+			pod:  runningDetectionPod("shop", "detection-1", "node-a", corev1.PodRunning, map[string]string{"pod-1": "deployment-orders"}),
+			want: detectionTargets{"pod-1": {Namespace: "shop", Name: "deployment-orders"}},
+		},
+		{
+			name: "owned detection pod",
+			pod:  owned,
+			want: detectionTargets{"": {Namespace: "shop", Name: "deployment-orders"}},
+		},
+	}
+	for _, test := range tests {
+		if got := detectionPodTargets(test.pod); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: detectionPodTargets() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+)
+
+const (
+	// DetectionRecordAnnotation on the pod template records a snapshot of the next detection of the workload in the
+	// log of the detection container, see the detectors --record argument
+	DetectionRecordAnnotation = "logz.io/detection-record"
+	// detectionRecordLog is the --record value that prints the snapshot to the detector log
+	detectionRecordLog = "-"
+)
+
+// recordsDetection reports whether the annotations of a pod template, a pod of the workload or a detection pod ask
+// for a detection snapshot
+func recordsDetection(annotations map[string]string) bool {
+	return strings.ToLower(annotations[DetectionRecordAnnotation]) == "true"
+}
+
+// recordsWorkloadDetection reports whether the pod template of the workload asks for a detection snapshot
+func (r *InstrumentedApplicationReconciler) recordsWorkloadDetection(ctx context.Context, instrumentedApp *v1.InstrumentedApplication) bool {
+	podTemplate, err := r.getOwnerPodTemplate(ctx, instrumentedApp)
+	return err == nil && recordsDetection(podTemplate.Annotations)
+}
@@ -0,0 +1,287 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// detectionReportTokenAnnotation holds the sha256 of the token the detection pod authenticates its report with
+	detectionReportTokenAnnotation = "logz.io/detection-report-token"
+	// the token itself is stored in a secret per detection pod, so it is not readable from the pod spec
+	detectionReportSecretPrefix    = "detection-report-"
+	detectionReportSecretTokenKey  = "token"
+	maxDetectionReportSize         = 16 << 20
+	detectionReportShutdownTimeout = 5 * time.Second
+)
+
+// DetectionReportServer receives detection results from detection pods, without the 4096 bytes limit of the
+// termination message. It runs on every replica, not only on the leader, since the report is written to the API server
+type DetectionReportServer struct {
+	Reconciler  *InstrumentedApplicationReconciler
+	BindAddress string
+}
+
+// Start serves the report endpoint until the manager stops
+func (s *DetectionReportServer) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(consts.DetectionReportPath, s.Reconciler.handleDetectionReport)
+	server := &http.Server{Addr: s.BindAddress, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), detectionReportShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// NeedLeaderElection is false so every replica behind the service accepts reports
+func (s *DetectionReportServer) NeedLeaderElection() bool {
+	return false
+}
+
+func (r *InstrumentedApplicationReconciler) handleDetectionReport(w http.ResponseWriter, req *http.Request) {
+	logger := log.FromContext(req.Context()).WithName("detection-report")
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var report common.DetectionReport
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxDetectionReportSize)).Decode(&report); err != nil {
+		http.Error(w, "invalid detection report", http.StatusBadRequest)
+		return
+	}
+
+	if report.InstrumentedApplication != "" {
+		r.handleEphemeralDetectionReport(w, req, report)
+		return
+	}
+
+	var detectionPod corev1.Pod
+	err := r.Get(req.Context(), client.ObjectKey{Namespace: report.Namespace, Name: report.PodName}, &detectionPod)
+	if err != nil || !validDetectionReportToken(&detectionPod, req.Header.Get("Authorization")) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	targets := detectionPodTargets(&detectionPod)
+	podResults := report.Pods
+	if len(podResults) == 0 {
+		for podUID := range targets {
+			podResults = append(podResults, common.PodDetectionResult{PodUID: podUID, Result: report.Result})
+		}
+	}
+
+	updated := 0
+	for _, podResult := range podResults {
+		key, exists := targets[podResult.PodUID]
+		if !exists {
+			continue
+		}
+
+		var instrumentedApp v1.InstrumentedApplication
+		if err = r.Get(req.Context(), key, &instrumentedApp); err != nil ||
+			instrumentedApp.Status.InstrumentationDetection.Phase != v1.RunningInstrumentationDetectionPhase {
+			continue
+		}
+
+		err = r.recordDetectionResult(req.Context(), podResult.Result, podResult.PodUID, logger, instrumentedApp, key)
+		if err != nil {
+			logger.Error(err, "error updating detection result from report", "pod", report.PodName)
+			http.Error(w, "could not update detection result", http.StatusInternalServerError)
+			return
+		}
+		r.storeDetectionPodResult(req.Context(), logger, &detectionPod, podResult.PodUID, podResult.Result)
+		updated++
+	}
+
+	if updated == 0 {
+		http.Error(w, "detection is not running", http.StatusConflict)
+		return
+	}
+	// the token is single use, a later report with it is rejected
+	if err = r.revokeDetectionReportToken(req.Context(), &detectionPod); err != nil {
+		logger.Error(err, "error removing the detection report token", "pod", report.PodName)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleEphemeralDetectionReport keeps the report of an ephemeral detection container until all the containers of the
+// detection terminated. The token is shared by the containers of the detection, each target container reports once
+func (r *InstrumentedApplicationReconciler) handleEphemeralDetectionReport(w http.ResponseWriter, req *http.Request, report common.DetectionReport) {
+	logger := log.FromContext(req.Context()).WithName("detection-report")
+	var instrumentedApp v1.InstrumentedApplication
+	err := r.Get(req.Context(), client.ObjectKey{Namespace: report.Namespace, Name: report.InstrumentedApplication}, &instrumentedApp)
+	var record ephemeralDetection
+	if err == nil {
+		err = json.Unmarshal([]byte(instrumentedApp.Annotations[ephemeralDetectionAnnotation]), &record)
+	}
+	if err != nil || record.PodName != report.PodName || !validReportToken(record.TokenHash, req.Header.Get("Authorization")) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	targeted := false
+	for _, target := range record.Containers {
+		targeted = targeted || target == report.TargetContainer
+	}
+	if !targeted {
+		http.Error(w, "unknown target container", http.StatusBadRequest)
+		return
+	}
+	if instrumentedApp.Status.InstrumentationDetection.Phase != v1.RunningInstrumentationDetectionPhase {
+		http.Error(w, "detection is not running", http.StatusConflict)
+		return
+	}
+
+	stored := false
+	_, err = r.updateReplicaResultsConfigMap(req.Context(), &instrumentedApp, func(results map[string]common.DetectionResult) bool {
+		if _, exists := results[report.TargetContainer]; exists {
+			return false
+		}
+		results[report.TargetContainer] = report.Result
+		stored = true
+		return true
+	})
+	if err != nil {
+		logger.Error(err, "error storing ephemeral detection report", "pod", report.PodName, "container", report.TargetContainer)
+		http.Error(w, "could not store detection result", http.StatusInternalServerError)
+		return
+	}
+	if !stored {
+		http.Error(w, "the container already reported", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// revokeDetectionReportToken removes the token hash from the detection pod and deletes its token secret once its report
+// was accepted
+func (r *InstrumentedApplicationReconciler) revokeDetectionReportToken(ctx context.Context, detectionPod *corev1.Pod) error {
+	patch := client.MergeFrom(detectionPod.DeepCopy())
+	delete(detectionPod.Annotations, detectionReportTokenAnnotation)
+	if err := client.IgnoreNotFound(r.Patch(ctx, detectionPod, patch)); err != nil {
+		return err
+	}
+	for _, container := range detectionPod.Spec.Containers {
+		for _, envVar := range container.Env {
+			if envVar.Name != consts.DetectionReportTokenEnvVar || envVar.ValueFrom == nil || envVar.ValueFrom.SecretKeyRef == nil {
+				continue
+			}
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: detectionPod.Namespace, Name: envVar.ValueFrom.SecretKeyRef.Name}}
+			if err := client.IgnoreNotFound(r.Delete(ctx, secret)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createWithDetectionReportSecret creates the token secret before its detection pod, createPod creates the pod. The pod
+// owns the secret once it exists, so the secret is garbage collected with it
+func (r *InstrumentedApplicationReconciler) createWithDetectionReportSecret(ctx context.Context, secret *corev1.Secret, pod *corev1.Pod, createPod func() error) error {
+	logger := log.FromContext(ctx).WithName("detection-report")
+	if err := r.Create(ctx, secret); err != nil {
+		return err
+	}
+	if err := createPod(); err != nil {
+		if deleteErr := client.IgnoreNotFound(r.Delete(ctx, secret)); deleteErr != nil {
+			logger.Error(deleteErr, "error deleting the detection report secret", "secret", secret.Name)
+		}
+		return err
+	}
+
+	// the pod is running already, a secret without owner is still deleted once the report is accepted
+	patch := client.MergeFrom(secret.DeepCopy())
+	err := controllerutil.SetOwnerReference(pod, secret, r.Scheme)
+	if err == nil {
+		err = r.Patch(ctx, secret, patch)
+	}
+	if err != nil {
+		logger.Error(err, "error setting the owner of the detection report secret", "secret", secret.Name)
+	}
+	return nil
+}
+
+// newDetectionReportSecret returns the secret holding a new report token for a detection pod and the hash of the token
+// stored on the pod
+func newDetectionReportSecret(namespace string) (*corev1.Secret, string, error) {
+	token, tokenHash, err := newDetectionReportToken()
+	if err != nil {
+		return nil, "", err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      detectionReportSecretPrefix + utilrand.String(10),
+			Namespace: namespace,
+			Labels:    map[string]string{DetectionPodLabel: "true"},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{detectionReportSecretTokenKey: []byte(token)},
+	}
+	return secret, tokenHash, nil
+}
+
+// detectionReportTokenEnv passes the token of the secret to the detector
+func detectionReportTokenEnv(secret *corev1.Secret) corev1.EnvVar {
+	return corev1.EnvVar{Name: consts.DetectionReportTokenEnvVar, ValueFrom: &corev1.EnvVarSource{
+		SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: secret.Name},
+			Key:                  detectionReportSecretTokenKey,
+		},
+	}}
+}
+
+// newDetectionReportToken returns a random token for the detection pod and the hash stored on the pod
+func newDetectionReportToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(buf)
+	return token, hashDetectionReportToken(token), nil
+}
+
+func hashDetectionReportToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validDetectionReportToken(pod *corev1.Pod, authorization string) bool {
+	return validReportToken(pod.Annotations[detectionReportTokenAnnotation], authorization)
+}
+
+// validReportToken compares the bearer token of the authorization header with the expected token hash
+func validReportToken(expected string, authorization string) bool {
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if expected == "" || token == "" || token == authorization {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashDetectionReportToken(token)), []byte(expected)) == 1
+}
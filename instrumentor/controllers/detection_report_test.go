@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/rollouts"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// newTestReconciler returns a reconciler backed by a fake client holding the objects
+func newTestReconciler(t *testing.T, objects ...client.Object) *InstrumentedApplicationReconciler {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := rollouts.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&v1.InstrumentedApplication{}).
+		WithIndex(&corev1.Pod{}, detectionTargetKey, detectionTargetIndex).
+		WithInterceptorFuncs(interceptor.Funcs{
+			// the fake client only updates the status of pods through a subresource, the API server updates their
+			// ephemeral containers
+			SubResourceUpdate: func(ctx context.Context, c client.Client, subResource string, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+				if subResource == "ephemeralcontainers" {
+					return c.Update(ctx, obj)
+				}
+				return c.SubResource(subResource).Update(ctx, obj, opts...)
+			},
+		}).
+		Build()
+	return &InstrumentedApplicationReconciler{
+		Client:             c,
+		APIReader:          c,
+		Scheme:             scheme,
+		Workloads:          BuiltinWorkloads(),
+		DetectionPodConfig: DefaultDetectionPodConfig(),
+		detectionQueue:     newDetectionQueue(),
+	}
+}
+
+func runningInstrumentedApp(namespace string, name string) *v1.InstrumentedApplication {
+	app := &v1.InstrumentedApplication{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	app.Status.InstrumentationDetection.Phase = v1.RunningInstrumentationDetectionPhase
+	return app
+}
+
+func TestDetectionReportSecret(t *testing.T) {
+	app := runningInstrumentedApp("shop", "deployment-orders")
+	target := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "orders-7d9f", UID: "pod-1"},
+		Spec:       corev1.PodSpec{NodeName: "node-a", Containers: []corev1.Container{{Name: "app"}}},
+	}
+	r := newTestReconciler(t, app, target)
+	r.DetectionReportURL = "http://instrumentor.monitoring.svc:8082/detection-report"
+
+	ctx := context.Background()
+	if err := r.createDetectionBatch(ctx, []detectionTarget{{app: app, pod: target}}); err != nil {
+		t.Fatalf("createDetectionBatch() error: %s", err)
+	}
+
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.MatchingLabels{DetectionPodLabel: "true"}); err != nil || len(pods.Items) != 1 {
+		t.Fatalf("detection pods = %d (%v), want 1", len(pods.Items), err)
+	}
+	detectionPod := pods.Items[0]
+	var secretName string
+	for _, envVar := range detectionPod.Spec.Containers[0].Env {
+		if envVar.Name != consts.DetectionReportTokenEnvVar {
+			continue
+		}
+		if envVar.Value != "" || envVar.ValueFrom == nil || envVar.ValueFrom.SecretKeyRef == nil {
+			t.Fatalf("report token env = %+v, want a secret reference", envVar)
+		}
+		secretName = envVar.ValueFrom.SecretKeyRef.Name
+	}
+
+	var secret corev1.Secret
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "shop", Name: secretName}, &secret); err != nil {
+		t.Fatalf("report token secret %q: %s", secretName, err)
+	}
+	token := string(secret.Data[detectionReportSecretTokenKey])
+	if !validDetectionReportToken(&detectionPod, "Bearer "+token) {
+		t.Errorf("the secret token does not match the token hash of the detection pod")
+	}
+	if owners := secret.OwnerReferences; len(owners) != 1 || owners[0].Kind != "Pod" || owners[0].Name != detectionPod.Name {
+		t.Errorf("report token secret owners = %+v, want the detection pod", owners)
+	}
+
+	if err := r.revokeDetectionReportToken(ctx, &detectionPod); err != nil {
+		t.Fatalf("revokeDetectionReportToken() error: %s", err)
+	}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "shop", Name: secretName}, &secret); !apierrors.IsNotFound(err) {
+		t.Errorf("report token secret after the report = %v, want not found", err)
+	}
+	if validDetectionReportToken(&detectionPod, "Bearer "+token) {
+		t.Errorf("the token is still valid after the report")
+	}
+}
+
+func TestValidDetectionReportToken(t *testing.T) {
+	token, tokenHash, err := newDetectionReportToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		annotation    string
+		authorization string
+		want          bool
+	}{
+		{name: "valid token", annotation: tokenHash, authorization: "Bearer " + token, want: true},
+		{name: "other token", annotation: tokenHash, authorization: "Bearer " + strings.Repeat("0", len(token))},
+		{name: "token hash", annotation: tokenHash, authorization: "Bearer " + tokenHash},
+		{name: "token without scheme", annotation: tokenHash, authorization: token},
+		{name: "basic scheme", annotation: tokenHash, authorization: "Basic " + token},
+		{name: "empty bearer token", annotation: tokenHash, authorization: "Bearer "},
+		{name: "no authorization", annotation: tokenHash},
+		{name: "revoked token", authorization: "Bearer " + token},
+		{name: "empty token of a revoked pod", authorization: "Bearer "},
+	}
+	for _, test := range tests {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+		if test.annotation != "" {
+			pod.Annotations[detectionReportTokenAnnotation] = test.annotation
+		}
+		if got := validDetectionReportToken(pod, test.authorization); got != test.want {
+			t.Errorf("%s: validDetectionReportToken() = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHandleDetectionReport(t *testing.T) {
+	token, tokenHash, err := newDetectionReportToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, _ := json.Marshal(map[string]string{"pod-1": "shop/deployment-orders"})
+	detectionPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "shop",
+		Name:      "orders-instrumentation-detection-x1",
+		Annotations: map[string]string{
+			detectionReportTokenAnnotation: tokenHash,
+			detectionTargetsAnnotation:     string(targets),
+		},
+	}}
+	result := common.DetectionResult{LanguageByContainer: []common.LanguageByContainer{{ContainerName: "app", Language: common.PythonProgrammingLanguage}}}
+	report, _ := json.Marshal(common.DetectionReport{Namespace: "shop", PodName: detectionPod.Name, Result: result})
+	otherPod, _ := json.Marshal(common.DetectionReport{Namespace: "shop", PodName: "other", Result: result})
+	oversized := []byte(`{"namespace":"shop","podName":"` + strings.Repeat("a", maxDetectionReportSize) + `"}`)
+
+	type request struct {
+		method        string
+		body          []byte
+		authorization string
+		want          int
+	}
+	tests := []struct {
+		name        string
+		phase       v1.InstrumentationPhase
+		requests    []request
+		wantUpdated bool
+	}{
+		{
+			name:  "accepted report",
+			phase: v1.RunningInstrumentationDetectionPhase,
+			requests: []request{
+				{method: http.MethodPost, body: report, authorization: "Bearer " + token, want: http.StatusOK},
+			},
+			wantUpdated: true,
+		},
+		{
+			name:  "reused token",
+			phase: v1.RunningInstrumentationDetectionPhase,
+			requests: []request{
+				{method: http.MethodPost, body: report, authorization: "Bearer " + token, want: http.StatusOK},
+				{method: http.MethodPost, body: report, authorization: "Bearer " + token, want: http.StatusUnauthorized},
+			},
+			wantUpdated: true,
+		},
+		{
+			name:  "bad token",
+			phase: v1.RunningInstrumentationDetectionPhase,
+			requests: []request{
+				{method: http.MethodPost, body: report, authorization: "Bearer " + tokenHash, want: http.StatusUnauthorized},
+				{method: http.MethodPost, body: report, want: http.StatusUnauthorized},
+			},
+		},
+		{
+			name:  "token of another detection pod",
+			phase: v1.RunningInstrumentationDetectionPhase,
+			requests: []request{
+				{method: http.MethodPost, body: otherPod, authorization: "Bearer " + token, want: http.StatusUnauthorized},
+			},
+		},
+		{
+			name:  "malformed report",
+			phase: v1.RunningInstrumentationDetectionPhase,
+			requests: []request{
+				{method: http.MethodPost, body: []byte(`{"namespace":`), authorization: "Bearer " + token, want: http.StatusBadRequest},
+				{method: http.MethodGet, authorization: "Bearer " + token, want: http.StatusMethodNotAllowed},
+			},
+		},
+		{
+			name:  "oversized report",
+			phase: v1.RunningInstrumentationDetectionPhase,
+			requests: []request{
+				{method: http.MethodPost, body: oversized, authorization: "Bearer " + token, want: http.StatusBadRequest},
+			},
+		},
+		{
+			name:  "detection not running",
+			phase: v1.CompletedInstrumentationDetectionPhase,
+			requests: []request{
+				{method: http.MethodPost, body: report, authorization: "Bearer " + token, want: http.StatusConflict},
+			},
+		},
+	}
+	for _, test := range tests {
+		app := runningInstrumentedApp("shop", "deployment-orders")
+		app.Status.InstrumentationDetection.Phase = test.phase
+		r := newTestReconciler(t, app, detectionPod.DeepCopy())
+
+		for i, req := range test.requests {
+			httpReq := httptest.NewRequest(req.method, consts.DetectionReportPath, bytes.NewReader(req.body))
+			if req.authorization != "" {
+				httpReq.Header.Set("Authorization", req.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			r.handleDetectionReport(recorder, httpReq)
+			if recorder.Code != req.want {
+				t.Errorf("%s: request %d status = %d, want %d", test.name, i, recorder.Code, req.want)
+			}
+		}
+
+		var updated v1.InstrumentedApplication
+		if err = r.Get(context.Background(), client.ObjectKeyFromObject(app), &updated); err != nil {
+			t.Fatal(err)
+		}
+		detected := len(updated.Spec.Languages) == 1 && updated.Status.InstrumentationDetection.Phase == v1.CompletedInstrumentationDetectionPhase
+		if detected != test.wantUpdated {
+			t.Errorf("%s: languages = %+v, phase %s, want updated %t", test.name, updated.Spec.Languages, updated.Status.InstrumentationDetection.Phase, test.wantUpdated)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	PodDetectionStrategy       = "pod"
+	EphemeralDetectionStrategy = "ephemeral"
+	// DetectionStrategyAnnotation on a namespace overrides the cluster detection strategy for its workloads
+	DetectionStrategyAnnotation = "logz.io/detection-strategy"
+	// ephemeralDetectionAnnotation records the target pod and the ephemeral detection containers of a running detection
+	ephemeralDetectionAnnotation = "logz.io/ephemeral-detection"
+	ephemeralDetectorPrefix      = "instrumentation-detector-"
+	ephemeralDetectionRequeue    = 5 * time.Second
+)
+
+type ephemeralDetection struct {
+	PodName string `json:"podName"`
+	// Containers maps the ephemeral container names to the app containers they target
+	Containers map[string]string `json:"containers"`
+	// ReportSecret holds the report token of the ephemeral containers, TokenHash is its hash. The full results they
+	// report are kept by target container in the replica results ConfigMap until all of them terminated
+	ReportSecret string `json:"reportSecret,omitempty"`
+	TokenHash    string `json:"tokenHash,omitempty"`
+}
+
+// detectionStrategy returns the strategy of the namespace annotation, or the cluster strategy
+func (r *InstrumentedApplicationReconciler) detectionStrategy(ctx context.Context, namespace string) string {
+	var ns corev1.Namespace
+	if err := r.APIReader.Get(ctx, client.ObjectKey{Name: namespace}, &ns); err == nil {
+		strategy := ns.Annotations[DetectionStrategyAnnotation]
+		if strategy == PodDetectionStrategy || strategy == EphemeralDetectionStrategy {
+			return strategy
+		}
+	}
+	return r.DetectionStrategy
+}
+
+// attachEphemeralDetectors adds an ephemeral detection container to the target pod for every app container. Each one
+// shares the process namespace of its container, so no hostPID pod is needed. Ephemeral containers can not be removed,
+// the record is written first so that a retry adds the recorded containers instead of new ones
+func (r *InstrumentedApplicationReconciler) attachEphemeralDetectors(ctx context.Context, instrumentedApp *v1.InstrumentedApplication, targetPod *corev1.Pod) error {
+	record := ephemeralDetection{PodName: targetPod.Name, Containers: make(map[string]string)}
+	suffix := utilrand.String(5)
+	for i, container := range r.detectedContainers(&targetPod.Spec) {
+		record.Containers[fmt.Sprintf("%s%s-%d", ephemeralDetectorPrefix, suffix, i)] = container.Name
+	}
+
+	// results reported by the containers of a previous detection are not mixed in
+	if err := r.deleteReplicaResults(ctx, client.ObjectKeyFromObject(instrumentedApp)); err != nil {
+		return err
+	}
+	if r.DetectionReportURL != "" {
+		// the InstrumentedApplication owns the secret, the ephemeral containers outlive the detection
+		secret, tokenHash, err := newDetectionReportSecret(instrumentedApp.Namespace)
+		if err != nil {
+			return err
+		}
+		if err = controllerutil.SetOwnerReference(instrumentedApp, secret, r.Scheme); err != nil {
+			return err
+		}
+		if err = r.Create(ctx, secret); err != nil {
+			return err
+		}
+		record.ReportSecret, record.TokenHash = secret.Name, tokenHash
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if instrumentedApp.Annotations == nil {
+		instrumentedApp.Annotations = make(map[string]string)
+	}
+	instrumentedApp.Annotations[ephemeralDetectionAnnotation] = string(data)
+	if err = r.Update(ctx, instrumentedApp); err != nil {
+		return err
+	}
+	return r.addEphemeralDetectors(ctx, instrumentedApp, record, targetPod)
+}
+
+// addEphemeralDetectors adds the recorded ephemeral detection containers the target pod does not have yet
+func (r *InstrumentedApplicationReconciler) addEphemeralDetectors(ctx context.Context, instrumentedApp *v1.InstrumentedApplication, record ephemeralDetection, targetPod *corev1.Pod) error {
+	existing := make(map[string]bool)
+	for _, container := range targetPod.Spec.EphemeralContainers {
+		existing[container.Name] = true
+	}
+	containers := make(map[string]corev1.Container)
+	for _, container := range r.detectedContainers(&targetPod.Spec) {
+		containers[container.Name] = container
+	}
+
+	var names []string
+	for name := range record.Containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	added := false
+	for _, name := range names {
+		container, exists := containers[record.Containers[name]]
+		if existing[name] || !exists {
+			continue
+		}
+		targetPod.Spec.EphemeralContainers = append(targetPod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+			TargetContainerName: container.Name,
+			EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+				Name:                   name,
+				Image:                  fmt.Sprintf("%s:%s", r.InstrumentationDetectorImage, r.InstrumentationDetectorTag),
+				Args:                   r.ephemeralDetectorArgs(targetPod, record, container.Name),
+				Env:                    ephemeralDetectorEnv(instrumentedApp, record, targetPod),
+				TerminationMessagePath: "/dev/detection-result",
+				// the error of a failed detector, like a permission error, is the last line of its log
+				TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+				ImagePullPolicy:          r.DetectionPodConfig.ImagePullPolicy,
+				// the same privileges as the target container are enough to read its processes,
+				// and are admitted by the same pod security rules
+				SecurityContext: container.SecurityContext.DeepCopy(),
+			},
+		})
+		added = true
+	}
+	if !added {
+		return nil
+	}
+	return r.SubResource("ephemeralcontainers").Update(ctx, targetPod)
+}
+
+// ephemeralDetectorArgs are the detector arguments of an ephemeral container, the snapshot of a recorded detection is
+// printed to its log, which is kept with the pod
+func (r *InstrumentedApplicationReconciler) ephemeralDetectorArgs(targetPod *corev1.Pod, record ephemeralDetection, containerName string) []string {
+	args := []string{fmt.Sprintf("--target-container=%s", containerName)}
+	if recordsDetection(targetPod.Annotations) {
+		args = append(args, fmt.Sprintf("--record=%s", detectionRecordLog))
+	}
+	if r.DetectionReportURL != "" && record.ReportSecret != "" {
+		args = append(args, fmt.Sprintf("--report-url=%s", r.DetectionReportURL))
+	}
+	return args
+}
+
+// ephemeralDetectorEnv identifies the report of an ephemeral container by the InstrumentedApplication and the target
+// pod. The token secret is optional: a container added after the secret was deleted falls back to the termination
+// message
+func ephemeralDetectorEnv(instrumentedApp *v1.InstrumentedApplication, record ephemeralDetection, targetPod *corev1.Pod) []corev1.EnvVar {
+	if record.ReportSecret == "" {
+		return nil
+	}
+	token := detectionReportTokenEnv(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: record.ReportSecret}})
+	optional := true
+	token.ValueFrom.SecretKeyRef.Optional = &optional
+	return []corev1.EnvVar{
+		token,
+		{Name: consts.DetectionPodNameEnvVar, Value: targetPod.Name},
+		{Name: consts.DetectionPodNamespaceEnvVar, Value: targetPod.Namespace},
+		{Name: consts.DetectionTargetAppEnvVar, Value: instrumentedApp.Name},
+	}
+}
+
+// startEphemeralDetection attaches the ephemeral detection containers to a running pod of the workload. Errors are
+// retried with the ephemeral strategy, a detection pod is never created instead
+func (r *InstrumentedApplicationReconciler) startEphemeralDetection(ctx context.Context, instrumentedApp *v1.InstrumentedApplication) error {
+	pod, err := r.choosePod(ctx, instrumentedApp)
+	if err != nil {
+		return err
+	}
+	return r.attachEphemeralDetectors(ctx, instrumentedApp, pod)
+}
+
+// checkEphemeralDetection collects the results of the ephemeral detection containers once all of them terminated
+func (r *InstrumentedApplicationReconciler) checkEphemeralDetection(ctx context.Context, logger logr.Logger, instrumentedApp v1.InstrumentedApplication) (ctrl.Result, error) {
+	var record ephemeralDetection
+	err := json.Unmarshal([]byte(instrumentedApp.Annotations[ephemeralDetectionAnnotation]), &record)
+	if err != nil {
+		logger.Error(err, "error parsing ephemeral detection record")
+		return ctrl.Result{}, r.restartEphemeralDetection(ctx, instrumentedApp)
+	}
+
+	var pod corev1.Pod
+	err = r.Get(ctx, client.ObjectKey{Namespace: instrumentedApp.Namespace, Name: record.PodName}, &pod)
+	if apierrors.IsNotFound(err) {
+		logger.V(0).Info("ephemeral detection target pod was deleted, restarting detection", "pod", record.PodName)
+		return ctrl.Result{}, r.restartEphemeralDetection(ctx, instrumentedApp)
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// the containers were recorded but adding them to the pod failed
+	if err = r.addEphemeralDetectors(ctx, &instrumentedApp, record, &pod); err != nil {
+		logger.Error(err, "error adding ephemeral detection containers", "pod", record.PodName)
+		if isAdmissionError(err) {
+			return ctrl.Result{}, r.setDetectionError(ctx, client.ObjectKeyFromObject(&instrumentedApp), v1.DetectionRejectedReason, err.Error())
+		}
+		return ctrl.Result{}, err
+	}
+
+	statuses := make(map[string]corev1.ContainerStatus)
+	for _, status := range pod.Status.EphemeralContainerStatuses {
+		statuses[status.Name] = status
+	}
+
+	for name := range record.Containers {
+		if status, exists := statuses[name]; !exists || status.State.Terminated == nil {
+			return ctrl.Result{RequeueAfter: ephemeralDetectionRequeue}, nil
+		}
+	}
+	reported, err := r.ephemeralReports(ctx, &instrumentedApp, record)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var detectionResult common.DetectionResult
+	for name, target := range record.Containers {
+		status := statuses[name]
+		if status.State.Terminated.ExitCode != 0 {
+			err = fmt.Errorf("ephemeral detection container failed: %s", status.State.Terminated.Reason)
+			if message := lastLogLine(status.State.Terminated.Message); message != "" {
+				err = fmt.Errorf("%w: %s", err, message)
+			}
+			logger.Error(err, "detection failed", "container", name)
+			setDetectionPhase(&instrumentedApp, v1.ErrorInstrumentationDetectionPhase, v1.DetectionContainerFailedReason, err.Error())
+			return ctrl.Result{}, r.completeEphemeralDetection(ctx, &instrumentedApp, record)
+		}
+
+		// the reported result holds the dependencies left out of the compact termination message
+		if result, exists := reported[target]; exists {
+			detectionResult.LanguageByContainer = append(detectionResult.LanguageByContainer, result.LanguageByContainer...)
+			detectionResult.ApplicationByContainer = append(detectionResult.ApplicationByContainer, result.ApplicationByContainer...)
+			detectionResult.DependenciesByContainer = append(detectionResult.DependenciesByContainer, result.DependenciesByContainer...)
+			continue
+		}
+		var containerResult common.DetectionResult
+		if err = json.Unmarshal([]byte(status.State.Terminated.Message), &containerResult); err != nil {
+			logger.Error(err, "error parsing detection result", "container", name)
+			// the termination message does not change, parsing it again would fail again
+			setDetectionPhase(&instrumentedApp, v1.ErrorInstrumentationDetectionPhase, v1.DetectionContainerFailedReason,
+				fmt.Sprintf("invalid detection result of ephemeral container %s: %s", name, err))
+			return ctrl.Result{}, r.completeEphemeralDetection(ctx, &instrumentedApp, record)
+		}
+		detectionResult.LanguageByContainer = append(detectionResult.LanguageByContainer, containerResult.LanguageByContainer...)
+		detectionResult.ApplicationByContainer = append(detectionResult.ApplicationByContainer, containerResult.ApplicationByContainer...)
+	}
+
+	err = r.updateDetectionResult(ctx, detectionResult, logger, instrumentedApp, client.ObjectKeyFromObject(&instrumentedApp))
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	r.storeDetectionResult(ctx, logger, r.podImageDigests(&pod), detectionResult)
+	return ctrl.Result{}, r.deleteEphemeralReportSecret(ctx, instrumentedApp.Namespace, record)
+}
+
+// ephemeralReports returns the results the ephemeral containers reported by target container
+func (r *InstrumentedApplicationReconciler) ephemeralReports(ctx context.Context, instrumentedApp *v1.InstrumentedApplication, record ephemeralDetection) (map[string]common.DetectionResult, error) {
+	if record.ReportSecret == "" {
+		return nil, nil
+	}
+	return r.updateReplicaResultsConfigMap(ctx, instrumentedApp, func(map[string]common.DetectionResult) bool { return false })
+}
+
+// completeEphemeralDetection updates the status of a failed ephemeral detection and drops what its containers reported
+func (r *InstrumentedApplicationReconciler) completeEphemeralDetection(ctx context.Context, instrumentedApp *v1.InstrumentedApplication, record ephemeralDetection) error {
+	if err := updateStatus(ctx, r.Client, instrumentedApp); err != nil {
+		return err
+	}
+	if err := r.deleteReplicaResults(ctx, client.ObjectKeyFromObject(instrumentedApp)); err != nil {
+		return err
+	}
+	return r.deleteEphemeralReportSecret(ctx, instrumentedApp.Namespace, record)
+}
+
+func (r *InstrumentedApplicationReconciler) deleteEphemeralReportSecret(ctx context.Context, namespace string, record ephemeralDetection) error {
+	if record.ReportSecret == "" {
+		return nil
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: record.ReportSecret}}
+	return client.IgnoreNotFound(r.Delete(ctx, secret))
+}
+
+// lastLogLine returns the last line of a termination message taken from the container log
+func lastLogLine(message string) string {
+	lines := strings.Split(strings.TrimSpace(message), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// restartEphemeralDetection drops the ephemeral detection record and moves the app back to pending, so detection
+// starts again on another pod
+func (r *InstrumentedApplicationReconciler) restartEphemeralDetection(ctx context.Context, instrumentedApp v1.InstrumentedApplication) error {
+	var record ephemeralDetection
+	if json.Unmarshal([]byte(instrumentedApp.Annotations[ephemeralDetectionAnnotation]), &record) == nil {
+		if err := r.deleteEphemeralReportSecret(ctx, instrumentedApp.Namespace, record); err != nil {
+			return err
+		}
+	}
+	delete(instrumentedApp.Annotations, ephemeralDetectionAnnotation)
+	err := r.Update(ctx, &instrumentedApp)
+	if err != nil {
+		return err
+	}
+
+	setDetectionPhase(&instrumentedApp, v1.PendingInstrumentationDetectionPhase, v1.DetectionPendingReason, "the ephemeral detection pod is gone, the detection is restarted")
+	return updateStatus(ctx, r.Client, &instrumentedApp)
+}
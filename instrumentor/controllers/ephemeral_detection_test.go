@@ -0,0 +1,386 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func ephemeralTargetPod() *corev1.Pod {
+	runAsUser := int64(1000)
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "orders-7d9f", UID: "pod-1"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", SecurityContext: &corev1.SecurityContext{RunAsUser: &runAsUser}},
+			{Name: "worker"},
+			{Name: "istio-proxy"},
+		}},
+	}
+}
+
+func TestAttachEphemeralDetectors(t *testing.T) {
+	tests := []struct {
+		name       string
+		reportURL  string
+		wantSecret bool
+	}{
+		{name: "termination message only"},
+		{name: "detection report", reportURL: "http://instrumentor.monitoring.svc:8082/detection-report", wantSecret: true},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		app := runningInstrumentedApp("shop", "deployment-orders")
+		r := newTestReconciler(t, app, ephemeralTargetPod())
+		r.DetectionReportURL = test.reportURL
+
+		var pod corev1.Pod
+		if err := r.Get(ctx, client.ObjectKey{Namespace: "shop", Name: "orders-7d9f"}, &pod); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.attachEphemeralDetectors(ctx, app, &pod); err != nil {
+			t.Fatalf("%s: attachEphemeralDetectors() error: %s", test.name, err)
+		}
+
+		var record ephemeralDetection
+		if err := json.Unmarshal([]byte(app.Annotations[ephemeralDetectionAnnotation]), &record); err != nil {
+			t.Fatalf("%s: ephemeral detection record: %s", test.name, err)
+		}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(&pod), &pod); err != nil {
+			t.Fatal(err)
+		}
+		if len(pod.Spec.EphemeralContainers) != 2 || len(record.Containers) != 2 {
+			t.Fatalf("%s: ephemeral containers = %d, record %v, want the app and worker containers", test.name, len(pod.Spec.EphemeralContainers), record.Containers)
+		}
+		for _, container := range pod.Spec.EphemeralContainers {
+			if record.Containers[container.Name] != container.TargetContainerName {
+				t.Errorf("%s: ephemeral container %s targets %s, record %v", test.name, container.Name, container.TargetContainerName, record.Containers)
+			}
+			if container.TerminationMessagePolicy != corev1.TerminationMessageFallbackToLogsOnError {
+				t.Errorf("%s: termination message policy = %s, want the log on errors", test.name, container.TerminationMessagePolicy)
+			}
+			if container.TargetContainerName == "app" && (container.SecurityContext == nil || *container.SecurityContext.RunAsUser != 1000) {
+				t.Errorf("%s: security context = %+v, want the one of the app container", test.name, container.SecurityContext)
+			}
+			hasReportURL := strings.Contains(strings.Join(container.Args, " "), "--report-url="+test.reportURL)
+			env := make(map[string]corev1.EnvVar)
+			for _, envVar := range container.Env {
+				env[envVar.Name] = envVar
+			}
+			if !test.wantSecret {
+				if strings.Contains(strings.Join(container.Args, " "), "--report-url") || len(env) > 0 {
+					t.Errorf("%s: args %v, env %v, want no report", test.name, container.Args, env)
+				}
+				continue
+			}
+			token := env[consts.DetectionReportTokenEnvVar].ValueFrom
+			if !hasReportURL || token == nil || token.SecretKeyRef.Name != record.ReportSecret || !*token.SecretKeyRef.Optional ||
+				env[consts.DetectionPodNameEnvVar].Value != pod.Name || env[consts.DetectionTargetAppEnvVar].Value != app.Name {
+				t.Errorf("%s: args %v, env %v, want the report url and the token of secret %s", test.name, container.Args, env, record.ReportSecret)
+			}
+		}
+
+		var secret corev1.Secret
+		err := r.Get(ctx, client.ObjectKey{Namespace: "shop", Name: record.ReportSecret}, &secret)
+		if test.wantSecret {
+			if err != nil || !validReportToken(record.TokenHash, "Bearer "+string(secret.Data[detectionReportSecretTokenKey])) {
+				t.Errorf("%s: report secret %q = %v, want the token of the record", test.name, record.ReportSecret, err)
+			}
+			if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].Name != app.Name {
+				t.Errorf("%s: report secret owners = %+v, want the InstrumentedApplication", test.name, secret.OwnerReferences)
+			}
+		} else if record.ReportSecret != "" || record.TokenHash != "" {
+			t.Errorf("%s: record = %+v, want no report secret", test.name, record)
+		}
+
+		// a retry adds the recorded containers that are missing only
+		if err = r.addEphemeralDetectors(ctx, app, record, &pod); err != nil {
+			t.Fatalf("%s: addEphemeralDetectors() error: %s", test.name, err)
+		}
+		if err = r.Get(ctx, client.ObjectKeyFromObject(&pod), &pod); err != nil || len(pod.Spec.EphemeralContainers) != 2 {
+			t.Errorf("%s: ephemeral containers after a retry = %d, want 2", test.name, len(pod.Spec.EphemeralContainers))
+		}
+	}
+}
+
+func TestCheckEphemeralDetection(t *testing.T) {
+	pythonResult := `{"languageByContainer":[{"containerName":"app","language":"python"}]}`
+	javaResult := `{"languageByContainer":[{"containerName":"worker","language":"java"}]}`
+	reported := common.DetectionResult{
+		LanguageByContainer:     []common.LanguageByContainer{{ContainerName: "app", Language: common.PythonProgrammingLanguage}},
+		DependenciesByContainer: []common.DependenciesByContainer{{ContainerName: "app", Dependencies: []common.Dependency{{Name: "flask", Version: "2.3.0", Ecosystem: common.PyPIDependencyEcosystem}}}},
+	}
+	terminated := func(exitCode int32, message string) corev1.ContainerState {
+		return corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: exitCode, Reason: "Completed", Message: message}}
+	}
+	tests := []struct {
+		name         string
+		podDeleted   bool
+		states       map[string]corev1.ContainerState
+		reports      map[string]common.DetectionResult
+		wantRequeue  bool
+		wantPhase    v1.InstrumentationPhase
+		wantLangs    int
+		wantLibs     bool
+		wantMessage  string
+		wantCleanups bool
+	}{
+		{
+			name: "containers still running",
+			states: map[string]corev1.ContainerState{
+				"instrumentation-detector-abcde-0": terminated(0, pythonResult),
+				"instrumentation-detector-abcde-1": {Running: &corev1.ContainerStateRunning{}},
+			},
+			wantRequeue: true,
+			wantPhase:   v1.RunningInstrumentationDetectionPhase,
+		},
+		{
+			name: "termination messages",
+			states: map[string]corev1.ContainerState{
+				"instrumentation-detector-abcde-0": terminated(0, pythonResult),
+				"instrumentation-detector-abcde-1": terminated(0, javaResult),
+			},
+			wantPhase:    v1.CompletedInstrumentationDetectionPhase,
+			wantLangs:    2,
+			wantCleanups: true,
+		},
+		{
+			name: "reported result with its dependencies",
+			states: map[string]corev1.ContainerState{
+				"instrumentation-detector-abcde-0": terminated(0, pythonResult),
+				"instrumentation-detector-abcde-1": terminated(0, javaResult),
+			},
+			reports:      map[string]common.DetectionResult{"app": reported},
+			wantPhase:    v1.CompletedInstrumentationDetectionPhase,
+			wantLangs:    2,
+			wantLibs:     true,
+			wantCleanups: true,
+		},
+		{
+			name: "detector without permission",
+			states: map[string]corev1.ContainerState{
+				"instrumentation-detector-abcde-0": terminated(1, "2023/10/01 detection started\n2023/10/01 could not find processes, error: the detector running as uid 0 can not read the processes of container app\n"),
+				"instrumentation-detector-abcde-1": terminated(0, javaResult),
+			},
+			wantPhase:    v1.ErrorInstrumentationDetectionPhase,
+			wantMessage:  "can not read the processes of container app",
+			wantCleanups: true,
+		},
+		{
+			name: "invalid termination message",
+			states: map[string]corev1.ContainerState{
+				"instrumentation-detector-abcde-0": terminated(0, `{"languageByContainer":[`),
+				"instrumentation-detector-abcde-1": terminated(0, javaResult),
+			},
+			wantPhase:    v1.ErrorInstrumentationDetectionPhase,
+			wantMessage:  "invalid detection result of ephemeral container",
+			wantCleanups: true,
+		},
+		{
+			name:         "target pod deleted",
+			podDeleted:   true,
+			wantPhase:    v1.PendingInstrumentationDetectionPhase,
+			wantCleanups: true,
+		},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		record := ephemeralDetection{
+			PodName:      "orders-7d9f",
+			Containers:   map[string]string{"instrumentation-detector-abcde-0": "app", "instrumentation-detector-abcde-1": "worker"},
+			ReportSecret: "detection-report-abcde",
+		}
+		data, _ := json.Marshal(record)
+		app := runningInstrumentedApp("shop", "deployment-orders")
+		app.Annotations = map[string]string{ephemeralDetectionAnnotation: string(data)}
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: record.ReportSecret}}
+		objects := []client.Object{app, secret}
+		if !test.podDeleted {
+			pod := ephemeralTargetPod()
+			for name, target := range record.Containers {
+				pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+					TargetContainerName:      target,
+					EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: name},
+				})
+				pod.Status.EphemeralContainerStatuses = append(pod.Status.EphemeralContainerStatuses, corev1.ContainerStatus{Name: name, State: test.states[name]})
+			}
+			objects = append(objects, pod)
+		}
+		r := newTestReconciler(t, objects...)
+		if test.reports != nil {
+			_, err := r.updateReplicaResultsConfigMap(ctx, app, func(results map[string]common.DetectionResult) bool {
+				for target, result := range test.reports {
+					results[target] = result
+				}
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		result, err := r.checkEphemeralDetection(ctx, logr.Discard(), *app.DeepCopy())
+		if err != nil {
+			t.Fatalf("%s: checkEphemeralDetection() error: %s", test.name, err)
+		}
+		if (result.RequeueAfter > 0) != test.wantRequeue {
+			t.Errorf("%s: checkEphemeralDetection() = %+v, want requeue %t", test.name, result, test.wantRequeue)
+		}
+
+		var updated v1.InstrumentedApplication
+		if err = r.Get(ctx, client.ObjectKeyFromObject(app), &updated); err != nil {
+			t.Fatal(err)
+		}
+		if phase := updated.Status.InstrumentationDetection.Phase; phase != test.wantPhase {
+			t.Errorf("%s: detection phase = %s, want %s", test.name, phase, test.wantPhase)
+		}
+		if len(updated.Spec.Languages) != test.wantLangs {
+			t.Errorf("%s: languages = %+v, want %d", test.name, updated.Spec.Languages, test.wantLangs)
+		}
+		if (len(updated.Status.LibraryCompatibility) > 0) != test.wantLibs {
+			t.Errorf("%s: library compatibility = %+v, want reported dependencies %t", test.name, updated.Status.LibraryCompatibility, test.wantLibs)
+		}
+		if test.wantMessage != "" {
+			condition := meta.FindStatusCondition(updated.Status.Conditions, v1.DetectionSucceededCondition)
+			if condition == nil || !strings.Contains(condition.Message, test.wantMessage) || strings.Contains(condition.Message, "detection started") {
+				t.Errorf("%s: detection condition = %+v, want message %q", test.name, condition, test.wantMessage)
+			}
+		}
+
+		secretErr := r.Get(ctx, client.ObjectKeyFromObject(secret), &corev1.Secret{})
+		resultsErr := r.Get(ctx, replicaResultsKey(client.ObjectKeyFromObject(app)), &corev1.ConfigMap{})
+		cleaned := apierrors.IsNotFound(secretErr) && (test.reports == nil || apierrors.IsNotFound(resultsErr))
+		if cleaned != test.wantCleanups {
+			t.Errorf("%s: report secret %v, reported results %v, want deleted %t", test.name, secretErr, resultsErr, test.wantCleanups)
+		}
+	}
+}
+
+func TestHandleEphemeralDetectionReport(t *testing.T) {
+	token, tokenHash, err := newDetectionReportToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, _ := json.Marshal(ephemeralDetection{
+		PodName:      "orders-7d9f",
+		Containers:   map[string]string{"instrumentation-detector-abcde-0": "app"},
+		ReportSecret: "detection-report-abcde",
+		TokenHash:    tokenHash,
+	})
+	result := common.DetectionResult{LanguageByContainer: []common.LanguageByContainer{{ContainerName: "app", Language: common.PythonProgrammingLanguage}}}
+	report := func(podName string, app string, container string) []byte {
+		data, _ := json.Marshal(common.DetectionReport{Namespace: "shop", PodName: podName, InstrumentedApplication: app, TargetContainer: container, Result: result})
+		return data
+	}
+	valid := report("orders-7d9f", "deployment-orders", "app")
+
+	type request struct {
+		body          []byte
+		authorization string
+		want          int
+	}
+	tests := []struct {
+		name       string
+		phase      v1.InstrumentationPhase
+		requests   []request
+		wantStored bool
+	}{
+		{
+			name:       "accepted report",
+			phase:      v1.RunningInstrumentationDetectionPhase,
+			requests:   []request{{body: valid, authorization: "Bearer " + token, want: http.StatusOK}},
+			wantStored: true,
+		},
+		{
+			name:  "second report of the container",
+			phase: v1.RunningInstrumentationDetectionPhase,
+			requests: []request{
+				{body: valid, authorization: "Bearer " + token, want: http.StatusOK},
+				{body: valid, authorization: "Bearer " + token, want: http.StatusConflict},
+			},
+			wantStored: true,
+		},
+		{
+			name:     "bad token",
+			phase:    v1.RunningInstrumentationDetectionPhase,
+			requests: []request{{body: valid, authorization: "Bearer " + tokenHash, want: http.StatusUnauthorized}},
+		},
+		{
+			name:     "other pod",
+			phase:    v1.RunningInstrumentationDetectionPhase,
+			requests: []request{{body: report("orders-1a2b", "deployment-orders", "app"), authorization: "Bearer " + token, want: http.StatusUnauthorized}},
+		},
+		{
+			name:     "other InstrumentedApplication",
+			phase:    v1.RunningInstrumentationDetectionPhase,
+			requests: []request{{body: report("orders-7d9f", "deployment-payments", "app"), authorization: "Bearer " + token, want: http.StatusUnauthorized}},
+		},
+		{
+			name:     "container not detected",
+			phase:    v1.RunningInstrumentationDetectionPhase,
+			requests: []request{{body: report("orders-7d9f", "deployment-orders", "istio-proxy"), authorization: "Bearer " + token, want: http.StatusBadRequest}},
+		},
+		{
+			name:     "detection not running",
+			phase:    v1.CompletedInstrumentationDetectionPhase,
+			requests: []request{{body: valid, authorization: "Bearer " + token, want: http.StatusConflict}},
+		},
+	}
+	for _, test := range tests {
+		app := runningInstrumentedApp("shop", "deployment-orders")
+		app.Status.InstrumentationDetection.Phase = test.phase
+		app.Annotations = map[string]string{ephemeralDetectionAnnotation: string(record)}
+		r := newTestReconciler(t, app)
+
+		for i, req := range test.requests {
+			httpReq := httptest.NewRequest(http.MethodPost, consts.DetectionReportPath, bytes.NewReader(req.body))
+			httpReq.Header.Set("Authorization", req.authorization)
+			recorder := httptest.NewRecorder()
+			r.handleDetectionReport(recorder, httpReq)
+			if recorder.Code != req.want {
+				t.Errorf("%s: request %d status = %d, want %d", test.name, i, recorder.Code, req.want)
+			}
+		}
+
+		results, err := r.ephemeralReports(context.Background(), app, ephemeralDetection{ReportSecret: "detection-report-abcde"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, stored := results["app"]; stored != test.wantStored {
+			t.Errorf("%s: reported results = %v, want stored %t", test.name, results, test.wantStored)
+		}
+	}
+}
+
+func TestDetectionStrategy(t *testing.T) {
+	tests := []struct {
+		annotation string
+		want       string
+	}{
+		{annotation: "", want: PodDetectionStrategy},
+		{annotation: EphemeralDetectionStrategy, want: EphemeralDetectionStrategy},
+		{annotation: PodDetectionStrategy, want: PodDetectionStrategy},
+		{annotation: "sidecar", want: PodDetectionStrategy},
+	}
+	for _, test := range tests {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop", Annotations: map[string]string{DetectionStrategyAnnotation: test.annotation}}}
+		r := newTestReconciler(t, ns)
+		r.DetectionStrategy = PodDetectionStrategy
+		if got := r.detectionStrategy(context.Background(), "shop"); got != test.want {
+			t.Errorf("detectionStrategy() with annotation %q = %s, want %s", test.annotation, got, test.want)
+		}
+	}
+}
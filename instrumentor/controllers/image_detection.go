@@ -0,0 +1,315 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/detectors/detection"
+	"github.com/logzio/kubernetes-instrumentor/detectors/image"
+	"github.com/logzio/kubernetes-instrumentor/detectors/process"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/registry"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	ProcessDetectionBackend           = "process"
+	ImageDetectionBackend             = "image"
+	ImageWithFallbackDetectionBackend = "image-fallback"
+	imageDetectionTimeout             = 10 * time.Minute
+	// imageDetectionConcurrency is the number of images pulled and unpacked at the same time
+	imageDetectionConcurrency = 2
+	// imageDetectionRetries is the number of times an image detection failing with a transient registry error is
+	// retried, imageDetectionRetryDelay doubles with every retry
+	imageDetectionRetries        = 5
+	imageDetectionRetryDelay     = 30 * time.Second
+	backgroundDetectionQueueSize = 1024
+	defaultServiceAccountName    = "default"
+	defaultPlatformOS            = "linux"
+	defaultPlatformArchitecture  = "amd64"
+)
+
+// backgroundDetections are the detections queued or running outside of Reconcile, image detections since pulling an
+// image takes minutes and detection agent calls since they wait for the agent to scan /proc
+type backgroundDetections struct {
+	mu       sync.Mutex
+	pending  map[types.NamespacedName]bool
+	requests chan types.NamespacedName
+}
+
+func newBackgroundDetections() *backgroundDetections {
+	return &backgroundDetections{
+		pending:  make(map[types.NamespacedName]bool),
+		requests: make(chan types.NamespacedName, backgroundDetectionQueueSize),
+	}
+}
+
+// add queues the detection of the InstrumentedApplication, it returns false when the queue is full
+func (d *backgroundDetections) add(key types.NamespacedName) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending[key] {
+		return true
+	}
+	select {
+	case d.requests <- key:
+		d.pending[key] = true
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *backgroundDetections) contains(key types.NamespacedName) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pending[key]
+}
+
+func (d *backgroundDetections) done(key types.NamespacedName) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, key)
+}
+
+// startImageDetection queues the image detection of the InstrumentedApplication, a full queue is retried later
+func (r *InstrumentedApplicationReconciler) startImageDetection(key types.NamespacedName) ctrl.Result {
+	if r.imageDetections.add(key) {
+		return ctrl.Result{}
+	}
+	return ctrl.Result{RequeueAfter: detectionRetryDelay}
+}
+
+// runImageDetections runs the queued image detections, imageDetectionConcurrency at a time, until the manager stops.
+// It only runs on the leader
+func (r *InstrumentedApplicationReconciler) runImageDetections(ctx context.Context) error {
+	return runBackgroundDetections(ctx, r.imageDetections, imageDetectionConcurrency, r.detectImages)
+}
+
+// runBackgroundDetections runs the queued detections, concurrency at a time, until the manager stops
+func runBackgroundDetections(ctx context.Context, detections *backgroundDetections, concurrency int, detect func(context.Context, types.NamespacedName)) error {
+	running := make(chan struct{}, concurrency)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case key := <-detections.requests:
+			select {
+			case <-ctx.Done():
+				return nil
+			case running <- struct{}{}:
+			}
+			go func() {
+				defer func() { <-running }()
+				detect(ctx, key)
+			}()
+		}
+	}
+}
+
+// detectImages completes the detection of the InstrumentedApplication from its images. Transient registry errors are
+// retried, the image-fallback backend falls back to process detection when no language is detected
+func (r *InstrumentedApplicationReconciler) detectImages(ctx context.Context, key types.NamespacedName) {
+	defer r.imageDetections.done(key)
+	logger := log.FromContext(ctx).WithName("image-detection").WithValues("instrumentedApplication", key)
+	delay := imageDetectionRetryDelay
+	for attempt := 0; ; attempt++ {
+		var instrumentedApp v1.InstrumentedApplication
+		if err := r.Get(ctx, key, &instrumentedApp); err != nil ||
+			instrumentedApp.Status.InstrumentationDetection.Phase != v1.RunningInstrumentationDetectionPhase {
+			return
+		}
+
+		backend := r.detectionBackend(&instrumentedApp)
+		detectionResult, err := r.detectFromImage(ctx, logger, &instrumentedApp)
+		if err == nil && (backend == ImageDetectionBackend || len(detectionResult.LanguageByContainer) > 0) {
+			if err = r.updateDetectionResult(ctx, *detectionResult, logger, instrumentedApp, key); err != nil {
+				logger.Error(err, "error updating detection result")
+			}
+			return
+		}
+
+		if backend != ImageDetectionBackend {
+			logger.V(0).Info("image detection did not detect a language, falling back to process detection", "error", err)
+			if err = r.detectLanguage(ctx, &instrumentedApp); err != nil {
+				logger.Error(err, "error detecting language")
+				if isAdmissionError(err) {
+					_ = r.setDetectionError(ctx, key, v1.DetectionRejectedReason, err.Error())
+				}
+			}
+			return
+		}
+
+		if err != nil && !registry.IsPermanent(err) && attempt < imageDetectionRetries {
+			logger.V(0).Info("could not detect the images, retrying", "error", err.Error(), "delay", delay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			continue
+		}
+
+		logger.Error(err, "error detecting language from image")
+		message := "no language was detected from the images"
+		if err != nil {
+			message = err.Error()
+		}
+		if err = r.setDetectionError(ctx, key, v1.ImageDetectionFailedReason, message); err != nil {
+			logger.Error(err, "error updating detection status")
+		}
+		return
+	}
+}
+
+// detectFromImage runs the detectors against the images of the owner pod template, pulled through the registry API
+// with the image pull secrets of the workload. No detection pod is created
+func (r *InstrumentedApplicationReconciler) detectFromImage(ctx context.Context, logger logr.Logger, instrumentedApp *v1.InstrumentedApplication) (*common.DetectionResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, imageDetectionTimeout)
+	defer cancel()
+
+	podTemplate, err := r.getOwnerPodTemplate(ctx, instrumentedApp)
+	if err != nil {
+		return nil, err
+	}
+
+	keychain, err := r.imagePullKeychain(ctx, instrumentedApp.Namespace, &podTemplate.Spec)
+	if err != nil {
+		return nil, err
+	}
+	registryClient := registry.NewClient(keychain, r.InsecureRegistries)
+
+	// a running pod pins the image digests and the platform of the node it runs on
+	platform := registry.Platform{OS: defaultPlatformOS, Architecture: defaultPlatformArchitecture}
+	imageIDs := make(map[string]string)
+	var digests map[string]string
+	if pod, err := r.choosePod(ctx, instrumentedApp); err == nil {
+		for _, status := range append(pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses...) {
+			imageIDs[status.Name] = status.ImageID
+		}
+		platform = r.nodePlatform(ctx, pod.Spec.NodeName, platform)
+		digests = r.podImageDigests(pod)
+	}
+
+	var result common.DetectionResult
+	for _, container := range r.detectedContainers(&podTemplate.Spec) {
+		err = r.detectContainerImage(ctx, registryClient, container, imageIDs[container.Name], platform, &result)
+		if err != nil {
+			return nil, fmt.Errorf("could not detect container %s from image %s: %w", container.Name, container.Image, err)
+		}
+		logger.V(0).Info("detected container from image", "container", container.Name, "image", container.Image)
+	}
+
+	r.storeDetectionResult(ctx, logger, digests, result)
+	return &result, nil
+}
+
+func (r *InstrumentedApplicationReconciler) detectContainerImage(ctx context.Context, registryClient *registry.Client, container corev1.Container,
+	imageID string, platform registry.Platform, result *common.DetectionResult) error {
+	ref, err := registry.ParseReference(container.Image)
+	if err != nil {
+		return err
+	}
+	ref = ref.WithDigest(imageID)
+
+	rootfs, err := os.MkdirTemp("", "image-detection-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(rootfs)
+
+	config, err := registryClient.Pull(ctx, ref, platform, rootfs)
+	if err != nil {
+		return err
+	}
+
+	cmd, env, workingDir := containerCommand(container, config)
+	details, err := process.FromRootFS(rootfs, cmd, env, workingDir)
+	if err != nil {
+		return err
+	}
+
+	detection.DetectContainer(container.Name, []process.Details{details}, result)
+	return nil
+}
+
+// containerCommand applies the container spec on top of the image config the way the kubelet does:
+// command replaces the entrypoint, args replace the image cmd and env values override the image env
+func containerCommand(container corev1.Container, config *image.Config) ([]string, map[string]string, string) {
+	var cmd []string
+	if len(container.Command) > 0 {
+		cmd = append(append(cmd, container.Command...), container.Args...)
+	} else if len(container.Args) > 0 {
+		cmd = append(append(cmd, config.Entrypoint...), container.Args...)
+	} else {
+		cmd = config.Command()
+	}
+
+	env := process.ParseEnv(config.Env)
+	for _, envVar := range container.Env {
+		// values from secrets, config maps and the downward API are only known at runtime
+		if envVar.ValueFrom == nil {
+			env[envVar.Name] = envVar.Value
+		}
+	}
+
+	workingDir := config.WorkingDir
+	if container.WorkingDir != "" {
+		workingDir = container.WorkingDir
+	}
+	return cmd, env, workingDir
+}
+
+// imagePullKeychain collects the credentials of the pod image pull secrets and of its service account
+func (r *InstrumentedApplicationReconciler) imagePullKeychain(ctx context.Context, namespace string, podSpec *corev1.PodSpec) (registry.Keychain, error) {
+	secretRefs := append([]corev1.LocalObjectReference{}, podSpec.ImagePullSecrets...)
+
+	serviceAccountName := podSpec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = defaultServiceAccountName
+	}
+	var serviceAccount corev1.ServiceAccount
+	err := r.APIReader.Get(ctx, client.ObjectKey{Namespace: namespace, Name: serviceAccountName}, &serviceAccount)
+	if client.IgnoreNotFound(err) != nil {
+		return nil, err
+	}
+	secretRefs = append(secretRefs, serviceAccount.ImagePullSecrets...)
+
+	keychain := registry.Keychain{}
+	for _, ref := range secretRefs {
+		var secret corev1.Secret
+		err = r.APIReader.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, &secret)
+		if err != nil {
+			// the kubelet ignores missing pull secrets as well
+			continue
+		}
+		switch secret.Type {
+		case corev1.SecretTypeDockerConfigJson:
+			err = keychain.AddDockerConfigJSON(secret.Data[corev1.DockerConfigJsonKey])
+		case corev1.SecretTypeDockercfg:
+			err = keychain.AddDockerCfg(secret.Data[corev1.DockerConfigKey])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read image pull secret %s: %w", ref.Name, err)
+		}
+	}
+	return keychain, nil
+}
+
+func (r *InstrumentedApplicationReconciler) nodePlatform(ctx context.Context, nodeName string, fallback registry.Platform) registry.Platform {
+	var node corev1.Node
+	if nodeName == "" || r.APIReader.Get(ctx, client.ObjectKey{Name: nodeName}, &node) != nil {
+		return fallback
+	}
+	return registry.Platform{OS: node.Status.NodeInfo.OperatingSystem, Architecture: node.Status.NodeInfo.Architecture}
+}
@@ -24,12 +24,16 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
-	v1 "github.com/logzio/kubernetes-instrumentor/api/v1alpha1"
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
 	"github.com/logzio/kubernetes-instrumentor/common"
 	"github.com/logzio/kubernetes-instrumentor/common/consts"
-	appsv1 "k8s.io/api/apps/v1"
+	"github.com/logzio/kubernetes-instrumentor/common/utils"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/compatibility"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/patch"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/vulnerability"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -38,12 +42,14 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
 var (
-	podOwnerKey = ".metadata.controller"
-	apiGVStr    = v1.GroupVersion.String()
+	apiGVStr = v1.GroupVersion.String()
 )
 
 const (
@@ -60,6 +66,53 @@ type InstrumentedApplicationReconciler struct {
 	InstrumentationDetectorTag        string
 	InstrumentationDetectorImage      string
 	DeleteInstrumentationDetectorPods bool
+	// DetectionBackend selects process based detection (detection pods), image based detection or image based
+	// detection with a fallback to detection pods
+	DetectionBackend string
+	// InsecureRegistries are accessed without TLS verification, or over plain HTTP, by the image detection backend
+	InsecureRegistries []string
+	// DetectionCacheTTL is how long detection results are reused for pods running the same image digests, 0 disables the cache
+	DetectionCacheTTL time.Duration
+	// APIReader reads secrets, service accounts and nodes without caching them in the manager
+	APIReader client.Reader
+	// DetectionReportURL is the instrumentor endpoint detection pods post their result to, empty keeps the
+	// termination message as the only channel
+	DetectionReportURL string
+	// DetectionAgent sends detection requests to the detection agent DaemonSet pod on the node of the target pod,
+	// detection pods are only created when no agent is available
+	DetectionAgent      bool
+	DetectionAgentPort  int
+	DetectionAgentToken string
+	// DetectionStrategy selects detection pods or ephemeral detection containers for process detection, namespaces
+	// can override it with the DetectionStrategyAnnotation
+	DetectionStrategy string
+	// MaxConcurrentDetections and MaxNodeDetections limit the detection pods running in the cluster and on a node,
+	// 0 is unlimited. DetectionBatchSize is the number of pods of the same node and namespace one detection pod detects
+	MaxConcurrentDetections int
+	MaxNodeDetections       int
+	DetectionBatchSize      int
+	detectionQueue          *detectionQueue
+	imageDetections         *backgroundDetections
+	agentDetections         *backgroundDetections
+	// DetectionPodsInOperatorNamespace creates detection pods in the instrumentor namespace instead of the workload
+	// namespace, for workload namespaces whose pod security level rejects hostPID pods
+	DetectionPodsInOperatorNamespace bool
+	// DetectionPodConfig sets the resources, scheduling and image pull settings of detection pods
+	DetectionPodConfig DetectionPodConfig
+	// DetectNativeSidecars detects the native sidecars of workloads, init containers with restartPolicy Always, next
+	// to their app containers
+	DetectNativeSidecars bool
+	// DetectionReplicas is the number of replicas of the current workload revision detected, their results are merged
+	// and the containers they disagree on are flagged on the InstrumentedApplication
+	DetectionReplicas int
+	// ExportSBOM writes the dependencies detected in the workload as a CycloneDX SBOM ConfigMap next to the
+	// InstrumentedApplication
+	ExportSBOM bool
+	// VulnerabilityDatabase is the offline OSV database the detected libraries are matched against, nil disables the
+	// vulnerability scan
+	VulnerabilityDatabase *vulnerability.Database
+	// Workloads are the workload kinds InstrumentedApplications are owned by
+	Workloads Workloads
 }
 
 // Reconcile is responsible for language detection. The function starts the lang detection process-app if the InstrumentedApplication
@@ -70,12 +123,16 @@ func (r *InstrumentedApplicationReconciler) Reconcile(ctx context.Context, req c
 	err := r.Get(ctx, req.NamespacedName, &instrumentedApp)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
-			return ctrl.Result{}, nil
+			r.detectionQueue.done(req.NamespacedName)
+			deleteVulnerabilitiesMetric(req.NamespacedName)
+			return ctrl.Result{}, r.deleteOrphanedDetectionPods(ctx, logger, req.NamespacedName)
 		}
 
 		logger.Error(err, "error fetching instrumented application object")
 		return ctrl.Result{}, err
 	}
+	// the gauges are published by the leader only, from the status written by any replica
+	setVulnerabilitiesMetric(req.NamespacedName, vulnerability.Counts(instrumentedApp.Status.Vulnerabilities))
 
 	// If language and app were already detected - there is nothing to do
 	if r.isLangDetected(&instrumentedApp) && r.isAppDetected(&instrumentedApp) {
@@ -88,20 +145,42 @@ func (r *InstrumentedApplicationReconciler) Reconcile(ctx context.Context, req c
 
 	// Language/app detection is in progress, check if lang detection pods finished
 	if instrumentedApp.Status.InstrumentationDetection.Phase == v1.RunningInstrumentationDetectionPhase {
-		var childPods corev1.PodList
-		err = r.List(ctx, &childPods, client.InNamespace(req.Namespace), client.MatchingFields{podOwnerKey: req.Name})
+		if _, exists := instrumentedApp.Annotations[ephemeralDetectionAnnotation]; exists {
+			return r.checkEphemeralDetection(ctx, logger, instrumentedApp)
+		}
+		if isBatchOwner(&instrumentedApp) && r.detectionQueue.isPending(req.NamespacedName) {
+			return ctrl.Result{}, r.detectBatchRun(ctx, logger, &instrumentedApp)
+		}
+
+		childPods, err := r.detectionPods(ctx, req.NamespacedName)
 		if err != nil {
 			logger.Error(err, "could not find child pods")
 			return ctrl.Result{}, err
 		}
 
-		for _, pod := range childPods.Items {
+		// the queues are kept in memory, detections queued before a restart are queued again
+		if len(childPods) == 0 && !r.detectionQueue.contains(req.NamespacedName) {
+			if r.imageDetections.contains(req.NamespacedName) || r.agentDetections.contains(req.NamespacedName) {
+				return ctrl.Result{}, nil
+			}
+			if r.detectsImages(&instrumentedApp) {
+				return r.startImageDetection(req.NamespacedName), nil
+			}
+			// ephemeral containers failed to be attached, they are retried rather than replaced by a detection pod
+			if r.detectionStrategy(ctx, instrumentedApp.Namespace) == EphemeralDetectionStrategy {
+				return r.detectionErrorResult(ctx, logger, &instrumentedApp, r.startEphemeralDetection(ctx, &instrumentedApp))
+			}
+			r.enqueueDetection(ctx, &instrumentedApp)
+			return ctrl.Result{}, nil
+		}
+
+		for _, pod := range childPods {
 			if pod.Status.Phase == corev1.PodSucceeded && len(pod.Status.ContainerStatuses) > 0 {
 				containerStatus := pod.Status.ContainerStatuses[0]
 				if containerStatus.State.Terminated == nil {
 					continue
 				}
-				err = r.updatePodWithDetectionResult(ctx, containerStatus, logger, instrumentedApp, req.NamespacedName)
+				err = r.updatePodWithDetectionResult(ctx, &pod, containerStatus, logger, instrumentedApp, req.NamespacedName)
 				if err != nil {
 					if apierrors.IsConflict(err) {
 						logger.V(0).Info("Conflict encountered and ignored during instrumentedApp update")
@@ -120,7 +199,19 @@ func (r *InstrumentedApplicationReconciler) Reconcile(ctx context.Context, req c
 						failureReason = terminatedState.Reason
 					}
 				}
+				// the kubelet rejected the pod, for example for lack of resources on the node
+				if len(pod.Status.ContainerStatuses) == 0 && pod.Status.Reason != "" {
+					failureReason = pod.Status.Reason
+					logger.Error(fmt.Errorf("detection pod was not admitted: %s", pod.Status.Message), failureReason)
+					return ctrl.Result{}, r.setDetectionError(ctx, req.NamespacedName, v1.DetectionPodFailedReason,
+						fmt.Sprintf("the detection pod was not admitted: %s: %s", failureReason, pod.Status.Message))
+				}
 				logger.Error(fmt.Errorf("detection pod failed: %s", failureReason), failureReason)
+				for _, podUID := range detectionPodTargets(&pod).podUIDs(req.NamespacedName) {
+					if err = r.discardDetectionReplica(ctx, logger, req.NamespacedName, podUID); err != nil {
+						return ctrl.Result{}, client.IgnoreNotFound(err)
+					}
+				}
 				return ctrl.Result{}, nil
 			}
 		}
@@ -129,17 +220,23 @@ func (r *InstrumentedApplicationReconciler) Reconcile(ctx context.Context, req c
 	// Clean up finished pods
 	if instrumentedApp.Status.InstrumentationDetection.Phase == v1.CompletedInstrumentationDetectionPhase ||
 		instrumentedApp.Status.InstrumentationDetection.Phase == v1.ErrorInstrumentationDetectionPhase {
-		var childPods corev1.PodList
-		err = r.List(ctx, &childPods, client.InNamespace(req.Namespace), client.MatchingFields{podOwnerKey: req.Name})
+		childPods, err := r.detectionPods(ctx, req.NamespacedName)
 		if err != nil {
 			logger.Error(err, "could not find child pods")
 			return ctrl.Result{}, err
 		}
-		for _, pod := range childPods.Items {
+		for _, pod := range childPods {
 			if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
 				if !r.DeleteInstrumentationDetectorPods {
 					return ctrl.Result{}, nil
 				}
+				if recordsDetection(pod.Annotations) {
+					continue
+				}
+				// a batched detection pod is kept until every app it detects read its result
+				if r.detectionPodInUse(ctx, &pod) {
+					continue
+				}
 
 				err = r.Client.Delete(ctx, &pod)
 				if client.IgnoreNotFound(err) != nil {
@@ -153,59 +250,142 @@ func (r *InstrumentedApplicationReconciler) Reconcile(ctx context.Context, req c
 	return ctrl.Result{}, nil
 }
 
-func (r *InstrumentedApplicationReconciler) updatePodWithDetectionResult(ctx context.Context, containerStatus corev1.ContainerStatus, logger logr.Logger, instrumentedApp v1.InstrumentedApplication, namespacedName types.NamespacedName) error {
-	// Read detection result
+func (r *InstrumentedApplicationReconciler) updatePodWithDetectionResult(ctx context.Context, detectionPod *corev1.Pod, containerStatus corev1.ContainerStatus, logger logr.Logger, instrumentedApp v1.InstrumentedApplication, namespacedName types.NamespacedName) error {
+	targets := detectionPodTargets(detectionPod)
+	podUIDs := targets.podUIDs(namespacedName)
+	if len(podUIDs) == 0 {
+		return fmt.Errorf("detection pod %s does not detect %s", detectionPod.Name, namespacedName.Name)
+	}
+
+	// Read detection result, batched detection pods write a result for every target pod
 	result := containerStatus.State.Terminated.Message
-	var detectionResult common.DetectionResult
-	err := json.Unmarshal([]byte(result), &detectionResult)
+	detectionResults := make(map[string]common.DetectionResult)
+	var err error
+	if len(targets) > 1 {
+		var podResults []common.PodDetectionResult
+		err = json.Unmarshal([]byte(result), &podResults)
+		for _, podResult := range podResults {
+			detectionResults[podResult.PodUID] = podResult.Result
+		}
+	} else {
+		var detectionResult common.DetectionResult
+		err = json.Unmarshal([]byte(result), &detectionResult)
+		detectionResults[podUIDs[0]] = detectionResult
+	}
 	if err != nil {
 		logger.Error(err, "error parsing detection result")
 		return err
-	} else {
-		err = r.Get(ctx, namespacedName, &instrumentedApp)
-		if err != nil {
-			logger.Error(err, "error fetching instrumented application object")
-			return err
-		}
-		logger.V(0).Info("detection result", "result", detectionResult)
-		instrumentedApp.Spec.Languages = detectionResult.LanguageByContainer
-		instrumentedApp.Spec.Applications = detectionResult.ApplicationByContainer
-		err = r.Update(ctx, &instrumentedApp)
+	}
+
+	// replicas of the same workload on the same node are detected by the same detection pod
+	for _, podUID := range podUIDs {
+		err = r.recordDetectionResult(ctx, detectionResults[podUID], podUID, logger, instrumentedApp, namespacedName)
 		if err != nil {
 			return err
 		}
+		r.storeDetectionPodResult(ctx, logger, detectionPod, podUID, detectionResults[podUID])
+	}
+	return nil
+}
 
-		instrumentedApp.Status.InstrumentationDetection.Phase = v1.CompletedInstrumentationDetectionPhase
-		err = r.Status().Update(ctx, &instrumentedApp)
-		if err != nil {
-			return err
+// storeDetectionPodResult caches the result of a detection pod by the image digests of its target pod
+func (r *InstrumentedApplicationReconciler) storeDetectionPodResult(ctx context.Context, logger logr.Logger, detectionPod *corev1.Pod, podUID string, detectionResult common.DetectionResult) {
+	if digestsData, exists := detectionPod.Annotations[detectionImageDigestsAnnotation]; exists {
+		var digests map[string]map[string]string
+		if json.Unmarshal([]byte(digestsData), &digests) == nil {
+			r.storeDetectionResult(ctx, logger, digests[podUID], detectionResult)
 		}
 	}
+}
 
-	return nil
+func (r *InstrumentedApplicationReconciler) updateDetectionResult(ctx context.Context, detectionResult common.DetectionResult, logger logr.Logger, instrumentedApp v1.InstrumentedApplication, namespacedName types.NamespacedName) error {
+	return r.updateMergedDetectionResult(ctx, detectionResult, nil, logger, instrumentedApp, namespacedName)
+}
+
+// updateMergedDetectionResult completes the detection with the result merged from the detected replicas and the
+// containers they disagree on
+func (r *InstrumentedApplicationReconciler) updateMergedDetectionResult(ctx context.Context, detectionResult common.DetectionResult, disagreements []string, logger logr.Logger, instrumentedApp v1.InstrumentedApplication, namespacedName types.NamespacedName) error {
+	err := r.Get(ctx, namespacedName, &instrumentedApp)
+	if err != nil {
+		logger.Error(err, "error fetching instrumented application object")
+		return err
+	}
+	r.markNativeSidecars(ctx, &instrumentedApp, &detectionResult)
+	logger.V(0).Info("detection result", "result", detectionResult)
+	delete(instrumentedApp.Annotations, ephemeralDetectionAnnotation)
+	delete(instrumentedApp.Annotations, detectionReplicasAnnotation)
+	if err = r.deleteReplicaResults(ctx, namespacedName); err != nil {
+		return err
+	}
+	r.detectionQueue.done(namespacedName)
+	instrumentedApp.Spec.Languages = detectionResult.LanguageByContainer
+	instrumentedApp.Spec.Applications = detectionResult.ApplicationByContainer
+	err = r.Update(ctx, &instrumentedApp)
+	if err != nil {
+		return err
+	}
+	r.storeSBOM(ctx, logger, &instrumentedApp, detectionResult)
+
+	instrumentedApp.Status.DetectionDisagreements = disagreements
+	// results without dependencies, like the compact termination message, keep the previous library reports
+	if len(detectionResult.DependenciesByContainer) > 0 {
+		instrumentedApp.Status.LibraryCompatibility = compatibility.Report(detectionResult)
+		instrumentedApp.Status.Vulnerabilities = nil
+		if r.VulnerabilityDatabase != nil {
+			instrumentedApp.Status.Vulnerabilities = r.VulnerabilityDatabase.Scan(detectionResult.DependenciesByContainer)
+		}
+	}
+	setDetectionPhase(&instrumentedApp, v1.CompletedInstrumentationDetectionPhase, v1.DetectedReason, "")
+	return updateStatus(ctx, r.Client, &instrumentedApp)
 }
 
 func (r *InstrumentedApplicationReconciler) startDetection(ctx context.Context, logger logr.Logger, instrumentedApp v1.InstrumentedApplication) (ctrl.Result, error) {
-	instrumentedApp.Status.InstrumentationDetection.Phase = v1.RunningInstrumentationDetectionPhase
-	err := r.Status().Update(ctx, &instrumentedApp)
+	setDetectionPhase(&instrumentedApp, v1.RunningInstrumentationDetectionPhase, v1.DetectionRunningReason, "the languages of the workload are being detected")
+	err := updateStatus(ctx, r.Client, &instrumentedApp)
 	if err != nil {
 		logger.Error(err, "error updating instrument app status")
 		return ctrl.Result{}, err
 	}
 
-	labels, err := r.getOwnerTemplateLabels(ctx, &instrumentedApp)
-	if err != nil {
-		logger.Error(err, "error getting owner labels")
-		return ctrl.Result{}, err
+	if detectionResult, cached := r.cachedDetectionResult(ctx, logger, &instrumentedApp); cached {
+		return ctrl.Result{}, r.updateDetectionResult(ctx, *detectionResult, logger, instrumentedApp, client.ObjectKeyFromObject(&instrumentedApp))
 	}
 
-	err = r.detectLanguage(ctx, &instrumentedApp, labels)
+	if r.detectsImages(&instrumentedApp) {
+		return r.startImageDetection(client.ObjectKeyFromObject(&instrumentedApp)), nil
+	}
+
+	return r.detectionErrorResult(ctx, logger, &instrumentedApp, r.detectLanguage(ctx, &instrumentedApp))
+}
+
+// detectionErrorResult retries a detection that failed to start, unless the API server rejected it
+func (r *InstrumentedApplicationReconciler) detectionErrorResult(ctx context.Context, logger logr.Logger, instrumentedApp *v1.InstrumentedApplication, err error) (ctrl.Result, error) {
 	if err != nil {
 		logger.Error(err, "error detecting language")
+		if isAdmissionError(err) {
+			return ctrl.Result{}, r.setDetectionError(ctx, client.ObjectKeyFromObject(instrumentedApp), v1.DetectionRejectedReason, err.Error())
+		}
 	}
 	return ctrl.Result{}, err
 }
 
+// isAdmissionError reports whether the API server rejected a detection pod or container, for example by pod security
+// admission or a resource quota. Retrying does not help
+func isAdmissionError(err error) bool {
+	return apierrors.IsForbidden(err) || apierrors.IsInvalid(err)
+}
+
+func (r *InstrumentedApplicationReconciler) setDetectionError(ctx context.Context, key types.NamespacedName, reason string, message string) error {
+	r.detectionQueue.done(key)
+	var instrumentedApp v1.InstrumentedApplication
+	err := r.Get(ctx, key, &instrumentedApp)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	setDetectionPhase(&instrumentedApp, v1.ErrorInstrumentationDetectionPhase, reason, message)
+	return updateStatus(ctx, r.Client, &instrumentedApp)
+}
+
 func (r *InstrumentedApplicationReconciler) shouldStartDetection(app *v1.InstrumentedApplication) bool {
 	return app.Status.InstrumentationDetection.Phase == v1.PendingInstrumentationDetectionPhase
 }
@@ -218,46 +398,56 @@ func (r *InstrumentedApplicationReconciler) isAppDetected(app *v1.InstrumentedAp
 	return len(app.Spec.Applications) > 0
 }
 
-func (r *InstrumentedApplicationReconciler) detectLanguage(ctx context.Context, app *v1.InstrumentedApplication, labels map[string]string) error {
-	pod, err := r.choosePod(ctx, labels, app.Namespace)
-	if err != nil {
-		return err
+func (r *InstrumentedApplicationReconciler) detectLanguage(ctx context.Context, app *v1.InstrumentedApplication) error {
+	if r.detectionStrategy(ctx, app.Namespace) == EphemeralDetectionStrategy {
+		return r.startEphemeralDetection(ctx, app)
 	}
 
-	langDetectionPod, err := r.createLangDetectionPod(pod, app)
-	if err != nil {
-		return err
+	// the detection agent does not record snapshots, a full agent queue falls back to a detection pod
+	if r.DetectionAgent && !r.recordsWorkloadDetection(ctx, app) && r.agentDetections.add(client.ObjectKeyFromObject(app)) {
+		return nil
 	}
 
-	err = r.Create(ctx, langDetectionPod)
-	return err
+	r.enqueueDetection(ctx, app)
+	return nil
 }
 
-func (r *InstrumentedApplicationReconciler) choosePod(ctx context.Context, labels map[string]string, namespace string) (*corev1.Pod, error) {
-	var podList corev1.PodList
-	err := r.List(ctx, &podList, client.MatchingLabels(labels), client.InNamespace(namespace))
-	if err != nil {
-		return nil, err
+// createLangDetectionPod creates a detection pod for target pods running on the same node, in the same namespace, and
+// the secret holding its report token when detection reports are enabled
+func (r *InstrumentedApplicationReconciler) createLangDetectionPod(targets []detectionTarget) (*corev1.Pod, *corev1.Secret, error) {
+	targetPod := targets[0].pod
+	var podUIDs, containerNames []string
+	seenContainers := make(map[string]bool)
+	podTargets := make(map[string]string)
+	digests := make(map[string]map[string]string)
+	for _, target := range targets {
+		podUIDs = append(podUIDs, string(target.pod.UID))
+		for _, name := range r.getContainerNames(target.pod) {
+			if !seenContainers[name] {
+				seenContainers[name] = true
+				containerNames = append(containerNames, name)
+			}
+		}
+		podTargets[string(target.pod.UID)] = client.ObjectKeyFromObject(target.app).String()
+		if podDigests := r.podImageDigests(target.pod); podDigests != nil {
+			digests[string(target.pod.UID)] = podDigests
+		}
 	}
-
-	if len(podList.Items) == 0 {
-		return nil, consts.PodsNotFoundErr
+	targetsData, err := json.Marshal(podTargets)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	for _, pod := range podList.Items {
-		if pod.Status.Phase == corev1.PodRunning {
-			return &pod, nil
-		}
+	namespace := targetPod.Namespace
+	if r.DetectionPodsInOperatorNamespace {
+		namespace = utils.GetCurrentNamespace()
 	}
 
-	return nil, consts.PodsNotFoundErr
-}
-
-func (r *InstrumentedApplicationReconciler) createLangDetectionPod(targetPod *corev1.Pod, instrumentedApp *v1.InstrumentedApplication) (*corev1.Pod, error) {
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			GenerateName: fmt.Sprintf("%s-instrumentation-detection-", targetPod.Name),
-			Namespace:    targetPod.Namespace,
+			Namespace:    namespace,
+			Labels:       map[string]string{DetectionPodLabel: "true"},
 			Annotations: map[string]string{
 				consts.InstrumentationDetectionContainerAnnotationKey: "true",
 				istioAnnotationKey:   istioAnnotationValue,
@@ -270,8 +460,8 @@ func (r *InstrumentedApplicationReconciler) createLangDetectionPod(targetPod *co
 					Name:  "instrumentation-detector",
 					Image: fmt.Sprintf("%s:%s", r.InstrumentationDetectorImage, r.InstrumentationDetectorTag),
 					Args: []string{
-						fmt.Sprintf("--pod-uid=%s", targetPod.UID),
-						fmt.Sprintf("--container-names=%s", strings.Join(r.getContainerNames(targetPod), ",")),
+						fmt.Sprintf("--pod-uid=%s", strings.Join(podUIDs, ",")),
+						fmt.Sprintf("--container-names=%s", strings.Join(containerNames, ",")),
 					},
 					TerminationMessagePath: "/dev/detection-result",
 					SecurityContext: &corev1.SecurityContext{
@@ -279,91 +469,191 @@ func (r *InstrumentedApplicationReconciler) createLangDetectionPod(targetPod *co
 							Add: []corev1.Capability{"SYS_PTRACE"},
 						},
 					},
+					Resources:       *r.DetectionPodConfig.Resources.DeepCopy(),
+					ImagePullPolicy: r.DetectionPodConfig.ImagePullPolicy,
 				},
 			},
-			RestartPolicy: "Never",
-			NodeName:      targetPod.Spec.NodeName,
-			HostPID:       true,
+			RestartPolicy:     "Never",
+			NodeName:          targetPod.Spec.NodeName,
+			HostPID:           true,
+			Tolerations:       r.DetectionPodConfig.detectionPodTolerations(targets),
+			PriorityClassName: r.DetectionPodConfig.PriorityClassName,
+			ImagePullSecrets:  r.DetectionPodConfig.ImagePullSecrets,
 		},
 	}
 
-	err := ctrl.SetControllerReference(instrumentedApp, pod, r.Scheme)
+	pod.Annotations[detectionTargetsAnnotation] = string(targetsData)
+
+	for _, target := range targets {
+		if recordsDetection(target.pod.Annotations) {
+			// the snapshot is printed to the container log, the pod is kept after the detection to read it
+			pod.Annotations[DetectionRecordAnnotation] = "true"
+			pod.Spec.Containers[0].Args = append(pod.Spec.Containers[0].Args, fmt.Sprintf("--record=%s", detectionRecordLog))
+			break
+		}
+	}
+
+	if r.DetectionCacheTTL > 0 && len(digests) > 0 {
+		digestsData, err := json.Marshal(digests)
+		if err != nil {
+			return nil, nil, err
+		}
+		pod.Annotations[detectionImageDigestsAnnotation] = string(digestsData)
+	}
+
+	var reportSecret *corev1.Secret
+	if r.DetectionReportURL != "" {
+		var tokenHash string
+		reportSecret, tokenHash, err = newDetectionReportSecret(namespace)
+		if err != nil {
+			return nil, nil, err
+		}
+		pod.Annotations[detectionReportTokenAnnotation] = tokenHash
+		container := &pod.Spec.Containers[0]
+		container.Args = append(container.Args, fmt.Sprintf("--report-url=%s", r.DetectionReportURL))
+		container.Env = append(container.Env,
+			detectionReportTokenEnv(reportSecret),
+			corev1.EnvVar{Name: consts.DetectionPodNameEnvVar, ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+			}},
+			corev1.EnvVar{Name: consts.DetectionPodNamespaceEnvVar, ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+			}},
+		)
+	}
+
+	// owner references can not cross namespaces, detection pods in the operator namespace are deleted by the
+	// reconciler when their InstrumentedApplications are deleted
+	if namespace != targetPod.Namespace {
+		return pod, reportSecret, nil
+	}
+	err = ctrl.SetControllerReference(targets[0].app, pod, r.Scheme)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	for _, target := range targets[1:] {
+		if err = controllerutil.SetOwnerReference(target.app, pod, r.Scheme); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	return pod, nil
+	return pod, reportSecret, nil
 }
 
 func (r *InstrumentedApplicationReconciler) getContainerNames(pod *corev1.Pod) []string {
 	var result []string
-	for _, c := range pod.Spec.Containers {
+	for _, c := range r.detectedContainers(&pod.Spec) {
+		result = append(result, c.Name)
+	}
+
+	return result
+}
+
+// detectedContainers returns the app containers of the pod spec, and its native sidecars when they are detected
+func (r *InstrumentedApplicationReconciler) detectedContainers(spec *corev1.PodSpec) []corev1.Container {
+	var result []corev1.Container
+	for _, c := range spec.Containers {
 		if !r.skipContainer(c.Name) {
-			result = append(result, c.Name)
+			result = append(result, c)
+		}
+	}
+	if !r.DetectNativeSidecars {
+		return result
+	}
+	for i := range spec.InitContainers {
+		if patch.IsNativeSidecar(&spec.InitContainers[i]) && !r.skipContainer(spec.InitContainers[i].Name) {
+			result = append(result, spec.InitContainers[i])
 		}
 	}
 
 	return result
 }
 
+// markNativeSidecars flags the detected containers that are native sidecars of the workload
+func (r *InstrumentedApplicationReconciler) markNativeSidecars(ctx context.Context, instrumentedApp *v1.InstrumentedApplication, detectionResult *common.DetectionResult) {
+	podTemplate, err := r.getOwnerPodTemplate(ctx, instrumentedApp)
+	if err != nil {
+		return
+	}
+	sidecars := make(map[string]bool)
+	for i := range podTemplate.Spec.InitContainers {
+		if patch.IsNativeSidecar(&podTemplate.Spec.InitContainers[i]) {
+			sidecars[podTemplate.Spec.InitContainers[i].Name] = true
+		}
+	}
+	for i := range detectionResult.LanguageByContainer {
+		detectionResult.LanguageByContainer[i].NativeSidecar = sidecars[detectionResult.LanguageByContainer[i].ContainerName]
+	}
+	for i := range detectionResult.ApplicationByContainer {
+		detectionResult.ApplicationByContainer[i].NativeSidecar = sidecars[detectionResult.ApplicationByContainer[i].ContainerName]
+	}
+}
+
 func (r *InstrumentedApplicationReconciler) skipContainer(name string) bool {
 	return name == "istio-proxy" || name == "linkerd-proxy"
 }
 
-func (r *InstrumentedApplicationReconciler) getOwnerTemplateLabels(ctx context.Context, instrumentedApp *v1.InstrumentedApplication) (map[string]string, error) {
+func (r *InstrumentedApplicationReconciler) getOwnerPodTemplate(ctx context.Context, instrumentedApp *v1.InstrumentedApplication) (*corev1.PodTemplateSpec, error) {
+	workload, obj, err := r.getOwner(ctx, instrumentedApp)
+	if err != nil {
+		return nil, err
+	}
+	return workload.PodTemplate(obj)
+}
+
+// getOwner returns the workload owning the InstrumentedApp with the adapter of its kind
+func (r *InstrumentedApplicationReconciler) getOwner(ctx context.Context, instrumentedApp *v1.InstrumentedApplication) (WorkloadAdapter, client.Object, error) {
 	owner := metav1.GetControllerOf(instrumentedApp)
 	if owner == nil {
-		return nil, errors.New("could not find owner for InstrumentedApp")
+		return nil, nil, errors.New("could not find owner for InstrumentedApp")
 	}
 
-	if owner.Kind == consts.SupportedResourceDeployment && owner.APIVersion == appsv1.SchemeGroupVersion.String() {
-		var dep appsv1.Deployment
-		err := r.Get(ctx, client.ObjectKey{
-			Namespace: instrumentedApp.Namespace,
-			Name:      owner.Name,
-		}, &dep)
-		if err != nil {
-			return nil, err
-		}
-
-		return dep.Spec.Template.Labels, nil
-	} else if owner.Kind == consts.SupportedResourceStatefulSet && owner.APIVersion == appsv1.SchemeGroupVersion.String() {
-		var ss appsv1.StatefulSet
-		err := r.Get(ctx, client.ObjectKey{
-			Namespace: instrumentedApp.Namespace,
-			Name:      owner.Name,
-		}, &ss)
-		if err != nil {
-			return nil, err
-		}
-
-		return ss.Spec.Template.Labels, nil
+	workload := r.Workloads.adapterFor(owner.APIVersion, owner.Kind)
+	if workload == nil {
+		return nil, nil, errors.New("unrecognized owner kind:" + owner.Kind)
+	}
+	obj := workload.NewObject()
+	err := r.Get(ctx, client.ObjectKey{
+		Namespace: instrumentedApp.Namespace,
+		Name:      owner.Name,
+	}, obj)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return nil, errors.New("unrecognized owner kind:" + owner.Kind)
+	return workload, obj, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *InstrumentedApplicationReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	// Index pods by owner for fast lookup
-	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, podOwnerKey, func(rawObj client.Object) []string {
-		pod := rawObj.(*corev1.Pod)
-		owner := metav1.GetControllerOf(pod)
-		if owner == nil {
-			return nil
-		}
-
-		if owner.APIVersion != apiGVStr || owner.Kind != "InstrumentedApplication" {
-			return nil
-		}
+	// Index detection pods by the InstrumentedApplications they detect for fast lookup, across namespaces
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, detectionTargetKey, detectionTargetIndex); err != nil {
+		return err
+	}
 
-		return []string{owner.Name}
-	}); err != nil {
+	r.detectionQueue = newDetectionQueue()
+	if err := mgr.Add(manager.RunnableFunc(r.dispatchDetections)); err != nil {
 		return err
 	}
+	r.imageDetections = newBackgroundDetections()
+	if err := mgr.Add(manager.RunnableFunc(r.runImageDetections)); err != nil {
+		return err
+	}
+	r.agentDetections = newBackgroundDetections()
+	if r.DetectionAgent {
+		if err := mgr.Add(manager.RunnableFunc(r.runAgentDetections)); err != nil {
+			return err
+		}
+	}
+	if r.VulnerabilityDatabase != nil {
+		if err := mgr.Add(manager.RunnableFunc(r.rescanVulnerabilities)); err != nil {
+			return err
+		}
+	}
 
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&v1.InstrumentedApplication{}).
-		Owns(&corev1.Pod{}).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(detectionPodRequests)).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(r.batchRunPodRequests)).
 		Complete(r)
 }
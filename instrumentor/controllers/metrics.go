@@ -0,0 +1,34 @@
+package controllers
+
+import (
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/vulnerability"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// vulnerabilitiesMetric counts the known vulnerabilities of the libraries detected in each InstrumentedApplication
+var vulnerabilitiesMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "logzio_instrumentor_vulnerabilities",
+	Help: "Known vulnerabilities of the libraries detected in the workload, by severity",
+}, []string{"namespace", "instrumented_application", "severity"})
+
+func init() {
+	metrics.Registry.MustRegister(vulnerabilitiesMetric)
+}
+
+// setVulnerabilitiesMetric exposes the vulnerability counts of the InstrumentedApplication, the series are removed
+// when its libraries were not scanned
+func setVulnerabilitiesMetric(key types.NamespacedName, counts map[string]int) {
+	if counts == nil {
+		deleteVulnerabilitiesMetric(key)
+		return
+	}
+	for _, severity := range vulnerability.Severities {
+		vulnerabilitiesMetric.WithLabelValues(key.Namespace, key.Name, severity).Set(float64(counts[severity]))
+	}
+}
+
+func deleteVulnerabilitiesMetric(key types.NamespacedName) {
+	vulnerabilitiesMetric.DeletePartialMatch(prometheus.Labels{"namespace": key.Namespace, "instrumented_application": key.Name})
+}
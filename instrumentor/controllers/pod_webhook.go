@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/patch"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// TemplateInstrumentationMode patches the pod template of workloads, their pods are replaced by their rollout
+	TemplateInstrumentationMode = "template"
+	// WebhookInstrumentationMode patches pods when they are created with the pod webhook, workloads are not changed
+	WebhookInstrumentationMode = "webhook"
+	// PodWebhookPath is the path the pod webhook is served at
+	PodWebhookPath = "/mutate-v1-pod"
+	// maxOwnerDepth bounds the controllers followed from a pod to its workload, like a Knative Service controlling the
+	// Configuration, Revision, Deployment and ReplicaSet of its pods
+	maxOwnerDepth = 6
+)
+
+// PodWebhook instruments pods when they are created, with the detection result of the InstrumentedApplication of
+// their workload and the same patchers as the pod template instrumentation
+type PodWebhook struct {
+	Client client.Client
+	// APIReader reads the controllers between a pod and its workload that are not workload kinds, and the workloads
+	// created too recently to be in the cache
+	APIReader client.Reader
+	Workloads Workloads
+	// FailurePolicy rejects the pods that could not be instrumented when it is Fail, they are created without
+	// instrumentation otherwise
+	FailurePolicy admissionregistrationv1.FailurePolicyType
+	decoder       *admission.Decoder
+}
+
+// SetupWithManager registers the pod webhook on the webhook server of the manager
+func (w *PodWebhook) SetupWithManager(mgr ctrl.Manager) {
+	w.decoder = admission.NewDecoder(mgr.GetScheme())
+	mgr.GetWebhookServer().Register(PodWebhookPath, &webhook.Admission{Handler: w})
+}
+
+// Handle patches the pod being created when its workload asks for instrumentation and was detected
+func (w *PodWebhook) Handle(ctx context.Context, req admission.Request) admission.Response {
+	logger := log.FromContext(ctx).WithName("pod-webhook")
+	var pod corev1.Pod
+	if err := w.decoder.Decode(req, &pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// the namespace of a pod created by a workload is only set from the request
+	namespace := req.Namespace
+	template := standalonePodTemplate(&pod)
+	if shouldSkip(pod.Annotations, namespace) || isDetectionPod(&pod) || !shouldInstrument(template) {
+		return admission.Allowed("instrumentation not requested")
+	}
+
+	instApp, err := w.instrumentedApplicationOf(ctx, namespace, &pod)
+	if err != nil {
+		return w.failed(logger, err)
+	}
+	if instApp == nil {
+		return admission.Allowed("no instrumented workload")
+	}
+	if instApp.Status.InstrumentationDetection.Phase != v1.CompletedInstrumentationDetectionPhase || len(instApp.Spec.Languages) == 0 {
+		return admission.Allowed("workload not detected yet")
+	}
+	// the pod template of the workload may have been instrumented in the template mode
+	instrumented, err := patch.IsTracesInstrumented(template, instApp)
+	if err != nil {
+		return w.failed(logger, err)
+	}
+	if instrumented {
+		return admission.Allowed("already instrumented")
+	}
+
+	if err = patch.ModifyObject(template, instApp); err != nil {
+		return w.failed(logger, err)
+	}
+	pod.Labels, pod.Annotations, pod.Spec = template.Labels, template.Annotations, template.Spec
+	marshaled, err := json.Marshal(&pod)
+	if err != nil {
+		return w.failed(logger, err)
+	}
+	logger.V(0).Info("Instrumenting pod", "namespace", namespace, "instrumentedApplication", instApp.Name)
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+func (w *PodWebhook) failed(logger logr.Logger, err error) admission.Response {
+	logger.Error(err, "could not instrument pod")
+	if w.FailurePolicy == admissionregistrationv1.Fail {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.Allowed("not instrumented: " + err.Error())
+}
+
+// instrumentedApplicationOf follows the controllers of the pod up to the workload owning an InstrumentedApplication,
+// nil when there is none or the pod template of the workload can not be changed, like a Job's
+func (w *PodWebhook) instrumentedApplicationOf(ctx context.Context, namespace string, pod *corev1.Pod) (*v1.InstrumentedApplication, error) {
+	owner := metav1.GetControllerOf(pod)
+	for depth := 0; owner != nil && depth < maxOwnerDepth; depth++ {
+		key := client.ObjectKey{Namespace: namespace, Name: owner.Name}
+		workload := w.Workloads.adapterFor(owner.APIVersion, owner.Kind)
+		var obj client.Object
+		if workload != nil {
+			obj = workload.NewObject()
+		} else {
+			metadata := &metav1.PartialObjectMetadata{}
+			metadata.SetGroupVersionKind(schema.FromAPIVersionAndKind(owner.APIVersion, owner.Kind))
+			obj = metadata
+		}
+		if err := w.get(ctx, key, obj, workload != nil); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+
+		if workload != nil {
+			instApp, err := instrumentedAppOf(ctx, w.Client, workload.GroupVersionKind(), namespace, obj.GetName(), obj.GetUID())
+			if err != nil {
+				return nil, err
+			}
+			if instApp != nil {
+				if workload.ImmutableReason(obj) != "" {
+					return nil, nil
+				}
+				return instApp, nil
+			}
+		}
+		owner = metav1.GetControllerOf(obj)
+	}
+	return nil, nil
+}
+
+// get reads workloads from the cache, the ReplicaSet of a new Deployment revision creates its pods right after it is
+// created and may not be cached yet
+func (w *PodWebhook) get(ctx context.Context, key client.ObjectKey, obj client.Object, cached bool) error {
+	if cached {
+		err := w.Client.Get(ctx, key, obj)
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return w.APIReader.Get(ctx, key, obj)
+}
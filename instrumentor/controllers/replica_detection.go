@@ -0,0 +1,383 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// detectionReplicasAnnotation maps the UIDs of the replicas detected for an InstrumentedApplication to their pod
+	// names, the detection completes once every replica reported a result
+	detectionReplicasAnnotation = "logz.io/detection-replicas"
+	// detectionReplicaResultsNamePrefix names the ConfigMap holding the results of the replicas that were already
+	// detected by pod UID, next to the InstrumentedApplication and owned by it. Results may list hundreds of
+	// dependencies, more than fits the annotations of the InstrumentedApplication
+	detectionReplicaResultsNamePrefix = "detection-replicas-"
+	detectionReplicaResultsLabel      = "logz.io/detection-replicas"
+	// noReplicaValue describes a replica on which nothing was detected for a container
+	noReplicaValue = "none"
+)
+
+// detectionReplicaCount is the number of replicas of a workload to detect and merge
+func (r *InstrumentedApplicationReconciler) detectionReplicaCount() int {
+	if r.DetectionReplicas < 1 {
+		return 1
+	}
+	return r.DetectionReplicas
+}
+
+// setDetectionReplicas records the replicas the detection of the InstrumentedApplication waits for, a single replica
+// completes the detection with its own result
+func (r *InstrumentedApplicationReconciler) setDetectionReplicas(ctx context.Context, key types.NamespacedName, pods []*corev1.Pod) error {
+	var instrumentedApp v1.InstrumentedApplication
+	if err := r.Get(ctx, key, &instrumentedApp); err != nil {
+		return err
+	}
+
+	if err := r.deleteReplicaResults(ctx, key); err != nil {
+		return err
+	}
+	if len(pods) < 2 {
+		delete(instrumentedApp.Annotations, detectionReplicasAnnotation)
+		return r.Update(ctx, &instrumentedApp)
+	}
+
+	replicas := make(map[string]string)
+	for _, pod := range pods {
+		replicas[string(pod.UID)] = pod.Name
+	}
+	data, err := json.Marshal(replicas)
+	if err != nil {
+		return err
+	}
+	if instrumentedApp.Annotations == nil {
+		instrumentedApp.Annotations = make(map[string]string)
+	}
+	instrumentedApp.Annotations[detectionReplicasAnnotation] = string(data)
+	return r.Update(ctx, &instrumentedApp)
+}
+
+func detectionReplicas(instrumentedApp *v1.InstrumentedApplication) map[string]string {
+	replicas := make(map[string]string)
+	if data, exists := instrumentedApp.Annotations[detectionReplicasAnnotation]; exists {
+		_ = json.Unmarshal([]byte(data), &replicas)
+	}
+	return replicas
+}
+
+func replicaResultsKey(key types.NamespacedName) client.ObjectKey {
+	return client.ObjectKey{Namespace: key.Namespace, Name: detectionReplicaResultsNamePrefix + key.Name}
+}
+
+// updateReplicaResultsConfigMap applies update to the replica results of the InstrumentedApplication, creating their
+// ConfigMap when needed. Results are reported by every instrumentor replica and read by the leader, the update is
+// retried on conflicts. It returns the results after the update
+func (r *InstrumentedApplicationReconciler) updateReplicaResultsConfigMap(ctx context.Context, instrumentedApp *v1.InstrumentedApplication,
+	update func(results map[string]common.DetectionResult) bool) (map[string]common.DetectionResult, error) {
+	var results map[string]common.DetectionResult
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		var cm corev1.ConfigMap
+		err := r.APIReader.Get(ctx, replicaResultsKey(client.ObjectKeyFromObject(instrumentedApp)), &cm)
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		exists := err == nil
+
+		results = make(map[string]common.DetectionResult)
+		for podUID, data := range cm.Data {
+			var result common.DetectionResult
+			if json.Unmarshal([]byte(data), &result) == nil {
+				results[podUID] = result
+			}
+		}
+		if !update(results) {
+			return nil
+		}
+
+		cm.Data = make(map[string]string)
+		for podUID, result := range results {
+			data, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+			cm.Data[podUID] = string(data)
+		}
+		if exists {
+			return r.Update(ctx, &cm)
+		}
+		cm.ObjectMeta = metav1.ObjectMeta{
+			Name:      replicaResultsKey(client.ObjectKeyFromObject(instrumentedApp)).Name,
+			Namespace: instrumentedApp.Namespace,
+			Labels:    map[string]string{detectionReplicaResultsLabel: instrumentedApp.Name},
+		}
+		if err = ctrl.SetControllerReference(instrumentedApp, &cm, r.Scheme); err != nil {
+			return err
+		}
+		return r.Create(ctx, &cm)
+	})
+	return results, err
+}
+
+// deleteReplicaResults deletes the results of the replicas of a previous or completed detection
+func (r *InstrumentedApplicationReconciler) deleteReplicaResults(ctx context.Context, key types.NamespacedName) error {
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: replicaResultsKey(key).Name}}
+	return client.IgnoreNotFound(r.Delete(ctx, cm))
+}
+
+// recordDetectionResult updates the InstrumentedApplication with the result of the detected pod. When several replicas
+// are detected, the result is kept until the other replicas report and the merged result is used
+func (r *InstrumentedApplicationReconciler) recordDetectionResult(ctx context.Context, detectionResult common.DetectionResult, podUID string, logger logr.Logger, instrumentedApp v1.InstrumentedApplication, namespacedName types.NamespacedName) error {
+	err := r.Get(ctx, namespacedName, &instrumentedApp)
+	if err != nil {
+		return err
+	}
+	replicas := detectionReplicas(&instrumentedApp)
+	if _, exists := replicas[podUID]; !exists {
+		return r.updateDetectionResult(ctx, detectionResult, logger, instrumentedApp, namespacedName)
+	}
+	if instrumentedApp.Status.InstrumentationDetection.Phase != v1.RunningInstrumentationDetectionPhase {
+		return nil
+	}
+
+	recorded := false
+	results, err := r.updateReplicaResultsConfigMap(ctx, &instrumentedApp, func(results map[string]common.DetectionResult) bool {
+		if _, exists := results[podUID]; exists {
+			return false
+		}
+		result := detectionResult
+		// the replicas run the same images, the dependencies of one replica are enough
+		for _, other := range results {
+			if len(other.DependenciesByContainer) > 0 {
+				result.DependenciesByContainer = nil
+				break
+			}
+		}
+		results[podUID] = result
+		recorded = true
+		return true
+	})
+	if err != nil || !recorded {
+		return err
+	}
+	logger.V(0).Info("replica detection result", "pod", replicas[podUID], "detected", len(results), "replicas", len(replicas))
+	return r.completeReplicaDetection(ctx, logger, instrumentedApp, namespacedName, replicas, results)
+}
+
+// discardDetectionReplica stops waiting for a replica whose detection failed, the detection completes with the results
+// of the other replicas
+func (r *InstrumentedApplicationReconciler) discardDetectionReplica(ctx context.Context, logger logr.Logger, namespacedName types.NamespacedName, podUID string) error {
+	var instrumentedApp v1.InstrumentedApplication
+	err := r.Get(ctx, namespacedName, &instrumentedApp)
+	if err != nil {
+		return err
+	}
+	replicas := detectionReplicas(&instrumentedApp)
+	if _, exists := replicas[podUID]; !exists || instrumentedApp.Status.InstrumentationDetection.Phase != v1.RunningInstrumentationDetectionPhase {
+		return nil
+	}
+
+	logger.V(0).Info("discarding replica with failed detection", "pod", replicas[podUID])
+	delete(replicas, podUID)
+	if len(replicas) == 0 {
+		delete(instrumentedApp.Annotations, detectionReplicasAnnotation)
+		if err = r.Update(ctx, &instrumentedApp); err != nil {
+			return err
+		}
+		return r.deleteReplicaResults(ctx, namespacedName)
+	}
+
+	replicasData, err := json.Marshal(replicas)
+	if err != nil {
+		return err
+	}
+	instrumentedApp.Annotations[detectionReplicasAnnotation] = string(replicasData)
+	if err = r.Update(ctx, &instrumentedApp); err != nil {
+		return err
+	}
+	results, err := r.updateReplicaResultsConfigMap(ctx, &instrumentedApp, func(results map[string]common.DetectionResult) bool {
+		_, exists := results[podUID]
+		delete(results, podUID)
+		return exists
+	})
+	if err != nil {
+		return err
+	}
+	return r.completeReplicaDetection(ctx, logger, instrumentedApp, namespacedName, replicas, results)
+}
+
+// completeReplicaDetection completes the detection with the merged result once every replica was detected
+func (r *InstrumentedApplicationReconciler) completeReplicaDetection(ctx context.Context, logger logr.Logger, instrumentedApp v1.InstrumentedApplication,
+	namespacedName types.NamespacedName, replicas map[string]string, results map[string]common.DetectionResult) error {
+	resultsByPod := make(map[string]common.DetectionResult)
+	for podUID := range replicas {
+		result, exists := results[podUID]
+		if !exists {
+			return nil
+		}
+		resultsByPod[replicas[podUID]] = result
+	}
+
+	detectionResult, disagreements := mergeReplicaResults(resultsByPod)
+	for _, disagreement := range disagreements {
+		logger.V(0).Info("detected replicas disagree", "instrumentedApplication", namespacedName, "disagreement", disagreement)
+	}
+	return r.updateMergedDetectionResult(ctx, detectionResult, disagreements, logger, instrumentedApp, namespacedName)
+}
+
+// replicaValues groups the replicas by the value detected for a container, in the order the values were first seen
+type replicaValues struct {
+	values   []string
+	replicas map[string][]string
+}
+
+func (v *replicaValues) add(value string, replica string) {
+	if v.replicas == nil {
+		v.replicas = make(map[string][]string)
+	}
+	if _, exists := v.replicas[value]; !exists {
+		v.values = append(v.values, value)
+	}
+	v.replicas[value] = append(v.replicas[value], replica)
+}
+
+// majority returns the value detected on most replicas, the first value seen on a tie
+func (v *replicaValues) majority() string {
+	var chosen string
+	for _, value := range v.values {
+		if len(v.replicas[value]) > len(v.replicas[chosen]) {
+			chosen = value
+		}
+	}
+	return chosen
+}
+
+// disagreement describes the values of a container that was not detected alike on every replica
+func (v *replicaValues) disagreement(container string, kind string, replicas []string) (string, bool) {
+	detected := 0
+	for _, value := range v.values {
+		detected += len(v.replicas[value])
+	}
+	if len(v.values) == 1 && detected == len(replicas) {
+		return "", false
+	}
+
+	var missing []string
+	for _, replica := range replicas {
+		found := false
+		for _, value := range v.values {
+			for _, valueReplica := range v.replicas[value] {
+				found = found || valueReplica == replica
+			}
+		}
+		if !found {
+			missing = append(missing, replica)
+		}
+	}
+
+	var parts []string
+	for _, value := range v.values {
+		parts = append(parts, fmt.Sprintf("%s on %s", value, strings.Join(v.replicas[value], ", ")))
+	}
+	if len(missing) > 0 {
+		parts = append(parts, fmt.Sprintf("%s on %s", noReplicaValue, strings.Join(missing, ", ")))
+	}
+	return fmt.Sprintf("container %s: %s differs between replicas (%s)", container, kind, strings.Join(parts, "; ")), true
+}
+
+// mergeReplicaResults merges the detection results of the replicas of a workload by pod name. Each container gets the
+// language and application detected on most replicas, the containers the replicas disagree on are described
+func mergeReplicaResults(results map[string]common.DetectionResult) (common.DetectionResult, []string) {
+	var replicas []string
+	for replica := range results {
+		replicas = append(replicas, replica)
+	}
+	sort.Strings(replicas)
+
+	var languageContainers, applicationContainers []string
+	languages := make(map[string]*replicaValues)
+	applications := make(map[string]*replicaValues)
+	languageEntries := make(map[string]common.LanguageByContainer)
+	applicationEntries := make(map[string]common.ApplicationByContainer)
+	for _, replica := range replicas {
+		for _, l := range results[replica].LanguageByContainer {
+			if languages[l.ContainerName] == nil {
+				languages[l.ContainerName] = &replicaValues{}
+				languageContainers = append(languageContainers, l.ContainerName)
+			}
+			languages[l.ContainerName].add(string(l.Language), replica)
+			key := l.ContainerName + "/" + string(l.Language)
+			if _, exists := languageEntries[key]; !exists {
+				languageEntries[key] = l
+			}
+		}
+		for _, a := range results[replica].ApplicationByContainer {
+			if applications[a.ContainerName] == nil {
+				applications[a.ContainerName] = &replicaValues{}
+				applicationContainers = append(applicationContainers, a.ContainerName)
+			}
+			applications[a.ContainerName].add(string(a.Application), replica)
+			key := a.ContainerName + "/" + string(a.Application)
+			if _, exists := applicationEntries[key]; !exists {
+				applicationEntries[key] = a
+			}
+		}
+	}
+
+	var merged common.DetectionResult
+	var disagreements []string
+	for _, container := range languageContainers {
+		merged.LanguageByContainer = append(merged.LanguageByContainer, languageEntries[container+"/"+languages[container].majority()])
+		if disagreement, exists := languages[container].disagreement(container, "language", replicas); exists {
+			disagreements = append(disagreements, disagreement)
+		}
+	}
+	for _, container := range applicationContainers {
+		merged.ApplicationByContainer = append(merged.ApplicationByContainer, applicationEntries[container+"/"+applications[container].majority()])
+		if disagreement, exists := applications[container].disagreement(container, "application", replicas); exists {
+			disagreements = append(disagreements, disagreement)
+		}
+	}
+	merged.DependenciesByContainer = mergeReplicaDependencies(replicas, results)
+	return merged, disagreements
+}
+
+// mergeReplicaDependencies unions the dependencies reported by the replicas for each container
+func mergeReplicaDependencies(replicas []string, results map[string]common.DetectionResult) []common.DependenciesByContainer {
+	var merged []common.DependenciesByContainer
+	indexes := make(map[string]int)
+	seen := make(map[string]map[common.Dependency]bool)
+	for _, replica := range replicas {
+		for _, d := range results[replica].DependenciesByContainer {
+			i, exists := indexes[d.ContainerName]
+			if !exists {
+				i = len(merged)
+				indexes[d.ContainerName] = i
+				seen[d.ContainerName] = make(map[common.Dependency]bool)
+				merged = append(merged, common.DependenciesByContainer{ContainerName: d.ContainerName})
+			}
+			for _, dep := range d.Dependencies {
+				if !seen[d.ContainerName][dep] {
+					seen[d.ContainerName][dep] = true
+					merged[i].Dependencies = append(merged[i].Dependencies, dep)
+				}
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/logzio/kubernetes-instrumentor/common"
+)
+
+func TestMergeReplicaResults(t *testing.T) {
+	java := func(container string) common.LanguageByContainer {
+		return common.LanguageByContainer{ContainerName: container, Language: common.JavaProgrammingLanguage}
+	}
+	python := func(container string) common.LanguageByContainer {
+		return common.LanguageByContainer{ContainerName: container, Language: common.PythonProgrammingLanguage}
+	}
+	nginx := common.ApplicationByContainer{ContainerName: "proxy", Application: "nginx"}
+	kafka := common.Dependency{Name: "org.apache.kafka:kafka-clients", Version: "3.5.1", Ecosystem: common.MavenDependencyEcosystem}
+	grpc := common.Dependency{Name: "io.grpc:grpc-core", Version: "1.58.0", Ecosystem: common.MavenDependencyEcosystem}
+
+	tests := []struct {
+		name              string
+		results           map[string]common.DetectionResult
+		want              common.DetectionResult
+		wantDisagreements []string
+	}{
+		{
+			name: "replicas agree",
+			results: map[string]common.DetectionResult{
+				"shop-a": {LanguageByContainer: []common.LanguageByContainer{java("app")}, ApplicationByContainer: []common.ApplicationByContainer{nginx}},
+				"shop-b": {LanguageByContainer: []common.LanguageByContainer{java("app")}, ApplicationByContainer: []common.ApplicationByContainer{nginx}},
+			},
+			want: common.DetectionResult{LanguageByContainer: []common.LanguageByContainer{java("app")}, ApplicationByContainer: []common.ApplicationByContainer{nginx}},
+		},
+		{
+			name: "majority language",
+			results: map[string]common.DetectionResult{
+				"shop-a": {LanguageByContainer: []common.LanguageByContainer{python("app")}},
+				"shop-b": {LanguageByContainer: []common.LanguageByContainer{java("app")}},
+				"shop-c": {LanguageByContainer: []common.LanguageByContainer{java("app")}},
+			},
+			want:              common.DetectionResult{LanguageByContainer: []common.LanguageByContainer{java("app")}},
+			wantDisagreements: []string{"container app: language differs between replicas (python on shop-a; java on shop-b, shop-c)"},
+		},
+		{
+			name: "tie keeps the first replica",
+			results: map[string]common.DetectionResult{
+				"shop-b": {LanguageByContainer: []common.LanguageByContainer{java("app")}},
+				"shop-a": {LanguageByContainer: []common.LanguageByContainer{python("app")}},
+			},
+			want:              common.DetectionResult{LanguageByContainer: []common.LanguageByContainer{python("app")}},
+			wantDisagreements: []string{"container app: language differs between replicas (python on shop-a; java on shop-b)"},
+		},
+		{
+			name: "container missing on a replica",
+			results: map[string]common.DetectionResult{
+				"shop-a": {ApplicationByContainer: []common.ApplicationByContainer{nginx}},
+				"shop-b": {},
+			},
+			want:              common.DetectionResult{ApplicationByContainer: []common.ApplicationByContainer{nginx}},
+			wantDisagreements: []string{"container proxy: application differs between replicas (nginx on shop-a; none on shop-b)"},
+		},
+		{
+			name: "dependencies are unioned",
+			results: map[string]common.DetectionResult{
+				"shop-a": {DependenciesByContainer: []common.DependenciesByContainer{{ContainerName: "app", Dependencies: []common.Dependency{kafka}}}},
+				"shop-b": {DependenciesByContainer: []common.DependenciesByContainer{{ContainerName: "app", Dependencies: []common.Dependency{kafka, grpc}}}},
+			},
+			want: common.DetectionResult{DependenciesByContainer: []common.DependenciesByContainer{{ContainerName: "app", Dependencies: []common.Dependency{kafka, grpc}}}},
+		},
+	}
+	for _, test := range tests {
+		merged, disagreements := mergeReplicaResults(test.results)
+		if !reflect.DeepEqual(merged, test.want) {
+			t.Errorf("%s: merged result = %+v, want %+v", test.name, merged, test.want)
+		}
+		if !reflect.DeepEqual(disagreements, test.wantDisagreements) {
+			t.Errorf("%s: disagreements = %q, want %q", test.name, disagreements, test.wantDisagreements)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package controllers
+
+import (
+	"context"
+	"strconv"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/rollouts"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const deploymentRevisionAnnotation = "deployment.kubernetes.io/revision"
+
+// choosePod returns a running pod of the current revision of the workload
+func (r *InstrumentedApplicationReconciler) choosePod(ctx context.Context, instrumentedApp *v1.InstrumentedApplication) (*corev1.Pod, error) {
+	pods, err := r.choosePods(ctx, instrumentedApp, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &pods[0], nil
+}
+
+// choosePods returns up to count running pods of the current revision of the workload, on different nodes when possible
+func (r *InstrumentedApplicationReconciler) choosePods(ctx context.Context, instrumentedApp *v1.InstrumentedApplication, count int) ([]corev1.Pod, error) {
+	pods, err := r.currentRevisionPods(ctx, instrumentedApp)
+	if err != nil {
+		return nil, err
+	}
+	if len(pods) == 0 {
+		return nil, consts.PodsNotFoundErr
+	}
+
+	var chosen []corev1.Pod
+	nodes := make(map[string]bool)
+	for _, pod := range pods {
+		if len(chosen) < count && !nodes[pod.Spec.NodeName] {
+			chosen = append(chosen, pod)
+			nodes[pod.Spec.NodeName] = true
+		}
+	}
+	for _, pod := range pods {
+		if len(chosen) < count && nodes[pod.Spec.NodeName] && !containsPod(chosen, pod.UID) {
+			chosen = append(chosen, pod)
+		}
+	}
+	return chosen, nil
+}
+
+// currentRevisionPods returns the running pods owned by the current revision of the workload, read by its adapter
+func (r *InstrumentedApplicationReconciler) currentRevisionPods(ctx context.Context, instrumentedApp *v1.InstrumentedApplication) ([]corev1.Pod, error) {
+	workload, obj, err := r.getOwner(ctx, instrumentedApp)
+	if err != nil {
+		return nil, err
+	}
+	return workload.CurrentPods(ctx, r.Client, obj)
+}
+
+// deploymentPods returns the running pods of the ReplicaSet of the current deployment revision
+func deploymentPods(ctx context.Context, c client.Reader, obj client.Object) ([]corev1.Pod, error) {
+	dep := obj.(*appsv1.Deployment)
+	rs, err := currentReplicaSet(ctx, c, dep)
+	if err != nil {
+		return nil, err
+	}
+	return runningPodsOf(ctx, c, dep.Namespace, dep.Spec.Template.Labels, rs.UID,
+		appsv1.DefaultDeploymentUniqueLabelKey, rs.Labels[appsv1.DefaultDeploymentUniqueLabelKey])
+}
+
+// statefulSetPods returns the running pods of the update revision of the statefulset
+func statefulSetPods(ctx context.Context, c client.Reader, obj client.Object) ([]corev1.Pod, error) {
+	ss := obj.(*appsv1.StatefulSet)
+	revision := ss.Status.UpdateRevision
+	if revision == "" {
+		revision = ss.Status.CurrentRevision
+	}
+	return runningPodsOf(ctx, c, ss.Namespace, ss.Spec.Template.Labels, ss.UID, appsv1.ControllerRevisionHashLabelKey, revision)
+}
+
+// daemonSetPods returns the running pods of the newest revision of the daemonset
+func daemonSetPods(ctx context.Context, c client.Reader, obj client.Object) ([]corev1.Pod, error) {
+	ds := obj.(*appsv1.DaemonSet)
+	revision, err := currentControllerRevision(ctx, c, ds)
+	if err != nil {
+		return nil, err
+	}
+	return runningPodsOf(ctx, c, ds.Namespace, ds.Spec.Template.Labels, ds.UID, appsv1.DefaultDaemonSetUniqueLabelKey, revision)
+}
+
+// rolloutPods returns the running pods of the desired revision of the rollout
+func rolloutPods(ctx context.Context, c client.Reader, obj client.Object) ([]corev1.Pod, error) {
+	ro := obj.(*rollouts.Rollout)
+	rs, err := currentRolloutReplicaSet(ctx, c, ro)
+	if err != nil {
+		return nil, err
+	}
+	return runningPodsOf(ctx, c, ro.Namespace, ro.Spec.Template.Labels, rs.UID, rollouts.PodTemplateHashLabel, ro.Status.CurrentPodHash)
+}
+
+// currentReplicaSet returns the ReplicaSet of the deployment revision, or its newest ReplicaSet
+func currentReplicaSet(ctx context.Context, c client.Reader, dep *appsv1.Deployment) (*appsv1.ReplicaSet, error) {
+	var replicaSets appsv1.ReplicaSetList
+	err := c.List(ctx, &replicaSets, client.InNamespace(dep.Namespace), client.MatchingLabels(dep.Spec.Template.Labels))
+	if err != nil {
+		return nil, err
+	}
+
+	var current *appsv1.ReplicaSet
+	currentRevision := -1
+	for i := range replicaSets.Items {
+		rs := &replicaSets.Items[i]
+		if !isControlledBy(rs, dep.UID) {
+			continue
+		}
+		if rs.Annotations[deploymentRevisionAnnotation] == dep.Annotations[deploymentRevisionAnnotation] && dep.Annotations[deploymentRevisionAnnotation] != "" {
+			return rs, nil
+		}
+		if revision, err := strconv.Atoi(rs.Annotations[deploymentRevisionAnnotation]); err == nil && revision > currentRevision {
+			current, currentRevision = rs, revision
+		}
+	}
+	if current == nil {
+		return nil, consts.PodsNotFoundErr
+	}
+	return current, nil
+}
+
+// currentRolloutReplicaSet returns the ReplicaSet of the desired revision of the rollout, during a canary update it
+// runs the canary pods
+func currentRolloutReplicaSet(ctx context.Context, c client.Reader, ro *rollouts.Rollout) (*appsv1.ReplicaSet, error) {
+	if ro.Status.CurrentPodHash == "" {
+		return nil, consts.PodsNotFoundErr
+	}
+	var replicaSets appsv1.ReplicaSetList
+	err := c.List(ctx, &replicaSets, client.InNamespace(ro.Namespace),
+		client.MatchingLabels{rollouts.PodTemplateHashLabel: ro.Status.CurrentPodHash})
+	if err != nil {
+		return nil, err
+	}
+	for i := range replicaSets.Items {
+		if isControlledBy(&replicaSets.Items[i], ro.UID) {
+			return &replicaSets.Items[i], nil
+		}
+	}
+	return nil, consts.PodsNotFoundErr
+}
+
+// currentControllerRevision returns the hash of the newest ControllerRevision of the daemonset, the pods of its current
+// template are labelled with it. A daemonset with the OnDelete update strategy keeps running pods of older revisions
+// until they are deleted
+func currentControllerRevision(ctx context.Context, c client.Reader, ds *appsv1.DaemonSet) (string, error) {
+	var revisions appsv1.ControllerRevisionList
+	err := c.List(ctx, &revisions, client.InNamespace(ds.Namespace), client.MatchingLabels(ds.Spec.Template.Labels))
+	if err != nil {
+		return "", err
+	}
+
+	var current *appsv1.ControllerRevision
+	for i := range revisions.Items {
+		revision := &revisions.Items[i]
+		if isControlledBy(revision, ds.UID) && (current == nil || revision.Revision > current.Revision) {
+			current = revision
+		}
+	}
+	if current == nil {
+		return "", consts.PodsNotFoundErr
+	}
+	return current.Labels[appsv1.DefaultDaemonSetUniqueLabelKey], nil
+}
+
+// runningPodsOf lists the running pods matching the template labels, controlled by the owner and labelled with the
+// revision, an empty owner UID or revision label matches any pod
+func runningPodsOf(ctx context.Context, c client.Reader, namespace string, templateLabels map[string]string,
+	ownerUID types.UID, revisionLabel string, revision string) ([]corev1.Pod, error) {
+	labels := client.MatchingLabels{}
+	for k, v := range templateLabels {
+		labels[k] = v
+	}
+	if revisionLabel != "" && revision != "" {
+		labels[revisionLabel] = revision
+	}
+
+	var podList corev1.PodList
+	err := c.List(ctx, &podList, labels, client.InNamespace(namespace))
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []corev1.Pod
+	for _, pod := range podList.Items {
+		if pod.Status.Phase == corev1.PodRunning && (ownerUID == "" || isControlledBy(&pod, ownerUID)) {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+func isControlledBy(obj metav1.Object, ownerUID types.UID) bool {
+	owner := metav1.GetControllerOf(obj)
+	return owner != nil && owner.UID == ownerUID
+}
+
+func containsPod(pods []corev1.Pod, uid types.UID) bool {
+	for _, pod := range pods {
+		if pod.UID == uid {
+			return true
+		}
+	}
+	return false
+}
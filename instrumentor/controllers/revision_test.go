@@ -0,0 +1,374 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/rollouts"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var revisionLabels = map[string]string{"app": "orders"}
+
+func revisionReplicaSet(name string, revision string, owner metav1.OwnerReference) *appsv1.ReplicaSet {
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "shop",
+		Name:            name,
+		UID:             types.UID("shop-" + name),
+		Labels:          map[string]string{"app": "orders", appsv1.DefaultDeploymentUniqueLabelKey: name},
+		OwnerReferences: []metav1.OwnerReference{owner},
+	}}
+	if revision != "" {
+		rs.Annotations = map[string]string{deploymentRevisionAnnotation: revision}
+	}
+	return rs
+}
+
+// revisionPod returns a pod of the revision labelled with the hash, controlled by the owner
+func revisionPod(name string, node string, hashLabel string, hash string, owner metav1.OwnerReference) *corev1.Pod {
+	return runningPod("shop", name, node, map[string]string{"app": "orders", hashLabel: hash}, owner)
+}
+
+func controllerRevision(name string, revision int64, owner metav1.OwnerReference) *appsv1.ControllerRevision {
+	return &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "shop",
+			Name:            "orders-" + name,
+			Labels:          map[string]string{"app": "orders", appsv1.DefaultDaemonSetUniqueLabelKey: name},
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Revision: revision,
+	}
+}
+
+func TestCurrentReplicaSet(t *testing.T) {
+	depOwner := controllerReference("apps/v1", "Deployment", "orders", "dep-1")
+	otherOwner := controllerReference("apps/v1", "Deployment", "orders-canary", "dep-2")
+	tests := []struct {
+		name        string
+		revision    string
+		replicaSets []client.Object
+		want        string
+		wantErr     error
+	}{
+		{
+			name:     "replica set of the deployment revision",
+			revision: "2",
+			replicaSets: []client.Object{
+				revisionReplicaSet("orders-a", "1", depOwner),
+				revisionReplicaSet("orders-b", "2", depOwner),
+				revisionReplicaSet("orders-c", "3", depOwner),
+			},
+			want: "orders-b",
+		},
+		{
+			name: "deployment without revision falls back to the highest revision",
+			replicaSets: []client.Object{
+				revisionReplicaSet("orders-a", "9", depOwner),
+				revisionReplicaSet("orders-b", "10", depOwner),
+				revisionReplicaSet("orders-c", "2", depOwner),
+			},
+			want: "orders-b",
+		},
+		{
+			name:     "replica set of the revision not created yet",
+			revision: "4",
+			replicaSets: []client.Object{
+				revisionReplicaSet("orders-a", "3", depOwner),
+				revisionReplicaSet("orders-b", "1", depOwner),
+			},
+			want: "orders-a",
+		},
+		{
+			name:     "replica sets of another deployment are ignored",
+			revision: "1",
+			replicaSets: []client.Object{
+				revisionReplicaSet("orders-a", "1", otherOwner),
+				revisionReplicaSet("orders-b", "1", depOwner),
+			},
+			want: "orders-b",
+		},
+		{
+			name: "invalid revisions are ignored",
+			replicaSets: []client.Object{
+				revisionReplicaSet("orders-a", "latest", depOwner),
+				revisionReplicaSet("orders-b", "1", depOwner),
+				revisionReplicaSet("orders-c", "", depOwner),
+			},
+			want: "orders-b",
+		},
+		{
+			name:        "no replica set",
+			replicaSets: []client.Object{revisionReplicaSet("orders-a", "1", otherOwner)},
+			wantErr:     consts.PodsNotFoundErr,
+		},
+	}
+	for _, test := range tests {
+		dep := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "orders", UID: "dep-1"},
+			Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: revisionLabels}}},
+		}
+		if test.revision != "" {
+			dep.Annotations = map[string]string{deploymentRevisionAnnotation: test.revision}
+		}
+		r := newTestReconciler(t, test.replicaSets...)
+
+		rs, err := currentReplicaSet(context.Background(), r.Client, dep)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: currentReplicaSet() error = %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && rs.Name != test.want {
+			t.Errorf("%s: currentReplicaSet() = %s, want %s", test.name, rs.Name, test.want)
+		}
+	}
+}
+
+func TestCurrentControllerRevision(t *testing.T) {
+	dsOwner := controllerReference("apps/v1", "DaemonSet", "orders", "ds-1")
+	otherOwner := controllerReference("apps/v1", "DaemonSet", "orders-debug", "ds-2")
+	tests := []struct {
+		name      string
+		revisions []client.Object
+		want      string
+		wantErr   error
+	}{
+		{
+			name: "newest revision",
+			revisions: []client.Object{
+				controllerRevision("7b6c", 2, dsOwner),
+				controllerRevision("5f4d", 3, dsOwner),
+				controllerRevision("9a8e", 1, dsOwner),
+			},
+			want: "5f4d",
+		},
+		{
+			name: "revisions of another daemonset are ignored",
+			revisions: []client.Object{
+				controllerRevision("7b6c", 1, dsOwner),
+				controllerRevision("5f4d", 4, otherOwner),
+			},
+			want: "7b6c",
+		},
+		{
+			name:      "no revision",
+			revisions: []client.Object{controllerRevision("5f4d", 1, otherOwner)},
+			wantErr:   consts.PodsNotFoundErr,
+		},
+	}
+	for _, test := range tests {
+		ds := &appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "orders", UID: "ds-1"},
+			Spec:       appsv1.DaemonSetSpec{Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: revisionLabels}}},
+		}
+		r := newTestReconciler(t, test.revisions...)
+
+		got, err := currentControllerRevision(context.Background(), r.Client, ds)
+		if !errors.Is(err, test.wantErr) || got != test.want {
+			t.Errorf("%s: currentControllerRevision() = (%s, %v), want (%s, %v)", test.name, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestChoosePods(t *testing.T) {
+	template := corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: revisionLabels}}
+	depOwner := controllerReference("apps/v1", "Deployment", "orders", "dep-1")
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "orders", UID: "dep-1", Annotations: map[string]string{deploymentRevisionAnnotation: "2"}},
+		Spec:       appsv1.DeploymentSpec{Template: template},
+	}
+	oldRS := revisionReplicaSet("orders-old", "1", depOwner)
+	newRS := revisionReplicaSet("orders-new", "2", depOwner)
+	oldRSOwner := controllerReference("apps/v1", "ReplicaSet", oldRS.Name, oldRS.UID)
+	newRSOwner := controllerReference("apps/v1", "ReplicaSet", newRS.Name, newRS.UID)
+	unrevisioned := deployment.DeepCopy()
+	unrevisioned.Annotations = nil
+
+	ssOwner := controllerReference("apps/v1", "StatefulSet", "orders", "ss-1")
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "orders", UID: "ss-1"},
+		Spec:       appsv1.StatefulSetSpec{Template: template},
+		Status:     appsv1.StatefulSetStatus{CurrentRevision: "orders-1", UpdateRevision: "orders-2"},
+	}
+	settledStatefulSet := statefulSet.DeepCopy()
+	settledStatefulSet.Status.UpdateRevision = ""
+
+	dsOwner := controllerReference("apps/v1", "DaemonSet", "orders", "ds-1")
+	daemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "orders", UID: "ds-1"},
+		Spec: appsv1.DaemonSetSpec{
+			Template:       template,
+			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{Type: appsv1.OnDeleteDaemonSetStrategyType},
+		},
+	}
+
+	roOwner := controllerReference(rollouts.GroupVersion.String(), rollouts.Kind, "orders", "ro-1")
+	rollout := &rollouts.Rollout{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "orders", UID: "ro-1"},
+		Spec:       rollouts.RolloutSpec{Template: template},
+		Status:     rollouts.RolloutStatus{CurrentPodHash: "canary", StableRS: "stable"},
+	}
+	stableRS := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "shop", Name: "orders-stable", UID: "rs-stable",
+		Labels:          map[string]string{"app": "orders", rollouts.PodTemplateHashLabel: "stable"},
+		OwnerReferences: []metav1.OwnerReference{roOwner},
+	}}
+	canaryRS := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "shop", Name: "orders-canary", UID: "rs-canary",
+		Labels:          map[string]string{"app": "orders", rollouts.PodTemplateHashLabel: "canary"},
+		OwnerReferences: []metav1.OwnerReference{roOwner},
+	}}
+	unsetRollout := rollout.DeepCopy()
+	unsetRollout.Status = rollouts.RolloutStatus{}
+
+	hash := appsv1.DefaultDeploymentUniqueLabelKey
+	pending := revisionPod("orders-new-p", "node-a", hash, newRS.Name, newRSOwner)
+	pending.Status.Phase = corev1.PodPending
+
+	tests := []struct {
+		name    string
+		owner   metav1.OwnerReference
+		objects []client.Object
+		count   int
+		want    []string
+		wantErr error
+	}{
+		{
+			name:  "deployment during a rollout",
+			owner: depOwner,
+			objects: []client.Object{deployment, oldRS, newRS,
+				revisionPod("orders-old-a", "node-a", hash, oldRS.Name, oldRSOwner),
+				revisionPod("orders-new-b", "node-b", hash, newRS.Name, newRSOwner),
+				pending,
+			},
+			count: 3,
+			want:  []string{"orders-new-b"},
+		},
+		{
+			name:  "deployment without revision falls back to the highest revision",
+			owner: depOwner,
+			objects: []client.Object{unrevisioned, oldRS, newRS,
+				revisionPod("orders-old-a", "node-a", hash, oldRS.Name, oldRSOwner),
+				revisionPod("orders-new-b", "node-b", hash, newRS.Name, newRSOwner),
+			},
+			count: 1,
+			want:  []string{"orders-new-b"},
+		},
+		{
+			name:  "deployment replicas on different nodes first",
+			owner: depOwner,
+			objects: []client.Object{deployment, newRS,
+				revisionPod("orders-new-a", "node-a", hash, newRS.Name, newRSOwner),
+				revisionPod("orders-new-b", "node-a", hash, newRS.Name, newRSOwner),
+				revisionPod("orders-new-c", "node-b", hash, newRS.Name, newRSOwner),
+			},
+			count: 2,
+			want:  []string{"orders-new-a", "orders-new-c"},
+		},
+		{
+			name:  "deployment replicas on the same node when no other node runs one",
+			owner: depOwner,
+			objects: []client.Object{deployment, newRS,
+				revisionPod("orders-new-a", "node-a", hash, newRS.Name, newRSOwner),
+				revisionPod("orders-new-b", "node-a", hash, newRS.Name, newRSOwner),
+				revisionPod("orders-new-c", "node-b", hash, newRS.Name, newRSOwner),
+			},
+			count: 3,
+			want:  []string{"orders-new-a", "orders-new-c", "orders-new-b"},
+		},
+		{
+			name:  "pods of another workload sharing the labels",
+			owner: depOwner,
+			objects: []client.Object{deployment, newRS,
+				revisionPod("orders-other", "node-a", hash, newRS.Name, oldRSOwner),
+			},
+			count:   1,
+			wantErr: consts.PodsNotFoundErr,
+		},
+		{
+			name:  "statefulset update revision",
+			owner: ssOwner,
+			objects: []client.Object{statefulSet,
+				revisionPod("orders-0", "node-a", appsv1.ControllerRevisionHashLabelKey, "orders-1", ssOwner),
+				revisionPod("orders-1", "node-b", appsv1.ControllerRevisionHashLabelKey, "orders-2", ssOwner),
+			},
+			count: 2,
+			want:  []string{"orders-1"},
+		},
+		{
+			name:  "statefulset current revision",
+			owner: ssOwner,
+			objects: []client.Object{settledStatefulSet,
+				revisionPod("orders-0", "node-a", appsv1.ControllerRevisionHashLabelKey, "orders-1", ssOwner),
+				revisionPod("orders-1", "node-b", appsv1.ControllerRevisionHashLabelKey, "orders-1", ssOwner),
+			},
+			count: 2,
+			want:  []string{"orders-0", "orders-1"},
+		},
+		{
+			name:  "daemonset newest revision",
+			owner: dsOwner,
+			objects: []client.Object{daemonSet, controllerRevision("old", 1, dsOwner), controllerRevision("new", 2, dsOwner),
+				revisionPod("orders-a", "node-a", appsv1.DefaultDaemonSetUniqueLabelKey, "old", dsOwner),
+				revisionPod("orders-b", "node-b", appsv1.DefaultDaemonSetUniqueLabelKey, "new", dsOwner),
+			},
+			count: 2,
+			want:  []string{"orders-b"},
+		},
+		{
+			name:  "on delete daemonset with only pods of older revisions",
+			owner: dsOwner,
+			objects: []client.Object{daemonSet, controllerRevision("old", 1, dsOwner), controllerRevision("new", 2, dsOwner),
+				revisionPod("orders-a", "node-a", appsv1.DefaultDaemonSetUniqueLabelKey, "old", dsOwner),
+				revisionPod("orders-b", "node-b", appsv1.DefaultDaemonSetUniqueLabelKey, "old", dsOwner),
+			},
+			count:   1,
+			wantErr: consts.PodsNotFoundErr,
+		},
+		{
+			name:  "rollout canary pods",
+			owner: roOwner,
+			objects: []client.Object{rollout, stableRS, canaryRS,
+				revisionPod("orders-stable-a", "node-a", rollouts.PodTemplateHashLabel, "stable", controllerReference("apps/v1", "ReplicaSet", stableRS.Name, stableRS.UID)),
+				revisionPod("orders-canary-a", "node-b", rollouts.PodTemplateHashLabel, "canary", controllerReference("apps/v1", "ReplicaSet", canaryRS.Name, canaryRS.UID)),
+			},
+			count: 2,
+			want:  []string{"orders-canary-a"},
+		},
+		{
+			name:  "rollout without a desired revision",
+			owner: roOwner,
+			objects: []client.Object{unsetRollout, stableRS,
+				revisionPod("orders-stable-a", "node-a", rollouts.PodTemplateHashLabel, "stable", controllerReference("apps/v1", "ReplicaSet", stableRS.Name, stableRS.UID)),
+			},
+			count:   1,
+			wantErr: consts.PodsNotFoundErr,
+		},
+	}
+	for _, test := range tests {
+		app := runningInstrumentedApp("shop", "orders")
+		app.OwnerReferences = []metav1.OwnerReference{test.owner}
+		r := newTestReconciler(t, append(test.objects, app)...)
+		r.Workloads = append(BuiltinWorkloads(), RolloutWorkload())
+
+		pods, err := r.choosePods(context.Background(), app, test.count)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: choosePods() error = %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+		var got []string
+		for _, pod := range pods {
+			got = append(got, pod.Name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: choosePods() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
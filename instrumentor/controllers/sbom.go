@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/sbom"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	sbomLabel         = "logz.io/sbom"
+	sbomNamePrefix    = "sbom-"
+	sbomKey           = "bom.json"
+	sbomWorkloadLabel = "logz.io/sbom-instrumented-application"
+	// sbomCompressedKey holds the gzipped SBOM in the binary data of the ConfigMap when the JSON does not fit in it
+	sbomCompressedKey = "bom.json.gz"
+	// maxSBOMSize keeps the SBOM below the 1 MiB ConfigMap limit, leaving room for the metadata of the ConfigMap
+	maxSBOMSize = 1024*1024 - 64*1024
+)
+
+// storeSBOM writes the dependencies detected in the containers of the workload as a CycloneDX SBOM to a ConfigMap
+// next to the InstrumentedApplication, owned by it. Results without dependencies, like the compact termination message,
+// keep the previous SBOM. With a vulnerability database the SBOM keeps the dependencies scanned again after a reload.
+// An SBOM larger than a ConfigMap is stored gzipped, the outcome is set in the SBOMStored condition of the status
+func (r *InstrumentedApplicationReconciler) storeSBOM(ctx context.Context, logger logr.Logger, instrumentedApp *v1.InstrumentedApplication, result common.DetectionResult) {
+	if (!r.ExportSBOM && r.VulnerabilityDatabase == nil) || len(result.DependenciesByContainer) == 0 {
+		return
+	}
+
+	data, err := sbom.Build(instrumentedApp.Namespace, instrumentedApp.Name, result.DependenciesByContainer).Marshal()
+	if err != nil {
+		logger.Error(err, "error serializing sbom")
+		setCondition(instrumentedApp, v1.SBOMStoredCondition, false, v1.SBOMStoreFailedReason, err.Error())
+		return
+	}
+
+	cm := corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sbomNamePrefix + instrumentedApp.Name,
+			Namespace: instrumentedApp.Namespace,
+			Labels: map[string]string{
+				sbomLabel:         "true",
+				sbomWorkloadLabel: instrumentedApp.Name,
+			},
+		},
+	}
+	reason, message := v1.SBOMStoredReason, fmt.Sprintf("the SBOM is stored under the %s key of the %s ConfigMap", sbomKey, cm.Name)
+	if len(data) <= maxSBOMSize {
+		cm.Data = map[string]string{sbomKey: string(data)}
+	} else {
+		compressed, err := gzipData(data)
+		if err != nil || len(compressed) > maxSBOMSize {
+			// a stale SBOM would not match the detected dependencies
+			if err = r.Delete(ctx, &cm); client.IgnoreNotFound(err) != nil {
+				logger.Error(err, "error deleting stale sbom", "configmap", cm.Name)
+			}
+			setCondition(instrumentedApp, v1.SBOMStoredCondition, false, v1.SBOMTooLargeReason,
+				fmt.Sprintf("the SBOM of %d bytes does not fit in a ConfigMap, even compressed", len(data)))
+			return
+		}
+		cm.BinaryData = map[string][]byte{sbomCompressedKey: compressed}
+		reason, message = v1.SBOMCompressedReason, fmt.Sprintf("the SBOM of %d bytes is stored gzipped under the %s key of the %s ConfigMap", len(data), sbomCompressedKey, cm.Name)
+	}
+
+	if err = ctrl.SetControllerReference(instrumentedApp, &cm, r.Scheme); err != nil {
+		logger.Error(err, "error setting sbom owner")
+		setCondition(instrumentedApp, v1.SBOMStoredCondition, false, v1.SBOMStoreFailedReason, err.Error())
+		return
+	}
+	err = r.Create(ctx, &cm)
+	if apierrors.IsAlreadyExists(err) {
+		err = r.Update(ctx, &cm)
+	}
+	if err != nil {
+		logger.Error(err, "error storing sbom", "configmap", cm.Name)
+		setCondition(instrumentedApp, v1.SBOMStoredCondition, false, v1.SBOMStoreFailedReason, err.Error())
+		return
+	}
+	setCondition(instrumentedApp, v1.SBOMStoredCondition, true, reason, message)
+}
+
+// sbomData returns the SBOM JSON stored in the ConfigMap, plain or gzipped
+func sbomData(cm *corev1.ConfigMap) ([]byte, error) {
+	compressed, exists := cm.BinaryData[sbomCompressedKey]
+	if !exists {
+		return []byte(cm.Data[sbomKey]), nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func gzipData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
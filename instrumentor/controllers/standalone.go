@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ownedSkipReason skips the ReplicaSets and pods controlled by a workload, they are detected and instrumented through
+// the InstrumentedApplication of the workload
+func ownedSkipReason(obj client.Object) string {
+	if owner := metav1.GetControllerOf(obj); owner != nil {
+		return "controlled by " + owner.Kind + " " + owner.Name
+	}
+	return ""
+}
+
+// standalonePodSkipReason skips the pods controlled by a workload and the detection pods of the instrumentor, which
+// are standalone when they run in the instrumentor namespace
+func standalonePodSkipReason(pod *corev1.Pod) string {
+	if isDetectionPod(pod) {
+		return "detection pod"
+	}
+	return ownedSkipReason(pod)
+}
+
+// isDetectionPod reports whether the pod is a detection pod of the instrumentor
+func isDetectionPod(pod *corev1.Pod) bool {
+	return pod.Labels[DetectionPodLabel] != "" || pod.Annotations[consts.InstrumentationDetectionContainerAnnotationKey] != ""
+}
+
+// standalonePodTemplate returns the labels, annotations and spec of a pod as a pod template
+func standalonePodTemplate(pod *corev1.Pod) *corev1.PodTemplateSpec {
+	return &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pod.Name,
+			Labels:      pod.Labels,
+			Annotations: pod.Annotations,
+		},
+		Spec: pod.Spec,
+	}
+}
+
+// standalonePodReady creates the InstrumentedApplication of a pod once it runs
+func standalonePodReady(pod *corev1.Pod) int32 {
+	if pod.Status.Phase == corev1.PodRunning {
+		return 1
+	}
+	return 0
+}
+
+// standalonePodWarning explains why a standalone pod is not instrumented
+func standalonePodWarning(pod *corev1.Pod) string {
+	return fmt.Sprintf("%s %s is not instrumented, the spec of a pod can not be changed after it is created, instrument "+
+		"the workload creating it", consts.SupportedResourcePod, pod.Name)
+}
+
+// standalonePodPods returns the pod when it runs
+func standalonePodPods(_ context.Context, _ client.Reader, obj client.Object) ([]corev1.Pod, error) {
+	pod := obj.(*corev1.Pod)
+	if pod.Status.Phase != corev1.PodRunning {
+		return nil, nil
+	}
+	return []corev1.Pod{*pod}, nil
+}
+
+// replicaSetPods returns the running pods of the ReplicaSet
+func replicaSetPods(ctx context.Context, c client.Reader, obj client.Object) ([]corev1.Pod, error) {
+	rs := obj.(*appsv1.ReplicaSet)
+	return runningPodsOf(ctx, c, rs.Namespace, rs.Spec.Template.Labels, rs.UID, "", "")
+}
+
+// isStandaloneOwner reports whether the InstrumentedApplication belongs to a pod or a ReplicaSet
+func isStandaloneOwner(instrumentedApp *v1.InstrumentedApplication) bool {
+	owner := metav1.GetControllerOf(instrumentedApp)
+	return owner != nil && ((owner.APIVersion == corev1.SchemeGroupVersion.String() && owner.Kind == consts.SupportedResourcePod) ||
+		(owner.APIVersion == appsv1.SchemeGroupVersion.String() && owner.Kind == consts.SupportedResourceReplicaSet))
+}
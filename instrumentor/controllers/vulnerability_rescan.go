@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/sbom"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// rescanVulnerabilities matches the detected libraries of every InstrumentedApplication against the vulnerability
+// database again after it was reloaded, the libraries are read back from their SBOM ConfigMap. It runs on the leader
+func (r *InstrumentedApplicationReconciler) rescanVulnerabilities(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("vulnerability-rescan")
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-r.VulnerabilityDatabase.Reloaded():
+			var instrumentedApps v1.InstrumentedApplicationList
+			if err := r.List(ctx, &instrumentedApps); err != nil {
+				logger.Error(err, "error listing instrumented applications")
+				continue
+			}
+			for i := range instrumentedApps.Items {
+				if err := r.rescanInstrumentedApplication(ctx, &instrumentedApps.Items[i]); err != nil {
+					logger.Error(err, "error scanning instrumented application", "instrumentedApplication", client.ObjectKeyFromObject(&instrumentedApps.Items[i]))
+				}
+			}
+		}
+	}
+}
+
+func (r *InstrumentedApplicationReconciler) rescanInstrumentedApplication(ctx context.Context, instrumentedApp *v1.InstrumentedApplication) error {
+	if instrumentedApp.Status.InstrumentationDetection.Phase != v1.CompletedInstrumentationDetectionPhase {
+		return nil
+	}
+	var cm corev1.ConfigMap
+	err := r.APIReader.Get(ctx, client.ObjectKey{Namespace: instrumentedApp.Namespace, Name: sbomNamePrefix + instrumentedApp.Name}, &cm)
+	if apierrors.IsNotFound(err) {
+		// no full detection result was reported, nothing was scanned
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := sbomData(&cm)
+	if err != nil {
+		return err
+	}
+	dependencies, err := sbom.Dependencies(data)
+	if err != nil || len(dependencies) == 0 {
+		return err
+	}
+
+	vulnerabilities := r.VulnerabilityDatabase.Scan(dependencies)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := r.Get(ctx, client.ObjectKeyFromObject(instrumentedApp), instrumentedApp); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		if reflect.DeepEqual(vulnerabilities, instrumentedApp.Status.Vulnerabilities) {
+			return nil
+		}
+		instrumentedApp.Status.Vulnerabilities = vulnerabilities
+		return updateStatus(ctx, r.Client, instrumentedApp)
+	})
+}
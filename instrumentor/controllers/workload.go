@@ -0,0 +1,252 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/rollouts"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// readyWithoutPods creates the InstrumentedApplication of a workload whose ready pods are unknown or may not run, such
+// as a CronJob between its runs. It is detected from its images without waiting for a pod
+const readyWithoutPods int32 = 1
+
+// WorkloadAdapter reads and patches the pod template of a kind of workload. The built-in kinds are typed, the kinds
+// of the workload config are read by paths in their unstructured content
+type WorkloadAdapter interface {
+	GroupVersionKind() schema.GroupVersionKind
+	// NewObject returns an empty object of the kind to read a workload into
+	NewObject() client.Object
+	// PodTemplate returns the pod template of the workload, SetPodTemplate writes a changed template back before the
+	// workload is updated
+	PodTemplate(obj client.Object) (*corev1.PodTemplateSpec, error)
+	SetPodTemplate(obj client.Object, template *corev1.PodTemplateSpec) error
+	// ReadyReplicas returns the ready pods of the workload, its InstrumentedApplication is created once one is ready
+	ReadyReplicas(obj client.Object) int32
+	// PodSelector returns the labels of the pods of the workload
+	PodSelector(obj client.Object) (map[string]string, error)
+	// CurrentPods returns the running pods of the current revision of the workload. Pods of a previous revision during
+	// a rollout, or of another workload sharing the template labels, are not candidates
+	CurrentPods(ctx context.Context, c client.Reader, obj client.Object) ([]corev1.Pod, error)
+	// SkipReason returns why the workload is not synced now, empty when it is
+	SkipReason(obj client.Object) string
+	// ImmutableReason returns why the pod template of the workload can not be changed, empty when it can. Such
+	// workloads are detected but not instrumented
+	ImmutableReason(obj client.Object) string
+}
+
+// Workloads are the workload kinds the instrumentor detects and instruments
+type Workloads []WorkloadAdapter
+
+// adapterFor returns the adapter of the kind, nil when the kind is not supported
+func (w Workloads) adapterFor(apiVersion string, kind string) WorkloadAdapter {
+	for _, adapter := range w {
+		gvk := adapter.GroupVersionKind()
+		if gvk.GroupVersion().String() == apiVersion && gvk.Kind == kind {
+			return adapter
+		}
+	}
+	return nil
+}
+
+// Add adds a workload kind, a kind can only be supported once
+func (w Workloads) Add(adapter WorkloadAdapter) (Workloads, error) {
+	gvk := adapter.GroupVersionKind()
+	for _, existing := range w {
+		if existing.GroupVersionKind().GroupKind() == gvk.GroupKind() {
+			return w, fmt.Errorf("workload kind %s is already supported", gvk.GroupKind())
+		}
+	}
+	return append(w, adapter), nil
+}
+
+// ownerIndexKey indexes the InstrumentedApplications by the name of their workload of the kind
+func ownerIndexKey(gvk schema.GroupVersionKind) string {
+	return fmt.Sprintf(".metadata.%s.controller", strings.ToLower(gvk.GroupKind().String()))
+}
+
+// instrumentedAppOf returns the InstrumentedApplication controlled by the workload of the kind, nil when it has none.
+// It is found by its owner rather than by name, since workloads of different kinds may share a name
+func instrumentedAppOf(ctx context.Context, c client.Reader, gvk schema.GroupVersionKind, namespace string, name string, uid types.UID) (*v1.InstrumentedApplication, error) {
+	var instrumentedApps v1.InstrumentedApplicationList
+	err := c.List(ctx, &instrumentedApps, client.InNamespace(namespace), client.MatchingFields{ownerIndexKey(gvk): name})
+	if err != nil {
+		return nil, err
+	}
+	for i := range instrumentedApps.Items {
+		if isControlledBy(&instrumentedApps.Items[i], uid) {
+			return &instrumentedApps.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// kindQualifiedName names the InstrumentedApplication of a workload whose name is taken by the InstrumentedApplication
+// of a workload of another kind in the namespace
+func kindQualifiedName(gvk schema.GroupVersionKind, name string) string {
+	return name + "-" + strings.ToLower(gvk.Kind)
+}
+
+// typedWorkload is the adapter of a kind with a go type, its pod template is a field of the object
+type typedWorkload struct {
+	gvk       schema.GroupVersionKind
+	newObject func() client.Object
+	template  func(obj client.Object) *corev1.PodTemplateSpec
+	ready     func(obj client.Object) int32
+	pods      func(ctx context.Context, c client.Reader, obj client.Object) ([]corev1.Pod, error)
+	skip      func(obj client.Object) string
+	immutable func(obj client.Object) string
+}
+
+func (w *typedWorkload) GroupVersionKind() schema.GroupVersionKind {
+	return w.gvk
+}
+
+func (w *typedWorkload) NewObject() client.Object {
+	return w.newObject()
+}
+
+func (w *typedWorkload) PodTemplate(obj client.Object) (*corev1.PodTemplateSpec, error) {
+	return w.template(obj), nil
+}
+
+func (w *typedWorkload) SetPodTemplate(obj client.Object, template *corev1.PodTemplateSpec) error {
+	if current := w.template(obj); current != template {
+		template.DeepCopyInto(current)
+	}
+	return nil
+}
+
+func (w *typedWorkload) ReadyReplicas(obj client.Object) int32 {
+	return w.ready(obj)
+}
+
+func (w *typedWorkload) PodSelector(obj client.Object) (map[string]string, error) {
+	return w.template(obj).Labels, nil
+}
+
+func (w *typedWorkload) CurrentPods(ctx context.Context, c client.Reader, obj client.Object) ([]corev1.Pod, error) {
+	return w.pods(ctx, c, obj)
+}
+
+func (w *typedWorkload) SkipReason(obj client.Object) string {
+	if w.skip == nil {
+		return ""
+	}
+	return w.skip(obj)
+}
+
+func (w *typedWorkload) ImmutableReason(obj client.Object) string {
+	if w.immutable == nil {
+		return ""
+	}
+	return w.immutable(obj)
+}
+
+// BuiltinWorkloads returns the adapters of the kubernetes workload kinds
+func BuiltinWorkloads() Workloads {
+	return Workloads{
+		&typedWorkload{
+			gvk:       appsv1.SchemeGroupVersion.WithKind(consts.SupportedResourceDeployment),
+			newObject: func() client.Object { return &appsv1.Deployment{} },
+			template:  func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.Deployment).Spec.Template },
+			ready:     func(obj client.Object) int32 { return obj.(*appsv1.Deployment).Status.ReadyReplicas },
+			pods:      deploymentPods,
+		},
+		&typedWorkload{
+			gvk:       appsv1.SchemeGroupVersion.WithKind(consts.SupportedResourceStatefulSet),
+			newObject: func() client.Object { return &appsv1.StatefulSet{} },
+			template:  func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.StatefulSet).Spec.Template },
+			ready:     func(obj client.Object) int32 { return obj.(*appsv1.StatefulSet).Status.ReadyReplicas },
+			pods:      statefulSetPods,
+		},
+		&typedWorkload{
+			gvk:       appsv1.SchemeGroupVersion.WithKind(consts.SupportedResourceDaemonSet),
+			newObject: func() client.Object { return &appsv1.DaemonSet{} },
+			template:  func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.DaemonSet).Spec.Template },
+			ready:     func(obj client.Object) int32 { return obj.(*appsv1.DaemonSet).Status.NumberReady },
+			pods:      daemonSetPods,
+		},
+		&typedWorkload{
+			gvk:       batchv1.SchemeGroupVersion.WithKind(consts.SupportedResourceCronJob),
+			newObject: func() client.Object { return &batchv1.CronJob{} },
+			template: func(obj client.Object) *corev1.PodTemplateSpec {
+				return &obj.(*batchv1.CronJob).Spec.JobTemplate.Spec.Template
+			},
+			// a CronJob rarely has a running pod, it is detected from its images without waiting for a run
+			ready: func(obj client.Object) int32 { return readyWithoutPods },
+			pods:  cronJobPods,
+		},
+		&typedWorkload{
+			gvk:       batchv1.SchemeGroupVersion.WithKind(consts.SupportedResourceJob),
+			newObject: func() client.Object { return &batchv1.Job{} },
+			template:  func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*batchv1.Job).Spec.Template },
+			ready:     func(obj client.Object) int32 { return obj.(*batchv1.Job).Status.Active },
+			pods:      jobPods,
+			// the Jobs of a CronJob belong to the InstrumentedApplication of the CronJob
+			skip: func(obj client.Object) string {
+				if isCronJobRun(obj.(*batchv1.Job)) {
+					return "job created by a cronjob"
+				}
+				return ""
+			},
+			immutable: func(obj client.Object) string { return jobTemplateWarning(obj.(*batchv1.Job)) },
+		},
+		&typedWorkload{
+			gvk:       appsv1.SchemeGroupVersion.WithKind(consts.SupportedResourceReplicaSet),
+			newObject: func() client.Object { return &appsv1.ReplicaSet{} },
+			template:  func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.ReplicaSet).Spec.Template },
+			ready:     func(obj client.Object) int32 { return obj.(*appsv1.ReplicaSet).Status.ReadyReplicas },
+			pods:      replicaSetPods,
+			// the ReplicaSets of a Deployment or a Rollout belong to its InstrumentedApplication
+			skip: func(obj client.Object) string { return ownedSkipReason(obj) },
+		},
+	}
+}
+
+// StandalonePodWorkload returns the adapter of the pods not controlled by a workload. A pod can not be changed after it
+// is created, they are detected only, each running pod gets its own InstrumentedApplication
+func StandalonePodWorkload() WorkloadAdapter {
+	return &typedWorkload{
+		gvk:       corev1.SchemeGroupVersion.WithKind(consts.SupportedResourcePod),
+		newObject: func() client.Object { return &corev1.Pod{} },
+		template:  func(obj client.Object) *corev1.PodTemplateSpec { return standalonePodTemplate(obj.(*corev1.Pod)) },
+		ready:     func(obj client.Object) int32 { return standalonePodReady(obj.(*corev1.Pod)) },
+		pods:      standalonePodPods,
+		skip:      func(obj client.Object) string { return standalonePodSkipReason(obj.(*corev1.Pod)) },
+		immutable: func(obj client.Object) string { return standalonePodWarning(obj.(*corev1.Pod)) },
+	}
+}
+
+// RolloutWorkload returns the adapter of Argo Rollouts, supported when the Rollout CRD is installed
+func RolloutWorkload() WorkloadAdapter {
+	return &typedWorkload{
+		gvk:       rollouts.GroupVersion.WithKind(rollouts.Kind),
+		newObject: func() client.Object { return &rollouts.Rollout{} },
+		template:  func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*rollouts.Rollout).Spec.Template },
+		ready:     func(obj client.Object) int32 { return obj.(*rollouts.Rollout).Status.ReadyReplicas },
+		pods:      rolloutPods,
+		skip: func(obj client.Object) string {
+			ro := obj.(*rollouts.Rollout)
+			// the template of a Rollout referencing a Deployment is the Deployment's, which is scaled to zero
+			if ro.Spec.WorkloadRef != nil {
+				return "rollout referencing a workload, only rollouts with a pod template are supported"
+			}
+			// the pod template is rolled out by the canary or blue-green strategy of the Rollout, changing it in the
+			// middle of an update would restart the update. The status changes when the update completes
+			if !ro.Settled() {
+				return "rollout update in progress"
+			}
+			return ""
+		},
+	}
+}
@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// WorkloadConfig lists workload kinds supported without go code: custom resources with a pod template, like Knative
+// Services, OpenKruise CloneSets or OpenShift DeploymentConfigs
+type WorkloadConfig struct {
+	Workloads []WorkloadKindConfig `json:"workloads"`
+}
+
+// WorkloadKindConfig locates the pod template and the ready pods of a workload kind. Paths are dot separated field
+// names, like spec.template
+type WorkloadKindConfig struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	// PodTemplatePath is the path of the pod template, the fields of the template that are not fields of a pod
+	// template (like containerConcurrency of a Knative revision template) are kept as they are
+	PodTemplatePath string `json:"podTemplatePath"`
+	// ReadyReplicasPath is the path of the number of ready pods in the status. When empty the InstrumentedApplication is
+	// created without waiting for a ready pod
+	ReadyReplicasPath string `json:"readyReplicasPath,omitempty"`
+	// PodSelectorLabel is a label holding the workload name on its pods, like serving.knative.dev/service. When empty
+	// the pods are selected by the labels of the pod template
+	PodSelectorLabel string `json:"podSelectorLabel,omitempty"`
+}
+
+// LoadWorkloadConfig reads a YAML workload config and returns the adapters of its kinds
+func LoadWorkloadConfig(path string) (Workloads, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config WorkloadConfig
+	if err = yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+
+	var workloads Workloads
+	for _, kind := range config.Workloads {
+		gv, err := schema.ParseGroupVersion(kind.APIVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid apiVersion of workload kind %s: %w", kind.Kind, err)
+		}
+		if kind.Kind == "" || kind.PodTemplatePath == "" {
+			return nil, errors.New("a workload kind needs a kind and a podTemplatePath")
+		}
+		workloads, err = workloads.Add(&unstructuredWorkload{
+			gvk:           gv.WithKind(kind.Kind),
+			templatePath:  strings.Split(kind.PodTemplatePath, "."),
+			readyPath:     splitPath(kind.ReadyReplicasPath),
+			selectorLabel: kind.PodSelectorLabel,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return workloads, nil
+}
+
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// unstructuredWorkload is the adapter of a configured kind, read by paths in the unstructured content of its objects
+type unstructuredWorkload struct {
+	gvk           schema.GroupVersionKind
+	templatePath  []string
+	readyPath     []string
+	selectorLabel string
+}
+
+func (w *unstructuredWorkload) GroupVersionKind() schema.GroupVersionKind {
+	return w.gvk
+}
+
+func (w *unstructuredWorkload) NewObject() client.Object {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(w.gvk)
+	return obj
+}
+
+func (w *unstructuredWorkload) PodTemplate(obj client.Object) (*corev1.PodTemplateSpec, error) {
+	content, found, err := unstructured.NestedMap(obj.(*unstructured.Unstructured).Object, w.templatePath...)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%s %s has no pod template at %s", w.gvk.Kind, obj.GetName(), strings.Join(w.templatePath, "."))
+	}
+	var template corev1.PodTemplateSpec
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(content, &template); err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+func (w *unstructuredWorkload) SetPodTemplate(obj client.Object, template *corev1.PodTemplateSpec) error {
+	content := obj.(*unstructured.Unstructured).Object
+	original, _, err := unstructured.NestedMap(content, w.templatePath...)
+	if err != nil {
+		return err
+	}
+	converted, err := runtime.DefaultUnstructuredConverter.ToUnstructured(template)
+	if err != nil {
+		return err
+	}
+	return unstructured.SetNestedMap(content, mergePodTemplate(original, converted), w.templatePath...)
+}
+
+func (w *unstructuredWorkload) ReadyReplicas(obj client.Object) int32 {
+	if len(w.readyPath) == 0 {
+		return readyWithoutPods
+	}
+	value, found, err := unstructured.NestedFieldNoCopy(obj.(*unstructured.Unstructured).Object, w.readyPath...)
+	if err != nil || !found {
+		return 0
+	}
+	switch v := value.(type) {
+	case int64:
+		return int32(v)
+	case float64:
+		return int32(v)
+	}
+	return 0
+}
+
+func (w *unstructuredWorkload) PodSelector(obj client.Object) (map[string]string, error) {
+	if w.selectorLabel != "" {
+		return map[string]string{w.selectorLabel: obj.GetName()}, nil
+	}
+	template, err := w.PodTemplate(obj)
+	if err != nil {
+		return nil, err
+	}
+	return template.Labels, nil
+}
+
+func (w *unstructuredWorkload) CurrentPods(ctx context.Context, c client.Reader, obj client.Object) ([]corev1.Pod, error) {
+	selector, err := w.PodSelector(obj)
+	if err != nil {
+		return nil, err
+	}
+	// an empty selector would match every pod of the namespace
+	if len(selector) == 0 {
+		return nil, consts.PodsNotFoundErr
+	}
+	// the pods of configured kinds are controlled by intermediate objects, like the Revisions of a Knative Service
+	return runningPodsOf(ctx, c, obj.GetNamespace(), selector, "", "", "")
+}
+
+func (w *unstructuredWorkload) SkipReason(client.Object) string {
+	return ""
+}
+
+func (w *unstructuredWorkload) ImmutableReason(client.Object) string {
+	return ""
+}
+
+var (
+	podTemplateFields = jsonFields(reflect.TypeOf(corev1.PodTemplateSpec{}))
+	podSpecFields     = jsonFields(reflect.TypeOf(corev1.PodSpec{}))
+)
+
+// mergePodTemplate returns the converted pod template with the fields of the original template, and of its spec,
+// that a pod template does not have
+func mergePodTemplate(original map[string]interface{}, converted map[string]interface{}) map[string]interface{} {
+	for k, v := range original {
+		if !podTemplateFields[k] {
+			converted[k] = v
+		}
+	}
+	originalSpec, _ := original["spec"].(map[string]interface{})
+	convertedSpec, _ := converted["spec"].(map[string]interface{})
+	if originalSpec != nil && convertedSpec != nil {
+		for k, v := range originalSpec {
+			if !podSpecFields[k] {
+				convertedSpec[k] = v
+			}
+		}
+	}
+	return converted
+}
+
+// jsonFields returns the JSON names of the fields of a struct type
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
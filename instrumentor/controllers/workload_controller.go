@@ -0,0 +1,114 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Credits: https://github.com/keyval-dev/odigos
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// WorkloadReconciler reconciles the workloads of a kind, through its adapter
+type WorkloadReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Workload WorkloadAdapter
+	// PodWebhook leaves the pod template as it is, the pod webhook instruments the pods when they are created
+	PodWebhook bool
+}
+
+// Reconcile is responsible for creating InstrumentedApplication objects for every workload.
+// In addition, Reconcile patch the workload according to the discovered language and keeps the `instrumented` field
+// of InstrumentedApplication up to date with the workload pod template.
+//
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.11.2/pkg/reconcile
+func (r *WorkloadReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	kind := strings.ToLower(r.Workload.GroupVersionKind().Kind)
+
+	obj := r.Workload.NewObject()
+	err := r.Get(ctx, req.NamespacedName, obj)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+
+		logger.Error(err, "error fetching "+kind+" object")
+		return ctrl.Result{}, err
+	}
+
+	if shouldSkip(obj.GetAnnotations(), obj.GetNamespace()) {
+		logger.V(5).Info("skipped instrumentation for " + kind)
+		return ctrl.Result{}, nil
+	}
+	if reason := r.Workload.SkipReason(obj); reason != "" {
+		logger.V(5).Info("skipped instrumentation for "+kind, "reason", reason)
+		return ctrl.Result{}, nil
+	}
+
+	err = syncInstrumentedApps(ctx, &req, r.Client, r.Scheme, r.Workload, obj, r.PodWebhook)
+	if err != nil {
+		if apierrors.IsConflict(err) {
+			logger.V(0).Info("Conflict encountered and ignored during update")
+		} else {
+			logger.Error(err, "Encountered an error while trying to instrument "+kind)
+		}
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *WorkloadReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	gvk := r.Workload.GroupVersionKind()
+	// Index InstrumentedApps by owner for fast lookup
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1.InstrumentedApplication{}, ownerIndexKey(gvk), func(rawObj client.Object) []string {
+		instApp := rawObj.(*v1.InstrumentedApplication)
+		owner := metav1.GetControllerOf(instApp)
+		if owner == nil {
+			return nil
+		}
+
+		if owner.APIVersion != gvk.GroupVersion().String() || owner.Kind != gvk.Kind {
+			return nil
+		}
+
+		return []string{owner.Name}
+	}); err != nil {
+		return err
+	}
+
+	builder := ctrl.NewControllerManagedBy(mgr).
+		For(r.Workload.NewObject()).
+		Owns(&v1.InstrumentedApplication{})
+	// configured kinds of different groups may share a kind name
+	if _, configured := r.Workload.(*unstructuredWorkload); configured {
+		builder = builder.Named(strings.ToLower(fmt.Sprintf("%s-%s", gvk.Kind, strings.ReplaceAll(gvk.Group, ".", "-"))))
+	}
+	return builder.Complete(r)
+}
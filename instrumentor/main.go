@@ -19,27 +19,44 @@ Credits: https://github.com/keyval-dev/odigos
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	"github.com/logzio/kubernetes-instrumentor/common/utils"
 
-	v1 "github.com/logzio/kubernetes-instrumentor/api/v1alpha1"
+	"github.com/logzio/kubernetes-instrumentor/api/v1alpha1"
+	"github.com/logzio/kubernetes-instrumentor/api/v1beta1"
 
 	"github.com/logzio/kubernetes-instrumentor/instrumentor/controllers"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/rollouts"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/vulnerability"
+	"github.com/logzio/kubernetes-instrumentor/instrumentor/webhooks"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 )
 
+// conversionWebhookPath is the path controller-runtime serves the conversion webhook of every convertible kind at
+const conversionWebhookPath = "/convert"
+
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
@@ -47,7 +64,9 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
-	utilruntime.Must(v1.AddToScheme(scheme))
+	utilruntime.Must(v1alpha1.AddToScheme(scheme))
+	utilruntime.Must(v1beta1.AddToScheme(scheme))
+	utilruntime.Must(rollouts.AddToScheme(scheme))
 }
 
 func main() {
@@ -57,6 +76,30 @@ func main() {
 	var instrumentationDetectorTag string
 	var instrumentationDetectorImage string
 	var deleteInstrumentationDetectionPods bool
+	var detectionBackend string
+	var insecureRegistries string
+	var detectionCacheTTL time.Duration
+	var detectionReportAddr string
+	var detectionReportURL string
+	var detectionAgent bool
+	var detectionAgentPort int
+	var detectionStrategy string
+	var maxConcurrentDetections int
+	var maxNodeDetections int
+	var detectionReplicas int
+	var exportSBOM bool
+	var vulnerabilityDBPath string
+	var vulnerabilityDBRefresh time.Duration
+	var detectNativeSidecars bool
+	var detectStandalonePods bool
+	var detectionBatchSize int
+	var detectionPodsInOperatorNamespace bool
+	var detectionPodConfigPath string
+	var workloadConfigPath string
+	var instrumentationMode string
+	var webhookFailurePolicy string
+	var webhookServiceName string
+	var webhookCertDir string
 
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
@@ -66,6 +109,36 @@ func main() {
 	flag.StringVar(&instrumentationDetectorTag, "instrumentation-detector-tag", "latest", "container tag to use for lang detection")
 	flag.StringVar(&instrumentationDetectorImage, "instrumentation-detector-image", "logzio/instrumentation-detector", "container image to use for lang detection")
 	flag.BoolVar(&deleteInstrumentationDetectionPods, "delete-detection-pods", true, "Automatic termination of detection pods")
+	flag.StringVar(&detectionBackend, "detection-backend", controllers.ProcessDetectionBackend,
+		"Detection backend: process (detection pods), image (image contents from the registry) or image-fallback (image, then detection pods)")
+	flag.DurationVar(&detectionCacheTTL, "detection-cache-ttl", 24*time.Hour, "How long detection results are reused for workloads running the same image digests, 0 disables the cache")
+	flag.StringVar(&insecureRegistries, "insecure-registries", "", "Comma separated registries the image detection backend accesses without TLS verification, falling back to plain HTTP")
+	flag.StringVar(&detectionReportAddr, "detection-report-bind-address", ":8082", "The address the detection report endpoint binds to.")
+	flag.StringVar(&detectionReportURL, "detection-report-url", "",
+		"URL detection pods post their full result to, for example the instrumentor service. Empty keeps the termination message only")
+	flag.StringVar(&detectionStrategy, "detection-strategy", controllers.PodDetectionStrategy,
+		"Process detection strategy: pod (hostPID detection pods) or ephemeral (ephemeral detection containers in the target pod)")
+	flag.IntVar(&maxConcurrentDetections, "max-concurrent-detections", 10, "Maximum detection pods running in the cluster, 0 is unlimited")
+	flag.IntVar(&maxNodeDetections, "max-node-detections", 2, "Maximum detection pods running on a node, 0 is unlimited")
+	flag.BoolVar(&detectStandalonePods, "detect-standalone-pods", false, "Detect the pods not controlled by a workload, each running pod gets its own InstrumentedApplication and is never instrumented")
+	flag.BoolVar(&detectNativeSidecars, "detect-native-sidecars", false, "Detect native sidecars (init containers with restartPolicy Always) next to the app containers")
+	flag.IntVar(&detectionReplicas, "detection-replicas", 1, "Number of replicas of the current workload revision to detect, their results are merged")
+	flag.BoolVar(&exportSBOM, "export-sbom", false, "Write the detected dependencies of each workload as a CycloneDX SBOM ConfigMap next to its InstrumentedApplication")
+	flag.StringVar(&vulnerabilityDBPath, "vulnerability-db", "", "Directory of an offline OSV vulnerability database the detected libraries are matched against, empty disables the scan")
+	flag.DurationVar(&vulnerabilityDBRefresh, "vulnerability-db-refresh", time.Hour, "How often the vulnerability database directory is checked for changes and reloaded")
+	flag.IntVar(&detectionBatchSize, "detection-batch-size", 5, "Maximum pods of the same node and namespace detected by one detection pod")
+	flag.BoolVar(&detectionPodsInOperatorNamespace, "detection-pods-in-operator-namespace", false,
+		"Create detection pods in the instrumentor namespace, for workload namespaces whose pod security level rejects hostPID pods")
+	flag.StringVar(&detectionPodConfigPath, "detection-pod-config", "", "Path of a YAML file with the resources, tolerations, priority class and image pull settings of detection pods")
+	flag.StringVar(&workloadConfigPath, "workload-config", "", "Path of a YAML file with the custom resource kinds with a pod template to detect and instrument")
+	flag.StringVar(&instrumentationMode, "instrumentation-mode", controllers.TemplateInstrumentationMode,
+		"Instrumentation mode: template (patch the pod template of workloads) or webhook (patch pods when they are created with a mutating webhook)")
+	flag.StringVar(&webhookFailurePolicy, "webhook-failure-policy", string(admissionregistrationv1.Ignore),
+		"Failure policy of the pod webhook: Ignore (create pods without instrumentation) or Fail (reject pods) when the webhook fails")
+	flag.StringVar(&webhookServiceName, "webhook-service-name", "kubernetes-instrumentor-service", "The service of the instrumentor the API server calls the conversion and pod webhooks through")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs"), "The directory the webhook certificate is written to")
+	flag.BoolVar(&detectionAgent, "detection-agent", false, "Detect with the detection agent DaemonSet, detection pods are created only when no agent runs on the node")
+	flag.IntVar(&detectionAgentPort, "detection-agent-port", 8083, "The port the detection agents listen on")
 
 	opts := zap.Options{
 		Development: true,
@@ -75,10 +148,83 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	if detectionBackend != controllers.ProcessDetectionBackend && detectionBackend != controllers.ImageDetectionBackend &&
+		detectionBackend != controllers.ImageWithFallbackDetectionBackend {
+		setupLog.Error(fmt.Errorf("unknown detection backend %s", detectionBackend), "invalid arguments")
+		os.Exit(1)
+	}
+	if detectionStrategy != controllers.PodDetectionStrategy && detectionStrategy != controllers.EphemeralDetectionStrategy {
+		setupLog.Error(fmt.Errorf("unknown detection strategy %s", detectionStrategy), "invalid arguments")
+		os.Exit(1)
+	}
+	if instrumentationMode != controllers.TemplateInstrumentationMode && instrumentationMode != controllers.WebhookInstrumentationMode {
+		setupLog.Error(fmt.Errorf("unknown instrumentation mode %s", instrumentationMode), "invalid arguments")
+		os.Exit(1)
+	}
+	if webhookFailurePolicy != string(admissionregistrationv1.Ignore) && webhookFailurePolicy != string(admissionregistrationv1.Fail) {
+		setupLog.Error(fmt.Errorf("unknown webhook failure policy %s", webhookFailurePolicy), "invalid arguments")
+		os.Exit(1)
+	}
+	podWebhook := instrumentationMode == controllers.WebhookInstrumentationMode
+	detectionPodConfig, err := controllers.LoadDetectionPodConfig(detectionPodConfigPath)
+	if err != nil {
+		setupLog.Error(err, "unable to load detection pod config")
+		os.Exit(1)
+	}
+	configuredWorkloads, err := controllers.LoadWorkloadConfig(workloadConfigPath)
+	if err != nil {
+		setupLog.Error(err, "unable to load workload config")
+		os.Exit(1)
+	}
+	var vulnerabilityDB *vulnerability.Database
+	if vulnerabilityDBPath != "" {
+		vulnerabilityDB, err = vulnerability.Load(vulnerabilityDBPath)
+		if err != nil {
+			setupLog.Error(err, "unable to load vulnerability database")
+			os.Exit(1)
+		}
+		setupLog.Info("loaded vulnerability database", "dir", vulnerabilityDBPath, "entries", vulnerabilityDB.Len())
+	}
+
+	config := ctrl.GetConfigOrDie()
+	// the certificate is read by the webhook server when the manager starts, and the CRD converts InstrumentedApplications
+	// through it before the caches are synced
+	bootstrapClient, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		setupLog.Error(err, "unable to create client")
+		os.Exit(1)
+	}
+	if err = webhooks.Bootstrap(context.Background(), bootstrapClient, webhooks.Config{
+		Namespace:         utils.GetCurrentNamespace(),
+		ServiceName:       webhookServiceName,
+		ServicePort:       443,
+		SecretName:        "kubernetes-instrumentor-webhook-cert",
+		CRDName:           "instrumentedapplications.logz.io",
+		ConversionPath:    conversionWebhookPath,
+		PodWebhook:        podWebhook,
+		PodWebhookPath:    controllers.PodWebhookPath,
+		WebhookConfigName: "kubernetes-instrumentor-pod-webhook",
+		CertDir:           webhookCertDir,
+		FailurePolicy:     admissionregistrationv1.FailurePolicyType(webhookFailurePolicy),
+		IgnoredNamespaces: consts.IgnoredNamespaces,
+		DetectionPodLabel: controllers.DetectionPodLabel,
+	}); err != nil {
+		setupLog.Error(err, "unable to bootstrap the webhooks")
+		os.Exit(1)
+	}
+	detectionAgentToken := os.Getenv(consts.DetectionAgentTokenEnvVar)
+	if detectionAgent && detectionAgentToken == "" {
+		detectionAgentToken, err = controllers.EnsureDetectionAgentToken(context.Background(), bootstrapClient, utils.GetCurrentNamespace())
+		if err != nil {
+			setupLog.Error(err, "unable to create the detection agent token")
+			os.Exit(1)
+		}
+	}
+
+	mgr, err := ctrl.NewManager(config, ctrl.Options{
 		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
+		Metrics:                metricsserver.Options{BindAddress: metricsAddr},
+		WebhookServer:          webhook.NewServer(webhook.Options{Port: 9443, CertDir: webhookCertDir}),
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "201bdfa0.logz.io",
@@ -88,30 +234,110 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.InstrumentedApplicationReconciler{
+	workloads := controllers.BuiltinWorkloads()
+	if detectStandalonePods {
+		workloads, err = workloads.Add(controllers.StandalonePodWorkload())
+		if err != nil {
+			setupLog.Error(err, "unable to add workload kind", "kind", "Pod")
+			os.Exit(1)
+		}
+	}
+	// Argo Rollouts is optional, rollouts are only instrumented when the Rollout CRD is installed
+	if _, err = mgr.GetRESTMapper().RESTMapping(rollouts.GroupVersion.WithKind(rollouts.Kind).GroupKind(), rollouts.GroupVersion.Version); err == nil {
+		workloads, err = workloads.Add(controllers.RolloutWorkload())
+		if err != nil {
+			setupLog.Error(err, "unable to add workload kind", "kind", rollouts.Kind)
+			os.Exit(1)
+		}
+	} else {
+		setupLog.Info("Argo Rollouts is not installed, rollouts are not instrumented", "reason", err.Error())
+	}
+	for _, workload := range configuredWorkloads {
+		gvk := workload.GroupVersionKind()
+		if _, err = mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+			setupLog.Info("configured workload kind is not installed, it is not instrumented", "kind", gvk.String(), "reason", err.Error())
+			continue
+		}
+		workloads, err = workloads.Add(workload)
+		if err != nil {
+			setupLog.Error(err, "unable to add workload kind", "kind", gvk.String())
+			os.Exit(1)
+		}
+	}
+
+	instrumentedAppReconciler := &controllers.InstrumentedApplicationReconciler{
 		Client:                            mgr.GetClient(),
 		Scheme:                            mgr.GetScheme(),
 		InstrumentationDetectorTag:        instrumentationDetectorTag,
 		InstrumentationDetectorImage:      instrumentationDetectorImage,
 		DeleteInstrumentationDetectorPods: deleteInstrumentationDetectionPods,
-	}).SetupWithManager(mgr); err != nil {
+		DetectionBackend:                  detectionBackend,
+		InsecureRegistries:                strings.Split(insecureRegistries, ","),
+		DetectionCacheTTL:                 detectionCacheTTL,
+		APIReader:                         mgr.GetAPIReader(),
+		DetectionReportURL:                detectionReportURL,
+		DetectionAgent:                    detectionAgent,
+		DetectionAgentPort:                detectionAgentPort,
+		DetectionAgentToken:               detectionAgentToken,
+		DetectionStrategy:                 detectionStrategy,
+		MaxConcurrentDetections:           maxConcurrentDetections,
+		MaxNodeDetections:                 maxNodeDetections,
+		DetectionBatchSize:                detectionBatchSize,
+		DetectionPodsInOperatorNamespace:  detectionPodsInOperatorNamespace,
+		DetectionPodConfig:                detectionPodConfig,
+		DetectionReplicas:                 detectionReplicas,
+		ExportSBOM:                        exportSBOM,
+		VulnerabilityDatabase:             vulnerabilityDB,
+		DetectNativeSidecars:              detectNativeSidecars,
+		Workloads:                         workloads,
+	}
+	if err = instrumentedAppReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "InstrumentedApplication")
 		os.Exit(1)
 	}
-	if err = (&controllers.DeploymentReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", consts.SupportedResourceDeployment)
-		os.Exit(1)
+	if detectionReportURL != "" {
+		if err = mgr.Add(&controllers.DetectionReportServer{
+			Reconciler:  instrumentedAppReconciler,
+			BindAddress: detectionReportAddr,
+		}); err != nil {
+			setupLog.Error(err, "unable to add detection report server")
+			os.Exit(1)
+		}
+	}
+	if vulnerabilityDB != nil && vulnerabilityDBRefresh > 0 {
+		if err = mgr.Add(&vulnerability.Refresher{
+			Database: vulnerabilityDB,
+			Interval: vulnerabilityDBRefresh,
+			Logger:   ctrl.Log.WithName("vulnerability-db"),
+		}); err != nil {
+			setupLog.Error(err, "unable to add vulnerability database refresh")
+			os.Exit(1)
+		}
 	}
-	if err = (&controllers.StatefulSetReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", consts.SupportedResourceStatefulSet)
+	for _, workload := range workloads {
+		if err = (&controllers.WorkloadReconciler{
+			Client:     mgr.GetClient(),
+			Scheme:     mgr.GetScheme(),
+			Workload:   workload,
+			PodWebhook: podWebhook,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", workload.GroupVersionKind().Kind)
+			os.Exit(1)
+		}
+	}
+	// the conversion webhook is served at conversionWebhookPath
+	if err = ctrl.NewWebhookManagedBy(mgr).For(&v1beta1.InstrumentedApplication{}).Complete(); err != nil {
+		setupLog.Error(err, "unable to create conversion webhook", "webhook", "InstrumentedApplication")
 		os.Exit(1)
 	}
+	if podWebhook {
+		(&controllers.PodWebhook{
+			Client:        mgr.GetClient(),
+			APIReader:     mgr.GetAPIReader(),
+			Workloads:     workloads,
+			FailurePolicy: admissionregistrationv1.FailurePolicyType(webhookFailurePolicy),
+		}).SetupWithManager(mgr)
+	}
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
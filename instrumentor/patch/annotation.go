@@ -23,7 +23,7 @@ import (
 	"log"
 	"strings"
 
-	"github.com/logzio/kubernetes-instrumentor/api/v1alpha1"
+	"github.com/logzio/kubernetes-instrumentor/api/v1beta1"
 	"github.com/logzio/kubernetes-instrumentor/common/consts"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	goclient "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -41,7 +41,7 @@ var AnnotationPatcherInst = &AnnotationPatcher{}
 
 type AnnotationPatcher struct{}
 
-func (d *AnnotationPatcher) Patch(ctx context.Context, detected *v1alpha1.InstrumentedApplication, object client.Object) error {
+func (d *AnnotationPatcher) Patch(ctx context.Context, detected *v1beta1.InstrumentedApplication, object client.Object) error {
 
 	if d.shouldPatch(object.GetAnnotations(), object.GetNamespace()) {
 		kubeClient, err := getKubeClient()
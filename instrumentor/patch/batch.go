@@ -0,0 +1,76 @@
+package patch
+
+import (
+	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	envOtelBspScheduleDelay = "OTEL_BSP_SCHEDULE_DELAY"
+	envOtelBspExportTimeout = "OTEL_BSP_EXPORT_TIMEOUT"
+	// batch pods may exit seconds after they start, the batch span processor exports every 500ms (instead of 5s) and
+	// gives up an export after 5s (instead of 30s) so the flush on exit does not hold the pod
+	batchBspScheduleDelay = "500"
+	batchBspExportTimeout = "5000"
+)
+
+// batchSpanProcessorEnv are the batch span processor settings of the containers of batch workloads, read by the
+// SDKs of every agent
+var batchSpanProcessorEnv = []v1.EnvVar{
+	{Name: envOtelBspScheduleDelay, Value: batchBspScheduleDelay},
+	{Name: envOtelBspExportTimeout, Value: batchBspExportTimeout},
+}
+
+// isBatchWorkload reports whether the instrumentation belongs to a CronJob or a Job
+func isBatchWorkload(instrumentation *apiV1.InstrumentedApplication) bool {
+	owner := metav1.GetControllerOf(instrumentation)
+	return owner != nil && owner.APIVersion == batchv1.SchemeGroupVersion.String() &&
+		(owner.Kind == consts.SupportedResourceCronJob || owner.Kind == consts.SupportedResourceJob)
+}
+
+// patchBatchSpanProcessor sets the batch span processor settings of the instrumented containers of a batch workload,
+// the values set in the pod template are kept
+func patchBatchSpanProcessor(original *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication) {
+	if !isBatchWorkload(instrumentation) {
+		return
+	}
+	for _, container := range patchableContainers(original) {
+		instrumented := false
+		for _, l := range getLangsInResult(original, instrumentation) {
+			instrumented = instrumented || shouldPatch(original, instrumentation, l, container.Name)
+		}
+		if !instrumented {
+			continue
+		}
+		for _, env := range batchSpanProcessorEnv {
+			if getIndexOfEnv(container.Env, env.Name) == -1 {
+				container.Env = append(container.Env, env)
+			}
+		}
+	}
+}
+
+// unpatchBatchSpanProcessor removes the batch span processor settings set by patchBatchSpanProcessor
+func unpatchBatchSpanProcessor(original *v1.PodTemplateSpec) {
+	for _, container := range instrumentableContainers(original) {
+		var newEnv []v1.EnvVar
+		for _, env := range container.Env {
+			if !isBatchSpanProcessorEnv(env) {
+				newEnv = append(newEnv, env)
+			}
+		}
+		container.Env = newEnv
+	}
+}
+
+func isBatchSpanProcessorEnv(env v1.EnvVar) bool {
+	for _, batchEnv := range batchSpanProcessorEnv {
+		if env.Name == batchEnv.Name && env.Value == batchEnv.Value && env.ValueFrom == nil {
+			return true
+		}
+	}
+	return false
+}
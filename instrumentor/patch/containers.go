@@ -0,0 +1,138 @@
+package patch
+
+import (
+	"fmt"
+	"strings"
+
+	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+	v1 "k8s.io/api/core/v1"
+)
+
+// agent is the init container copying the agent of a language and the volume it is copied to, mounted in the
+// instrumented containers
+type agent struct {
+	initContainerName string
+	volumeName        string
+}
+
+var agents = map[common.ProgrammingLanguage]agent{
+	common.JavaProgrammingLanguage:       {initContainerName: javaInitContainerName, volumeName: javaVolumeName},
+	common.PythonProgrammingLanguage:     {initContainerName: pythonInitContainerName, volumeName: pythonVolumeName},
+	common.DotNetProgrammingLanguage:     {initContainerName: dotnetInitContainerName, volumeName: dotnetVolumeName},
+	common.JavascriptProgrammingLanguage: {initContainerName: nodeInitContainerName, volumeName: nodeVolumeName},
+}
+
+// ContainerStatuses returns the instrumentation state of the app containers and the detected native sidecars of the
+// pod template, read from the agents injected in each container. The containers that would be instrumented if the
+// workload asked for it are not instrumented for the reason and message
+func ContainerStatuses(podSpec *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication, reason string, message string) []apiV1.ContainerInstrumentation {
+	detected := make(map[string]common.LanguageByContainer)
+	for _, l := range instrumentation.Spec.Languages {
+		detected[l.ContainerName] = l
+	}
+	sidecarsOptedIn := strings.ToLower(podSpec.Annotations[InstrumentNativeSidecarsAnnotation]) == "true"
+
+	var statuses []apiV1.ContainerInstrumentation
+	for _, container := range instrumentableContainers(podSpec) {
+		language, exists := detected[container.Name]
+		if !exists && IsNativeSidecar(container) {
+			continue
+		}
+		status := apiV1.ContainerInstrumentation{ContainerName: container.Name, Language: language.Language}
+		instrumented := injectedLanguages(podSpec, container, language)
+		switch {
+		case !exists:
+			status.State = apiV1.SkippedContainerState
+			status.Reason = apiV1.LanguageNotDetectedReason
+			status.Message = "no supported language was detected in the container"
+		case len(instrumented) > 0:
+			status.Language = instrumented[0]
+			status.AgentVersion = agentVersion(podSpec, instrumented[0])
+			status.ServiceName = language.ActiveServiceName
+			status.State = apiV1.InstrumentedContainerState
+			status.Reason = apiV1.AgentInjectedReason
+			status.Message = injectedMessage(instrumented, language)
+		case language.OpentelemetryPreconfigured:
+			status.State = apiV1.SkippedContainerState
+			status.Reason = apiV1.ExistingAgentReason
+			status.Message = "the container is already configured with OpenTelemetry, no agent is injected"
+		case IsNativeSidecar(container) && !sidecarsOptedIn:
+			status.State = apiV1.SkippedContainerState
+			status.Reason = apiV1.NativeSidecarNotOptedInReason
+			status.Message = fmt.Sprintf("the container is a native sidecar, set the %s annotation to instrument it", InstrumentNativeSidecarsAnnotation)
+		case len(containerLanguages(podSpec, language)) == 0:
+			status.State = apiV1.SkippedContainerState
+			status.Reason = apiV1.MixedLanguagePolicyReason
+			status.Message = fmt.Sprintf("the container runs processes of several languages and the %s annotation skips it", MixedLanguagePolicyAnnotation)
+		default:
+			status.State = apiV1.NotInstrumentedContainerState
+			status.Reason = reason
+			status.Message = message
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// injectedLanguages returns the detected languages of the container whose agent is injected: the pod template copies
+// the agent and the container mounts it
+func injectedLanguages(podSpec *v1.PodTemplateSpec, container *v1.Container, language common.LanguageByContainer) []common.ProgrammingLanguage {
+	if language.Language == "" {
+		return nil
+	}
+	var injected []common.ProgrammingLanguage
+	for _, l := range language.ProcessLanguages() {
+		a, exists := agents[l]
+		if !exists || agentInitContainer(podSpec, a) == nil {
+			continue
+		}
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == a.volumeName {
+				injected = append(injected, l)
+				break
+			}
+		}
+	}
+	return injected
+}
+
+func agentInitContainer(podSpec *v1.PodTemplateSpec, a agent) *v1.Container {
+	for i := range podSpec.Spec.InitContainers {
+		if podSpec.Spec.InitContainers[i].Name == a.initContainerName {
+			return &podSpec.Spec.InitContainers[i]
+		}
+	}
+	return nil
+}
+
+// agentVersion returns the tag or digest of the agent image of the language copied by the pod template
+func agentVersion(podSpec *v1.PodTemplateSpec, language common.ProgrammingLanguage) string {
+	initContainer := agentInitContainer(podSpec, agents[language])
+	if initContainer == nil {
+		return ""
+	}
+	image := initContainer.Image
+	if i := strings.LastIndex(image, "@"); i != -1 {
+		return image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i+1:]
+	}
+	return "latest"
+}
+
+func injectedMessage(injected []common.ProgrammingLanguage, language common.LanguageByContainer) string {
+	var names []string
+	for _, l := range injected {
+		names = append(names, string(l))
+	}
+	message := fmt.Sprintf("the %s agent is injected", strings.Join(names, " and "))
+	if len(injected) > 1 {
+		message = fmt.Sprintf("the %s agents are injected", strings.Join(names, " and "))
+	}
+	if language.OpentelemetryPreconfigured {
+		message += ", the container was already configured with OpenTelemetry"
+	}
+	return message
+}
@@ -23,7 +23,7 @@ import (
 	"github.com/logzio/kubernetes-instrumentor/common/consts"
 	"strings"
 
-	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1alpha1"
+	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
 	"github.com/logzio/kubernetes-instrumentor/common"
 	v1 "k8s.io/api/core/v1"
 )
@@ -91,9 +91,9 @@ func (d *dotNetPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 		RunAsGroup:   &root,
 	}
 
-	var modifiedContainers []v1.Container
-	for _, container := range podSpec.Spec.Containers {
-		if shouldPatch(instrumentation, common.DotNetProgrammingLanguage, container.Name) {
+	patched := false
+	for _, container := range patchableContainers(podSpec) {
+		if shouldPatch(podSpec, instrumentation, common.DotNetProgrammingLanguage, container.Name) {
 			container.Env = append([]v1.EnvVar{{
 				Name: NodeIPEnvName,
 				ValueFrom: &v1.EnvVarSource{
@@ -128,7 +128,7 @@ func (d *dotNetPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 				Value: fmt.Sprintf("http://%s:%d", LogzioMonitoringService, consts.OTLPPort),
 			})
 			// calculate active service name
-			activeServiceName := calculateServiceName(podSpec, &container, instrumentation)
+			activeServiceName := calculateServiceName(podSpec, container, instrumentation)
 			container.Env = append(container.Env, v1.EnvVar{
 				Name:  serviceNameEnv,
 				Value: activeServiceName,
@@ -185,30 +185,7 @@ func (d *dotNetPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 					break
 				}
 			}
-			// Check if init container already exists
-			initContainerExists := false
-			for _, initContainer := range podSpec.Spec.InitContainers {
-				if initContainer.Name == dotnetInitContainerName {
-					initContainerExists = true
-					break
-				}
-			}
-
-			// If not, add init container
-			if !initContainerExists {
-				podSpec.Spec.InitContainers = append(podSpec.Spec.InitContainers, v1.Container{
-					Name:            dotnetInitContainerName,
-					Image:           dotnetAgentName,
-					Command:         []string{"/bin/sh", "-c", "/init.sh"},
-					SecurityContext: securityContext,
-					VolumeMounts: []v1.VolumeMount{
-						{
-							Name:      dotnetVolumeName,
-							MountPath: mountPath,
-						},
-					},
-				})
-			}
+			patched = true
 
 			// If not, add volume mount
 			if !volumeMountExists {
@@ -218,10 +195,35 @@ func (d *dotNetPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 				})
 			}
 		}
-		modifiedContainers = append(modifiedContainers, container)
 	}
 
-	podSpec.Spec.Containers = modifiedContainers
+	if !patched {
+		return
+	}
+	// Check if init container already exists
+	initContainerExists := false
+	for _, initContainer := range podSpec.Spec.InitContainers {
+		if initContainer.Name == dotnetInitContainerName {
+			initContainerExists = true
+			break
+		}
+	}
+
+	// If not, add init container, after the containers were patched as it may move the native sidecars
+	if !initContainerExists {
+		addAgentInitContainer(podSpec, v1.Container{
+			Name:            dotnetInitContainerName,
+			Image:           dotnetAgentName,
+			Command:         []string{"/bin/sh", "-c", "/init.sh"},
+			SecurityContext: securityContext,
+			VolumeMounts: []v1.VolumeMount{
+				{
+					Name:      dotnetVolumeName,
+					MountPath: mountPath,
+				},
+			},
+		})
+	}
 }
 
 func (d *dotNetPatcher) UnPatch(podSpec *v1.PodTemplateSpec) error {
@@ -235,8 +237,7 @@ func (d *dotNetPatcher) UnPatch(podSpec *v1.PodTemplateSpec) error {
 	podSpec.Spec.InitContainers = newInitContainers
 
 	// remove the environment variables
-	var modifiedContainers []v1.Container
-	for _, container := range podSpec.Spec.Containers {
+	for _, container := range instrumentableContainers(podSpec) {
 		var newEnv []v1.EnvVar
 		for _, env := range container.Env {
 			if env.Name != resourceAttrEnv && env.Name != metricsExporterEnv && env.Name != logsExporterEnv && env.Name != NodeIPEnvName && env.Name != enableProfilingEnvVar && env.Name != profilerEndVar && env.Name != profilerPathEnv && env.Name != serviceNameEnv && env.Name != collectorUrlEnv && env.Name != tracerHomeEnv && env.Name != exportTypeEnv && env.Name != exportProtocolEnv && env.Name != startupHookEnv && env.Name != additonalDepsEnv && env.Name != sharedStoreEnv {
@@ -244,9 +245,7 @@ func (d *dotNetPatcher) UnPatch(podSpec *v1.PodTemplateSpec) error {
 			}
 		}
 		container.Env = newEnv
-		modifiedContainers = append(modifiedContainers, container)
 	}
-	podSpec.Spec.Containers = modifiedContainers
 
 	// remove the annotations
 	delete(podSpec.Annotations, LogzioLanguageAnnotation)
@@ -265,11 +264,10 @@ func (d *dotNetPatcher) IsTracesInstrumented(podSpec *v1.PodTemplateSpec) bool {
 }
 
 func (d *dotNetPatcher) UpdateServiceNameEnv(podSpec *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication) {
-	var modifiedContainers []v1.Container
-	for _, container := range podSpec.Spec.Containers {
+	for _, container := range patchableContainers(podSpec) {
 		// calculate active service name
-		serviceName := calculateServiceName(podSpec, &container, instrumentation)
-		if shouldUpdateServiceName(instrumentation, common.DotNetProgrammingLanguage, container.Name, serviceName) {
+		serviceName := calculateServiceName(podSpec, container, instrumentation)
+		if shouldUpdateServiceName(podSpec, instrumentation, common.DotNetProgrammingLanguage, container.Name, serviceName) {
 			// remove old env
 			var newEnv []v1.EnvVar
 			for _, env := range container.Env {
@@ -288,10 +286,6 @@ func (d *dotNetPatcher) UpdateServiceNameEnv(podSpec *v1.PodTemplateSpec, instru
 					instrumentation.Spec.Languages[j].ActiveServiceName = serviceName
 				}
 			}
-			modifiedContainers = append(modifiedContainers, container)
 		}
 	}
-	if len(modifiedContainers) > 0 {
-		podSpec.Spec.Containers = modifiedContainers
-	}
 }
@@ -22,7 +22,7 @@ import (
 	"fmt"
 	"strings"
 
-	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1alpha1"
+	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
 	"github.com/logzio/kubernetes-instrumentor/common"
 	"github.com/logzio/kubernetes-instrumentor/common/consts"
 	v1 "k8s.io/api/core/v1"
@@ -84,7 +84,7 @@ func (j *javaPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV1.
 
 	// If not, add init container
 	if !initContainerExists {
-		podSpec.Spec.InitContainers = append(podSpec.Spec.InitContainers, v1.Container{
+		addAgentInitContainer(podSpec, v1.Container{
 			Name:            javaInitContainerName,
 			Image:           javaAgentImage,
 			Command:         []string{"cp", "/javaagent.jar", "/agent/opentelemetry-javaagent-all.jar"},
@@ -98,9 +98,8 @@ func (j *javaPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV1.
 		})
 	}
 
-	var modifiedContainers []v1.Container
-	for _, container := range podSpec.Spec.Containers {
-		if shouldPatch(instrumentation, common.JavaProgrammingLanguage, container.Name) {
+	for _, container := range patchableContainers(podSpec) {
+		if shouldPatch(podSpec, instrumentation, common.JavaProgrammingLanguage, container.Name) {
 			container.Env = append([]v1.EnvVar{{
 				Name: NodeIPEnvName,
 				ValueFrom: &v1.EnvVarSource{
@@ -138,7 +137,7 @@ func (j *javaPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV1.
 				container.Env[idx].Value = container.Env[idx].Value + " " + fmt.Sprintf(javaToolOptionsPattern, LogzioMonitoringService, consts.OTLPPort)
 			}
 			// calculate active service name
-			activeServiceName := calculateServiceName(podSpec, &container, instrumentation)
+			activeServiceName := calculateServiceName(podSpec, container, instrumentation)
 			container.Env = append(container.Env, v1.EnvVar{
 				Name:  otelResourceAttributesEnvVar,
 				Value: fmt.Sprintf(otelResourceAttrPatteern, easyConnectVersion, activeServiceName, PodNameEnvValue),
@@ -166,10 +165,7 @@ func (j *javaPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV1.
 				})
 			}
 		}
-		modifiedContainers = append(modifiedContainers, container)
 	}
-
-	podSpec.Spec.Containers = modifiedContainers
 }
 
 func (j *javaPatcher) UnPatch(podSpec *v1.PodTemplateSpec) error {
@@ -186,8 +182,7 @@ func (j *javaPatcher) UnPatch(podSpec *v1.PodTemplateSpec) error {
 	podSpec.Spec.InitContainers = newInitContainers
 
 	// remove the environment variables
-	var modifiedContainers []v1.Container
-	for _, container := range podSpec.Spec.Containers {
+	for _, container := range instrumentableContainers(podSpec) {
 		var newEnv []v1.EnvVar
 		for _, env := range container.Env {
 			if env.Name != NodeIPEnvName && env.Name != PodNameEnvVName && env.Name != otelResourceAttributesEnvVar {
@@ -209,9 +204,7 @@ func (j *javaPatcher) UnPatch(podSpec *v1.PodTemplateSpec) error {
 			}
 		}
 		container.Env = newEnv
-		modifiedContainers = append(modifiedContainers, container)
 	}
-	podSpec.Spec.Containers = modifiedContainers
 	return nil
 }
 
@@ -226,11 +219,10 @@ func (j *javaPatcher) IsTracesInstrumented(podSpec *v1.PodTemplateSpec) bool {
 }
 
 func (j *javaPatcher) UpdateServiceNameEnv(podSpec *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication) {
-	var modifiedContainers []v1.Container
-	for _, container := range podSpec.Spec.Containers {
+	for _, container := range patchableContainers(podSpec) {
 		// calculate service name
-		serviceName := calculateServiceName(podSpec, &container, instrumentation)
-		if shouldUpdateServiceName(instrumentation, common.JavaProgrammingLanguage, container.Name, serviceName) {
+		serviceName := calculateServiceName(podSpec, container, instrumentation)
+		if shouldUpdateServiceName(podSpec, instrumentation, common.JavaProgrammingLanguage, container.Name, serviceName) {
 			// remove old env
 			var newEnv []v1.EnvVar
 			for _, env := range container.Env {
@@ -249,10 +241,6 @@ func (j *javaPatcher) UpdateServiceNameEnv(podSpec *v1.PodTemplateSpec, instrume
 					instrumentation.Spec.Languages[idx].ActiveServiceName = serviceName
 				}
 			}
-			modifiedContainers = append(modifiedContainers, container)
 		}
 	}
-	if len(modifiedContainers) > 0 {
-		podSpec.Spec.Containers = modifiedContainers
-	}
 }
@@ -24,7 +24,7 @@ import (
 	"strconv"
 	"strings"
 
-	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1alpha1"
+	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
 	"github.com/logzio/kubernetes-instrumentor/common"
 	"github.com/logzio/kubernetes-instrumentor/common/consts"
 	v1 "k8s.io/api/core/v1"
@@ -83,7 +83,7 @@ func (n *nodeJsPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 	}
 	if !initContainerExists {
 		// Add init container that copies the agent
-		podSpec.Spec.InitContainers = append(podSpec.Spec.InitContainers, v1.Container{
+		addAgentInitContainer(podSpec, v1.Container{
 			Name:            nodeInitContainerName,
 			Image:           nodeAgentImage,
 			Command:         []string{"cp", "-a", "/autoinstrumentation/.", fmt.Sprintf("%s/", nodeMountPath)},
@@ -97,9 +97,8 @@ func (n *nodeJsPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 		})
 	}
 
-	var modifiedContainers []v1.Container
-	for _, container := range podSpec.Spec.Containers {
-		if shouldPatch(instrumentation, common.JavascriptProgrammingLanguage, container.Name) {
+	for _, container := range patchableContainers(podSpec) {
+		if shouldPatch(podSpec, instrumentation, common.JavascriptProgrammingLanguage, container.Name) {
 			container.Env = append([]v1.EnvVar{{
 				Name: NodeIPEnvName,
 				ValueFrom: &v1.EnvVarSource{
@@ -134,7 +133,7 @@ func (n *nodeJsPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 			})
 
 			// calculate active service name
-			activeServiceName := calculateServiceName(podSpec, &container, instrumentation)
+			activeServiceName := calculateServiceName(podSpec, container, instrumentation)
 			container.Env = append(container.Env, v1.EnvVar{
 				Name:  nodeEnvServiceName,
 				Value: activeServiceName,
@@ -176,9 +175,7 @@ func (n *nodeJsPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 				})
 			}
 		}
-		modifiedContainers = append(modifiedContainers, container)
 	}
-	podSpec.Spec.Containers = modifiedContainers
 }
 
 func (n *nodeJsPatcher) UnPatch(podSpec *v1.PodTemplateSpec) error {
@@ -195,7 +192,7 @@ func (n *nodeJsPatcher) UnPatch(podSpec *v1.PodTemplateSpec) error {
 	}
 	podSpec.Spec.InitContainers = newInitContainers
 	// remove environment variables from containers
-	for i, container := range podSpec.Spec.Containers {
+	for _, container := range instrumentableContainers(podSpec) {
 		var newEnv []v1.EnvVar
 		for _, envVar := range container.Env {
 			if envVar.Name != NodeIPEnvName && envVar.Name != resourceAttrEnv && envVar.Name != nodeEnvNodeDebug && envVar.Name != nodeEnvTraceExporter && envVar.Name != nodeEnvEndpoint && envVar.Name != nodeEnvTraceProtocol && envVar.Name != nodeEnvServiceName {
@@ -209,7 +206,7 @@ func (n *nodeJsPatcher) UnPatch(podSpec *v1.PodTemplateSpec) error {
 				newEnv = append(newEnv, envVar)
 			}
 		}
-		podSpec.Spec.Containers[i].Env = newEnv
+		container.Env = newEnv
 	}
 	return nil
 }
@@ -225,10 +222,9 @@ func (n *nodeJsPatcher) IsTracesInstrumented(podSpec *v1.PodTemplateSpec) bool {
 }
 
 func (n *nodeJsPatcher) UpdateServiceNameEnv(podSpec *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication) {
-	var modifiedContainers []v1.Container
-	for _, container := range podSpec.Spec.Containers {
-		serviceName := calculateServiceName(podSpec, &container, instrumentation)
-		if shouldUpdateServiceName(instrumentation, common.JavascriptProgrammingLanguage, container.Name, serviceName) {
+	for _, container := range patchableContainers(podSpec) {
+		serviceName := calculateServiceName(podSpec, container, instrumentation)
+		if shouldUpdateServiceName(podSpec, instrumentation, common.JavascriptProgrammingLanguage, container.Name, serviceName) {
 			// remove old env
 			var newEnv []v1.EnvVar
 			for _, env := range container.Env {
@@ -248,10 +244,6 @@ func (n *nodeJsPatcher) UpdateServiceNameEnv(podSpec *v1.PodTemplateSpec, instru
 					instrumentation.Spec.Languages[j].ActiveServiceName = serviceName
 				}
 			}
-			modifiedContainers = append(modifiedContainers, container)
 		}
 	}
-	if len(modifiedContainers) > 0 {
-		podSpec.Spec.Containers = modifiedContainers
-	}
 }
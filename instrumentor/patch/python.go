@@ -22,7 +22,7 @@ import (
 	"fmt"
 	"strings"
 
-	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1alpha1"
+	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
 	"github.com/logzio/kubernetes-instrumentor/common"
 	"github.com/logzio/kubernetes-instrumentor/common/consts"
 	v1 "k8s.io/api/core/v1"
@@ -38,6 +38,15 @@ const (
 	envOtelExporterOTLPTracesProtocol  = "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"
 	envOtelExporterOTLPMetricsProtocol = "OTEL_EXPORTER_OTLP_METRICS_PROTOCOL"
 	httpProtoProtocol                  = "http/protobuf"
+	envValOtelNoneExporter             = "none"
+	envUwsgiEnableThreads              = "UWSGI_ENABLE_THREADS"
+	envUwsgiLazyApps                   = "UWSGI_LAZY_APPS"
+	// envValPreforkExporter is the metrics exporter of the python agent for servers forking workers after the
+	// application is loaded (agents/python/logzio_prefork.py), the workers inherit it from the master
+	envValPreforkExporter = "logzio_otlp_prefork"
+	// envPythonPreforkAdded lists the server variables added by the patcher, the values set in the pod template are
+	// kept by UnPatch
+	envPythonPreforkAdded = "LOGZIO_PYTHON_PREFORK_ENV"
 )
 
 var python = &pythonPatcher{}
@@ -87,7 +96,7 @@ func (p *pythonPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 
 	// If not, add init container
 	if !initContainerExists {
-		podSpec.Spec.InitContainers = append(podSpec.Spec.InitContainers, v1.Container{
+		addAgentInitContainer(podSpec, v1.Container{
 			Name:            pythonInitContainerName,
 			Image:           pythonAgentName,
 			Command:         []string{"cp", "-a", "/autoinstrumentation/.", "/otel-auto-instrumentation/"},
@@ -101,9 +110,8 @@ func (p *pythonPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 		})
 	}
 
-	var modifiedContainers []v1.Container
-	for _, container := range podSpec.Spec.Containers {
-		if shouldPatch(instrumentation, common.PythonProgrammingLanguage, container.Name) {
+	for _, container := range patchableContainers(podSpec) {
+		if shouldPatch(podSpec, instrumentation, common.PythonProgrammingLanguage, container.Name) {
 			container.Env = append([]v1.EnvVar{{
 				Name: NodeIPEnvName,
 				ValueFrom: &v1.EnvVarSource{
@@ -142,7 +150,7 @@ func (p *pythonPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 				Value: fmt.Sprintf("http://%s:%d", LogzioMonitoringService, consts.OTLPHttpPort),
 			})
 			// calculate active service name
-			activeServiceName := calculateServiceName(podSpec, &container, instrumentation)
+			activeServiceName := calculateServiceName(podSpec, container, instrumentation)
 			container.Env = append(container.Env, v1.EnvVar{
 				Name:  resourceAttrEnv,
 				Value: fmt.Sprintf("easy.connect.version=%s,service.name=%s,k8s.pod.name=%s", easyConnectVersion, activeServiceName, PodNameEnvValue),
@@ -161,8 +169,9 @@ func (p *pythonPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 
 			container.Env = append(container.Env, v1.EnvVar{
 				Name:  envOtelMetricsExporter,
-				Value: envValOtelOtlpExporter,
+				Value: pythonMetricsExporter(instrumentation, container.Name),
 			})
+			container.Env = appendPythonPreforkEnv(container.Env, instrumentation, container.Name)
 
 			// Check if volume mount already exists
 			volumeMountExists := false
@@ -181,10 +190,7 @@ func (p *pythonPatcher) Patch(podSpec *v1.PodTemplateSpec, instrumentation *apiV
 				})
 			}
 		}
-		modifiedContainers = append(modifiedContainers, container)
 	}
-
-	podSpec.Spec.Containers = modifiedContainers
 }
 
 func (p *pythonPatcher) UnPatch(podSpec *v1.PodTemplateSpec) error {
@@ -201,18 +207,103 @@ func (p *pythonPatcher) UnPatch(podSpec *v1.PodTemplateSpec) error {
 	podSpec.Spec.InitContainers = newInitContainers
 
 	// remove the environment variables from the containers
-	for i, container := range podSpec.Spec.Containers {
+	for _, container := range instrumentableContainers(podSpec) {
+		container.Env = removePythonPreforkEnv(container.Env)
 		var newEnv []v1.EnvVar
 		for _, env := range container.Env {
 			if env.Name != NodeIPEnvName && env.Name != PodNameEnvVName && env.Name != envLogCorrelation && env.Name != "PYTHONPATH" && env.Name != "OTEL_EXPORTER_OTLP_ENDPOINT" && env.Name != resourceAttrEnv && env.Name != envOtelTracesExporter && env.Name != envOtelExporterOTLPTracesProtocol && env.Name != envOtelExporterOTLPMetricsProtocol && env.Name != envOtelMetricsExporter && env.Name != httpProtoProtocol {
 				newEnv = append(newEnv, env)
 			}
 		}
-		podSpec.Spec.Containers[i].Env = newEnv
+		container.Env = newEnv
 	}
 	return nil
 }
 
+// Warnings reports the python containers that can not be instrumented safely because of their server model, and the
+// server settings changed to instrument them
+func (p *pythonPatcher) Warnings(instrumentation *apiV1.InstrumentedApplication) []string {
+	var warnings []string
+	for _, l := range instrumentation.Spec.Languages {
+		if l.Language != common.PythonProgrammingLanguage || !l.PythonPreload {
+			continue
+		}
+		switch l.PythonServerModel {
+		case common.GunicornPythonServerModel:
+			warnings = append(warnings, fmt.Sprintf("container %s: gunicorn preloads the application before forking workers, "+
+				"the metrics are exported with the %s exporter, which the workers inherit from the master", l.ContainerName, envValPreforkExporter))
+		case common.UwsgiPythonServerModel:
+			warnings = append(warnings, fmt.Sprintf("container %s: uwsgi loads the application before forking workers, "+
+				"%s=1 was forced to load the application and the instrumentation in each worker", l.ContainerName, envUwsgiLazyApps))
+		case common.CeleryPythonServerModel:
+			warnings = append(warnings, fmt.Sprintf("container %s: the celery worker pool forks after the application is loaded, "+
+				"python metrics were disabled", l.ContainerName))
+		}
+	}
+	return warnings
+}
+
+// pythonMetricsExporter chooses the metrics exporter of pre-fork servers that load the application before forking.
+// The instruments of the application are bound to the meter provider of the master, gunicorn workers export them
+// through the fork safe exporter of the master, the celery pool metrics are disabled
+func pythonMetricsExporter(instrumentation *apiV1.InstrumentedApplication, containerName string) string {
+	for _, l := range instrumentation.Spec.Languages {
+		if l.ContainerName != containerName || !l.PythonPreload {
+			continue
+		}
+		switch l.PythonServerModel {
+		case common.GunicornPythonServerModel:
+			return envValPreforkExporter
+		case common.CeleryPythonServerModel:
+			return envValOtelNoneExporter
+		}
+	}
+	return envValOtelOtlpExporter
+}
+
+// appendPythonPreforkEnv adds the server settings that start the instrumentation after the workers are forked, the
+// added variables are listed in envPythonPreforkAdded
+func appendPythonPreforkEnv(envs []v1.EnvVar, instrumentation *apiV1.InstrumentedApplication, containerName string) []v1.EnvVar {
+	var added []string
+	for _, l := range instrumentation.Spec.Languages {
+		if l.ContainerName != containerName || l.PythonServerModel != common.UwsgiPythonServerModel {
+			continue
+		}
+		// uwsgi disables python threads by default, the batch span processor needs them
+		if getIndexOfEnv(envs, envUwsgiEnableThreads) == -1 {
+			envs = append(envs, v1.EnvVar{Name: envUwsgiEnableThreads, Value: "1"})
+			added = append(added, envUwsgiEnableThreads)
+		}
+		// load the application (and the instrumentation) in each worker instead of the master
+		if l.PythonPreload && getIndexOfEnv(envs, envUwsgiLazyApps) == -1 {
+			envs = append(envs, v1.EnvVar{Name: envUwsgiLazyApps, Value: "1"})
+			added = append(added, envUwsgiLazyApps)
+		}
+	}
+	if len(added) > 0 {
+		envs = append(envs, v1.EnvVar{Name: envPythonPreforkAdded, Value: strings.Join(added, ",")})
+	}
+	return envs
+}
+
+// removePythonPreforkEnv removes the server settings added by appendPythonPreforkEnv
+func removePythonPreforkEnv(envs []v1.EnvVar) []v1.EnvVar {
+	added := make(map[string]bool)
+	if i := getIndexOfEnv(envs, envPythonPreforkAdded); i != -1 {
+		for _, name := range strings.Split(envs[i].Value, ",") {
+			added[name] = true
+		}
+	}
+	var newEnv []v1.EnvVar
+	for _, env := range envs {
+		if env.Name == envPythonPreforkAdded || added[env.Name] {
+			continue
+		}
+		newEnv = append(newEnv, env)
+	}
+	return newEnv
+}
+
 func (p *pythonPatcher) IsTracesInstrumented(podSpec *v1.PodTemplateSpec) bool {
 	for key, value := range podSpec.Annotations {
 		if key == tracesInstrumentedAnnotation && strings.ToLower(value) == "true" {
@@ -222,10 +313,9 @@ func (p *pythonPatcher) IsTracesInstrumented(podSpec *v1.PodTemplateSpec) bool {
 	return false
 }
 func (p *pythonPatcher) UpdateServiceNameEnv(podSpec *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication) {
-	var modifiedContainers []v1.Container
-	for _, container := range podSpec.Spec.Containers {
-		serviceName := calculateServiceName(podSpec, &container, instrumentation)
-		if shouldUpdateServiceName(instrumentation, common.PythonProgrammingLanguage, container.Name, serviceName) {
+	for _, container := range patchableContainers(podSpec) {
+		serviceName := calculateServiceName(podSpec, container, instrumentation)
+		if shouldUpdateServiceName(podSpec, instrumentation, common.PythonProgrammingLanguage, container.Name, serviceName) {
 			// remove old env
 			var newEnv []v1.EnvVar
 			for _, env := range container.Env {
@@ -245,10 +335,6 @@ func (p *pythonPatcher) UpdateServiceNameEnv(podSpec *v1.PodTemplateSpec, instru
 					instrumentation.Spec.Languages[j].ActiveServiceName = serviceName
 				}
 			}
-			modifiedContainers = append(modifiedContainers, container)
 		}
 	}
-	if len(modifiedContainers) > 0 {
-		podSpec.Spec.Containers = modifiedContainers
-	}
 }
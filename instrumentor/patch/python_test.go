@@ -0,0 +1,112 @@
+package patch
+
+import (
+	"reflect"
+	"testing"
+
+	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+	v1 "k8s.io/api/core/v1"
+)
+
+func pythonInstrumentation(model common.PythonServerModel, preload bool) *apiV1.InstrumentedApplication {
+	return &apiV1.InstrumentedApplication{Spec: apiV1.InstrumentedApplicationSpec{Languages: []common.LanguageByContainer{{
+		ContainerName:     "app",
+		Language:          common.PythonProgrammingLanguage,
+		PythonServerModel: model,
+		PythonPreload:     preload,
+	}}}}
+}
+
+func TestPythonPreforkEnv(t *testing.T) {
+	userEnv := v1.EnvVar{Name: "APP_ENV", Value: "production"}
+	fromSecret := v1.EnvVar{Name: envUwsgiLazyApps, ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{Key: "lazy"}}}
+	tests := []struct {
+		name    string
+		model   common.PythonServerModel
+		preload bool
+		env     []v1.EnvVar
+		want    []v1.EnvVar
+	}{
+		{
+			name:  "plain python",
+			model: common.PlainPythonServerModel,
+			env:   []v1.EnvVar{userEnv},
+			want:  []v1.EnvVar{userEnv},
+		},
+		{
+			name:    "gunicorn preload",
+			model:   common.GunicornPythonServerModel,
+			preload: true,
+			env:     []v1.EnvVar{userEnv},
+			want:    []v1.EnvVar{userEnv},
+		},
+		{
+			name:  "uwsgi lazy apps",
+			model: common.UwsgiPythonServerModel,
+			env:   []v1.EnvVar{userEnv},
+			want: []v1.EnvVar{userEnv,
+				{Name: envUwsgiEnableThreads, Value: "1"},
+				{Name: envPythonPreforkAdded, Value: envUwsgiEnableThreads}},
+		},
+		{
+			name:    "uwsgi preload",
+			model:   common.UwsgiPythonServerModel,
+			preload: true,
+			env:     []v1.EnvVar{userEnv},
+			want: []v1.EnvVar{userEnv,
+				{Name: envUwsgiEnableThreads, Value: "1"},
+				{Name: envUwsgiLazyApps, Value: "1"},
+				{Name: envPythonPreforkAdded, Value: envUwsgiEnableThreads + "," + envUwsgiLazyApps}},
+		},
+		{
+			name:    "uwsgi variables of the pod template",
+			model:   common.UwsgiPythonServerModel,
+			preload: true,
+			env:     []v1.EnvVar{{Name: envUwsgiEnableThreads, Value: "true"}, fromSecret},
+			want:    []v1.EnvVar{{Name: envUwsgiEnableThreads, Value: "true"}, fromSecret},
+		},
+		{
+			name:    "celery preload",
+			model:   common.CeleryPythonServerModel,
+			preload: true,
+			env:     []v1.EnvVar{userEnv},
+			want:    []v1.EnvVar{userEnv},
+		},
+	}
+	for _, test := range tests {
+		env := append([]v1.EnvVar(nil), test.env...)
+		patched := appendPythonPreforkEnv(env, pythonInstrumentation(test.model, test.preload), "app")
+		if !reflect.DeepEqual(patched, test.want) {
+			t.Errorf("%s: appendPythonPreforkEnv() = %+v, want %+v", test.name, patched, test.want)
+		}
+		// other containers are not changed
+		if other := appendPythonPreforkEnv(append([]v1.EnvVar(nil), test.env...), pythonInstrumentation(test.model, test.preload), "sidecar"); !reflect.DeepEqual(other, test.env) {
+			t.Errorf("%s: appendPythonPreforkEnv() of another container = %+v, want %+v", test.name, other, test.env)
+		}
+		if restored := removePythonPreforkEnv(patched); !reflect.DeepEqual(restored, test.env) {
+			t.Errorf("%s: removePythonPreforkEnv() = %+v, want %+v", test.name, restored, test.env)
+		}
+	}
+}
+
+func TestPythonMetricsExporter(t *testing.T) {
+	tests := []struct {
+		model   common.PythonServerModel
+		preload bool
+		want    string
+	}{
+		{common.PlainPythonServerModel, false, envValOtelOtlpExporter},
+		{common.GunicornPythonServerModel, false, envValOtelOtlpExporter},
+		{common.GunicornPythonServerModel, true, envValPreforkExporter},
+		{common.UwsgiPythonServerModel, true, envValOtelOtlpExporter},
+		{common.CeleryPythonServerModel, false, envValOtelOtlpExporter},
+		{common.CeleryPythonServerModel, true, envValOtelNoneExporter},
+		{common.UvicornPythonServerModel, false, envValOtelOtlpExporter},
+	}
+	for _, test := range tests {
+		if got := pythonMetricsExporter(pythonInstrumentation(test.model, test.preload), "app"); got != test.want {
+			t.Errorf("pythonMetricsExporter(%s, preload %t) = %s, want %s", test.model, test.preload, got, test.want)
+		}
+	}
+}
@@ -22,9 +22,12 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 
-	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1alpha1"
+	apiV1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
 	"github.com/logzio/kubernetes-instrumentor/common"
+	"github.com/logzio/kubernetes-instrumentor/common/consts"
 	v1 "k8s.io/api/core/v1"
 )
 
@@ -42,6 +45,15 @@ const (
 	easyConnectVersion           = "v1.0.10"
 	resourceAttrEnv              = "OTEL_RESOURCE_ATTRIBUTES"
 	resourceAttr                 = "easy.connect.version=%s"
+	// MixedLanguagePolicyAnnotation on the pod template selects the languages instrumented in containers running
+	// processes of several languages: primary (the default), all, skip or the name of a language to prefer
+	MixedLanguagePolicyAnnotation = "logz.io/mixed-language-policy"
+	PrimaryMixedLanguagePolicy    = "primary"
+	AllMixedLanguagePolicy        = "all"
+	SkipMixedLanguagePolicy       = "skip"
+	// InstrumentNativeSidecarsAnnotation on the pod template opts in to instrumenting native sidecars, init
+	// containers with restartPolicy Always
+	InstrumentNativeSidecarsAnnotation = "logz.io/instrument-native-sidecars"
 )
 
 var (
@@ -59,6 +71,11 @@ type Patcher interface {
 	UpdateServiceNameEnv(podSpec *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication)
 }
 
+// warningPatcher is implemented by patchers that can report instrumentation which could not be applied safely
+type warningPatcher interface {
+	Warnings(instrumentation *apiV1.InstrumentedApplication) []string
+}
+
 var patcherMap = map[common.ProgrammingLanguage]Patcher{
 	common.JavaProgrammingLanguage:       java,
 	common.PythonProgrammingLanguage:     python,
@@ -69,7 +86,7 @@ var patcherMap = map[common.ProgrammingLanguage]Patcher{
 var annotationPatcherMap = map[string]AnnotationPatcher{}
 
 func ModifyObject(original *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication) error {
-	for _, l := range getLangsInResult(instrumentation) {
+	for _, l := range getLangsInResult(original, instrumentation) {
 		p, exists := patcherMap[l]
 		if !exists {
 			return fmt.Errorf("unable to find patcher for lang %s", l)
@@ -77,12 +94,14 @@ func ModifyObject(original *v1.PodTemplateSpec, instrumentation *apiV1.Instrumen
 
 		p.Patch(original, instrumentation)
 	}
+	mergeSharedEnv(original, instrumentation)
+	patchBatchSpanProcessor(original, instrumentation)
 
 	return nil
 }
 
 func UpdateActiveServiceName(original *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication) error {
-	for _, l := range getLangsInResult(instrumentation) {
+	for _, l := range getLangsInResult(original, instrumentation) {
 		p, exists := patcherMap[l]
 		if !exists {
 			return fmt.Errorf("unable to find patcher for lang %s", l)
@@ -95,19 +114,21 @@ func UpdateActiveServiceName(original *v1.PodTemplateSpec, instrumentation *apiV
 }
 
 func RollbackPatch(original *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication) error {
-	for _, l := range getLangsInResult(instrumentation) {
+	// every detected language is rolled back, the policy may have changed since the object was patched
+	for _, l := range getLangsInResult(nil, instrumentation) {
 		p, exists := patcherMap[l]
 		if !exists {
 			return fmt.Errorf("unable to find patcher for lang %s", l)
 		}
 		p.UnPatch(original)
 	}
+	unpatchBatchSpanProcessor(original)
 	return nil
 }
 
 func IsTracesInstrumented(original *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication) (bool, error) {
 	instrumented := true
-	for _, l := range getLangsInResult(instrumentation) {
+	for _, l := range getLangsInResult(original, instrumentation) {
 		p, exists := patcherMap[l]
 		if !exists {
 			return false, fmt.Errorf("unable to find patcher for lang %s", l)
@@ -119,23 +140,140 @@ func IsTracesInstrumented(original *v1.PodTemplateSpec, instrumentation *apiV1.I
 	return instrumented, nil
 }
 
-func getLangsInResult(instrumentation *apiV1.InstrumentedApplication) []common.ProgrammingLanguage {
+// InstrumentationWarnings collects the warnings of the patchers for the instrumented languages, and the languages of
+// mixed containers that were not instrumented
+func InstrumentationWarnings(original *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication) []string {
+	var warnings []string
+	for _, l := range getLangsInResult(original, instrumentation) {
+		if p, ok := patcherMap[l].(warningPatcher); ok {
+			warnings = append(warnings, p.Warnings(instrumentation)...)
+		}
+	}
+	for _, c := range instrumentation.Spec.Languages {
+		if !c.IsMixed() {
+			continue
+		}
+		instrumented := containerLanguages(original, c)
+		var skipped []string
+		for _, l := range c.ProcessLanguages() {
+			if !containsLanguage(instrumented, l) {
+				skipped = append(skipped, string(l))
+			}
+		}
+		if len(skipped) > 0 {
+			warnings = append(warnings, fmt.Sprintf("container %s runs processes of several languages, %s was not instrumented "+
+				"(set the %s annotation to change the instrumented languages)", c.ContainerName, strings.Join(skipped, ", "), MixedLanguagePolicyAnnotation))
+		}
+	}
+	return warnings
+}
+
+// getLangsInResult returns the languages to instrument in any container, by the mixed language policy of the pod
+// template, sorted so that the patchers always run in the same order. Without a pod template every detected language
+// is returned
+func getLangsInResult(original *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication) []common.ProgrammingLanguage {
 	langMap := make(map[common.ProgrammingLanguage]interface{})
 	for _, c := range instrumentation.Spec.Languages {
-		langMap[c.Language] = nil
+		languages := c.ProcessLanguages()
+		if original != nil {
+			languages = containerLanguages(original, c)
+		}
+		for _, l := range languages {
+			langMap[l] = nil
+		}
 	}
 
 	var langs []common.ProgrammingLanguage
 	for l := range langMap {
 		langs = append(langs, l)
 	}
+	sort.Slice(langs, func(i, j int) bool {
+		return langs[i] < langs[j]
+	})
 
 	return langs
 }
 
-func shouldPatch(instrumentation *apiV1.InstrumentedApplication, lang common.ProgrammingLanguage, containerName string) bool {
+// mergeSharedEnv leaves a single entry of each environment variable in the containers instrumented for several
+// languages, where every patcher added its own. The value kubernetes would use, the last one, is kept. The agents
+// configured by environment variables read the same OTLP variables, they all export over http/protobuf in such
+// containers, and share the resource attributes with the service name
+func mergeSharedEnv(original *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication) {
+	for _, container := range patchableContainers(original) {
+		instrumented := 0
+		for _, l := range getLangsInResult(original, instrumentation) {
+			if shouldPatch(original, instrumentation, l, container.Name) {
+				instrumented++
+			}
+		}
+		if instrumented < 2 {
+			continue
+		}
+
+		var env []v1.EnvVar
+		for _, envVar := range container.Env {
+			if idx := getIndexOfEnv(env, envVar.Name); idx != -1 {
+				env[idx] = envVar
+				continue
+			}
+			env = append(env, envVar)
+		}
+		serviceName := calculateServiceName(original, container, instrumentation)
+		setEnvValue(env, resourceAttrEnv, fmt.Sprintf(otelResourceAttrPatteern, easyConnectVersion, serviceName, PodNameEnvValue))
+		setEnvValue(env, collectorUrlEnv, fmt.Sprintf("http://%s:%d", LogzioMonitoringService, consts.OTLPHttpPort))
+		setEnvValue(env, exportProtocolEnv, httpProtoProtocol)
+		setEnvValue(env, envOtelExporterOTLPTracesProtocol, httpProtoProtocol)
+		setEnvValue(env, nodeEnvEndpoint, fmt.Sprintf("http://%s:%d/v1/traces", LogzioMonitoringService, consts.OTLPHttpPort))
+		container.Env = env
+	}
+}
+
+// setEnvValue replaces the value of the environment variable, if it is set
+func setEnvValue(envs []v1.EnvVar, name string, value string) {
+	if idx := getIndexOfEnv(envs, name); idx != -1 {
+		envs[idx] = v1.EnvVar{Name: name, Value: value}
+	}
+}
+
+// containerLanguages returns the languages to instrument in the container. A container running processes of a
+// single language gets that language, mixed containers get the languages selected by the policy of the pod template
+func containerLanguages(original *v1.PodTemplateSpec, container common.LanguageByContainer) []common.ProgrammingLanguage {
+	// a container already configured with OpenTelemetry keeps its own agent, a second one would duplicate its spans
+	if container.OpentelemetryPreconfigured {
+		return nil
+	}
+	languages := container.ProcessLanguages()
+	if len(languages) == 1 {
+		return languages
+	}
+
+	policy := strings.ToLower(original.Annotations[MixedLanguagePolicyAnnotation])
+	switch policy {
+	case AllMixedLanguagePolicy:
+		return languages
+	case SkipMixedLanguagePolicy:
+		return nil
+	case "", PrimaryMixedLanguagePolicy:
+		return languages[:1]
+	}
+	if containsLanguage(languages, common.ProgrammingLanguage(policy)) {
+		return []common.ProgrammingLanguage{common.ProgrammingLanguage(policy)}
+	}
+	return languages[:1]
+}
+
+func containsLanguage(languages []common.ProgrammingLanguage, lang common.ProgrammingLanguage) bool {
+	for _, l := range languages {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+func shouldPatch(original *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication, lang common.ProgrammingLanguage, containerName string) bool {
 	for _, l := range instrumentation.Spec.Languages {
-		if l.ContainerName == containerName && l.Language == lang {
+		if l.ContainerName == containerName && containsLanguage(containerLanguages(original, l), lang) {
 			// TODO: Handle CGO
 			return true
 		}
@@ -143,9 +281,9 @@ func shouldPatch(instrumentation *apiV1.InstrumentedApplication, lang common.Pro
 	return false
 }
 
-func shouldUpdateServiceName(instrumentation *apiV1.InstrumentedApplication, lang common.ProgrammingLanguage, containerName string, serviceName string) bool {
+func shouldUpdateServiceName(original *v1.PodTemplateSpec, instrumentation *apiV1.InstrumentedApplication, lang common.ProgrammingLanguage, containerName string, serviceName string) bool {
 	for _, l := range instrumentation.Spec.Languages {
-		if l.ContainerName == containerName && l.Language == lang {
+		if l.ContainerName == containerName && containsLanguage(containerLanguages(original, l), lang) {
 			// the active service name is different from the calculated service name
 			if serviceName != "" && l.ActiveServiceName != "" && l.ActiveServiceName != serviceName {
 				return true
@@ -155,6 +293,57 @@ func shouldUpdateServiceName(instrumentation *apiV1.InstrumentedApplication, lan
 	return false
 }
 
+// IsNativeSidecar reports whether the init container is a native sidecar, which keeps running next to the app containers
+func IsNativeSidecar(container *v1.Container) bool {
+	return container.RestartPolicy != nil && *container.RestartPolicy == v1.ContainerRestartPolicyAlways
+}
+
+// patchableContainers returns the app containers of the pod template, and its native sidecars when the workload opts in
+func patchableContainers(podSpec *v1.PodTemplateSpec) []*v1.Container {
+	var containers []*v1.Container
+	for i := range podSpec.Spec.Containers {
+		containers = append(containers, &podSpec.Spec.Containers[i])
+	}
+	if strings.ToLower(podSpec.Annotations[InstrumentNativeSidecarsAnnotation]) != "true" {
+		return containers
+	}
+	for i := range podSpec.Spec.InitContainers {
+		if IsNativeSidecar(&podSpec.Spec.InitContainers[i]) {
+			containers = append(containers, &podSpec.Spec.InitContainers[i])
+		}
+	}
+	return containers
+}
+
+// instrumentableContainers returns the app containers and every native sidecar of the pod template, the
+// instrumentation is removed from sidecars even if the workload opted out since it was patched
+func instrumentableContainers(podSpec *v1.PodTemplateSpec) []*v1.Container {
+	var containers []*v1.Container
+	for i := range podSpec.Spec.Containers {
+		containers = append(containers, &podSpec.Spec.Containers[i])
+	}
+	for i := range podSpec.Spec.InitContainers {
+		if IsNativeSidecar(&podSpec.Spec.InitContainers[i]) {
+			containers = append(containers, &podSpec.Spec.InitContainers[i])
+		}
+	}
+	return containers
+}
+
+// addAgentInitContainer adds an init container copying an agent before the first native sidecar, init containers run
+// in order and a sidecar starts before the next init container runs
+func addAgentInitContainer(podSpec *v1.PodTemplateSpec, container v1.Container) {
+	for i := range podSpec.Spec.InitContainers {
+		if IsNativeSidecar(&podSpec.Spec.InitContainers[i]) {
+			initContainers := append([]v1.Container{}, podSpec.Spec.InitContainers[:i]...)
+			initContainers = append(initContainers, container)
+			podSpec.Spec.InitContainers = append(initContainers, podSpec.Spec.InitContainers[i:]...)
+			return
+		}
+	}
+	podSpec.Spec.InitContainers = append(podSpec.Spec.InitContainers, container)
+}
+
 func getIndexOfEnv(envs []v1.EnvVar, name string) int {
 	for i := range envs {
 		if envs[i].Name == name {
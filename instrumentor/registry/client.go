@@ -0,0 +1,453 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/logzio/kubernetes-instrumentor/detectors/image"
+)
+
+const (
+	ociIndexMediaType        = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType     = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestListType   = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifestMediaType  = "application/vnd.docker.distribution.manifest.v2+json"
+	zstdLayerMediaTypeSuffix = "+zstd"
+	// maxManifestSize bounds the manifests and the image configs read in memory
+	maxManifestSize            = 4 << 20
+	wwwAuthenticateHeader      = "WWW-Authenticate"
+	bearerAuthenticationPrefix = "Bearer "
+)
+
+const (
+	// MaxImageSize is the size of the compressed layers of the largest image unpacked for detection
+	MaxImageSize = 2 << 30
+	// MaxUnpackedSize bounds the uncompressed layers of an image, the bytes extracted to the disk
+	MaxUnpackedSize = 2 << 30
+)
+
+var (
+	// ErrImageTooLarge is returned for images whose layers are larger than MaxImageSize or MaxUnpackedSize once
+	// uncompressed, and for manifests and configs larger than 4MiB
+	ErrImageTooLarge = errors.New("the image is too large to be detected")
+	// ErrNoPlatformManifest is returned for images not built for the platform of the node
+	ErrNoPlatformManifest = errors.New("no manifest for the platform")
+)
+
+// StatusError is returned when the registry answers a request with an unexpected status
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Path       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("registry returned %s for %s", e.Status, e.Path)
+}
+
+// IsPermanent reports whether pulling the image again can not succeed: the registry rejected the request, the image
+// does not exist or can not be detected. Network errors, throttling and server errors are transient
+func IsPermanent(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode < http.StatusInternalServerError && statusErr.StatusCode != http.StatusTooManyRequests
+	}
+	return errors.Is(err, ErrImageTooLarge) || errors.Is(err, ErrNoPlatformManifest) || errors.Is(err, image.ErrUnsupportedCompression)
+}
+
+var acceptedManifestTypes = strings.Join([]string{ociIndexMediaType, ociManifestMediaType, dockerManifestListType, dockerManifestMediaType}, ",")
+
+// Platform selects the image of a multi platform index
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+}
+
+type descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// Client pulls images through the registry HTTP API v2, a Client caches tokens and is not safe for concurrent use
+type Client struct {
+	httpClient         *http.Client
+	insecureHTTPClient *http.Client
+	keychain           Keychain
+	insecureRegistries map[string]bool
+	// bearer tokens by registry and repository
+	tokens map[string]string
+	// schemes are the schemes insecure registries answered on
+	schemes         map[string]string
+	maxUnpackedSize int64
+}
+
+// NewClient creates a registry client, insecure registries (for example a local registry) are accessed over HTTPS
+// without certificate verification, or over plain HTTP when they do not serve HTTPS
+func NewClient(keychain Keychain, insecureRegistries []string) *Client {
+	insecure := make(map[string]bool)
+	for _, registry := range insecureRegistries {
+		if registry != "" {
+			insecure[normalizeHost(registry)] = true
+		}
+	}
+
+	return &Client{
+		httpClient: http.DefaultClient,
+		insecureHTTPClient: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}},
+		keychain:           keychain,
+		insecureRegistries: insecure,
+		tokens:             make(map[string]string),
+		schemes:            make(map[string]string),
+		maxUnpackedSize:    MaxUnpackedSize,
+	}
+}
+
+// Pull resolves the image manifest for the platform, unpacks its layers into rootfs and returns the image config
+func (c *Client) Pull(ctx context.Context, ref Reference, platform Platform, rootfs string) (*image.Config, error) {
+	m, err := c.resolveManifest(ctx, ref, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	configData, err := c.readBlob(ctx, ref, m.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("could not read image config: %w", err)
+	}
+	config, err := image.ParseConfig(configData)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	for _, layer := range m.Layers {
+		size += layer.Size
+		if strings.HasSuffix(layer.MediaType, zstdLayerMediaTypeSuffix) {
+			return nil, fmt.Errorf("%w: layer %s of %s is %s", image.ErrUnsupportedCompression, layer.Digest, ref, layer.MediaType)
+		}
+	}
+	if size > MaxImageSize {
+		return nil, fmt.Errorf("%w: the layers of %s are %d bytes", ErrImageTooLarge, ref, size)
+	}
+
+	remaining := c.maxUnpackedSize
+	for _, layer := range m.Layers {
+		unpacked, err := c.applyLayer(ctx, ref, layer.Digest, rootfs, remaining)
+		if errors.Is(err, image.ErrLayerTooLarge) {
+			return nil, fmt.Errorf("%w: the uncompressed layers of %s are larger than %d bytes", ErrImageTooLarge, ref, c.maxUnpackedSize)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not unpack layer %s: %w", layer.Digest, err)
+		}
+		remaining -= unpacked
+	}
+	return config, nil
+}
+
+func (c *Client) resolveManifest(ctx context.Context, ref Reference, platform Platform) (*manifest, error) {
+	m, err := c.getManifest(ctx, ref, ref.Reference)
+	if err != nil {
+		return nil, err
+	}
+	if m.MediaType != ociIndexMediaType && m.MediaType != dockerManifestListType && len(m.Manifests) == 0 {
+		return m, nil
+	}
+
+	for _, d := range m.Manifests {
+		if d.Platform != nil && d.Platform.OS == platform.OS && d.Platform.Architecture == platform.Architecture {
+			return c.getManifest(ctx, ref, d.Digest)
+		}
+	}
+	return nil, fmt.Errorf("%w: image %s has no manifest for platform %s/%s", ErrNoPlatformManifest, ref, platform.OS, platform.Architecture)
+}
+
+func (c *Client) getManifest(ctx context.Context, ref Reference, reference string) (*manifest, error) {
+	resp, err := c.do(ctx, ref, "/manifests/"+reference, acceptedManifestTypes)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := readLimited(resp.Body, maxManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest %s: %w", reference, err)
+	}
+	if strings.HasPrefix(reference, "sha256:") {
+		if err = verifyDigest(reference, data); err != nil {
+			return nil, err
+		}
+	}
+
+	var m manifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("could not parse manifest: %w", err)
+	}
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+	return &m, nil
+}
+
+func (c *Client) readBlob(ctx context.Context, ref Reference, digest string) ([]byte, error) {
+	resp, err := c.do(ctx, ref, "/blobs/"+digest, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := readLimited(resp.Body, maxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+	return data, verifyDigest(digest, data)
+}
+
+// readLimited reads a response body of at most limit bytes
+func readLimited(body io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: larger than %d bytes", ErrImageTooLarge, limit)
+	}
+	return data, nil
+}
+
+// applyLayer unpacks a layer of at most limit uncompressed bytes and returns its uncompressed size
+func (c *Client) applyLayer(ctx context.Context, ref Reference, digest string, rootfs string, limit int64) (int64, error) {
+	resp, err := c.do(ctx, ref, "/blobs/"+digest, "")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	hash := sha256.New()
+	body := io.TeeReader(resp.Body, hash)
+	unpacked, err := image.ApplyLayerLimit(body, rootfs, limit)
+	if err != nil {
+		return unpacked, err
+	}
+	// the tar reader stops at the end of archive marker, the digest covers the whole blob
+	if _, err = io.Copy(io.Discard, body); err != nil {
+		return unpacked, err
+	}
+	if actual := "sha256:" + hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		return unpacked, fmt.Errorf("layer digest mismatch, expected %s got %s", digest, actual)
+	}
+	return unpacked, nil
+}
+
+// do sends an authenticated GET request to the repository API, on a 401 challenge it authenticates and retries once
+func (c *Client) do(ctx context.Context, ref Reference, apiPath string, accept string) (*http.Response, error) {
+	tokenKey := ref.Registry + "/" + ref.Repository
+	resp, err := c.get(ctx, ref, apiPath, accept, c.tokens[tokenKey])
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get(wwwAuthenticateHeader)
+		resp.Body.Close()
+
+		authorization, err := c.authenticate(ctx, ref, challenge)
+		if err != nil {
+			return nil, err
+		}
+		c.tokens[tokenKey] = authorization
+		resp, err = c.get(ctx, ref, apiPath, accept, authorization)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Path: ref.Repository + apiPath}
+	}
+	return resp, nil
+}
+
+// get sends a GET request to the registry API. Insecure registries are tried over HTTPS without certificate
+// verification first and over plain HTTP when HTTPS fails, the scheme that answered is used for the next requests
+func (c *Client) get(ctx context.Context, ref Reference, apiPath string, accept string, authorization string) (*http.Response, error) {
+	if !c.isInsecure(ref.Registry) {
+		return c.send(ctx, c.httpClient, "https", ref, apiPath, accept, authorization)
+	}
+	if scheme, known := c.schemes[ref.Registry]; known {
+		return c.send(ctx, c.insecureHTTPClient, scheme, ref, apiPath, accept, authorization)
+	}
+
+	resp, err := c.send(ctx, c.insecureHTTPClient, "https", ref, apiPath, accept, authorization)
+	if err == nil {
+		c.schemes[ref.Registry] = "https"
+		return resp, nil
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	resp, httpErr := c.send(ctx, c.insecureHTTPClient, "http", ref, apiPath, accept, authorization)
+	if httpErr != nil {
+		return nil, fmt.Errorf("registry %s answered neither over HTTPS (%s) nor over HTTP: %w", ref.Registry, err, httpErr)
+	}
+	c.schemes[ref.Registry] = "http"
+	return resp, nil
+}
+
+func (c *Client) send(ctx context.Context, httpClient *http.Client, scheme string, ref Reference, apiPath string, accept string, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/v2/%s%s", scheme, ref.apiHost(), ref.Repository, apiPath), nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return httpClient.Do(req)
+}
+
+// authenticate answers a registry challenge, basic challenges use the pull secret credentials directly and bearer
+// challenges exchange them for a pull token
+func (c *Client) authenticate(ctx context.Context, ref Reference, challenge string) (string, error) {
+	credentials, hasCredentials := c.keychain.Get(ref.Registry)
+	if !strings.HasPrefix(challenge, bearerAuthenticationPrefix) {
+		if !hasCredentials {
+			return "", fmt.Errorf("registry %s requires credentials, no matching image pull secret", ref.Registry)
+		}
+		return "Basic " + basicAuth(credentials), nil
+	}
+
+	params := parseChallenge(strings.TrimPrefix(challenge, bearerAuthenticationPrefix))
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid authentication challenge: %s", challenge)
+	}
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", ref.Repository)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if hasCredentials {
+		req.Header.Set("Authorization", "Basic "+basicAuth(credentials))
+	}
+	httpClient := c.httpClient
+	if c.isInsecure(ref.Registry) {
+		httpClient = c.insecureHTTPClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token service returned %s for %s", resp.Status, ref.Repository)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", errors.New("token service returned an empty token")
+	}
+	return bearerAuthenticationPrefix + token.Token, nil
+}
+
+// isInsecure reports whether the registry is configured as insecure or runs on the loopback interface
+func (c *Client) isInsecure(registry string) bool {
+	host := normalizeHost(registry)
+	if c.insecureRegistries[host] {
+		return true
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// parseChallenge parses the key="value" pairs of a WWW-Authenticate header
+func parseChallenge(challenge string) map[string]string {
+	params := make(map[string]string)
+	for challenge != "" {
+		eq := strings.Index(challenge, "=")
+		if eq == -1 {
+			break
+		}
+		key := strings.TrimSpace(challenge[:eq])
+		rest := challenge[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end == -1 {
+				break
+			}
+			value = rest[1 : end+1]
+			rest = rest[end+2:]
+		} else if comma := strings.Index(rest, ","); comma != -1 {
+			value = rest[:comma]
+			rest = rest[comma:]
+		} else {
+			value = rest
+			rest = ""
+		}
+		params[key] = value
+		challenge = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+	return params
+}
+
+func basicAuth(credentials Credentials) string {
+	return base64.StdEncoding.EncodeToString([]byte(credentials.Username + ":" + credentials.Password))
+}
+
+func verifyDigest(digest string, data []byte) error {
+	sum := sha256.Sum256(data)
+	if actual := "sha256:" + hex.EncodeToString(sum[:]); actual != digest {
+		return fmt.Errorf("digest mismatch, expected %s got %s", digest, actual)
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/logzio/kubernetes-instrumentor/detectors/image"
+)
+
+const ociLayerMediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+// testRegistry serves the manifests and blobs of the repository "app", authorize checks the requests to the API
+type testRegistry struct {
+	manifests map[string]testManifest
+	blobs     map[string][]byte
+	authorize func(w http.ResponseWriter, r *http.Request) bool
+}
+
+type testManifest struct {
+	mediaType string
+	data      []byte
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{manifests: make(map[string]testManifest), blobs: make(map[string][]byte)}
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if reg.authorize != nil && !reg.authorize(w, r) {
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v2/app/manifests/"):
+		m, exists := reg.manifests[strings.TrimPrefix(r.URL.Path, "/v2/app/manifests/")]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Write(m.data)
+	case strings.HasPrefix(r.URL.Path, "/v2/app/blobs/"):
+		blob, exists := reg.blobs[strings.TrimPrefix(r.URL.Path, "/v2/app/blobs/")]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(blob)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// addBlob stores a blob and returns its descriptor
+func (reg *testRegistry) addBlob(mediaType string, data []byte) descriptor {
+	d := descriptor{MediaType: mediaType, Digest: digestOf(data), Size: int64(len(data))}
+	reg.blobs[d.Digest] = data
+	return d
+}
+
+// addManifest stores a manifest under its digest and the tags, and returns its descriptor
+func (reg *testRegistry) addManifest(t *testing.T, m manifest, tags ...string) descriptor {
+	t.Helper()
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := descriptor{MediaType: m.MediaType, Digest: digestOf(data), Size: int64(len(data))}
+	for _, key := range append(tags, d.Digest) {
+		reg.manifests[key] = testManifest{mediaType: m.MediaType, data: data}
+	}
+	return d
+}
+
+// addImage stores an image with a layer holding the files and returns its manifest descriptor
+func (reg *testRegistry) addImage(t *testing.T, entrypoint string, files map[string]string, tags ...string) descriptor {
+	t.Helper()
+	config, err := json.Marshal(map[string]interface{}{"config": image.Config{Entrypoint: []string{entrypoint}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg.addManifest(t, manifest{
+		MediaType: ociManifestMediaType,
+		Config:    reg.addBlob("application/vnd.oci.image.config.v1+json", config),
+		Layers:    []descriptor{reg.addBlob(ociLayerMediaType, gzipLayer(t, files))},
+	}, tags...)
+}
+
+func gzipLayer(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, content := range files {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func serverRef(server *httptest.Server, tag string) Reference {
+	return Reference{Registry: server.Listener.Addr().String(), Repository: "app", Reference: tag}
+}
+
+func TestPull(t *testing.T) {
+	linux := Platform{OS: "linux", Architecture: "amd64"}
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, reg *testRegistry, client *Client)
+		tag     string
+		want    string
+		wantErr error
+	}{
+		{
+			name: "image manifest",
+			setup: func(t *testing.T, reg *testRegistry, client *Client) {
+				reg.addImage(t, "/app/main", map[string]string{"app/main": "amd64"}, "v1")
+			},
+			tag:  "v1",
+			want: "amd64",
+		},
+		{
+			name: "image index",
+			setup: func(t *testing.T, reg *testRegistry, client *Client) {
+				arm := reg.addImage(t, "/app/main", map[string]string{"app/main": "arm64"})
+				arm.Platform = &Platform{OS: "linux", Architecture: "arm64"}
+				amd := reg.addImage(t, "/app/main", map[string]string{"app/main": "amd64"})
+				amd.Platform = &Platform{OS: "linux", Architecture: "amd64"}
+				reg.addManifest(t, manifest{MediaType: ociIndexMediaType, Manifests: []descriptor{arm, amd}}, "v1")
+			},
+			tag:  "v1",
+			want: "amd64",
+		},
+		{
+			name: "pinned digest",
+			setup: func(t *testing.T, reg *testRegistry, client *Client) {
+				pinned := reg.addImage(t, "/app/main", map[string]string{"app/main": "pinned"})
+				reg.addImage(t, "/app/main", map[string]string{"app/main": "latest"}, "v1")
+				reg.manifests["pinned"] = reg.manifests[pinned.Digest]
+			},
+			tag:  "pinned",
+			want: "pinned",
+		},
+		{
+			name: "no manifest for the platform",
+			setup: func(t *testing.T, reg *testRegistry, client *Client) {
+				arm := reg.addImage(t, "/app/main", map[string]string{"app/main": "arm64"})
+				arm.Platform = &Platform{OS: "linux", Architecture: "arm64"}
+				reg.addManifest(t, manifest{MediaType: dockerManifestListType, Manifests: []descriptor{arm}}, "v1")
+			},
+			tag:     "v1",
+			wantErr: ErrNoPlatformManifest,
+		},
+		{
+			name: "zstd layer",
+			setup: func(t *testing.T, reg *testRegistry, client *Client) {
+				config := reg.addBlob("application/vnd.oci.image.config.v1+json", []byte(`{"config":{}}`))
+				layer := reg.addBlob("application/vnd.oci.image.layer.v1.tar+zstd", []byte{0x28, 0xb5, 0x2f, 0xfd})
+				reg.addManifest(t, manifest{MediaType: ociManifestMediaType, Config: config, Layers: []descriptor{layer}}, "v1")
+			},
+			tag:     "v1",
+			wantErr: image.ErrUnsupportedCompression,
+		},
+		{
+			name: "uncompressed layers over the limit",
+			setup: func(t *testing.T, reg *testRegistry, client *Client) {
+				client.maxUnpackedSize = 16 << 10
+				reg.addImage(t, "/app/main", map[string]string{"app/main": strings.Repeat("0", 64<<10)}, "v1")
+			},
+			tag:     "v1",
+			wantErr: ErrImageTooLarge,
+		},
+		{
+			name: "config over the limit",
+			setup: func(t *testing.T, reg *testRegistry, client *Client) {
+				config := reg.addBlob("application/vnd.oci.image.config.v1+json", bytes.Repeat([]byte(" "), maxManifestSize+1))
+				reg.addManifest(t, manifest{MediaType: ociManifestMediaType, Config: config}, "v1")
+			},
+			tag:     "v1",
+			wantErr: ErrImageTooLarge,
+		},
+		{
+			name: "layer digest mismatch",
+			setup: func(t *testing.T, reg *testRegistry, client *Client) {
+				d := reg.addImage(t, "/app/main", map[string]string{"app/main": "amd64"}, "v1")
+				var m manifest
+				json.Unmarshal(reg.manifests[d.Digest].data, &m)
+				reg.blobs[m.Layers[0].Digest] = gzipLayer(t, map[string]string{"app/main": "tampered"})
+			},
+			tag:     "v1",
+			wantErr: errors.New("layer digest mismatch"),
+		},
+		{
+			name:    "unknown tag",
+			setup:   func(t *testing.T, reg *testRegistry, client *Client) {},
+			tag:     "v2",
+			wantErr: &StatusError{StatusCode: http.StatusNotFound},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := newTestRegistry()
+			server := httptest.NewTLSServer(reg)
+			defer server.Close()
+			client := NewClient(Keychain{}, nil)
+			test.setup(t, reg, client)
+
+			rootfs := t.TempDir()
+			config, err := client.Pull(context.Background(), serverRef(server, test.tag), linux, rootfs)
+			if test.wantErr != nil {
+				var statusErr *StatusError
+				switch {
+				case err == nil:
+					t.Fatalf("Pull() succeeded, want error %s", test.wantErr)
+				case errors.As(test.wantErr, &statusErr):
+					if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound || !IsPermanent(err) {
+						t.Errorf("Pull() error = %v, want a permanent not found error", err)
+					}
+				case errors.Is(test.wantErr, ErrImageTooLarge) || errors.Is(test.wantErr, ErrNoPlatformManifest) || errors.Is(test.wantErr, image.ErrUnsupportedCompression):
+					if !errors.Is(err, test.wantErr) || !IsPermanent(err) {
+						t.Errorf("Pull() error = %v, want permanent %v", err, test.wantErr)
+					}
+				case !strings.Contains(err.Error(), test.wantErr.Error()):
+					t.Errorf("Pull() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Pull() error: %s", err)
+			}
+			if len(config.Entrypoint) != 1 || config.Entrypoint[0] != "/app/main" {
+				t.Errorf("Pull() config entrypoint = %q, want /app/main", config.Entrypoint)
+			}
+			data, err := os.ReadFile(filepath.Join(rootfs, "app/main"))
+			if err != nil || string(data) != test.want {
+				t.Errorf("unpacked app/main = %q (%v), want %q", data, err, test.want)
+			}
+		})
+	}
+}
+
+func TestInsecureRegistrySchemes(t *testing.T) {
+	for _, tls := range []bool{true, false} {
+		reg := newTestRegistry()
+		reg.addImage(t, "/app/main", map[string]string{"app/main": "amd64"}, "v1")
+		server := httptest.NewUnstartedServer(reg)
+		wantScheme := "http"
+		if tls {
+			server.StartTLS()
+			wantScheme = "https"
+		} else {
+			server.Start()
+		}
+		client := NewClient(Keychain{}, []string{server.Listener.Addr().String()})
+		if _, err := client.Pull(context.Background(), serverRef(server, "v1"), Platform{OS: "linux", Architecture: "amd64"}, t.TempDir()); err != nil {
+			t.Errorf("Pull() over %s error: %s", wantScheme, err)
+		}
+		if scheme := client.schemes[server.Listener.Addr().String()]; scheme != wantScheme {
+			t.Errorf("insecure registry scheme = %q, want %q", scheme, wantScheme)
+		}
+		server.Close()
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	credentials := Credentials{Username: "puller", Password: "s3cret"}
+	tests := []struct {
+		name              string
+		challenge         string
+		keychain          func(server *httptest.Server) Keychain
+		wantErr           string
+		wantTokens        int
+		wantAuthorization string
+	}{
+		{
+			name:      "bearer token",
+			challenge: `Bearer realm="%s/token",service="test-registry",scope="repository:app:pull"`,
+			keychain: func(server *httptest.Server) Keychain {
+				return Keychain{server.Listener.Addr().String(): credentials}
+			},
+			wantTokens:        1,
+			wantAuthorization: "Bearer pull-token",
+		},
+		{
+			name:      "anonymous bearer token",
+			challenge: `Bearer realm="%s/token",service="test-registry"`,
+			keychain:  func(server *httptest.Server) Keychain { return Keychain{} },
+			wantErr:   "token service returned 401",
+		},
+		{
+			name:      "basic credentials",
+			challenge: `Basic realm="test-registry"`,
+			keychain: func(server *httptest.Server) Keychain {
+				keychain := Keychain{}
+				keychain.AddDockerConfigJSON([]byte(`{"auths":{"https://` + server.Listener.Addr().String() + `/v1/":{"auth":"` + basicAuth(credentials) + `"}}}`))
+				return keychain
+			},
+			wantAuthorization: "Basic " + basicAuth(credentials),
+		},
+		{
+			name:      "basic without credentials",
+			challenge: `Basic realm="test-registry"`,
+			keychain:  func(server *httptest.Server) Keychain { return Keychain{} },
+			wantErr:   "requires credentials",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := newTestRegistry()
+			reg.addImage(t, "/app/main", map[string]string{"app/main": "amd64"}, "v1")
+			tokens := 0
+			var server *httptest.Server
+			mux := http.NewServeMux()
+			mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+				tokens++
+				username, password, ok := r.BasicAuth()
+				if !ok || username != credentials.Username || password != credentials.Password ||
+					r.URL.Query().Get("service") != "test-registry" || r.URL.Query().Get("scope") != "repository:app:pull" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]string{"access_token": "pull-token"})
+			})
+			challenge := test.challenge
+			if strings.Contains(challenge, "%s") {
+				challenge = ""
+			}
+			reg.authorize = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Header.Get("Authorization") == test.wantAuthorization && test.wantAuthorization != "" {
+					return true
+				}
+				if challenge == "" {
+					challenge = strings.Replace(test.challenge, "%s", server.URL, 1)
+				}
+				w.Header().Set(wwwAuthenticateHeader, challenge)
+				w.WriteHeader(http.StatusUnauthorized)
+				return false
+			}
+			mux.Handle("/v2/", reg)
+			server = httptest.NewTLSServer(mux)
+			defer server.Close()
+
+			client := NewClient(test.keychain(server), nil)
+			_, err := client.Pull(context.Background(), serverRef(server, "v1"), Platform{OS: "linux", Architecture: "amd64"}, t.TempDir())
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("Pull() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Pull() error: %s", err)
+			}
+			// the token is requested once and reused for the config and layer blobs
+			if tokens != test.wantTokens {
+				t.Errorf("token requests = %d, want %d", tokens, test.wantTokens)
+			}
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		challenge string
+		want      map[string]string
+	}{
+		{`realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"`,
+			map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/nginx:pull"}},
+		{`realm="https://ghcr.io/token",scope="repository:org/app:pull,push"`,
+			map[string]string{"realm": "https://ghcr.io/token", "scope": "repository:org/app:pull,push"}},
+		{`realm=https://registry.local/token, service=registry`,
+			map[string]string{"realm": "https://registry.local/token", "service": "registry"}},
+		{`realm="unterminated`, map[string]string{}},
+		{``, map[string]string{}},
+	}
+	for _, test := range tests {
+		got := parseChallenge(test.challenge)
+		if len(got) != len(test.want) {
+			t.Errorf("parseChallenge(%q) = %v, want %v", test.challenge, got, test.want)
+			continue
+		}
+		for key, value := range test.want {
+			if got[key] != value {
+				t.Errorf("parseChallenge(%q) = %v, want %v", test.challenge, got, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// Credentials for basic authentication against a registry or its token service
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Keychain maps registry hosts to credentials, it is built from image pull secrets
+type Keychain map[string]Credentials
+
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// AddDockerConfigJSON adds the credentials of a kubernetes.io/dockerconfigjson secret
+func (k Keychain) AddDockerConfigJSON(data []byte) error {
+	var config dockerConfigJSON
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	k.addEntries(config.Auths)
+	return nil
+}
+
+// AddDockerCfg adds the credentials of a legacy kubernetes.io/dockercfg secret
+func (k Keychain) AddDockerCfg(data []byte) error {
+	var entries map[string]dockerConfigEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	k.addEntries(entries)
+	return nil
+}
+
+func (k Keychain) addEntries(entries map[string]dockerConfigEntry) {
+	for server, entry := range entries {
+		credentials := Credentials{Username: entry.Username, Password: entry.Password}
+		if entry.Auth != "" {
+			if decoded, err := base64.StdEncoding.DecodeString(entry.Auth); err == nil {
+				if parts := strings.SplitN(string(decoded), ":", 2); len(parts) == 2 {
+					credentials = Credentials{Username: parts[0], Password: parts[1]}
+				}
+			}
+		}
+		k[normalizeHost(server)] = credentials
+	}
+}
+
+// Get returns the credentials of a registry, docker hub credentials are stored under several aliases
+func (k Keychain) Get(registry string) (Credentials, bool) {
+	host := normalizeHost(registry)
+	if credentials, ok := k[host]; ok {
+		return credentials, true
+	}
+	if host == dockerHubRegistry || host == dockerHubAPIRegistry {
+		for _, alias := range []string{dockerHubRegistry, dockerHubAPIRegistry, "index.docker.io"} {
+			if credentials, ok := k[alias]; ok {
+				return credentials, true
+			}
+		}
+	}
+	return Credentials{}, false
+}
+
+// normalizeHost strips the scheme and path from docker config server keys (https://index.docker.io/v1/)
+func normalizeHost(server string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	if idx := strings.Index(host, "/"); idx != -1 {
+		host = host[:idx]
+	}
+	return host
+}
@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"testing"
+)
+
+func TestKeychain(t *testing.T) {
+	robot := Credentials{Username: "robot", Password: "pa:ss"}
+	hub := Credentials{Username: "hub", Password: "token"}
+	tests := []struct {
+		name       string
+		dockerCfg  bool
+		data       string
+		registry   string
+		want       Credentials
+		wantExists bool
+		wantErr    bool
+	}{
+		{
+			name:       "auth field",
+			data:       `{"auths":{"registry.example.com":{"auth":"cm9ib3Q6cGE6c3M="}}}`,
+			registry:   "registry.example.com",
+			want:       robot,
+			wantExists: true,
+		},
+		{
+			name:       "username and password",
+			data:       `{"auths":{"https://registry.example.com:5000/v2/":{"username":"robot","password":"pa:ss"}}}`,
+			registry:   "registry.example.com:5000",
+			want:       robot,
+			wantExists: true,
+		},
+		{
+			name:       "auth field over username and password",
+			data:       `{"auths":{"registry.example.com":{"username":"other","password":"other","auth":"cm9ib3Q6cGE6c3M="}}}`,
+			registry:   "registry.example.com",
+			want:       robot,
+			wantExists: true,
+		},
+		{
+			name:       "docker hub legacy server",
+			data:       `{"auths":{"https://index.docker.io/v1/":{"username":"hub","password":"token"}}}`,
+			registry:   "docker.io",
+			want:       hub,
+			wantExists: true,
+		},
+		{
+			name:       "docker hub api host",
+			data:       `{"auths":{"docker.io":{"username":"hub","password":"token"}}}`,
+			registry:   "registry-1.docker.io",
+			want:       hub,
+			wantExists: true,
+		},
+		{
+			name:       "legacy dockercfg",
+			dockerCfg:  true,
+			data:       `{"https://registry.example.com":{"auth":"cm9ib3Q6cGE6c3M="}}`,
+			registry:   "registry.example.com",
+			want:       robot,
+			wantExists: true,
+		},
+		{
+			name:     "other registry",
+			data:     `{"auths":{"registry.example.com":{"auth":"cm9ib3Q6cGE6c3M="}}}`,
+			registry: "ghcr.io",
+		},
+		{
+			name:     "invalid secret",
+			data:     `{"auths":`,
+			registry: "registry.example.com",
+			wantErr:  true,
+		},
+	}
+	for _, test := range tests {
+		keychain := Keychain{}
+		var err error
+		if test.dockerCfg {
+			err = keychain.AddDockerCfg([]byte(test.data))
+		} else {
+			err = keychain.AddDockerConfigJSON([]byte(test.data))
+		}
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: add secret error = %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		got, exists := keychain.Get(test.registry)
+		if exists != test.wantExists || got != test.want {
+			t.Errorf("%s: Get(%s) = (%+v, %t), want (%+v, %t)", test.name, test.registry, got, exists, test.want, test.wantExists)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package registry
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	dockerHubRegistry    = "docker.io"
+	dockerHubAPIRegistry = "registry-1.docker.io"
+	dockerHubLibrary     = "library/"
+	latestTag            = "latest"
+	digestSeparator      = "@"
+)
+
+// Reference is a parsed image reference, Reference is either a tag or a digest
+type Reference struct {
+	Registry   string
+	Repository string
+	Reference  string
+}
+
+// ParseReference parses an image name the way the container runtime does, images without a registry are pulled
+// from docker hub and images without a tag use the latest tag
+func ParseReference(name string) (Reference, error) {
+	if name == "" {
+		return Reference{}, errors.New("empty image name")
+	}
+
+	ref := Reference{Registry: dockerHubRegistry}
+	remainder := name
+	if idx := strings.Index(remainder, "/"); idx != -1 {
+		host := remainder[:idx]
+		// the first component is a registry only if it looks like a host
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry = host
+			remainder = remainder[idx+1:]
+		}
+	}
+
+	// the digest of a reference with both a tag and a digest (name:tag@sha256:...) is pulled, the tag is ignored
+	digest := ""
+	if idx := strings.Index(remainder, digestSeparator); idx != -1 {
+		digest = remainder[idx+1:]
+		remainder = remainder[:idx]
+	}
+	ref.Reference = latestTag
+	if idx := strings.LastIndex(remainder, ":"); idx != -1 && !strings.Contains(remainder[idx:], "/") {
+		ref.Reference = remainder[idx+1:]
+		remainder = remainder[:idx]
+	}
+	if digest != "" {
+		ref.Reference = digest
+	}
+
+	if remainder == "" {
+		return Reference{}, errors.New("invalid image name: " + name)
+	}
+	if ref.Registry == dockerHubRegistry && !strings.Contains(remainder, "/") {
+		remainder = dockerHubLibrary + remainder
+	}
+	ref.Repository = remainder
+
+	return ref, nil
+}
+
+// WithDigest returns the reference pinned to the digest of the image that is actually running,
+// as reported in the container status image id (for example docker-pullable://nginx@sha256:...)
+func (r Reference) WithDigest(imageID string) Reference {
+	if idx := strings.LastIndex(imageID, digestSeparator+"sha256:"); idx != -1 {
+		r.Reference = imageID[idx+1:]
+	}
+	return r
+}
+
+// IsDigest returns true if the reference points to a manifest digest rather than a tag
+func (r Reference) IsDigest() bool {
+	return strings.HasPrefix(r.Reference, "sha256:")
+}
+
+// apiHost is the host serving the registry API
+func (r Reference) apiHost() string {
+	if r.Registry == dockerHubRegistry {
+		return dockerHubAPIRegistry
+	}
+	return r.Registry
+}
+
+func (r Reference) String() string {
+	separator := ":"
+	if r.IsDigest() {
+		separator = digestSeparator
+	}
+	return r.Registry + "/" + r.Repository + separator + r.Reference
+}
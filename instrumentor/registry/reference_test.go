@@ -0,0 +1,75 @@
+package registry
+
+import "testing"
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name string
+		want Reference
+	}{
+		{"nginx", Reference{Registry: "docker.io", Repository: "library/nginx", Reference: "latest"}},
+		{"nginx:1.25", Reference{Registry: "docker.io", Repository: "library/nginx", Reference: "1.25"}},
+		{"nginx@" + digest, Reference{Registry: "docker.io", Repository: "library/nginx", Reference: digest}},
+		{"nginx:1.25@" + digest, Reference{Registry: "docker.io", Repository: "library/nginx", Reference: digest}},
+		{"bitnami/redis:7.2", Reference{Registry: "docker.io", Repository: "bitnami/redis", Reference: "7.2"}},
+		{"docker.io/library/nginx", Reference{Registry: "docker.io", Repository: "library/nginx", Reference: "latest"}},
+		{"ghcr.io/org/app:v1", Reference{Registry: "ghcr.io", Repository: "org/app", Reference: "v1"}},
+		{"ghcr.io/org/app:v1@" + digest, Reference{Registry: "ghcr.io", Repository: "org/app", Reference: digest}},
+		{"localhost/app", Reference{Registry: "localhost", Repository: "app", Reference: "latest"}},
+		{"localhost:5000/app:dev", Reference{Registry: "localhost:5000", Repository: "app", Reference: "dev"}},
+		{"registry:5000/team/app", Reference{Registry: "registry:5000", Repository: "team/app", Reference: "latest"}},
+		{"registry:5000/team/app:1.0@" + digest, Reference{Registry: "registry:5000", Repository: "team/app", Reference: digest}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseReference(test.name)
+			if err != nil {
+				t.Fatalf("ParseReference(%q) returned error: %s", test.name, err)
+			}
+			if got != test.want {
+				t.Errorf("ParseReference(%q) = %+v, want %+v", test.name, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+	for _, name := range []string{"", "ghcr.io/", "@sha256:abc", ":tag"} {
+		if _, err := ParseReference(name); err == nil {
+			t.Errorf("ParseReference(%q) did not return an error", name)
+		}
+	}
+}
+
+func TestWithDigest(t *testing.T) {
+	digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	ref := Reference{Registry: "docker.io", Repository: "library/nginx", Reference: "1.25"}
+	if got := ref.WithDigest("docker-pullable://nginx@" + digest); got.Reference != digest {
+		t.Errorf("WithDigest pinned %q, want %q", got.Reference, digest)
+	}
+	if got := ref.WithDigest(""); got.Reference != "1.25" {
+		t.Errorf("WithDigest without an image id changed the reference to %q", got.Reference)
+	}
+}
+
+func TestIsInsecure(t *testing.T) {
+	c := NewClient(Keychain{}, []string{"registry.local:5000"})
+	tests := map[string]bool{
+		"registry.local:5000":      true,
+		"localhost":                true,
+		"localhost:5000":           true,
+		"127.0.0.1:5000":           true,
+		"[::1]:5000":               true,
+		"localhost.attacker.com":   false,
+		"127.0.0.1.attacker.com":   false,
+		"registry.local":           false,
+		"ghcr.io":                  false,
+		"localhostregistry.io:443": false,
+	}
+	for registry, want := range tests {
+		if got := c.isInsecure(registry); got != want {
+			t.Errorf("isInsecure(%q) = %t, want %t", registry, got, want)
+		}
+	}
+}
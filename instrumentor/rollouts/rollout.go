@@ -0,0 +1,196 @@
+// Package rollouts contains the parts of the Argo Rollouts API the instrumentor reads and patches. The Argo Rollouts
+// module is not a dependency, a Rollout keeps the fields of its spec the instrumentor does not know as they are
+package rollouts
+
+import (
+	"bytes"
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+const (
+	// Kind is the kind of a Rollout
+	Kind = "Rollout"
+	// PodTemplateHashLabel labels the ReplicaSets and pods of a Rollout with the hash of their pod template
+	PodTemplateHashLabel = "rollouts-pod-template-hash"
+	// PausedPhase is the phase of a Rollout waiting at a pause step or for its promotion
+	PausedPhase = "Paused"
+)
+
+var (
+	// GroupVersion is the group version of the Argo Rollouts API
+	GroupVersion = schema.GroupVersion{Group: "argoproj.io", Version: "v1alpha1"}
+
+	// SchemeBuilder is used to add go types to the GroupVersionKind scheme
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the types in this group-version to the given scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	SchemeBuilder.Register(&Rollout{}, &RolloutList{})
+}
+
+// Rollout is an Argo Rollout, a Deployment replacement with canary and blue-green update strategies
+type Rollout struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RolloutSpec   `json:"spec,omitempty"`
+	Status RolloutStatus `json:"status,omitempty"`
+}
+
+// RolloutList contains a list of Rollout
+type RolloutList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Rollout `json:"items"`
+}
+
+// RolloutSpec holds the pod template of a Rollout, the strategy and the other fields of the spec are kept as they are
+// read so updating a Rollout only changes its pod template
+type RolloutSpec struct {
+	Template corev1.PodTemplateSpec
+	// WorkloadRef references the Deployment holding the pod template instead of the Rollout
+	WorkloadRef *WorkloadRef
+	Paused      bool
+
+	fields map[string]interface{}
+}
+
+// WorkloadRef references the workload holding the pod template of a Rollout
+type WorkloadRef struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Name       string `json:"name,omitempty"`
+}
+
+// RolloutStatus is the part of the status of a Rollout the instrumentor reads
+type RolloutStatus struct {
+	// Abort is set when the update was aborted, for example by a failed analysis
+	Abort bool `json:"abort,omitempty"`
+	// CurrentPodHash is the pod template hash of the desired revision
+	CurrentPodHash string `json:"currentPodHash,omitempty"`
+	// StableRS is the pod template hash of the stable revision, equal to CurrentPodHash when no update is in progress
+	StableRS      string `json:"stableRS,omitempty"`
+	Phase         string `json:"phase,omitempty"`
+	ReadyReplicas int32  `json:"readyReplicas,omitempty"`
+}
+
+// Settled reports whether no update of the Rollout is in progress, paused or aborted. Changing the pod template of a
+// Rollout in the middle of a canary or blue-green update would restart it
+func (r *Rollout) Settled() bool {
+	return !r.Spec.Paused && !r.Status.Abort && r.Status.Phase != PausedPhase &&
+		r.Status.CurrentPodHash != "" && r.Status.CurrentPodHash == r.Status.StableRS
+}
+
+// UnmarshalJSON reads the pod template and the workload reference, and keeps every field of the spec
+func (s *RolloutSpec) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	fields := make(map[string]interface{})
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+
+	var known struct {
+		Template    corev1.PodTemplateSpec `json:"template"`
+		WorkloadRef *WorkloadRef           `json:"workloadRef,omitempty"`
+		Paused      bool                   `json:"paused,omitempty"`
+	}
+	if err := json.Unmarshal(data, &known); err != nil {
+		return err
+	}
+	*s = RolloutSpec{Template: known.Template, WorkloadRef: known.WorkloadRef, Paused: known.Paused, fields: fields}
+	return nil
+}
+
+// MarshalJSON writes the fields of the spec as they were read with the pod template
+func (s RolloutSpec) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(s.fields)+1)
+	for k, v := range s.fields {
+		fields[k] = v
+	}
+	// a Rollout referencing a Deployment has no template
+	if _, exists := s.fields["template"]; exists || s.WorkloadRef == nil {
+		fields["template"] = s.Template
+	}
+	return json.Marshal(fields)
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *Rollout) DeepCopyInto(out *Rollout) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	out.Status = in.Status
+}
+
+// DeepCopy copies the receiver, creating a new Rollout
+func (in *Rollout) DeepCopy() *Rollout {
+	if in == nil {
+		return nil
+	}
+	out := new(Rollout)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object
+func (in *Rollout) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *RolloutList) DeepCopyInto(out *RolloutList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]Rollout, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy copies the receiver, creating a new RolloutList
+func (in *RolloutList) DeepCopy() *RolloutList {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object
+func (in *RolloutList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *RolloutSpec) DeepCopyInto(out *RolloutSpec) {
+	*out = *in
+	in.Template.DeepCopyInto(&out.Template)
+	if in.WorkloadRef != nil {
+		ref := *in.WorkloadRef
+		out.WorkloadRef = &ref
+	}
+	if in.fields != nil {
+		out.fields = runtime.DeepCopyJSON(in.fields)
+	}
+}
@@ -0,0 +1,218 @@
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/logzio/kubernetes-instrumentor/common"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+const (
+	specVersion = "1.5"
+	toolName    = "kubernetes-instrumentor"
+	// properties of the components, namespaced as recommended by the CycloneDX property taxonomy
+	ecosystemProperty = "logz.io:ecosystem"
+	containerProperty = "logz.io:container"
+)
+
+// BOM is the subset of a CycloneDX document the instrumentor produces
+type BOM struct {
+	BOMFormat    string      `json:"bomFormat"`
+	SpecVersion  string      `json:"specVersion"`
+	SerialNumber string      `json:"serialNumber"`
+	Version      int         `json:"version"`
+	Metadata     Metadata    `json:"metadata"`
+	Components   []Component `json:"components"`
+}
+
+type Metadata struct {
+	Timestamp string     `json:"timestamp"`
+	Tools     Tools      `json:"tools"`
+	Component *Component `json:"component,omitempty"`
+}
+
+type Tools struct {
+	Components []Component `json:"components"`
+}
+
+type Component struct {
+	Type       string      `json:"type"`
+	BOMRef     string      `json:"bom-ref,omitempty"`
+	Group      string      `json:"group,omitempty"`
+	Name       string      `json:"name"`
+	Version    string      `json:"version,omitempty"`
+	PURL       string      `json:"purl,omitempty"`
+	Properties []Property  `json:"properties,omitempty"`
+	Components []Component `json:"components,omitempty"`
+}
+
+type Property struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Build creates the runtime SBOM of a workload. Each container is a component of the workload holding the libraries
+// detected in it
+func Build(namespace string, workload string, dependencies []common.DependenciesByContainer) BOM {
+	bom := BOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  specVersion,
+		SerialNumber: "urn:uuid:" + string(uuid.NewUUID()),
+		Version:      1,
+		Metadata: Metadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools:     Tools{Components: []Component{{Type: "application", Name: toolName}}},
+			Component: &Component{
+				Type:   "application",
+				BOMRef: namespace + "/" + workload,
+				Group:  namespace,
+				Name:   workload,
+			},
+		},
+		Components: []Component{},
+	}
+
+	for _, d := range dependencies {
+		container := Component{
+			Type:   "container",
+			BOMRef: namespace + "/" + workload + "/" + d.ContainerName,
+			Name:   d.ContainerName,
+		}
+		refs := make(map[string]bool)
+		for _, dep := range sortedDependencies(d.Dependencies) {
+			component := libraryComponent(container.BOMRef, d.ContainerName, dep)
+			// ranges of the same library have the same purl, bom-refs must be unique
+			if refs[component.BOMRef] {
+				continue
+			}
+			refs[component.BOMRef] = true
+			container.Components = append(container.Components, component)
+		}
+		bom.Components = append(bom.Components, container)
+	}
+	return bom
+}
+
+// Marshal returns the JSON document of the SBOM
+func (b BOM) Marshal() ([]byte, error) {
+	return json.Marshal(b)
+}
+
+// Dependencies reads back the dependencies of each container from an SBOM built by Build
+func Dependencies(data []byte) ([]common.DependenciesByContainer, error) {
+	var bom BOM
+	if err := json.Unmarshal(data, &bom); err != nil {
+		return nil, err
+	}
+	var dependencies []common.DependenciesByContainer
+	for _, container := range bom.Components {
+		if container.Type != "container" {
+			continue
+		}
+		d := common.DependenciesByContainer{ContainerName: container.Name}
+		for _, library := range container.Components {
+			for _, property := range library.Properties {
+				if property.Name == ecosystemProperty {
+					d.Dependencies = append(d.Dependencies, common.Dependency{
+						Name:      library.Name,
+						Version:   library.Version,
+						Ecosystem: common.DependencyEcosystem(property.Value),
+					})
+				}
+			}
+		}
+		dependencies = append(dependencies, d)
+	}
+	return dependencies, nil
+}
+
+func libraryComponent(containerRef string, containerName string, dep common.Dependency) Component {
+	purl := PackageURL(dep)
+	return Component{
+		Type:    "library",
+		BOMRef:  containerRef + "/" + purl,
+		Name:    dep.Name,
+		Version: dep.Version,
+		PURL:    purl,
+		Properties: []Property{
+			{Name: ecosystemProperty, Value: string(dep.Ecosystem)},
+			{Name: containerProperty, Value: containerName},
+		},
+	}
+}
+
+// PackageURL returns the purl of the dependency, the version is left out when only a range is known
+func PackageURL(dep common.Dependency) string {
+	var namespace, name string
+	switch dep.Ecosystem {
+	case common.NpmDependencyEcosystem:
+		if strings.HasPrefix(dep.Name, "@") && strings.Contains(dep.Name, "/") {
+			parts := strings.SplitN(dep.Name, "/", 2)
+			namespace, name = parts[0], parts[1]
+		} else {
+			name = dep.Name
+		}
+	case common.MavenDependencyEcosystem:
+		if i := strings.Index(dep.Name, ":"); i >= 0 {
+			namespace, name = dep.Name[:i], dep.Name[i+1:]
+		} else {
+			name = dep.Name
+		}
+	case common.PyPIDependencyEcosystem:
+		name = strings.ReplaceAll(strings.ToLower(dep.Name), "_", "-")
+	case common.GolangDependencyEcosystem:
+		if i := strings.LastIndex(dep.Name, "/"); i >= 0 {
+			namespace, name = dep.Name[:i], dep.Name[i+1:]
+		} else {
+			name = dep.Name
+		}
+	default:
+		name = dep.Name
+	}
+
+	purl := fmt.Sprintf("pkg:%s/", dep.Ecosystem)
+	if namespace != "" {
+		var segments []string
+		for _, segment := range strings.Split(namespace, "/") {
+			segments = append(segments, escape(segment))
+		}
+		purl += strings.Join(segments, "/") + "/"
+	}
+	purl += escape(name)
+	if isPinned(dep.Version) {
+		purl += "@" + escape(dep.Version)
+	}
+	return purl
+}
+
+// escape percent-encodes a purl segment, "@" separates the version and is encoded too (npm scopes become %40scope)
+func escape(segment string) string {
+	return strings.ReplaceAll(url.PathEscape(segment), "@", "%40")
+}
+
+// isPinned reports whether the version is an exact version rather than a range or a placeholder
+func isPinned(version string) bool {
+	if version == "" || strings.ContainsAny(version, " ^~<>=*|,") {
+		return false
+	}
+	return (version[0] >= '0' && version[0] <= '9') || (version[0] == 'v' && len(version) > 1 && version[1] >= '0' && version[1] <= '9')
+}
+
+func sortedDependencies(dependencies []common.Dependency) []common.Dependency {
+	sorted := append([]common.Dependency(nil), dependencies...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Ecosystem != sorted[j].Ecosystem {
+			return sorted[i].Ecosystem < sorted[j].Ecosystem
+		}
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].Version < sorted[j].Version
+	})
+	return sorted
+}
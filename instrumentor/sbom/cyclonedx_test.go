@@ -0,0 +1,88 @@
+package sbom
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/logzio/kubernetes-instrumentor/common"
+)
+
+func TestPackageURL(t *testing.T) {
+	tests := []struct {
+		dep  common.Dependency
+		want string
+	}{
+		{common.Dependency{Name: "express", Version: "4.18.2", Ecosystem: common.NpmDependencyEcosystem}, "pkg:npm/express@4.18.2"},
+		{common.Dependency{Name: "@grpc/grpc-js", Version: "1.9.0", Ecosystem: common.NpmDependencyEcosystem}, "pkg:npm/%40grpc/grpc-js@1.9.0"},
+		{common.Dependency{Name: "express", Version: "^4.18.0", Ecosystem: common.NpmDependencyEcosystem}, "pkg:npm/express"},
+		{common.Dependency{Name: "express", Version: "latest", Ecosystem: common.NpmDependencyEcosystem}, "pkg:npm/express"},
+		{common.Dependency{Name: "org.apache.kafka:kafka-clients", Version: "3.5.1", Ecosystem: common.MavenDependencyEcosystem}, "pkg:maven/org.apache.kafka/kafka-clients@3.5.1"},
+		{common.Dependency{Name: "Flask_SQLAlchemy", Version: "3.0.5", Ecosystem: common.PyPIDependencyEcosystem}, "pkg:pypi/flask-sqlalchemy@3.0.5"},
+		{common.Dependency{Name: "github.com/gin-gonic/gin", Version: "v1.9.1", Ecosystem: common.GolangDependencyEcosystem}, "pkg:golang/github.com/gin-gonic/gin@v1.9.1"},
+		{common.Dependency{Name: "Newtonsoft.Json", Version: "13.0.3", Ecosystem: common.NuGetDependencyEcosystem}, "pkg:nuget/Newtonsoft.Json@13.0.3"},
+		{common.Dependency{Name: "some lib", Version: "1.0.0+build", Ecosystem: common.NuGetDependencyEcosystem}, "pkg:nuget/some%20lib@1.0.0+build"},
+	}
+	for _, test := range tests {
+		if got := PackageURL(test.dep); got != test.want {
+			t.Errorf("PackageURL(%+v) = %q, want %q", test.dep, got, test.want)
+		}
+	}
+}
+
+func TestDependenciesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name         string
+		dependencies []common.DependenciesByContainer
+		want         []common.DependenciesByContainer
+	}{
+		{
+			name:         "no containers",
+			dependencies: nil,
+			want:         nil,
+		},
+		{
+			name: "sorted by ecosystem and name",
+			dependencies: []common.DependenciesByContainer{
+				{ContainerName: "app", Dependencies: []common.Dependency{
+					{Name: "requests", Version: "2.31.0", Ecosystem: common.PyPIDependencyEcosystem},
+					{Name: "express", Version: "4.18.2", Ecosystem: common.NpmDependencyEcosystem},
+				}},
+				{ContainerName: "sidecar"},
+			},
+			want: []common.DependenciesByContainer{
+				{ContainerName: "app", Dependencies: []common.Dependency{
+					{Name: "express", Version: "4.18.2", Ecosystem: common.NpmDependencyEcosystem},
+					{Name: "requests", Version: "2.31.0", Ecosystem: common.PyPIDependencyEcosystem},
+				}},
+				{ContainerName: "sidecar"},
+			},
+		},
+		{
+			name: "ranges of the same library",
+			dependencies: []common.DependenciesByContainer{
+				{ContainerName: "app", Dependencies: []common.Dependency{
+					{Name: "express", Version: "~4.18.0", Ecosystem: common.NpmDependencyEcosystem},
+					{Name: "express", Version: "^4.17.0", Ecosystem: common.NpmDependencyEcosystem},
+				}},
+			},
+			want: []common.DependenciesByContainer{
+				{ContainerName: "app", Dependencies: []common.Dependency{
+					{Name: "express", Version: "^4.17.0", Ecosystem: common.NpmDependencyEcosystem},
+				}},
+			},
+		},
+	}
+	for _, test := range tests {
+		data, err := Build("default", "shop", test.dependencies).Marshal()
+		if err != nil {
+			t.Fatalf("%s: Marshal() error: %s", test.name, err)
+		}
+		got, err := Dependencies(data)
+		if err != nil {
+			t.Fatalf("%s: Dependencies() error: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Dependencies() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
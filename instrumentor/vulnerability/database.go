@@ -0,0 +1,285 @@
+package vulnerability
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Database is an offline OSV database, loaded from the JSON entries (or zip archives of entries, as exported by
+// osv.dev per ecosystem) of a directory. A mounted ConfigMap or volume can be reloaded when its content changes.
+// Only the packages of the ecosystems the detected dependencies are matched in are indexed
+type Database struct {
+	dir     string
+	mu      sync.RWMutex
+	entries map[string][]*Entry
+	count   int
+	// fingerprint identifies the files the entries were read from, a refresh skips the reload while it is unchanged
+	fingerprint string
+	// reloaded is signaled after the entries were replaced by a refresh
+	reloaded chan struct{}
+}
+
+// Load reads the OSV entries of the directory
+func Load(dir string) (*Database, error) {
+	db := &Database{dir: dir, reloaded: make(chan struct{}, 1)}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload reads the directory again and replaces the entries when it succeeds
+func (db *Database) Reload() error {
+	fingerprint, err := db.dirFingerprint()
+	if err != nil {
+		return err
+	}
+
+	supported := make(map[string]bool, len(osvEcosystems))
+	for _, ecosystem := range osvEcosystems {
+		supported[ecosystem] = true
+	}
+	entries := make(map[string][]*Entry)
+	count := 0
+	add := func(data []byte, name string) error {
+		parsed, err := parseEntries(data)
+		if err != nil {
+			return fmt.Errorf("invalid OSV entries in %s: %w", name, err)
+		}
+		for _, entry := range parsed {
+			if entry.Withdrawn != nil {
+				continue
+			}
+			// the entries of other ecosystems, such as the OS packages of the osv.dev exports, are never matched
+			indexed := make(map[string]bool)
+			for _, affected := range entry.Affected {
+				if !supported[affected.Package.Ecosystem] {
+					continue
+				}
+				key := packageKey(affected.Package.Ecosystem, affected.Package.Name)
+				if !indexed[key] {
+					indexed[key] = true
+					entries[key] = append(entries[key], entry)
+				}
+			}
+			if len(indexed) > 0 {
+				count++
+			}
+		}
+		return nil
+	}
+
+	err = db.walkFiles(func(path string) error {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return add(data, path)
+		case ".zip":
+			return readArchive(path, add)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.entries = entries
+	db.count = count
+	db.fingerprint = fingerprint
+	return nil
+}
+
+// walkFiles calls fn with the path of every file of the directory
+func (db *Database) walkFiles(fn func(path string) error) error {
+	return filepath.WalkDir(db.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// ConfigMap volumes hold their files twice, as symlinks and in the ..data directories they point to
+		if strings.HasPrefix(d.Name(), "..") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// dirFingerprint hashes the paths, sizes and modification times of the files of the directory. The files of a
+// ConfigMap volume are resolved through its symlinks, the kubelet writes every update to a new directory
+func (db *Database) dirFingerprint() (string, error) {
+	hash := sha256.New()
+	err := db.walkFiles(func(path string) error {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(resolved)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%s\x00%d\x00%d\n", path, resolved, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// refresh reloads the directory when its files changed since the entries were read, reports whether it did
+func (db *Database) refresh() (bool, error) {
+	fingerprint, err := db.dirFingerprint()
+	if err != nil {
+		return false, err
+	}
+	db.mu.RLock()
+	unchanged := fingerprint == db.fingerprint
+	db.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	return true, db.Reload()
+}
+
+// Len returns the number of entries loaded
+func (db *Database) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.count
+}
+
+func readArchive(path string, add func([]byte, string) error) error {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for _, file := range reader.File {
+		if !strings.HasSuffix(strings.ToLower(file.Name), ".json") {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err = add(data, path+"/"+file.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseEntries reads a single OSV entry or a JSON array of entries
+func parseEntries(data []byte) ([]*Entry, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "[") {
+		var entries []*Entry
+		err := json.Unmarshal(data, &entries)
+		return entries, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return []*Entry{&entry}, nil
+}
+
+var pypiSeparators = regexp.MustCompile(`[-_.]+`)
+
+// packageKey normalizes an ecosystem and package name the way the ecosystem compares names
+func packageKey(ecosystem string, name string) string {
+	switch ecosystem {
+	case pypiEcosystem:
+		name = pypiSeparators.ReplaceAllString(strings.ToLower(name), "-")
+	case nugetEcosystem:
+		name = strings.ToLower(name)
+	}
+	return ecosystem + "/" + name
+}
+
+func (db *Database) lookup(ecosystem string, name string) []*Entry {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.entries[packageKey(ecosystem, name)]
+}
+
+// Reloaded is signaled after a refresh replaced the entries, the workloads that were already scanned are scanned again
+func (db *Database) Reloaded() <-chan struct{} {
+	return db.reloaded
+}
+
+// Refresh reloads the database every interval until the context is done, a mounted ConfigMap or volume is updated in
+// place by the kubelet. The reload and the rescan it signals are skipped while the files are unchanged, the entries
+// are kept when a reload fails
+func (db *Database) Refresh(ctx context.Context, interval time.Duration, logger logr.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := db.refresh()
+			if err != nil {
+				logger.Error(err, "error reloading vulnerability database", "dir", db.dir)
+				continue
+			}
+			if !reloaded {
+				continue
+			}
+			logger.V(1).Info("reloaded vulnerability database", "dir", db.dir, "entries", db.Len())
+			select {
+			case db.reloaded <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Refresher refreshes the database on every replica, the detection results reported to any replica are scanned with
+// the current entries
+type Refresher struct {
+	Database *Database
+	Interval time.Duration
+	Logger   logr.Logger
+}
+
+func (r *Refresher) Start(ctx context.Context) error {
+	r.Database.Refresh(ctx, r.Interval, r.Logger)
+	return nil
+}
+
+// NeedLeaderElection is false so the replicas that are not the leader refresh the database too
+func (r *Refresher) NeedLeaderElection() bool {
+	return false
+}
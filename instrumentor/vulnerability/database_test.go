@@ -0,0 +1,193 @@
+package vulnerability
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	pypiEntry   = `{"id":"PYSEC-1","affected":[{"package":{"ecosystem":"PyPI","name":"Flask_Cors"},"versions":["3.0.0"]}]}`
+	mixedEntry  = `{"id":"GHSA-1","affected":[{"package":{"ecosystem":"npm","name":"lodash"}},{"package":{"ecosystem":"crates.io","name":"lodash"}}]}`
+	debianEntry = `{"id":"DSA-1","affected":[{"package":{"ecosystem":"Debian:12","name":"openssl"}}]}`
+	withdrawn   = `{"id":"GHSA-2","withdrawn":"2023-01-01T00:00:00Z","affected":[{"package":{"ecosystem":"Go","name":"golang.org/x/net"}}]}`
+)
+
+func writeArchive(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "pypi.json"), []byte(pypiEntry), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "entries.json"), []byte("["+mixedEntry+","+withdrawn+"]"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writeArchive(t, filepath.Join(dir, "all.zip"), map[string]string{"DSA-1.json": debianEntry, "README.txt": "not an entry"})
+	// the files of a ConfigMap volume are also in its ..data directory
+	if err := os.Mkdir(filepath.Join(dir, "..data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "..data", "pypi.json"), []byte(pypiEntry), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load() error: %s", err)
+	}
+	if db.Len() != 2 {
+		t.Errorf("Len() = %d, want the PyPI and npm entries", db.Len())
+	}
+	tests := []struct {
+		ecosystem string
+		name      string
+		want      int
+	}{
+		{ecosystem: pypiEcosystem, name: "flask-cors", want: 1},
+		{ecosystem: npmEcosystem, name: "lodash", want: 1},
+		{ecosystem: "crates.io", name: "lodash"},
+		{ecosystem: "Debian:12", name: "openssl"},
+		{ecosystem: goEcosystem, name: "golang.org/x/net"},
+	}
+	for _, test := range tests {
+		if got := len(db.lookup(test.ecosystem, test.name)); got != test.want {
+			t.Errorf("lookup(%s, %s) = %d entries, want %d", test.ecosystem, test.name, got, test.want)
+		}
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, "invalid.json"), []byte(`{"id":`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load(dir); err == nil {
+		t.Errorf("Load() of an invalid entry succeeded")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pypi.json")
+	if err := os.WriteFile(path, []byte(pypiEntry), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		change     func() error
+		wantReload bool
+		wantErr    bool
+		wantLen    int
+	}{
+		{name: "unchanged", change: func() error { return nil }, wantLen: 1},
+		{
+			name:       "added file",
+			change:     func() error { return os.WriteFile(filepath.Join(dir, "npm.json"), []byte(mixedEntry), 0o644) },
+			wantReload: true,
+			wantLen:    2,
+		},
+		{name: "unchanged after a reload", change: func() error { return nil }, wantLen: 2},
+		{
+			name: "touched file",
+			change: func() error {
+				later := time.Now().Add(time.Minute)
+				return os.Chtimes(path, later, later)
+			},
+			wantReload: true,
+			wantLen:    2,
+		},
+		{
+			name:       "invalid file keeps the entries",
+			change:     func() error { return os.WriteFile(filepath.Join(dir, "npm.json"), []byte(`{"id":`), 0o644) },
+			wantReload: true,
+			wantErr:    true,
+			wantLen:    2,
+		},
+		{
+			name:       "failed reload is retried",
+			change:     func() error { return nil },
+			wantReload: true,
+			wantErr:    true,
+			wantLen:    2,
+		},
+		{
+			name:       "removed file",
+			change:     func() error { return os.Remove(filepath.Join(dir, "npm.json")) },
+			wantReload: true,
+			wantLen:    1,
+		},
+	}
+	for _, test := range tests {
+		if err = test.change(); err != nil {
+			t.Fatal(err)
+		}
+		reloaded, err := db.refresh()
+		if reloaded != test.wantReload || (err != nil) != test.wantErr {
+			t.Errorf("%s: refresh() = (%t, %v), want (%t, error %t)", test.name, reloaded, err, test.wantReload, test.wantErr)
+		}
+		if db.Len() != test.wantLen {
+			t.Errorf("%s: Len() = %d, want %d", test.name, db.Len(), test.wantLen)
+		}
+	}
+}
+
+func TestRefreshSignalsChanges(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pypi.json")
+	if err := os.WriteFile(path, []byte(pypiEntry), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go db.Refresh(ctx, 5*time.Millisecond, logr.Discard())
+
+	select {
+	case <-db.Reloaded():
+		t.Fatalf("Reloaded() signaled without a change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, "npm.json"), []byte(mixedEntry), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-db.Reloaded():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Reloaded() not signaled after a change")
+	}
+	if db.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", db.Len())
+	}
+}
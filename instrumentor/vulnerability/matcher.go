@@ -0,0 +1,207 @@
+package vulnerability
+
+import (
+	"sort"
+	"strings"
+
+	v1 "github.com/logzio/kubernetes-instrumentor/api/v1beta1"
+	"github.com/logzio/kubernetes-instrumentor/common"
+)
+
+// maxFindings bounds the findings listed on the InstrumentedApplication status, the counts include every finding
+const maxFindings = 50
+
+// osvEcosystems maps the ecosystems of the detected dependencies to their OSV names
+var osvEcosystems = map[common.DependencyEcosystem]string{
+	common.NpmDependencyEcosystem:    npmEcosystem,
+	common.PyPIDependencyEcosystem:   pypiEcosystem,
+	common.MavenDependencyEcosystem:  mavenEcosystem,
+	common.NuGetDependencyEcosystem:  nugetEcosystem,
+	common.GolangDependencyEcosystem: goEcosystem,
+}
+
+// Scan matches the dependencies of every container against the database. Dependencies declared with a range instead of
+// an exact version, and maven jars known only by their file name, cannot be matched and are skipped
+func (db *Database) Scan(dependencies []common.DependenciesByContainer) *v1.VulnerabilitySummary {
+	summary := &v1.VulnerabilitySummary{}
+	var findings []v1.VulnerabilityFinding
+	for _, d := range dependencies {
+		seen := make(map[string]bool)
+		for _, dep := range d.Dependencies {
+			ecosystem, known := osvEcosystems[dep.Ecosystem]
+			if !known || !isExactVersion(dep.Version) || (ecosystem == mavenEcosystem && !strings.Contains(dep.Name, ":")) {
+				continue
+			}
+			for _, finding := range db.match(ecosystem, dep) {
+				key := finding.ID + "/" + dep.Name + "/" + dep.Version
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				finding.ContainerName = d.ContainerName
+				findings = append(findings, finding)
+			}
+		}
+	}
+
+	for _, finding := range findings {
+		switch finding.Severity {
+		case CriticalSeverity:
+			summary.Critical++
+		case HighSeverity:
+			summary.High++
+		case MediumSeverity:
+			summary.Medium++
+		case LowSeverity:
+			summary.Low++
+		default:
+			summary.Unknown++
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return severityRank(findings[i].Severity) < severityRank(findings[j].Severity)
+	})
+	if len(findings) > maxFindings {
+		findings = findings[:maxFindings]
+	}
+	summary.Findings = findings
+	return summary
+}
+
+// match returns the entries affecting the version of the dependency
+func (db *Database) match(ecosystem string, dep common.Dependency) []v1.VulnerabilityFinding {
+	version := strings.TrimPrefix(dep.Version, "v")
+	var findings []v1.VulnerabilityFinding
+	for _, entry := range db.lookup(ecosystem, dep.Name) {
+		for _, affected := range entry.Affected {
+			if packageKey(affected.Package.Ecosystem, affected.Package.Name) != packageKey(ecosystem, dep.Name) {
+				continue
+			}
+			fixed, isAffected := affects(ecosystem, affected, version)
+			if !isAffected {
+				continue
+			}
+			findings = append(findings, v1.VulnerabilityFinding{
+				ID:        entry.ID,
+				Aliases:   entry.Aliases,
+				Package:   dep.Name,
+				Version:   dep.Version,
+				Ecosystem: string(dep.Ecosystem),
+				Severity:  severityOf(*entry, affected),
+				Fixed:     fixed,
+			})
+			break
+		}
+	}
+	return findings
+}
+
+// affects reports whether the version is listed or in one of the ranges of the affected package, with the version
+// fixing it when known
+func affects(ecosystem string, affected Affected, version string) (string, bool) {
+	for _, listed := range affected.Versions {
+		if compareVersions(ecosystem, strings.TrimPrefix(listed, "v"), version) == 0 {
+			return "", true
+		}
+	}
+	for _, r := range affected.Ranges {
+		if r.Type != "ECOSYSTEM" && r.Type != "SEMVER" {
+			continue
+		}
+		if fixed, isAffected := inRange(ecosystem, r.Events, version); isAffected {
+			return fixed, true
+		}
+	}
+	return "", false
+}
+
+// inRange evaluates the events of a range in version order: introduced starts an affected interval, fixed and limit end
+// it at their version and last_affected after its version
+func inRange(ecosystem string, events []Event, version string) (string, bool) {
+	sorted := append([]Event(nil), events...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return compareEvents(ecosystem, sorted[i], sorted[j]) < 0
+	})
+
+	affected := false
+	fixed := ""
+	for _, event := range sorted {
+		switch {
+		case event.Introduced != "":
+			if event.Introduced == "0" || compareVersions(ecosystem, version, event.Introduced) >= 0 {
+				affected = true
+				fixed = ""
+			}
+		case event.Fixed != "":
+			if compareVersions(ecosystem, version, event.Fixed) >= 0 {
+				affected = false
+			} else if affected && fixed == "" {
+				fixed = event.Fixed
+			}
+		case event.LastAffected != "":
+			if compareVersions(ecosystem, version, event.LastAffected) > 0 {
+				affected = false
+			}
+		case event.Limit != "":
+			if event.Limit != "*" && compareVersions(ecosystem, version, event.Limit) >= 0 {
+				affected = false
+			}
+		}
+	}
+	return fixed, affected
+}
+
+func compareEvents(ecosystem string, a Event, b Event) int {
+	aVersion, bVersion := eventVersion(a), eventVersion(b)
+	switch {
+	case aVersion == bVersion:
+		return 0
+	case aVersion == "0":
+		return -1
+	case bVersion == "0":
+		return 1
+	case aVersion == "*":
+		return 1
+	case bVersion == "*":
+		return -1
+	}
+	return compareVersions(ecosystem, aVersion, bVersion)
+}
+
+func eventVersion(event Event) string {
+	for _, version := range []string{event.Introduced, event.Fixed, event.LastAffected, event.Limit} {
+		if version != "" {
+			return version
+		}
+	}
+	return ""
+}
+
+// isExactVersion reports whether the version is an installed version rather than a range or a placeholder
+func isExactVersion(version string) bool {
+	version = strings.TrimPrefix(version, "v")
+	return version != "" && version[0] >= '0' && version[0] <= '9' && !strings.ContainsAny(version, " ^~<>=*|,") && !strings.Contains(strings.ToLower(version), ".x")
+}
+
+func severityRank(severity string) int {
+	for i, s := range Severities {
+		if s == severity {
+			return i
+		}
+	}
+	return len(Severities)
+}
+
+// Counts returns the counts of the summary by severity
+func Counts(summary *v1.VulnerabilitySummary) map[string]int {
+	if summary == nil {
+		return nil
+	}
+	return map[string]int{
+		CriticalSeverity: summary.Critical,
+		HighSeverity:     summary.High,
+		MediumSeverity:   summary.Medium,
+		LowSeverity:      summary.Low,
+		UnknownSeverity:  summary.Unknown,
+	}
+}
@@ -0,0 +1,62 @@
+package vulnerability
+
+import "testing"
+
+func TestInRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		ecosystem string
+		events    []Event
+		version   string
+		want      bool
+		wantFixed string
+	}{
+		{"introduced at zero", npmEcosystem, []Event{{Introduced: "0"}}, "0.0.1", true, ""},
+		{"before fixed", npmEcosystem, []Event{{Introduced: "0"}, {Fixed: "1.2.0"}}, "1.1.9", true, "1.2.0"},
+		{"at fixed", npmEcosystem, []Event{{Introduced: "0"}, {Fixed: "1.2.0"}}, "1.2.0", false, ""},
+		{"before introduced", npmEcosystem, []Event{{Introduced: "1.0.0"}, {Fixed: "1.2.0"}}, "0.9.0", false, ""},
+		{"at introduced", npmEcosystem, []Event{{Introduced: "1.0.0"}, {Fixed: "1.2.0"}}, "1.0.0", true, "1.2.0"},
+		{"at last affected", pypiEcosystem, []Event{{Introduced: "0"}, {LastAffected: "2.0"}}, "2.0", true, ""},
+		{"after last affected", pypiEcosystem, []Event{{Introduced: "0"}, {LastAffected: "2.0"}}, "2.0.post1", false, ""},
+		{"before limit", goEcosystem, []Event{{Introduced: "0"}, {Limit: "v1.5.0"}}, "v1.4.0", true, ""},
+		{"at limit", goEcosystem, []Event{{Introduced: "0"}, {Limit: "v1.5.0"}}, "v1.5.0", false, ""},
+		{"unlimited", goEcosystem, []Event{{Introduced: "1.0.0"}, {Limit: "*"}}, "v9.0.0", true, ""},
+		{"unsorted events", mavenEcosystem, []Event{{Fixed: "2.12.7.1"}, {Introduced: "2.0"}}, "2.12.7", true, "2.12.7.1"},
+		{"first interval", npmEcosystem, []Event{{Introduced: "1.0.0"}, {Fixed: "1.0.5"}, {Introduced: "2.0.0"}, {Fixed: "2.0.3"}}, "1.0.1", true, "1.0.5"},
+		{"between intervals", npmEcosystem, []Event{{Introduced: "1.0.0"}, {Fixed: "1.0.5"}, {Introduced: "2.0.0"}, {Fixed: "2.0.3"}}, "1.9.0", false, ""},
+		{"second interval", npmEcosystem, []Event{{Introduced: "1.0.0"}, {Fixed: "1.0.5"}, {Introduced: "2.0.0"}, {Fixed: "2.0.3"}}, "2.0.1", true, "2.0.3"},
+		{"after intervals", npmEcosystem, []Event{{Introduced: "1.0.0"}, {Fixed: "1.0.5"}, {Introduced: "2.0.0"}, {Fixed: "2.0.3"}}, "3.0.0", false, ""},
+		{"prerelease of fixed", npmEcosystem, []Event{{Introduced: "0"}, {Fixed: "1.0.0"}}, "1.0.0-rc.1", true, "1.0.0"},
+	}
+	for _, test := range tests {
+		fixed, affected := inRange(test.ecosystem, test.events, test.version)
+		if affected != test.want || fixed != test.wantFixed {
+			t.Errorf("%s: inRange(%s, %+v, %q) = (%q, %t), want (%q, %t)", test.name, test.ecosystem, test.events, test.version, fixed, affected, test.wantFixed, test.want)
+		}
+	}
+}
+
+func TestAffects(t *testing.T) {
+	ranges := []Range{{Type: "ECOSYSTEM", Events: []Event{{Introduced: "1.0"}, {Fixed: "1.4"}}}}
+	tests := []struct {
+		name      string
+		affected  Affected
+		version   string
+		want      bool
+		wantFixed string
+	}{
+		{"listed version", Affected{Versions: []string{"0.9", "0.9.1"}}, "0.9.1", true, ""},
+		{"listed version with prefix", Affected{Versions: []string{"v0.9.1"}}, "0.9.1", true, ""},
+		{"not listed", Affected{Versions: []string{"0.9", "0.9.1"}}, "0.9.2", false, ""},
+		{"ecosystem range", Affected{Ranges: ranges}, "1.2", true, "1.4"},
+		{"semver range", Affected{Ranges: []Range{{Type: "SEMVER", Events: ranges[0].Events}}}, "1.2", true, "1.4"},
+		{"git range ignored", Affected{Ranges: []Range{{Type: "GIT", Events: ranges[0].Events}}}, "1.2", false, ""},
+		{"out of range", Affected{Versions: []string{"0.9"}, Ranges: ranges}, "1.4", false, ""},
+	}
+	for _, test := range tests {
+		fixed, affected := affects(pypiEcosystem, test.affected, test.version)
+		if affected != test.want || fixed != test.wantFixed {
+			t.Errorf("%s: affects(%+v, %q) = (%q, %t), want (%q, %t)", test.name, test.affected, test.version, fixed, affected, test.wantFixed, test.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package vulnerability
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Entry is the subset of the OSV schema (https://ossf.github.io/osv-schema/) used to match dependencies
+type Entry struct {
+	ID               string           `json:"id"`
+	Summary          string           `json:"summary,omitempty"`
+	Aliases          []string         `json:"aliases,omitempty"`
+	Withdrawn        *time.Time       `json:"withdrawn,omitempty"`
+	Affected         []Affected       `json:"affected"`
+	Severity         []Severity       `json:"severity,omitempty"`
+	DatabaseSpecific DatabaseSpecific `json:"database_specific,omitempty"`
+}
+
+type Affected struct {
+	Package           Package          `json:"package"`
+	Ranges            []Range          `json:"ranges,omitempty"`
+	Versions          []string         `json:"versions,omitempty"`
+	Severity          []Severity       `json:"severity,omitempty"`
+	DatabaseSpecific  DatabaseSpecific `json:"database_specific,omitempty"`
+	EcosystemSpecific DatabaseSpecific `json:"ecosystem_specific,omitempty"`
+}
+
+type Package struct {
+	Ecosystem string `json:"ecosystem"`
+	Name      string `json:"name"`
+}
+
+// Range is a list of events, GIT ranges are ignored since the detected versions are not commits
+type Range struct {
+	Type   string  `json:"type"`
+	Events []Event `json:"events"`
+}
+
+type Event struct {
+	Introduced   string `json:"introduced,omitempty"`
+	Fixed        string `json:"fixed,omitempty"`
+	LastAffected string `json:"last_affected,omitempty"`
+	Limit        string `json:"limit,omitempty"`
+}
+
+type Severity struct {
+	Type  string `json:"type"`
+	Score string `json:"score"`
+}
+
+// DatabaseSpecific holds the severity label some databases (GitHub advisories, for example) add to the entries
+type DatabaseSpecific struct {
+	Severity string `json:"severity,omitempty"`
+}
+
+// UnmarshalJSON ignores database specific fields that are not objects, their schema is up to each database
+func (d *DatabaseSpecific) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	if severity, exists := fields["severity"]; exists {
+		_ = json.Unmarshal(severity, &d.Severity)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package vulnerability
+
+import (
+	"math"
+	"strings"
+)
+
+// Severity levels of the findings, from the CVSS base score or the severity label of the database
+const (
+	CriticalSeverity = "CRITICAL"
+	HighSeverity     = "HIGH"
+	MediumSeverity   = "MEDIUM"
+	LowSeverity      = "LOW"
+	UnknownSeverity  = "UNKNOWN"
+)
+
+// Severities lists the severity levels from the most to the least severe
+var Severities = []string{CriticalSeverity, HighSeverity, MediumSeverity, LowSeverity, UnknownSeverity}
+
+// severityOf returns the severity of the entry for the affected package: the CVSS v3 base score of the package or the
+// entry, otherwise the severity label of the database
+func severityOf(entry Entry, affected Affected) string {
+	for _, severities := range [][]Severity{affected.Severity, entry.Severity} {
+		for _, s := range severities {
+			if s.Type == "CVSS_V3" {
+				if score, ok := cvss3BaseScore(s.Score); ok {
+					return scoreSeverity(score)
+				}
+			}
+		}
+	}
+	for _, label := range []string{affected.EcosystemSpecific.Severity, affected.DatabaseSpecific.Severity, entry.DatabaseSpecific.Severity} {
+		switch strings.ToUpper(label) {
+		case CriticalSeverity:
+			return CriticalSeverity
+		case HighSeverity:
+			return HighSeverity
+		case MediumSeverity, "MODERATE":
+			return MediumSeverity
+		case LowSeverity:
+			return LowSeverity
+		}
+	}
+	return UnknownSeverity
+}
+
+// scoreSeverity maps a CVSS score to its qualitative rating
+func scoreSeverity(score float64) string {
+	switch {
+	case score >= 9.0:
+		return CriticalSeverity
+	case score >= 7.0:
+		return HighSeverity
+	case score >= 4.0:
+		return MediumSeverity
+	case score > 0:
+		return LowSeverity
+	}
+	return UnknownSeverity
+}
+
+var cvss3Weights = map[string]map[string]float64{
+	"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+	"AC": {"L": 0.77, "H": 0.44},
+	"UI": {"N": 0.85, "R": 0.62},
+	"C":  {"H": 0.56, "L": 0.22, "N": 0},
+	"I":  {"H": 0.56, "L": 0.22, "N": 0},
+	"A":  {"H": 0.56, "L": 0.22, "N": 0},
+}
+
+// cvss3BaseScore computes the base score of a CVSS v3.x vector like CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H
+func cvss3BaseScore(vector string) (float64, bool) {
+	if !strings.HasPrefix(vector, "CVSS:3.") {
+		return 0, false
+	}
+	metrics := make(map[string]string)
+	for _, part := range strings.Split(vector, "/")[1:] {
+		if key, value, found := strings.Cut(part, ":"); found {
+			metrics[key] = value
+		}
+	}
+
+	weights := make(map[string]float64)
+	for metric, values := range cvss3Weights {
+		weight, exists := values[metrics[metric]]
+		if !exists {
+			return 0, false
+		}
+		weights[metric] = weight
+	}
+	scopeChanged := metrics["S"] == "C"
+	if metrics["S"] != "C" && metrics["S"] != "U" {
+		return 0, false
+	}
+	var privileges float64
+	switch metrics["PR"] {
+	case "N":
+		privileges = 0.85
+	case "L":
+		privileges = 0.62
+		if scopeChanged {
+			privileges = 0.68
+		}
+	case "H":
+		privileges = 0.27
+		if scopeChanged {
+			privileges = 0.5
+		}
+	default:
+		return 0, false
+	}
+
+	iss := 1 - (1-weights["C"])*(1-weights["I"])*(1-weights["A"])
+	impact := 6.42 * iss
+	if scopeChanged {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0, true
+	}
+	exploitability := 8.22 * weights["AV"] * weights["AC"] * privileges * weights["UI"]
+	if scopeChanged {
+		return roundUp(math.Min(1.08*(impact+exploitability), 10)), true
+	}
+	return roundUp(math.Min(impact+exploitability, 10)), true
+}
+
+// roundUp rounds up to one decimal as defined by the CVSS v3.1 specification
+func roundUp(value float64) float64 {
+	integer := int(math.Round(value * 100000))
+	if integer%10000 == 0 {
+		return float64(integer) / 100000
+	}
+	return float64(integer/10000+1) / 10
+}
@@ -0,0 +1,266 @@
+package vulnerability
+
+import (
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// OSV ecosystem names
+const (
+	npmEcosystem   = "npm"
+	pypiEcosystem  = "PyPI"
+	mavenEcosystem = "Maven"
+	nugetEcosystem = "NuGet"
+	goEcosystem    = "Go"
+)
+
+var implicitPostRelease = regexp.MustCompile(`-(\d)`)
+
+// token is a part of a version, numbers compare numerically and qualifiers by their rank, then alphabetically
+type token struct {
+	number    *big.Int
+	qualifier string
+}
+
+// compareVersions orders two versions of the ecosystem, returns -1, 0 or 1
+func compareVersions(ecosystem string, a string, b string) int {
+	switch ecosystem {
+	case pypiEcosystem:
+		return compareTokens(pep440Tokens(a), pep440Tokens(b), pep440Rank)
+	case mavenEcosystem:
+		return compareTokens(mavenTokens(a), mavenTokens(b), mavenRank)
+	default:
+		// npm, Go and NuGet versions follow semantic versioning, NuGet allows a fourth release segment
+		return compareSemver(a, b)
+	}
+}
+
+// compareSemver compares the release segments numerically, a version with a pre-release is lower than the release.
+// Pre-release identifiers compare numerically when numeric and alphabetically otherwise, build metadata is ignored
+func compareSemver(a string, b string) int {
+	a, b = strings.TrimPrefix(strings.TrimSpace(a), "v"), strings.TrimPrefix(strings.TrimSpace(b), "v")
+	a, _, _ = strings.Cut(a, "+")
+	b, _, _ = strings.Cut(b, "+")
+	aRelease, aPre, aHasPre := strings.Cut(a, "-")
+	bRelease, bPre, bHasPre := strings.Cut(b, "-")
+
+	if c := compareTokens(numericTokens(strings.Split(aRelease, ".")), numericTokens(strings.Split(bRelease, ".")), nil); c != 0 {
+		return c
+	}
+	switch {
+	case !aHasPre && !bHasPre:
+		return 0
+	case !aHasPre:
+		return 1
+	case !bHasPre:
+		return -1
+	}
+
+	aParts, bParts := strings.Split(strings.ToLower(aPre), "."), strings.Split(strings.ToLower(bPre), ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aToken, bToken := parseToken(aParts[i]), parseToken(bParts[i])
+		switch {
+		case aToken.number != nil && bToken.number != nil:
+			if c := aToken.number.Cmp(bToken.number); c != 0 {
+				return c
+			}
+		case aToken.number != nil:
+			return -1
+		case bToken.number != nil:
+			return 1
+		default:
+			if c := strings.Compare(aParts[i], bParts[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return sign(len(aParts) - len(bParts))
+}
+
+func numericTokens(parts []string) []token {
+	var tokens []token
+	for _, part := range parts {
+		tokens = append(tokens, parseToken(part))
+	}
+	return tokens
+}
+
+func parseToken(part string) token {
+	if number, ok := new(big.Int).SetString(part, 10); ok {
+		return token{number: number}
+	}
+	return token{qualifier: part}
+}
+
+// compareTokens compares token by token, missing numbers count as zero and missing qualifiers as a release (rank 0).
+// rank orders the known qualifiers, unknown qualifiers come after the known ones and compare alphabetically
+func compareTokens(a []token, b []token, rank func(string) (int, bool)) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var aToken, bToken token
+		if i < len(a) {
+			aToken = a[i]
+		}
+		if i < len(b) {
+			bToken = b[i]
+		}
+		if c := compareToken(aToken, bToken, rank); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareToken(a token, b token, rank func(string) (int, bool)) int {
+	aNumber, bNumber := a.number, b.number
+	if aNumber == nil && a.qualifier == "" {
+		aNumber = big.NewInt(0)
+	}
+	if bNumber == nil && b.qualifier == "" {
+		bNumber = big.NewInt(0)
+	}
+	switch {
+	case aNumber != nil && bNumber != nil:
+		return aNumber.Cmp(bNumber)
+	case aNumber != nil:
+		// a release segment missing on the other side counts as zero, a later release than a qualifier unless the
+		// qualifier ranks after releases (post, sp): 1.0.1 is after 1.0.post1 and 1.0 before it
+		if aNumber.Sign() > 0 {
+			return 1
+		}
+		return -qualifierSign(b.qualifier, rank)
+	case bNumber != nil:
+		if bNumber.Sign() > 0 {
+			return -1
+		}
+		return qualifierSign(a.qualifier, rank)
+	}
+
+	aRank, aKnown := qualifierRank(a.qualifier, rank)
+	bRank, bKnown := qualifierRank(b.qualifier, rank)
+	switch {
+	case aKnown && bKnown:
+		// spellings of the same qualifier (a and alpha) are equal
+		return sign(aRank - bRank)
+	case aKnown && !bKnown:
+		return -1
+	case !aKnown && bKnown:
+		return 1
+	}
+	return strings.Compare(a.qualifier, b.qualifier)
+}
+
+// qualifierSign compares a qualifier with a release segment
+func qualifierSign(qualifier string, rank func(string) (int, bool)) int {
+	if r, known := qualifierRank(qualifier, rank); known && r > 0 {
+		return 1
+	}
+	return -1
+}
+
+func qualifierRank(qualifier string, rank func(string) (int, bool)) (int, bool) {
+	if rank == nil {
+		return 0, false
+	}
+	return rank(qualifier)
+}
+
+// pep440Tokens splits a PEP 440 version into its release segments and the pre, post and dev releases
+func pep440Tokens(version string) []token {
+	version = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "v")
+	if _, after, found := strings.Cut(version, "!"); found {
+		version = after
+	}
+	version, _, _ = strings.Cut(version, "+")
+	// a number after a dash is an implicit post release, 1.0-1 is 1.0.post1
+	version = implicitPostRelease.ReplaceAllString(version, ".post$1")
+	return splitTokens(strings.NewReplacer("-", ".", "_", ".").Replace(version))
+}
+
+func pep440Rank(qualifier string) (int, bool) {
+	switch qualifier {
+	case "dev":
+		return -4, true
+	case "a", "alpha":
+		return -3, true
+	case "b", "beta":
+		return -2, true
+	case "rc", "c", "pre", "preview":
+		return -1, true
+	case "post", "rev", "r":
+		return 1, true
+	}
+	return 0, false
+}
+
+// mavenTokens splits a maven version on dots, dashes and the transitions between digits and letters. The ga, final
+// and release qualifiers are the release itself, 1.0.RELEASE equals 1.0
+func mavenTokens(version string) []token {
+	var tokens []token
+	for _, t := range splitTokens(strings.ReplaceAll(strings.ToLower(strings.TrimSpace(version)), "-", ".")) {
+		if r, known := mavenRank(t.qualifier); t.number == nil && known && r == 0 {
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+	return trimZeros(tokens)
+}
+
+func mavenRank(qualifier string) (int, bool) {
+	switch qualifier {
+	case "alpha", "a":
+		return -5, true
+	case "beta", "b":
+		return -4, true
+	case "milestone", "m":
+		return -3, true
+	case "rc", "cr":
+		return -2, true
+	case "snapshot":
+		return -1, true
+	case "ga", "final", "release":
+		return 0, true
+	case "sp":
+		return 1, true
+	}
+	return 0, false
+}
+
+// splitTokens splits on dots and on the transitions between digits and letters, "1.0rc1" is 1, 0, rc, 1
+func splitTokens(version string) []token {
+	var tokens []token
+	for _, part := range strings.Split(version, ".") {
+		start := 0
+		for i := 1; i <= len(part); i++ {
+			if i == len(part) || isDigit(part[i]) != isDigit(part[i-1]) {
+				if start < i {
+					tokens = append(tokens, parseToken(part[start:i]))
+				}
+				start = i
+			}
+		}
+	}
+	return trimZeros(tokens)
+}
+
+// trimZeros removes the trailing zero segments, they do not change a version: 1.0 equals 1
+func trimZeros(tokens []token) []token {
+	for len(tokens) > 0 && tokens[len(tokens)-1].number != nil && tokens[len(tokens)-1].number.Sign() == 0 {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return tokens
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+package vulnerability
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		ecosystem string
+		a         string
+		b         string
+		want      int
+	}{
+		// semantic versioning, npm, Go and NuGet
+		{npmEcosystem, "1.2.3", "1.2.3", 0},
+		{npmEcosystem, "1.2.3", "1.2.4", -1},
+		{npmEcosystem, "1.10.0", "1.9.0", 1},
+		{npmEcosystem, "1.0", "1.0.0", 0},
+		{goEcosystem, "v1.2.3", "1.2.3", 0},
+		{npmEcosystem, "1.2.3+build.5", "1.2.3", 0},
+		{npmEcosystem, "1.0.0-alpha", "1.0.0", -1},
+		{npmEcosystem, "1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{npmEcosystem, "1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{npmEcosystem, "1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{npmEcosystem, "1.0.0-rc.1", "1.0.0-beta.11", 1},
+		{goEcosystem, "v0.0.0-20230101000000-abcdef", "v0.0.1", -1},
+		{nugetEcosystem, "1.0.0.1", "1.0.0", 1},
+		{nugetEcosystem, "4.0.0.0", "4.0.0", 0},
+		// PEP 440
+		{pypiEcosystem, "1.0", "1.0.0", 0},
+		{pypiEcosystem, "1.0.dev1", "1.0a1", -1},
+		{pypiEcosystem, "1.0a1", "1.0b1", -1},
+		{pypiEcosystem, "1.0b2", "1.0rc1", -1},
+		{pypiEcosystem, "1.0rc1", "1.0", -1},
+		{pypiEcosystem, "1.0", "1.0.post1", -1},
+		{pypiEcosystem, "1.0.post1", "1.1", -1},
+		{pypiEcosystem, "1.0-1", "1.0.post1", 0},
+		{pypiEcosystem, "1.0-1", "1.0.1", -1},
+		{pypiEcosystem, "1.0-rc1", "1.0rc1", 0},
+		{pypiEcosystem, "1.0alpha1", "1.0a1", 0},
+		{pypiEcosystem, "1.0+local.7", "1.0", 0},
+		{pypiEcosystem, "1!2.0", "2.0", 0},
+		{pypiEcosystem, "2.10", "2.9", 1},
+		{pypiEcosystem, "V1.0", "1.0", 0},
+		// Maven
+		{mavenEcosystem, "1.0", "1", 0},
+		{mavenEcosystem, "1.0-SNAPSHOT", "1.0", -1},
+		{mavenEcosystem, "1.0-alpha-1", "1.0-beta-1", -1},
+		{mavenEcosystem, "1.0-M1", "1.0-RC1", -1},
+		{mavenEcosystem, "1.0-RC1", "1.0-SNAPSHOT", -1},
+		{mavenEcosystem, "1.0.RELEASE", "1.0", 0},
+		{mavenEcosystem, "1.0.Final", "1.0.1", -1},
+		{mavenEcosystem, "1.0-GA", "1.0-sp1", -1},
+		{mavenEcosystem, "1.0-sp1", "1.1", -1},
+		{mavenEcosystem, "2.12.7.1", "2.12.7", 1},
+		{mavenEcosystem, "1.0-foo", "1.0-alpha", 1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.ecosystem, test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%s, %q, %q) = %d, want %d", test.ecosystem, test.a, test.b, got, test.want)
+		}
+		if got := compareVersions(test.ecosystem, test.b, test.a); got != -test.want {
+			t.Errorf("compareVersions(%s, %q, %q) = %d, want %d", test.ecosystem, test.b, test.a, got, -test.want)
+		}
+	}
+}
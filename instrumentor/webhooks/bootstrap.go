@@ -0,0 +1,303 @@
+// Package webhooks bootstraps the webhooks of the instrumentor: their serving certificate, shared by the instrumentor
+// replicas through a secret, the conversion webhook of the InstrumentedApplication CRD and the
+// MutatingWebhookConfiguration of the pod webhook trusting it
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// CASecretKey holds the CA the serving certificate is signed by in the certificate secret
+	CASecretKey = "ca.crt"
+	// WebhookName is the name of the pod webhook in the MutatingWebhookConfiguration
+	WebhookName = "pods.instrumentor.logz.io"
+
+	certValidity = 5 * 365 * 24 * time.Hour
+	// certRenewBefore renews a certificate expiring soon when the instrumentor starts
+	certRenewBefore = 30 * 24 * time.Hour
+	timeoutSeconds  = 5
+)
+
+// Config locates the webhook service, the certificate secret, the CRD and the MutatingWebhookConfiguration
+type Config struct {
+	// Namespace is the namespace of the instrumentor, its service and the certificate secret
+	Namespace   string
+	ServiceName string
+	// ServicePort is the port of the service forwarding to the webhook server
+	ServicePort int32
+	SecretName  string
+	// CRDName is the name of the CustomResourceDefinition whose versions are converted by the conversion webhook
+	CRDName        string
+	ConversionPath string
+	// PodWebhook registers the pod webhook, at PodWebhookPath
+	PodWebhook     bool
+	PodWebhookPath string
+	// WebhookConfigName is the name of the MutatingWebhookConfiguration created and updated by the instrumentor
+	WebhookConfigName string
+	// CertDir is the directory the webhook server reads tls.crt and tls.key from
+	CertDir       string
+	FailurePolicy admissionregistrationv1.FailurePolicyType
+	// IgnoredNamespaces are not sent to the webhook, with the namespace of the instrumentor
+	IgnoredNamespaces []string
+	// DetectionPodLabel labels the detection pods, which are not sent to the webhook
+	DetectionPodLabel string
+}
+
+// Bootstrap reads the serving certificate from the secret, creating or renewing it when it is missing, expiring or
+// issued for another service, writes it to the certificate directory and registers the webhooks with its CA. The pod
+// webhook is unregistered when it is not enabled
+func Bootstrap(ctx context.Context, c client.Client, config Config) error {
+	secret, err := ensureCertSecret(ctx, c, config)
+	if err != nil {
+		return fmt.Errorf("unable to bootstrap the webhook certificate: %w", err)
+	}
+	if err = writeCerts(config.CertDir, secret); err != nil {
+		return fmt.Errorf("unable to write the webhook certificate: %w", err)
+	}
+	if err = ensureConversionWebhook(ctx, c, config, secret.Data[CASecretKey]); err != nil {
+		return fmt.Errorf("unable to register the conversion webhook: %w", err)
+	}
+	if !config.PodWebhook {
+		// a configuration left by the webhook mode would send the pods to a path the instrumentor no longer serves
+		if err = deleteWebhookConfig(ctx, c, config); err != nil {
+			return fmt.Errorf("unable to unregister the pod webhook: %w", err)
+		}
+		return nil
+	}
+	if err = ensureWebhookConfig(ctx, c, config, secret.Data[CASecretKey]); err != nil {
+		return fmt.Errorf("unable to register the pod webhook: %w", err)
+	}
+	return nil
+}
+
+func ensureCertSecret(ctx context.Context, c client.Client, config Config) (*corev1.Secret, error) {
+	dnsName := fmt.Sprintf("%s.%s.svc", config.ServiceName, config.Namespace)
+	var secret corev1.Secret
+	err := c.Get(ctx, client.ObjectKey{Namespace: config.Namespace, Name: config.SecretName}, &secret)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	exists := err == nil
+	if exists && validCert(secret.Data, dnsName) {
+		return &secret, nil
+	}
+
+	data, err := generateCerts(dnsName)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		secret = corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: config.SecretName, Namespace: config.Namespace},
+			Type:       corev1.SecretTypeTLS,
+			Data:       data,
+		}
+		err = c.Create(ctx, &secret)
+	} else {
+		secret.Data = data
+		err = c.Update(ctx, &secret)
+	}
+	// another replica created or renewed the certificate first, every replica serves the same certificate
+	if apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err) {
+		if err = c.Get(ctx, client.ObjectKey{Namespace: config.Namespace, Name: config.SecretName}, &secret); err != nil {
+			return nil, err
+		}
+		if !validCert(secret.Data, dnsName) {
+			return nil, errors.New("the certificate secret was changed to an invalid certificate")
+		}
+		return &secret, nil
+	}
+	return &secret, err
+}
+
+// validCert reports whether the secret holds a key pair for the DNS name, signed by its CA and not expiring soon
+func validCert(data map[string][]byte, dnsName string) bool {
+	pair, err := tls.X509KeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil || time.Until(cert.NotAfter) < certRenewBefore {
+		return false
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data[CASecretKey]) {
+		return false
+	}
+	_, err = cert.Verify(x509.VerifyOptions{DNSName: dnsName, Roots: roots})
+	return err == nil
+}
+
+// generateCerts creates a CA and a serving certificate for the DNS name signed by it
+func generateCerts(dnsName string) (map[string][]byte, error) {
+	now := time.Now()
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "kubernetes-instrumentor-webhook-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName, dnsName + ".cluster.local"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{
+		CASecretKey:             pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}, nil
+}
+
+func serialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
+func writeCerts(dir string, secret *corev1.Secret) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	for _, key := range []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey} {
+		if err := os.WriteFile(filepath.Join(dir, key), secret.Data[key], 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureWebhookConfig creates the MutatingWebhookConfiguration or updates it to the service, CA and failure policy
+func ensureWebhookConfig(ctx context.Context, c client.Client, config Config, caBundle []byte) error {
+	webhook := podWebhook(config, caBundle)
+	var webhookConfig admissionregistrationv1.MutatingWebhookConfiguration
+	err := c.Get(ctx, client.ObjectKey{Name: config.WebhookConfigName}, &webhookConfig)
+	if apierrors.IsNotFound(err) {
+		webhookConfig = admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: config.WebhookConfigName},
+			Webhooks:   []admissionregistrationv1.MutatingWebhook{webhook},
+		}
+		err = c.Create(ctx, &webhookConfig)
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		// created by another replica
+		err = c.Get(ctx, client.ObjectKey{Name: config.WebhookConfigName}, &webhookConfig)
+	}
+	if err != nil {
+		return err
+	}
+
+	webhookConfig.Webhooks = []admissionregistrationv1.MutatingWebhook{webhook}
+	err = c.Update(ctx, &webhookConfig)
+	// updated by another replica, with the CA of the same secret
+	if apierrors.IsConflict(err) {
+		return nil
+	}
+	return err
+}
+
+// deleteWebhookConfig deletes the MutatingWebhookConfiguration, if any
+func deleteWebhookConfig(ctx context.Context, c client.Client, config Config) error {
+	webhookConfig := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: config.WebhookConfigName},
+	}
+	return client.IgnoreNotFound(c.Delete(ctx, webhookConfig))
+}
+
+// podWebhook sends the pods created outside of the ignored namespaces, except detection pods, to the webhook
+func podWebhook(config Config, caBundle []byte) admissionregistrationv1.MutatingWebhook {
+	path := config.PodWebhookPath
+	port := config.ServicePort
+	failurePolicy := config.FailurePolicy
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	scope := admissionregistrationv1.NamespacedScope
+	timeout := int32(timeoutSeconds)
+	// pods of the instrumentor are never sent to its own webhook, they could not be created while it is down
+	ignoredNamespaces := append([]string{config.Namespace}, config.IgnoredNamespaces...)
+
+	return admissionregistrationv1.MutatingWebhook{
+		Name: WebhookName,
+		ClientConfig: admissionregistrationv1.WebhookClientConfig{
+			Service: &admissionregistrationv1.ServiceReference{
+				Namespace: config.Namespace,
+				Name:      config.ServiceName,
+				Path:      &path,
+				Port:      &port,
+			},
+			CABundle: caBundle,
+		},
+		Rules: []admissionregistrationv1.RuleWithOperations{{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{""},
+				APIVersions: []string{"v1"},
+				Resources:   []string{"pods"},
+				Scope:       &scope,
+			},
+		}},
+		FailurePolicy: &failurePolicy,
+		NamespaceSelector: &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{{
+				Key:      corev1.LabelMetadataName,
+				Operator: metav1.LabelSelectorOpNotIn,
+				Values:   ignoredNamespaces,
+			}},
+		},
+		ObjectSelector: &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{{
+				Key:      config.DetectionPodLabel,
+				Operator: metav1.LabelSelectorOpDoesNotExist,
+			}},
+		},
+		SideEffects:             &sideEffects,
+		TimeoutSeconds:          &timeout,
+		AdmissionReviewVersions: []string{"v1"},
+	}
+}
@@ -0,0 +1,48 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var crdGroupVersionKind = schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}
+
+// ensureConversionWebhook points the conversion of the CRD to the service of the instrumentor, with the CA of its
+// certificate. The API server converts the InstrumentedApplications stored or requested in another version than the
+// storage version through it
+func ensureConversionWebhook(ctx context.Context, c client.Client, config Config, caBundle []byte) error {
+	conversion := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"conversion": map[string]interface{}{
+				"strategy": "Webhook",
+				"webhook": map[string]interface{}{
+					"conversionReviewVersions": []string{"v1"},
+					"clientConfig": map[string]interface{}{
+						"service": map[string]interface{}{
+							"namespace": config.Namespace,
+							"name":      config.ServiceName,
+							"path":      config.ConversionPath,
+							"port":      config.ServicePort,
+						},
+						// encoded in base64 like every []byte
+						"caBundle": caBundle,
+					},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(conversion)
+	if err != nil {
+		return err
+	}
+
+	crd := &unstructured.Unstructured{}
+	crd.SetGroupVersionKind(crdGroupVersionKind)
+	crd.SetName(config.CRDName)
+	return c.Patch(ctx, crd, client.RawPatch(types.MergePatchType, data))
+}